@@ -38,7 +38,7 @@ type DropRates struct {
 func NewDropRates() DropRates {
 	return DropRates{
 		Overall: 0,
-		Frames:  make(FrameDropRates, 9),
+		Frames:  make(FrameDropRates, 11),
 	}
 }
 
@@ -84,12 +84,17 @@ func NewPacketsReceived() PacketsReceived {
 }
 
 func defaultFrameCount() PeerFrameCount {
-	frameCount := make(FrameCounts, 9)
+	frameCount := make(FrameCounts, 11)
 	frameCount[types.TypeKeepalive] = atomic.NewUint64(0)
 	frameCount[types.TypeTreeAnnouncement] = atomic.NewUint64(0)
 	frameCount[types.TypeBootstrap] = atomic.NewUint64(0)
 	frameCount[types.TypeWakeupBroadcast] = atomic.NewUint64(0)
 	frameCount[types.TypeTraffic] = atomic.NewUint64(0)
+	frameCount[types.TypeSourceRouted] = atomic.NewUint64(0)
+	frameCount[types.TypeSNEKPing] = atomic.NewUint64(0)
+	frameCount[types.TypeSNEKPong] = atomic.NewUint64(0)
+	frameCount[types.TypePathMTUProbe] = atomic.NewUint64(0)
+	frameCount[types.TypePathMTUReply] = atomic.NewUint64(0)
 
 	peerFrameCount := PeerFrameCount{
 		frameCount: frameCount,
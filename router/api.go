@@ -19,6 +19,9 @@ package router
 
 import (
 	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
 
 	"github.com/Arceliar/phony"
 	"github.com/matrix-org/pinecone/router/events"
@@ -35,19 +38,210 @@ type PeerInfo struct {
 	PublicKey string
 	PeerType  int
 	Zone      string
+	Dropped   uint64
+	Cost      uint32
+}
+
+// SnakeEntry is a snapshot of a single entry in the SNEK routing table.
+type SnakeEntry struct {
+	PublicKey       types.PublicKey
+	SourcePort      types.SwitchPortID
+	DestinationPort types.SwitchPortID
+	Watermark       types.VirtualSnakeWatermark
+	LastSeen        time.Time
+	Root            types.Root
+	Static          bool // Added by AddStaticSnakeRoute
+}
+
+// SnakeNeighbour describes one of our immediate neighbours in keyspace.
+type SnakeNeighbour struct {
+	PublicKey types.PublicKey
+	Port      types.SwitchPortID // The port that we reach the neighbour through
+	LastSeen  time.Time
+	Root      types.Root
+}
+
+// PeerAnnouncementInfo describes the last tree announcement that we received
+// from one of our peers, which is what parent selection is based on.
+type PeerAnnouncementInfo struct {
+	PublicKey    types.PublicKey
+	Port         types.SwitchPortID
+	Root         types.Root
+	Signatures   int       // How many hops the announcement is from the root
+	ReceiveTime  time.Time // When we received the announcement
+	ReceiveOrder uint64    // Breaks ties between peers, lower was received first
+	Parent       bool      // The peer is our current parent
 }
 
 // Subscribe registers a subscriber to this node's events
 func (r *Router) Subscribe(ch chan<- events.Event) {
 	phony.Block(r, func() {
-		r._subscribers[ch] = &phony.Inbox{}
+		r._subscribers[ch] = &subscriber{}
 	})
 }
 
+// DroppedEvents returns the number of events that were not delivered to
+// subscribers because they weren't consuming events quickly enough.
+func (r *Router) DroppedEvents() uint64 {
+	return r._droppedEvents.Load()
+}
+
 func (r *Router) Coords() types.Coordinates {
 	return r.state.coords()
 }
 
+// SetPeerCost sets the cost of using the peering on the given port for tree
+// routing. Lower costs are preferred. All peerings start with a cost of zero.
+func (r *Router) SetPeerCost(port types.SwitchPortID, cost uint32) error {
+	var err error
+	phony.Block(r.state, func() {
+		if int(port) >= len(r.state._peers) || r.state._peers[port] == nil || port == 0 {
+			err = fmt.Errorf("no peer on port %d", port)
+			return
+		}
+		r.state._peers[port].cost.Store(cost)
+	})
+	return err
+}
+
+// LookupClosest returns the public key of the next-hop that traffic for the
+// given key would be sent to using SNEK routing, or our own public key if we
+// are the closest node to the key that we know of.
+func (r *Router) LookupClosest(key types.PublicKey) (types.PublicKey, error) {
+	var nexthop *peer
+	phony.Block(r.state, func() {
+		nexthop, _ = r.state._nextHopsSNEK(key, types.TypeTraffic, types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		})
+	})
+	switch {
+	case nexthop == nil:
+		return types.PublicKey{}, fmt.Errorf("no route to %s", key)
+	case nexthop == r.local:
+		return r.PublicKey(), nil
+	default:
+		return nexthop.public, nil
+	}
+}
+
+// IsReachable returns true if traffic for the given key has somewhere to go,
+// i.e. the key is our own, belongs to one of our peers, or SNEK routing gives
+// us a next-hop for it other than ourselves. This is best-effort only, as
+// SNEK routing will forward traffic towards the closest key that it knows of
+// even if the node itself has gone away, but a node that returns false here
+// would have nowhere to send the traffic at all.
+func (r *Router) IsReachable(key types.PublicKey) bool {
+	if key == r.PublicKey() {
+		return true
+	}
+	reachable := false
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p != nil && p != r.local && p.public == key && p.started.Load() {
+				reachable = true
+				return
+			}
+		}
+		nexthop, _ := r.state._nextHopsSNEK(key, types.TypeTraffic, types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		})
+		reachable = nexthop != nil && nexthop != r.local && nexthop.started.Load()
+	})
+	return reachable
+}
+
+// IsPartitioned returns true if this node has been cut off from the rest of
+// the network, that is, it has no peers and so is acting as its own root. A
+// PartitionChanged event is sent whenever this changes.
+func (r *Router) IsPartitioned() (partitioned bool) {
+	phony.Block(r.state, func() {
+		partitioned = r.state._partitioned
+	})
+	return
+}
+
+// RootDistance returns the number of hops between this node and the root of
+// the spanning tree, or 0 if this node is the root.
+func (r *Router) RootDistance() int {
+	var distance int
+	phony.Block(r.state, func() {
+		distance = len(r.state._rootAnnouncement().Signatures)
+	})
+	return distance
+}
+
+// Sequence returns the sequence number of the root announcement that this
+// node is currently following, which is its own if it is the root.
+func (r *Router) Sequence() uint64 {
+	var sequence types.Varu64
+	phony.Block(r.state, func() {
+		sequence = r.state._rootAnnouncement().RootSequence &^ pinnedRootSequence
+	})
+	return uint64(sequence)
+}
+
+// Ancestors returns the public keys of the nodes on our path to the root of
+// the spanning tree, starting with the root and ending with our parent. It
+// is empty if this node is the root.
+func (r *Router) Ancestors() (ancestors []types.PublicKey) {
+	phony.Block(r.state, func() {
+		ancestors = r.state._ancestors()
+	})
+	return
+}
+
+// Parent returns the public key of our parent in the spanning tree, or our
+// own public key if this node is the root.
+func (r *Router) Parent() types.PublicKey {
+	parent := r.PublicKey()
+	phony.Block(r.state, func() {
+		if p := r.state._parent; p != nil {
+			parent = p.public
+		}
+	})
+	return parent
+}
+
+// PeerVersion returns the protocol revision negotiated with the peer that has
+// the given public key, and false if we aren't peered with it. If there are
+// several peerings to the same node then the lowest revision is returned.
+func (r *Router) PeerVersion(key types.PublicKey) (uint8, bool) {
+	revision, found := ourRevision, false
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p == nil || p.public != key || !p.started.Load() {
+				continue
+			}
+			if !found || p.revision < revision {
+				revision = p.revision
+			}
+			found = true
+		}
+	})
+	if !found {
+		return 0, false
+	}
+	return revision, true
+}
+
+// PenalisedParents returns the public keys of the peers that are currently
+// excluded from parent selection because they kept failing as our parent,
+// along with the time until which each will be excluded.
+func (r *Router) PenalisedParents() map[types.PublicKey]time.Time {
+	penalised := map[types.PublicKey]time.Time{}
+	phony.Block(r.state, func() {
+		now := r.clock.Now()
+		for key, entry := range r.state._parentFlaps {
+			if entry.penalised(now) {
+				penalised[key] = entry.until
+			}
+		}
+	})
+	return penalised
+}
+
 func (r *Router) Peers() []PeerInfo {
 	var infos []PeerInfo
 	phony.Block(r.state, func() {
@@ -61,12 +255,315 @@ func (r *Router) Peers() []PeerInfo {
 				PublicKey: hex.EncodeToString(p.public[:]),
 				PeerType:  int(p.peertype),
 				Zone:      string(p.zone),
+				Dropped:   p.dropped.Load(),
+				Cost:      p.cost.Load(),
+			})
+		}
+	})
+	return infos
+}
+
+// PeerAnnouncements returns a snapshot of the last tree announcement that we
+// received from each of our peers, ordered by port. Peers that haven't sent
+// us an announcement yet aren't included.
+func (r *Router) PeerAnnouncements() []PeerAnnouncementInfo {
+	var infos []PeerAnnouncementInfo
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p == nil {
+				continue
+			}
+			ann, ok := r.state._announcements[p]
+			if !ok || ann == nil {
+				continue
+			}
+			infos = append(infos, PeerAnnouncementInfo{
+				PublicKey:    p.public,
+				Port:         p.port,
+				Root:         ann.Root,
+				Signatures:   len(ann.Signatures),
+				ReceiveTime:  ann.receiveTime,
+				ReceiveOrder: ann.receiveOrder,
+				Parent:       p == r.state._parent,
 			})
 		}
 	})
 	return infos
 }
 
+// SnakeRoutingTable returns a snapshot of all of the entries currently in
+// the SNEK routing table, ordered by public key. The returned entries are
+// copies and are safe to retain and modify.
+func (r *Router) SnakeRoutingTable() []SnakeEntry {
+	var entries []SnakeEntry
+	phony.Block(r.state, func() {
+		entries = make([]SnakeEntry, 0, len(r.state._table))
+		for k, v := range r.state._table {
+			entries = append(entries, newSnakeEntry(k, v))
+		}
+	})
+	sortSnakeEntries(entries)
+	return entries
+}
+
+// TransitPaths returns a snapshot of the entries in the SNEK routing table
+// for paths that pass through this node, i.e. that neither start nor end
+// here. This separates the load of forwarding for other nodes from the
+// paths that terminate here. The entries are ordered by public key, and are
+// copies that are safe to retain and modify.
+func (r *Router) TransitPaths() []SnakeEntry {
+	var entries []SnakeEntry
+	phony.Block(r.state, func() {
+		for k, v := range r.state._table {
+			if r.state._isTransitPath(v) {
+				entries = append(entries, newSnakeEntry(k, v))
+			}
+		}
+	})
+	sortSnakeEntries(entries)
+	return entries
+}
+
+// sortSnakeEntries orders SNEK routing table snapshots by public key, since
+// the table itself is a map and would otherwise be returned in random order.
+func sortSnakeEntries(entries []SnakeEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].PublicKey.CompareTo(entries[j].PublicKey) < 0
+	})
+}
+
+// TransitPathCount returns the number of SNEK paths that pass through this
+// node, as returned by TransitPaths.
+func (r *Router) TransitPathCount() int {
+	var count int
+	phony.Block(r.state, func() {
+		for _, v := range r.state._table {
+			if r.state._isTransitPath(v) {
+				count++
+			}
+		}
+	})
+	return count
+}
+
+// _isTransitPath returns true if the path neither starts nor ends at this
+// node. Paths with no destination ended here because there was nowhere
+// further for their bootstrap to go.
+func (s *state) _isTransitPath(v *virtualSnakeEntry) bool {
+	return v.Source != s.r.local && v.Destination != s.r.local && v.Destination != nil
+}
+
+func newSnakeEntry(index virtualSnakeIndex, v *virtualSnakeEntry) SnakeEntry {
+	entry := SnakeEntry{
+		PublicKey: index.PublicKey,
+		Watermark: v.Watermark,
+		LastSeen:  v.LastSeen,
+		Root:      v.Root,
+		Static:    v.static,
+	}
+	if v.Source != nil {
+		entry.SourcePort = v.Source.port
+	}
+	if v.Destination != nil {
+		entry.DestinationPort = v.Destination.port
+	}
+	return entry
+}
+
+// SnakeNeighbours returns our immediate neighbours in keyspace. The descending
+// neighbour is the node with the next lowest key that has bootstrapped to us.
+// The ascending neighbour is the node with the next highest key that we know
+// of, which is where our own bootstraps are sent, and its last seen time is
+// when we last heard from the peer that we reach it through. Either will be
+// nil if we don't have one.
+func (r *Router) SnakeNeighbours() (ascending, descending *SnakeNeighbour) {
+	phony.Block(r.state, func() {
+		if desc := r.state._descending; desc != nil && desc.valid(r.clock.Now()) {
+			descending = &SnakeNeighbour{
+				PublicKey: desc.PublicKey,
+				Port:      desc.Source.port,
+				LastSeen:  desc.LastSeen,
+				Root:      desc.Root,
+			}
+		}
+		ascending = r.state._ascendingNeighbour()
+	})
+	return
+}
+
+// _ascendingNeighbour returns the node with the next highest key that we know
+// of, or nil if there isn't one. It is only safe to call from the state actor.
+func (s *state) _ascendingNeighbour() *SnakeNeighbour {
+	ours := s.r.PublicKey()
+	nexthop, watermark := s._nextHopsSNEK(ours, types.TypeBootstrap, types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	})
+	if nexthop == nil || nexthop == s.r.local || watermark.PublicKey == ours {
+		return nil
+	}
+	ascending := &SnakeNeighbour{
+		PublicKey: watermark.PublicKey,
+		Port:      nexthop.port,
+		Root:      s._rootAnnouncement().Root,
+	}
+	if ann := s._announcements[nexthop]; ann != nil {
+		ascending.LastSeen = ann.receiveTime
+	}
+	return ascending
+}
+
+// SnakeStableFor returns how long it has been since either of our neighbours
+// in keyspace last changed, as measured by the router's clock. Watching this
+// across nodes shows whether SNEK has settled down after topology changes.
+// The ascending neighbour is checked during SNEK maintenance, so a change to
+// it may take up to a second to be noticed.
+func (r *Router) SnakeStableFor() time.Duration {
+	var since time.Time
+	phony.Block(r.state, func() {
+		since = r.state._snakeChanged
+	})
+	return r.clock.Now().Sub(since)
+}
+
+// HealthStatus summarises the routing state of the node, see Router.Health.
+type HealthStatus struct {
+	Ready         bool          // Has a parent, or is the root and has peers
+	HasParent     bool          // Has a parent in the tree
+	IsRoot        bool          // Is the root of the tree
+	HasAscending  bool          // Has an ascending neighbour in keyspace
+	HasDescending bool          // Has a descending neighbour in keyspace
+	Peers         int           // Number of directly connected nodes
+	StableFor     time.Duration // Since our coordinates or SNEK neighbours last changed
+}
+
+// Health returns a summary of the routing state of the node, which is
+// intended for liveness and readiness probes. The node is ready if it has a
+// parent in the tree, or if it is the root and has at least one peer, since
+// a node without peers is its own root but can't reach anyone. Having both
+// SNEK neighbours isn't required, as the nodes at either end of the keyspace
+// will only ever have one of them.
+func (r *Router) Health() HealthStatus {
+	var health HealthStatus
+	var changed time.Time
+	phony.Block(r.state, func() {
+		health.HasParent = r.state._parent != nil
+		health.IsRoot = r.state._rootAnnouncement().RootPublicKey == r.PublicKey()
+		if desc := r.state._descending; desc != nil && desc.valid(r.clock.Now()) {
+			health.HasDescending = true
+		}
+		health.HasAscending = r.state._ascendingNeighbour() != nil
+		health.Peers = r.state._peerCount(-1)
+		changed = r.state._snakeChanged
+		if r.state._treeChanged.After(changed) {
+			changed = r.state._treeChanged
+		}
+	})
+	health.Ready = health.HasParent || (health.IsRoot && health.Peers > 0)
+	health.StableFor = r.clock.Now().Sub(changed)
+	return health
+}
+
+// SnakePathAges returns how long ago each SNEK path was last seen, as
+// measured by the router's clock. This includes every entry in the routing
+// table, which includes the path to our descending neighbour, and the path
+// to our ascending neighbour if we have one. This is intended to be bucketed
+// into a histogram to show whether paths are stable or churning.
+func (r *Router) SnakePathAges() []time.Duration {
+	var ages []time.Duration
+	phony.Block(r.state, func() {
+		now := r.clock.Now()
+		ages = make([]time.Duration, 0, len(r.state._table)+1)
+		for _, v := range r.state._table {
+			ages = append(ages, now.Sub(v.LastSeen))
+		}
+		if asc := r.state._ascendingNeighbour(); asc != nil && !asc.LastSeen.IsZero() {
+			ages = append(ages, now.Sub(asc.LastSeen))
+		}
+	})
+	return ages
+}
+
+// CheckSnakeInvariants checks the SNEK routing table for internal
+// inconsistencies, returning one error for each problem found. This is
+// intended for debugging and should not be needed in normal operation.
+func (r *Router) CheckSnakeInvariants() (errs []error) {
+	phony.Block(r.state, func() {
+		errs = r.state._checkSnakeInvariants()
+	})
+	return
+}
+
+// LocalDroppedFrames returns the number of frames destined for this node that
+// have been dropped because the application wasn't reading them quickly
+// enough. See RouterOptionLocalQueueSize.
+func (r *Router) LocalDroppedFrames() uint64 {
+	if q, ok := r.local.traffic.(*fairFIFOQueue); ok {
+		return q.droppedcount()
+	}
+	return 0
+}
+
+// RateLimitedBootstraps returns the number of bootstraps that have been
+// dropped because a peer was sending them faster than the configured limit.
+func (r *Router) RateLimitedBootstraps() uint64 {
+	return r._limitedBootstraps.Load()
+}
+
+// SendStats returns how much traffic this node has sent towards each
+// destination key using WriteTo or SendLarge. Only the most recently used
+// keys are remembered, so keys that haven't been sent to for a while may be
+// missing. Traffic that this node has forwarded for others isn't counted.
+func (r *Router) SendStats() map[types.PublicKey]SendStat {
+	return r._sendStats.snapshot()
+}
+
+// FrameTypeStats returns how many frames of each type this node has received
+// from its peers, originated itself and forwarded on for other nodes. Types
+// that haven't been seen aren't included. Protocol frames, such as tree
+// announcements and keepalives, are sent on every peering, so each copy is
+// counted.
+func (r *Router) FrameTypeStats() map[types.FrameType]FrameTypeStat {
+	return r._frameTypeStats.snapshot()
+}
+
+// ShedBootstraps returns the number of bootstraps that have been dropped
+// because more arrived between SNEK maintenance runs than the configured
+// limit. See RouterOptionMaxBootstrapsPerInterval.
+func (r *Router) ShedBootstraps() uint64 {
+	return r._shedBootstraps.Load()
+}
+
+// LoopsDetected returns the number of times that traffic has been seen to
+// repeatedly bounce back to this node, suggesting a routing loop.
+func (r *Router) LoopsDetected() uint64 {
+	return r._loopsDetected.Load()
+}
+
+// StaleBootstraps returns the number of bootstraps that have been dropped
+// because their signed timestamp was too far from our own clock. A growing
+// count suggests that our clock, or that of a remote node, is skewed.
+func (r *Router) StaleBootstraps() uint64 {
+	return r._staleBootstraps.Load()
+}
+
+// MaintenanceStalls returns the number of times that the watchdog has found
+// that tree or SNEK maintenance had stopped running, usually because the
+// router was blocked by something slow such as a packet filter.
+func (r *Router) MaintenanceStalls() uint64 {
+	return r._maintenanceStalls.Load()
+}
+
+// DroppedFrames returns the number of frames that have been dropped while
+// forwarding, broken down by the reason that they were dropped.
+func (r *Router) DroppedFrames() map[DropReason]uint64 {
+	drops := make(map[DropReason]uint64, dropReasonCount)
+	for reason := DropReason(0); reason < dropReasonCount; reason++ {
+		drops[reason] = r._drops[reason].Load()
+	}
+	return drops
+}
+
 func (r *Router) EnableHopLimiting() {
 	r._hopLimiting.Store(true)
 }
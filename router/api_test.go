@@ -0,0 +1,957 @@
+//go:build !minimal
+// +build !minimal
+
+package router
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestSnakeRoutingTable(t *testing.T) {
+	r := newTestRouter(t)
+	a := newTestPeer(r, 1, types.PublicKey{1})
+	b := newTestPeer(r, 2, types.PublicKey{2})
+	root := types.Root{RootPublicKey: types.PublicKey{9}, RootSequence: 3}
+	now := time.Now()
+
+	expected := map[types.PublicKey]SnakeEntry{
+		{1}: {
+			PublicKey:       types.PublicKey{1},
+			SourcePort:      1,
+			DestinationPort: 0,
+			Watermark:       types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 7},
+			LastSeen:        now,
+			Root:            root,
+		},
+		{2}: {
+			PublicKey:       types.PublicKey{2},
+			SourcePort:      2,
+			DestinationPort: 0,
+			Watermark:       types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 8},
+			LastSeen:        now.Add(-time.Second),
+			Root:            root,
+		},
+	}
+
+	phony.Block(r.state, func() {
+		for _, p := range []*peer{a, b} {
+			e := expected[p.public]
+			index := virtualSnakeIndex{PublicKey: p.public}
+			r.state._table[index] = &virtualSnakeEntry{
+				virtualSnakeIndex: &index,
+				Source:            p,
+				Destination:       r.local,
+				Watermark:         e.Watermark,
+				LastSeen:          e.LastSeen,
+				Root:              e.Root,
+			}
+		}
+	})
+
+	entries := r.SnakeRoutingTable()
+	if len(entries) != len(expected) {
+		t.Fatalf("expected %d entries, got %d", len(expected), len(entries))
+	}
+	for _, entry := range entries {
+		e, ok := expected[entry.PublicKey]
+		if !ok {
+			t.Fatalf("unexpected entry for %s", entry.PublicKey)
+		}
+		if entry != e {
+			t.Fatalf("expected entry %+v, got %+v", e, entry)
+		}
+	}
+
+	// Changing the snapshot must not change the routing table.
+	entries[0].Root.RootSequence = 100
+	for _, entry := range r.SnakeRoutingTable() {
+		if entry.Root != root {
+			t.Fatalf("snapshot modification leaked into the routing table")
+		}
+	}
+}
+
+func TestSnapshotOrdering(t *testing.T) {
+	r := newTestRouter(t)
+	var peers []*peer
+	var keys []ed25519.PrivateKey
+	for port := types.SwitchPortID(1); port <= 8; port++ {
+		sk := newTestKey(t, 0x00, 0xff)
+		peers = append(peers, newTestPeer(r, port, testPublicKey(sk)))
+		keys = append(keys, sk)
+	}
+	phony.Block(r.state, func() {
+		for _, p := range peers {
+			r.state._peers[p.port] = p
+		}
+		// Fill the table with paths between our peers, which are all
+		// transit paths.
+		for i := 0; i < 64; i++ {
+			key := types.PublicKey{byte(i * 37), byte(i)}
+			index := virtualSnakeIndex{PublicKey: key}
+			r.state._table[index] = &virtualSnakeEntry{
+				virtualSnakeIndex: &index,
+				Source:            peers[i%len(peers)],
+				Destination:       peers[(i+1)%len(peers)],
+				LastSeen:          time.Now(),
+			}
+		}
+	})
+	for i, p := range peers {
+		root := types.Root{RootPublicKey: p.public, RootSequence: 1}
+		ann := newTestAnnouncement(t, root, keys[i])
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._handleTreeAnnouncement(p, ann)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	checkSorted := func(name string, entries []SnakeEntry) {
+		if !sort.SliceIsSorted(entries, func(i, j int) bool {
+			return entries[i].PublicKey.CompareTo(entries[j].PublicKey) < 0
+		}) {
+			t.Fatalf("expected %s to be ordered by public key", name)
+		}
+	}
+	table, transit, anns := r.SnakeRoutingTable(), r.TransitPaths(), r.PeerAnnouncements()
+	if len(table) != 64 || len(transit) != 64 || len(anns) != len(peers) {
+		t.Fatalf("expected 64 entries, 64 transit paths and %d announcements, got %d, %d and %d", len(peers), len(table), len(transit), len(anns))
+	}
+	checkSorted("SnakeRoutingTable", table)
+	checkSorted("TransitPaths", transit)
+	for i := 0; i < 10; i++ {
+		if !reflect.DeepEqual(table, r.SnakeRoutingTable()) {
+			t.Fatalf("expected SnakeRoutingTable to return the same order every time")
+		}
+		if !reflect.DeepEqual(transit, r.TransitPaths()) {
+			t.Fatalf("expected TransitPaths to return the same order every time")
+		}
+		if !reflect.DeepEqual(anns, r.PeerAnnouncements()) {
+			t.Fatalf("expected PeerAnnouncements to return the same order every time")
+		}
+	}
+}
+
+func TestSubscribeLifecycleEvents(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x80, 0xf0)
+	descSK := newTestKey(t, 0x00, 0x40)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	desc := testPublicKey(descSK)
+
+	// Make sure that the events from starting up the router have been
+	// published before we subscribe.
+	phony.Block(r.state, func() {})
+	ch := make(chan events.Event, 64)
+	r.Subscribe(ch)
+
+	ann := newTestAnnouncement(t, root, rootSK, aSK)
+	f := newTestBootstrap(t, descSK, root, types.Varu64(time.Now().UnixMilli()))
+	var err error
+	var accepted bool
+	phony.Block(r.state, func() {
+		if err = r.state._handleTreeAnnouncement(a, ann); err != nil {
+			return
+		}
+		if accepted = r.state._handleBootstrap(a, r.local, f); accepted {
+			r.state._removeRouteEntry(virtualSnakeIndex{PublicKey: desc})
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !accepted {
+		t.Fatalf("bootstrap should have been accepted")
+	}
+
+	expected := []events.Event{
+		events.TreeRootChanged{Root: root.RootPublicKey.String(), PreviousRoot: r.public.String()},
+		events.TreeParentUpdate{PeerID: a.public.String()},
+		events.SnakeEntryAdded{EntryID: desc.String(), PeerID: a.public.String()},
+		events.SnakeDescUpdate{PeerID: desc.String()},
+		events.SnakeEntryRemoved{EntryID: desc.String()},
+	}
+	for _, e := range expected {
+		for {
+			var got events.Event
+			select {
+			case got = <-ch:
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for event %#v", e)
+			}
+			switch got.(type) {
+			case events.TreeRootAnnUpdate, events.BandwidthReport:
+				continue
+			}
+			if got != e {
+				t.Fatalf("expected event %#v, got %#v", e, got)
+			}
+			break
+		}
+	}
+}
+
+func TestSubscribeSlowConsumerDropsEvents(t *testing.T) {
+	r := newTestRouter(t)
+	phony.Block(r.state, func() {})
+	ch := make(chan events.Event)
+	r.Subscribe(ch)
+
+	const extra = 5
+	phony.Block(r, func() {
+		for i := 0; i < eventSubscriberBacklog+extra; i++ {
+			r._publish(events.SnakeEntryRemoved{})
+		}
+	})
+	// Tree and SNEK maintenance carry on in the background and may publish
+	// events of their own, which can be dropped too.
+	if dropped := r.DroppedEvents(); dropped < extra {
+		t.Fatalf("expected at least %d dropped events, got %d", extra, dropped)
+	}
+
+	// The events that weren't dropped should still be delivered in full.
+	for i := 0; i < eventSubscriberBacklog; i++ {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %d", i)
+		}
+	}
+}
+
+func TestRootDistance(t *testing.T) {
+	// Build a line topology with the strongest key at one end, so that each
+	// node is one hop further from the root than the last.
+	routers := []*Router{
+		newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff)),
+		newTestRouterWithKey(t, newTestKey(t, 0x80, 0xc0)),
+		newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80)),
+		newTestRouterWithKey(t, newTestKey(t, 0x00, 0x40)),
+	}
+	for i := 1; i < len(routers); i++ {
+		connectTestRouters(t, routers[i-1], routers[i])
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for i, r := range routers {
+		for {
+			distance := r.RootDistance()
+			if distance == i {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %d has root distance %d, expected %d", i, distance, i)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func TestAncestors(t *testing.T) {
+	// Build a line topology with the strongest key at one end, so that the
+	// root is at one end and the middle node's parent is the root.
+	routers := []*Router{
+		newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff)),
+		newTestRouterWithKey(t, newTestKey(t, 0x80, 0xc0)),
+		newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80)),
+	}
+	for i := 1; i < len(routers); i++ {
+		connectTestRouters(t, routers[i-1], routers[i])
+	}
+	root, middle, end := routers[0], routers[1], routers[2]
+
+	deadline := time.Now().Add(time.Second * 5)
+	for end.RootDistance() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the tree to converge")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if ancestors := root.Ancestors(); len(ancestors) != 0 {
+		t.Fatalf("expected the root to have no ancestors, got %v", ancestors)
+	}
+	if parent := root.Parent(); parent != root.public {
+		t.Fatalf("expected the root to report itself as its parent, got %s", parent)
+	}
+	if ancestors := middle.Ancestors(); len(ancestors) != 1 || ancestors[0] != root.public {
+		t.Fatalf("expected the middle node to have ancestors [%s], got %v", root.public, ancestors)
+	}
+	if parent := middle.Parent(); parent != root.public {
+		t.Fatalf("expected the middle node's parent to be %s, got %s", root.public, parent)
+	}
+	ancestors := end.Ancestors()
+	if len(ancestors) != 2 || ancestors[0] != root.public || ancestors[1] != middle.public {
+		t.Fatalf("expected the end node to have ancestors [%s %s], got %v", root.public, middle.public, ancestors)
+	}
+	if parent := end.Parent(); parent != middle.public {
+		t.Fatalf("expected the end node's parent to be %s, got %s", middle.public, parent)
+	}
+}
+
+func TestSubscribePeerEvents(t *testing.T) {
+	a, b := newTestRouter(t), newTestRouter(t)
+	phony.Block(a.state, func() {})
+	ch := make(chan events.Event, 64)
+	a.Subscribe(ch)
+
+	ca, cb := net.Pipe()
+	port, err := a.Connect(ca, ConnectionPublicKey(b.public), ConnectionKeepalives(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = b.Connect(cb, ConnectionPublicKey(a.public), ConnectionKeepalives(false)); err != nil {
+		t.Fatal(err)
+	}
+	a.Disconnect(port, nil)
+
+	expected := []events.Event{
+		events.PeerAdded{Port: port, PeerID: b.public.String()},
+		events.PeerRemoved{Port: port, PeerID: b.public.String()},
+	}
+	for _, e := range expected {
+		for {
+			var got events.Event
+			select {
+			case got = <-ch:
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for event %#v", e)
+			}
+			switch got.(type) {
+			case events.PeerAdded, events.PeerRemoved:
+			default:
+				continue
+			}
+			if got != e {
+				t.Fatalf("expected event %#v, got %#v", e, got)
+			}
+			break
+		}
+	}
+}
+
+func TestLookupClosest(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0xf0, 0xff))
+	low := newTestPeer(r, 1, types.PublicKey{0x30})
+	high := newTestPeer(r, 2, types.PublicKey{0x60})
+	addTestSnakeEntry(r, low.public, low)
+	addTestSnakeEntry(r, high.public, high)
+
+	cases := []struct {
+		desc     string
+		key      types.PublicKey
+		expected types.PublicKey
+	}{
+		{"TestExactMatch", high.public, high.public},
+		{"TestBetweenEntries", types.PublicKey{0x40}, high.public},
+		{"TestBelowEntries", types.PublicKey{0x20}, low.public},
+		{"TestAboveEntries", types.PublicKey{0xff}, r.public},
+		{"TestOurKey", r.public, r.public},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			actual, err := r.LookupClosest(tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != tc.expected {
+				t.Fatalf("expected: %s got: %s", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestIsReachable(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	unknown := testPublicKey(newTestKey(t, 0, 0xff))
+
+	// An isolated node can only reach itself.
+	if !r.IsReachable(r.public) {
+		t.Fatalf("expected our own key to be reachable")
+	}
+	if r.IsReachable(unknown) {
+		t.Fatalf("expected an unknown key to be unreachable from an isolated node")
+	}
+
+	// Direct peers are reachable, until they stop.
+	peer := newTestPeer(r, 1, types.PublicKey{0x10})
+	phony.Block(r.state, func() {
+		r.state._peers[peer.port] = peer
+	})
+	if !r.IsReachable(peer.public) {
+		t.Fatalf("expected a direct peer to be reachable")
+	}
+	peer.started.Store(false)
+	if r.IsReachable(peer.public) {
+		t.Fatalf("expected a stopped peer to be unreachable")
+	}
+
+	// Nodes that we have a path to are reachable.
+	via := newTestPeer(r, 2, types.PublicKey{0x20})
+	phony.Block(r.state, func() {
+		r.state._peers[via.port] = via
+	})
+	addTestSnakeEntry(r, types.PublicKey{0x30}, via)
+	if !r.IsReachable(types.PublicKey{0x30}) {
+		t.Fatalf("expected a node with a path to be reachable")
+	}
+}
+
+func TestTransitPaths(t *testing.T) {
+	// The lowest node is only connected to the highest node, so its path to
+	// the middle node, which is next in keyspace, has to pass through it.
+	low := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x40))
+	high := newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff))
+	mid := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	connectTestRouters(t, low, high)
+	connectTestRouters(t, high, mid)
+
+	deadline := time.Now().Add(time.Second * 10)
+	for high.TransitPathCount() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a transit path through the highest node")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	paths := high.TransitPaths()
+	if len(paths) != 1 || high.TransitPathCount() != 1 {
+		t.Fatalf("expected one transit path, got %d", len(paths))
+	}
+	if paths[0].PublicKey != low.public {
+		t.Fatalf("expected the transit path to belong to %s, got %s", low.public, paths[0].PublicKey)
+	}
+	if paths[0].SourcePort == 0 || paths[0].DestinationPort == 0 || paths[0].SourcePort == paths[0].DestinationPort {
+		t.Fatalf("expected the transit path to use two different peerings")
+	}
+	for _, r := range []*Router{low, mid} {
+		if count := r.TransitPathCount(); count != 0 {
+			t.Fatalf("expected no transit paths at the endpoints, got %d", count)
+		}
+	}
+}
+
+func TestSnakeNeighbours(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	parentSK := newTestKey(t, 0xa0, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	parent := newTestPeer(r, 1, testPublicKey(parentSK))
+	child := newTestPeer(r, 2, types.PublicKey{0x10})
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	if ascending, descending := r.SnakeNeighbours(); ascending != nil || descending != nil {
+		t.Fatalf("expected no neighbours before joining the network")
+	}
+
+	var err error
+	ann := newTestAnnouncement(t, root, rootSK, parentSK)
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(parent, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestSnakeEntry(r, child.public, child)
+	phony.Block(r.state, func() {
+		r.state._setDescendingNode(r.state._table[virtualSnakeIndex{PublicKey: child.public}])
+	})
+
+	ascending, descending := r.SnakeNeighbours()
+	switch {
+	case ascending == nil:
+		t.Fatalf("expected an ascending neighbour")
+	case ascending.PublicKey != parent.public || ascending.Port != parent.port:
+		t.Fatalf("expected ascending neighbour %s on port %d, got %s on port %d", parent.public, parent.port, ascending.PublicKey, ascending.Port)
+	case descending == nil:
+		t.Fatalf("expected a descending neighbour")
+	case descending.PublicKey != child.public || descending.Port != child.port:
+		t.Fatalf("expected descending neighbour %s on port %d, got %s on port %d", child.public, child.port, descending.PublicKey, descending.Port)
+	}
+}
+
+func TestSnakeStableFor(t *testing.T) {
+	clock := newTestClock()
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	parentSK := newTestKey(t, 0xa0, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), RouterOptionClock{clock})
+	parent := newTestPeer(r, 1, testPublicKey(parentSK))
+	child := newTestPeer(r, 2, types.PublicKey{0x10})
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	stable := func(expected time.Duration) {
+		t.Helper()
+		if got := r.SnakeStableFor(); got != expected {
+			t.Fatalf("expected SNEK to have been stable for %s, got %s", expected, got)
+		}
+	}
+	phony.Block(r.state, r.state._maintainSnake)
+	clock.Advance(time.Second * 10)
+	stable(time.Second * 10)
+
+	// Joining the tree gives us an ascending neighbour.
+	var err error
+	ann := newTestAnnouncement(t, root, rootSK, parentSK)
+	phony.Block(r.state, func() {
+		r.state._peers[parent.port], r.state._peers[child.port] = parent, child
+		if err = r.state._handleTreeAnnouncement(parent, ann); err != nil {
+			return
+		}
+		r.state._maintainSnake()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stable(0)
+	clock.Advance(time.Second * 3)
+	phony.Block(r.state, r.state._maintainSnake)
+	stable(time.Second * 3)
+
+	// A node bootstrapping to us becomes our descending neighbour.
+	addTestSnakeEntry(r, child.public, child)
+	phony.Block(r.state, func() {
+		r.state._setDescendingNode(r.state._table[virtualSnakeIndex{PublicKey: child.public}])
+	})
+	stable(0)
+	clock.Advance(time.Second * 2)
+	phony.Block(r.state, r.state._maintainSnake)
+	stable(time.Second * 2)
+}
+
+func TestSnakePathAges(t *testing.T) {
+	clock := newTestClock()
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	parentSK := newTestKey(t, 0xa0, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), RouterOptionClock{clock})
+	parent := newTestPeer(r, 1, testPublicKey(parentSK))
+	child := newTestPeer(r, 2, types.PublicKey{0x10})
+	other := newTestPeer(r, 3, types.PublicKey{0x20})
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	if ages := r.SnakePathAges(); len(ages) != 0 {
+		t.Fatalf("expected no path ages before joining the network, got %v", ages)
+	}
+
+	// The ascending path was last seen when our parent last announced.
+	var err error
+	ann := newTestAnnouncement(t, root, rootSK, parentSK)
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(parent, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Second * 4)
+	addTestSnakeEntry(r, child.public, child)
+	phony.Block(r.state, func() {
+		r.state._setDescendingNode(r.state._table[virtualSnakeIndex{PublicKey: child.public}])
+	})
+	clock.Advance(time.Second * 2)
+	addTestSnakeEntry(r, other.public, other)
+	clock.Advance(time.Second)
+
+	ages := r.SnakePathAges()
+	sort.Slice(ages, func(i, j int) bool {
+		return ages[i] < ages[j]
+	})
+	expected := []time.Duration{time.Second, time.Second * 3, time.Second * 7}
+	if len(ages) != len(expected) {
+		t.Fatalf("expected %d path ages, got %v", len(expected), ages)
+	}
+	for i := range expected {
+		if ages[i] != expected[i] {
+			t.Fatalf("expected path ages %v, got %v", expected, ages)
+		}
+	}
+}
+
+func TestLocalQueueDropsWhenFull(t *testing.T) {
+	const frames = 100
+	r := newTestRouter(t, RouterOptionLocalQueueSize(16))
+	p := newTestPeer(r, 1, types.PublicKey{1})
+
+	// Nobody is reading from the router, so the local queue will fill up.
+	// Delivering more frames should drop the oldest ones rather than
+	// blocking the state actor.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		phony.Block(r.state, func() {
+			for i := 0; i < frames; i++ {
+				f := getFrame()
+				f.Type = types.TypeTraffic
+				f.DestinationKey = r.public
+				f.SourceKey = p.public
+				_ = r.state._forward(p, f)
+			}
+		})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("delivering to a full local queue blocked the router")
+	}
+
+	queued := r.local.traffic.queuecount()
+	if queued >= frames {
+		t.Fatalf("expected the local queue to fill up, but %d frames are queued", queued)
+	}
+	if dropped := r.LocalDroppedFrames(); dropped != uint64(frames-queued) {
+		t.Fatalf("expected %d dropped frames, got %d", frames-queued, dropped)
+	}
+}
+
+func TestPeerVersion(t *testing.T) {
+	r := newTestRouter(t)
+	if _, ok := r.PeerVersion(types.PublicKey{1}); ok {
+		t.Fatalf("expected no version for an unknown peer")
+	}
+
+	for _, tc := range []struct {
+		name     string
+		theirs   uint8
+		expected uint8
+	}{
+		{"Legacy", revisionLegacy, revisionLegacy},
+		{"Same", ourRevision, ourRevision},
+		{"Newer", ourRevision + 1, ourRevision},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sk := newTestKey(t, 0, 0xff)
+			local, remote := net.Pipe()
+			t.Cleanup(func() {
+				_ = remote.Close()
+			})
+			handshake := make([]byte, 8, 8+ed25519.PublicKeySize+ed25519.SignatureSize)
+			handshake[0], handshake[1] = ourVersion, tc.theirs
+			binary.BigEndian.PutUint32(handshake[4:8], ourCapabilities)
+			handshake = append(handshake, sk.Public().(ed25519.PublicKey)...)
+			handshake = append(handshake, ed25519.Sign(sk, handshake)...)
+			errs := make(chan error, 1)
+			go func() {
+				// Play the part of the remote node, then throw away anything
+				// that the router sends to it afterwards.
+				if _, err := io.ReadFull(remote, make([]byte, len(handshake))); err != nil {
+					errs <- err
+					return
+				}
+				_, err := remote.Write(handshake)
+				errs <- err
+				_, _ = io.Copy(io.Discard, remote)
+			}()
+			if _, err := r.Connect(local, ConnectionKeepalives(false)); err != nil {
+				t.Fatal(err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatal(err)
+			}
+			revision, ok := r.PeerVersion(testPublicKey(sk))
+			if !ok {
+				t.Fatalf("expected the peer to be connected")
+			}
+			if revision != tc.expected {
+				t.Fatalf("expected revision %d, got %d", tc.expected, revision)
+			}
+		})
+	}
+}
+
+func TestPeerVersionWithoutHandshake(t *testing.T) {
+	a, b := newTestRouter(t), newTestRouter(t)
+	connectTestRouters(t, a, b)
+	revision, ok := a.PeerVersion(b.PublicKey())
+	if !ok {
+		t.Fatalf("expected the peer to be connected")
+	}
+	if revision != revisionLegacy {
+		t.Fatalf("expected revision %d, got %d", revisionLegacy, revision)
+	}
+}
+
+func TestSendStats(t *testing.T) {
+	r := newTestRouter(t)
+	a, b := types.PublicKey{0x10}, types.PublicKey{0x20}
+	send := func(key types.PublicKey, length int) {
+		if _, err := r.WriteTo(make([]byte, length), key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	send(a, 100)
+	send(a, 50)
+	send(b, 10)
+	stats := r.SendStats()
+	if got, want := stats[a], (SendStat{Frames: 2, Bytes: 150}); got != want {
+		t.Fatalf("expected %+v sent to the first key, got %+v", want, got)
+	}
+	if got, want := stats[b], (SendStat{Frames: 1, Bytes: 10}); got != want {
+		t.Fatalf("expected %+v sent to the second key, got %+v", want, got)
+	}
+
+	// Sending to many more keys should forget the least recently used one,
+	// but not one that has just been sent to again.
+	send(a, 1)
+	for i := 0; i < maxSendStatsEntries-1; i++ {
+		send(types.PublicKey{0x30, byte(i)}, 1)
+	}
+	stats = r.SendStats()
+	if len(stats) != maxSendStatsEntries {
+		t.Fatalf("expected stats for %d keys, got %d", maxSendStatsEntries, len(stats))
+	}
+	if _, ok := stats[b]; ok {
+		t.Fatalf("expected the least recently used key to be forgotten")
+	}
+	if stats[a].Frames != 3 {
+		t.Fatalf("expected the recently used key to be kept")
+	}
+}
+
+func TestFrameTypeStats(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	dest := newTestPeer(r, 2, types.PublicKey{3})
+	addTestSnakeEntry(r, dest.public, dest)
+	root := newTestRoot(t, r)
+
+	traffic := func() *types.Frame {
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		f.DestinationKey = dest.public
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		return f
+	}
+	type sent struct {
+		from  *peer
+		frame *types.Frame
+	}
+	var frames []sent
+	for i := 0; i < 5; i++ {
+		frames = append(frames, sent{from, traffic()})
+	}
+	for i := 0; i < 2; i++ {
+		frames = append(frames, sent{r.local, traffic()})
+	}
+	// These keys are between dest's and ours, so the bootstraps end here.
+	seq := types.Varu64(time.Now().UnixMilli())
+	for _, sk := range []ed25519.PrivateKey{newTestKey(t, 0x10, 0x20), newTestKey(t, 0x20, 0x40)} {
+		frames = append(frames, sent{from, newTestBootstrap(t, sk, root, seq)})
+	}
+	unknown := getFrame()
+	unknown.Type = types.FrameType(200)
+	frames = append(frames, sent{from, unknown})
+
+	var errs []error
+	phony.Block(r.state, func() {
+		r.state._peers[from.port], r.state._peers[dest.port] = from, dest
+		for _, s := range frames {
+			errs = append(errs, r.state._forward(s.from, s.frame))
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Tree maintenance may have sent announcements and bootstraps of our
+	// own to the peers in the meantime, so only check what we sent above.
+	stats := r.FrameTypeStats()
+	if got, want := stats[types.TypeTraffic], (FrameTypeStat{Received: 5, Originated: 2, Forwarded: 5}); got != want {
+		t.Fatalf("expected traffic stats %+v, got %+v", want, got)
+	}
+	if got := stats[types.TypeBootstrap]; got.Received != 2 || got.Forwarded != 0 {
+		t.Fatalf("expected 2 bootstraps to be received and none forwarded, got %+v", got)
+	}
+	if got, want := stats[types.FrameType(200)], (FrameTypeStat{Received: 1}); got != want {
+		t.Fatalf("expected unknown frame stats %+v, got %+v", want, got)
+	}
+	if _, ok := stats[types.TypeSNEKPing]; ok {
+		t.Fatalf("expected no stats for frame types that haven't been seen")
+	}
+}
+
+func TestPeerAnnouncements(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	direct := newTestPeer(r, 1, testPublicKey(rootSK))
+	indirect := newTestPeer(r, 2, testPublicKey(midSK))
+	silent := newTestPeer(r, 3, types.PublicKey{3})
+	phony.Block(r.state, func() {
+		for _, p := range []*peer{direct, indirect, silent} {
+			r.state._peers[p.port] = p
+		}
+	})
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	directAnn := newTestAnnouncement(t, root, rootSK)
+	indirectAnn := newTestAnnouncement(t, root, rootSK, midSK)
+
+	// Process the announcements in the opposite order to the ports.
+	var err error
+	phony.Block(r.state, func() {
+		if err = r.state._handleTreeAnnouncement(indirect, indirectAnn); err != nil {
+			return
+		}
+		err = r.state._handleTreeAnnouncement(direct, directAnn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	infos := r.PeerAnnouncements()
+	if len(infos) != 2 {
+		t.Fatalf("expected announcements from 2 peers, got %d", len(infos))
+	}
+	first, second := infos[0], infos[1]
+	if first.PublicKey != direct.public || second.PublicKey != indirect.public {
+		t.Fatalf("expected the announcements to be ordered by port")
+	}
+	if second.ReceiveOrder >= first.ReceiveOrder {
+		t.Fatalf("expected the announcement processed first to have the lower receive order")
+	}
+	if first.ReceiveTime.IsZero() || second.ReceiveTime.IsZero() {
+		t.Fatalf("expected receive times to be set")
+	}
+	if first.Signatures != 1 || second.Signatures != 2 {
+		t.Fatalf("expected 1 and 2 signatures, got %d and %d", first.Signatures, second.Signatures)
+	}
+	if first.Root != root || second.Root != root {
+		t.Fatalf("expected both announcements to have root %v", root)
+	}
+	if !first.Parent || second.Parent {
+		t.Fatalf("expected only the peer closest to the root to be our parent")
+	}
+}
+
+func TestIsPartitioned(t *testing.T) {
+	a, b := newTestRouter(t), newTestRouter(t)
+	phony.Block(a.state, func() {})
+	ch := make(chan events.Event, 64)
+	a.Subscribe(ch)
+	if !a.IsPartitioned() {
+		t.Fatalf("expected a node without peers to be partitioned")
+	}
+
+	waitForPartition := func(expected bool) {
+		for {
+			select {
+			case e := <-ch:
+				if e, ok := e.(events.PartitionChanged); ok {
+					if e.Partitioned != expected {
+						t.Fatalf("expected partitioned to change to %v", expected)
+					}
+					if a.IsPartitioned() != expected {
+						t.Fatalf("expected IsPartitioned to return %v", expected)
+					}
+					return
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("timed out waiting for partitioned to change to %v", expected)
+			}
+		}
+	}
+
+	connectTestRouters(t, a, b)
+	waitForPartition(false)
+	if err := a.DisconnectPeer(b.public); err != nil {
+		t.Fatal(err)
+	}
+	waitForPartition(true)
+	connectTestRouters(t, a, b)
+	waitForPartition(false)
+}
+
+func TestHealth(t *testing.T) {
+	clock := newTestClock()
+	a := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xff), RouterOptionClock{clock})
+	b := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x80))
+
+	// A node without peers is its own root, but isn't ready.
+	waitForTreeMaintenance(t, a)
+	health := a.Health()
+	if health.Ready || health.HasParent || !health.IsRoot || health.Peers != 0 {
+		t.Fatalf("expected an isolated node not to be ready, got %+v", health)
+	}
+	if health.HasAscending || health.HasDescending {
+		t.Fatalf("expected an isolated node to have no neighbours, got %+v", health)
+	}
+	clock.Advance(time.Second * 10)
+	if stable := a.Health().StableFor; stable != time.Second*10 {
+		t.Fatalf("expected to have been stable for 10s, got %s", stable)
+	}
+
+	// Once peered, a is the root with a peer and b has a as its parent, so
+	// both are ready. In keyspace, b is below a and bootstraps to it.
+	connectTestRouters(t, a, b)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		ha, hb := a.Health(), b.Health()
+		if ha.Ready && ha.IsRoot && ha.HasDescending && hb.Ready && hb.HasParent && hb.HasAscending {
+			if ha.Peers != 1 || hb.Peers != 1 {
+				t.Fatalf("expected one peer each, got %d and %d", ha.Peers, hb.Peers)
+			}
+			if ha.HasAscending || hb.HasDescending || hb.IsRoot {
+				t.Fatalf("unexpected health %+v and %+v", ha, hb)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes never became healthy, got %+v and %+v", ha, hb)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if stable := a.Health().StableFor; stable >= time.Second*10 {
+		t.Fatalf("expected peering to reset the time since the last change, got %s", stable)
+	}
+}
+
+func TestMaintenanceWatchdog(t *testing.T) {
+	r := newTestRouter(t, RouterOptionSnakeMaintainInterval(minSnakeMaintainInterval))
+	ch := make(chan events.Event, 64)
+	r.Subscribe(ch)
+
+	waitForStall := func(expected bool) {
+		for {
+			select {
+			case e := <-ch:
+				if e, ok := e.(events.MaintenanceStalled); ok && e.Task == "snake" {
+					if e.Stalled != expected {
+						t.Fatalf("expected stalled to change to %v", expected)
+					}
+					return
+				}
+			case <-time.After(time.Second * 5):
+				t.Fatalf("timed out waiting for stalled to change to %v", expected)
+			}
+		}
+	}
+
+	// Block the state actor, as a slow packet filter would, for long enough
+	// that SNEK maintenance misses several intervals.
+	unblock := make(chan struct{})
+	r.state.Act(nil, func() {
+		<-unblock
+	})
+	waitForStall(true)
+	if stalls := r.MaintenanceStalls(); stalls != 1 {
+		t.Fatalf("expected 1 maintenance stall, got %d", stalls)
+	}
+	close(unblock)
+	waitForStall(false)
+}
@@ -0,0 +1,32 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "time"
+
+// Clock is the source of the current time for the router. All expiry and
+// timeout decisions, as well as the timestamps on bootstraps and broadcasts,
+// are based on it. Timers that drive the router's maintenance still use real
+// time, so a fake clock only changes what the router sees when they fire.
+type Clock interface {
+	Now() time.Time
+}
+
+// realClock is the default Clock, which uses the system clock.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
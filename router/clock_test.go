@@ -0,0 +1,91 @@
+package router
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// testClock is a Clock that only moves forward when told to.
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newTestClock() *testClock {
+	return &testClock{now: time.Now()}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestClockSnakeExpiry(t *testing.T) {
+	clock := newTestClock()
+	r := newTestRouter(t, RouterOptionClock{clock})
+	key := types.PublicKey{1}
+	addTestSnakeEntry(r, key, newTestPeer(r, 1, key))
+
+	present := func() (ok bool) {
+		phony.Block(r.state, func() {
+			r.state._maintainSnake()
+			_, ok = r.state._table[virtualSnakeIndex{PublicKey: key}]
+		})
+		return
+	}
+
+	clock.Advance(r.snakeNeighExpiry - time.Second)
+	if !present() {
+		t.Fatalf("entry should not have expired yet")
+	}
+	clock.Advance(time.Second)
+	if present() {
+		t.Fatalf("entry should have expired")
+	}
+}
+
+func TestClockAnnouncementTimeout(t *testing.T) {
+	clock := newTestClock()
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x80, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x80), RouterOptionClock{clock})
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	ann := newTestAnnouncement(t, root, rootSK, aSK)
+
+	var err error
+	phony.Block(r.state, func() {
+		r.state._peers[a.port] = a
+		err = r.state._handleTreeAnnouncement(a, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := func() (parent *peer) {
+		phony.Block(r.state, func() {
+			r.state._maintainTree()
+			parent = r.state._parent
+		})
+		return
+	}
+
+	clock.Advance(r.announceTimeout - time.Second)
+	if parent() != a {
+		t.Fatalf("expected peer A to still be our parent")
+	}
+	clock.Advance(time.Second)
+	if parent() != nil {
+		t.Fatalf("expected peer A to have timed out as our parent")
+	}
+}
@@ -17,11 +17,18 @@ package router
 import (
 	"math"
 	"time"
+
+	"github.com/matrix-org/pinecone/types"
 )
 
 const portCount = math.MaxUint8 - 1
 const trafficBuffer = math.MaxUint8 - 1
 
+// protoBuffer is the maximum number of protocol frames that
+// we will queue up for a peer before we start dropping them,
+// so that a stalled peer can't cause unbounded memory growth.
+const protoBuffer = 1024
+
 // peerKeepaliveInterval is the frequency at which this
 // node will send keepalive packets to other peers if no
 // other packets have been sent within the peerKeepaliveInterval.
@@ -32,6 +39,11 @@ const peerKeepaliveInterval = time.Second * 3
 // will assume that the peer is dead.
 const peerKeepaliveTimeout = time.Second * 5
 
+// leavingTimeout is how long closing the router will wait
+// for the final tree announcements, which tell our peers
+// that we are leaving, to be written to them.
+const leavingTimeout = time.Second
+
 // announcementInterval is the frequency at which this
 // node will send root announcements to other peers.
 const announcementInterval = time.Minute * 30
@@ -41,18 +53,140 @@ const announcementInterval = time.Minute * 30
 // will assume that the peer is dead.
 const announcementTimeout = time.Minute * 45
 
+// defaultTimerJitter is the fraction by which the tree and
+// SNEK maintenance intervals are randomly varied by default,
+// so that nodes that start together don't stay in lockstep.
+const defaultTimerJitter = 0.05
+
+// defaultStaleAnnouncementFraction is the default fraction of
+// the announcement timeout after which a peer's announcement is
+// considered stale when choosing tree next-hops.
+const defaultStaleAnnouncementFraction = 0.9
+
 // virtualSnakeMaintainInterval is how often we check to
-// see if SNEK maintenance needs to be done.
+// see if SNEK maintenance needs to be done by default.
 const virtualSnakeMaintainInterval = time.Second
 
+// minSnakeMaintainInterval is the shortest SNEK maintenance
+// interval that can be configured, so that the maintenance
+// timer can't keep the router busy.
+const minSnakeMaintainInterval = time.Millisecond * 10
+
+// maintenanceStallFactor is how many maintenance intervals
+// can pass without tree or SNEK maintenance running before
+// the watchdog considers the state actor to be stalled.
+const maintenanceStallFactor = 3
+
 // virtualSnakeBootstrapInterval is how often we will aim
 // to send bootstrap messages into the network.
 const virtualSnakeBootstrapInterval = time.Second * 5
 
+// virtualSnakeRebootstrapInterval is the minimum time
+// between bootstraps that can be forced by calling
+// Router.Rebootstrap.
+const virtualSnakeRebootstrapInterval = time.Second
+
 // virtualSnakeNeighExpiryPeriod is how long we'll wait
 // to expire a path that hasn't re-bootstrapped.
 const virtualSnakeNeighExpiryPeriod = virtualSnakeBootstrapInterval * 2
 
+// virtualSnakeBootstrapHopLimit is the hop limit that
+// bootstraps start out with. Each node that forwards a
+// bootstrap reduces it by one, so that a bootstrap that is
+// caught in a routing loop will eventually be dropped.
+const virtualSnakeBootstrapHopLimit = math.MaxUint8
+
+// virtualSnakeDescendingBackups is how many backup
+// descending candidates we will remember, so that we can
+// fail over quickly if our descending node goes away.
+const virtualSnakeDescendingBackups = 3
+
+// maxDescendingSlots is the most descending nodes that
+// RouterOptionDescendingSlots can ask us to keep. Each slot
+// beyond the first covers half as much keyspace as the one
+// before, so more than this would cover almost nothing.
+const maxDescendingSlots = 16
+
+// bootstrapRateLimitBurst is how many seconds' worth of
+// bootstraps a peer can send us in a burst when bootstrap
+// rate limiting is enabled.
+const bootstrapRateLimitBurst = 2
+
+// defaultMaxAnnouncementSignatures is the default maximum
+// number of signatures that we will accept in a single tree
+// announcement, which is also the deepest that the tree can
+// be from our point of view.
+const defaultMaxAnnouncementSignatures = 64
+
+// rootSequenceWindow is the furthest that a root sequence
+// number is allowed to jump ahead of the last one that we
+// saw from the same peer. Roots increase it by one every
+// announcement interval, so at the default interval this
+// covers years of announcements that we could have missed
+// while still spotting updates that are clearly bogus.
+const rootSequenceWindow = 1 << 16
+
+// pinnedRootSequence is set in the root sequence number of
+// announcements from a pinned root. The sequence number is
+// signed by the root, so this marks the root as pinned
+// without changing the announcement format.
+const pinnedRootSequence types.Varu64 = 1 << 63
+
+// rootElectionEpoch is how many root sequence numbers make
+// up one epoch of weighted root election, which works out
+// at a day with the default announcement interval.
+const rootElectionEpoch = 48
+
+// defaultMaxSnakeEntries is the default maximum number of
+// entries that we will hold in the virtual snake routing
+// table before we start evicting entries.
+const defaultMaxSnakeEntries = 1024
+
+// maxSnakeNextHopCacheEntries is the most SNEK next-hops
+// that we will remember for repeated destinations before
+// the cache is emptied and starts again.
+const maxSnakeNextHopCacheEntries = 1024
+
+// loopDetectionWindow is how long we will remember that
+// traffic between two nodes has bounced back to us from a
+// given peer.
+const loopDetectionWindow = time.Second
+
+// loopDetectionThreshold is how many times traffic between
+// the same two nodes can bounce back to us from the same
+// peer within the loop detection window before we will
+// report it as a routing loop.
+const loopDetectionThreshold = 3
+
+// loopDetectionMaxEntries is how many bouncing flows we
+// will remember at once. When full, the oldest is forgotten.
+const loopDetectionMaxEntries = 4096
+
+// parentFlapThreshold is how many times a parent can fail,
+// by timing out or disconnecting, within the parent flap
+// window before we stop choosing it as our parent for a while.
+const parentFlapThreshold = 3
+
+// parentFlapWindow is how long we will remember parent
+// failures for, in multiples of the announcement timeout,
+// since a parent can't time out faster than that.
+const parentFlapWindow = 6
+
+// parentFlapPenalty is how long a flapping parent will be
+// excluded from parent selection for, in multiples of the
+// announcement timeout.
+const parentFlapPenalty = 4
+
+// maxNextHopFallbacks is how many other next-hops we will
+// try, after the best one, when the queues of those that we
+// have tried are full.
+const maxNextHopFallbacks = 3
+
+// eventSubscriberBacklog is how many events we will queue
+// up for a single subscriber that isn't keeping up before
+// we start dropping events for that subscriber.
+const eventSubscriberBacklog = 1024
+
 // coordsCacheLifetime is how long we'll keep entries in
 // the coords cache for switching to tree routing.
 const coordsCacheLifetime = time.Minute
@@ -74,3 +208,29 @@ const broadcastExpiryPeriod = wakeupBroadcastInterval * 3
 // This helps to prevent broadcasts from flooding the
 // network.
 const broadcastFilterTime = wakeupBroadcastInterval / 2
+
+// fragmentPayloadSize is how many bytes of a large payload
+// are sent in each fragment by Router.SendLarge.
+const fragmentPayloadSize = 32768
+
+// maxReassembledSize is the largest payload that can be sent
+// using Router.SendLarge and reassembled by the remote side.
+const maxReassembledSize = 1 << 20
+
+// maxReassemblyBuffer is the most fragment data that we will
+// hold on to at once while waiting for the rest of a payload.
+const maxReassemblyBuffer = maxReassembledSize * 4
+
+// fragmentReassemblyTimeout is how long we will wait for all
+// of the fragments of a payload to arrive before dropping
+// the ones that we have.
+const fragmentReassemblyTimeout = time.Second * 10
+
+// maxSendStatsEntries is how many destination keys we will
+// keep send statistics for. When there are more, the least
+// recently used key is forgotten to make room.
+const maxSendStatsEntries = 256
+
+// pathMTUProbeTimeout is how long Router.PathMTU waits for a
+// reply to each probe before deciding that it didn't arrive.
+const pathMTUProbeTimeout = time.Second * 2
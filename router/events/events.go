@@ -62,6 +62,21 @@ type TreeRootAnnUpdate struct {
 // Tag TreeRootAnnUpdate as an Event
 func (e TreeRootAnnUpdate) isEvent() {}
 
+type TreeRootChanged struct {
+	Root         string // New Root Public Key
+	PreviousRoot string // Old Root Public Key
+}
+
+// Tag TreeRootChanged as an Event
+func (e TreeRootChanged) isEvent() {}
+
+type PartitionChanged struct {
+	Partitioned bool // True if we are our own root with no peers
+}
+
+// Tag PartitionChanged as an Event
+func (e PartitionChanged) isEvent() {}
+
 type SnakeEntryAdded struct {
 	EntryID string
 	PeerID  string
@@ -103,3 +118,11 @@ type BandwidthReport struct {
 
 // Tag BandwidthReport as an Event
 func (e BandwidthReport) isEvent() {}
+
+type MaintenanceStalled struct {
+	Task    string // Either "tree" or "snake"
+	Stalled bool   // False once the task has run again
+}
+
+// Tag MaintenanceStalled as an Event
+func (e MaintenanceStalled) isEvent() {}
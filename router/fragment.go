@@ -0,0 +1,176 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// SendLarge sends a payload that may be too large to fit into a single frame.
+// The payload is split into fragments, which the remote node reassembles
+// before returning the whole payload from ReadFrom, so the remote node must
+// also support fragmentation. Payloads of up to 1MB can be sent. The address
+// is used in the same way as for WriteTo.
+func (r *Router) SendLarge(addr net.Addr, payload []byte) error {
+	if l := len(payload); l > maxReassembledSize {
+		return fmt.Errorf("payload of %d bytes is larger than the maximum of %d", l, maxReassembledSize)
+	}
+	id := r._fragmentID.Inc()
+	buf := make([]byte, types.FragmentHeaderSize+fragmentPayloadSize)
+	for offset := 0; ; offset += fragmentPayloadSize {
+		end := offset + fragmentPayloadSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		header := types.FragmentHeader{
+			ID:     id,
+			Offset: uint32(offset),
+			More:   end < len(payload),
+		}
+		n, err := header.MarshalBinary(buf)
+		if err != nil {
+			return fmt.Errorf("header.MarshalBinary: %w", err)
+		}
+		n += copy(buf[n:], payload[offset:end])
+		if _, err := r.writeTo(buf[:n], addr, types.FlagFragment); err != nil {
+			return err
+		}
+		if !header.More {
+			return nil
+		}
+	}
+}
+
+type fragmentKey struct {
+	source types.PublicKey
+	id     uint32
+}
+
+type fragmentSet struct {
+	fragments map[uint32][]byte // Fragment data by offset
+	received  int               // How many bytes have arrived so far
+	total     int               // Length of the payload, or -1 if not known yet
+	deadline  time.Time         // When to give up on the rest of the fragments
+}
+
+// reassembler puts fragmented payloads back together. It is safe to be used
+// from multiple goroutines.
+type reassembler struct {
+	mutex    sync.Mutex
+	sets     map[fragmentKey]*fragmentSet
+	buffered int // Bytes held across all sets
+}
+
+// add stores the fragment carried in the given frame payload. Once all of the
+// fragments of a payload have arrived, the reassembled payload is returned.
+// Fragments that can't be stored because they are invalid, or because too
+// much data is already being held, are dropped. Incomplete payloads are
+// dropped once they have been waiting for longer than the reassembly timeout.
+func (r *reassembler) add(now time.Time, source types.PublicKey, payload []byte) ([]byte, bool) {
+	var header types.FragmentHeader
+	n, err := header.UnmarshalBinary(payload)
+	if err != nil {
+		return nil, false
+	}
+	data := payload[n:]
+	end := int(header.Offset) + len(data)
+	if end > maxReassembledSize {
+		return nil, false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.sets == nil {
+		r.sets = map[fragmentKey]*fragmentSet{}
+	}
+	for k, set := range r.sets {
+		if now.After(set.deadline) {
+			r._remove(k)
+		}
+	}
+
+	key := fragmentKey{source, header.ID}
+	set, ok := r.sets[key]
+	if !ok {
+		set = &fragmentSet{
+			fragments: map[uint32][]byte{},
+			total:     -1,
+			deadline:  now.Add(fragmentReassemblyTimeout),
+		}
+		r.sets[key] = set
+	}
+	if _, ok := set.fragments[header.Offset]; ok {
+		return nil, false // we already have this fragment
+	}
+	if r.buffered+len(data) > maxReassemblyBuffer {
+		return nil, false
+	}
+	if !header.More {
+		if set.total >= 0 && set.total != end {
+			r._remove(key) // the fragments don't agree on the length
+			return nil, false
+		}
+		set.total = end
+	}
+	set.fragments[header.Offset] = append([]byte(nil), data...)
+	set.received += len(data)
+	r.buffered += len(data)
+	if set.total < 0 || set.received < set.total {
+		return nil, false
+	}
+
+	// All of the data has arrived, so check that the fragments fit together
+	// without any gaps or overlaps before putting the payload back together.
+	defer r._remove(key)
+	offsets := make([]uint32, 0, len(set.fragments))
+	for offset := range set.fragments {
+		offsets = append(offsets, offset)
+	}
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsets[i] < offsets[j]
+	})
+	reassembled := make([]byte, 0, set.total)
+	for _, offset := range offsets {
+		if int(offset) != len(reassembled) {
+			return nil, false
+		}
+		reassembled = append(reassembled, set.fragments[offset]...)
+	}
+	if len(reassembled) != set.total {
+		return nil, false
+	}
+	return reassembled, true
+}
+
+// _remove drops the given fragment set. The mutex must be held.
+func (r *reassembler) _remove(key fragmentKey) {
+	if set, ok := r.sets[key]; ok {
+		r.buffered -= set.received
+		delete(r.sets, key)
+	}
+}
+
+// pending returns how many payloads are waiting for more fragments.
+func (r *reassembler) pending() int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return len(r.sets)
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestFragmentSendLarge(t *testing.T) {
+	a := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xff))
+	b := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x80))
+	connectTestRouters(t, a, b)
+
+	// Wait for b to join a's tree.
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var root types.PublicKey
+		phony.Block(b.state, func() {
+			root = b.state._rootAnnouncement().RootPublicKey
+		})
+		if root == a.public {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("b didn't join a's tree")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	payload := make([]byte, types.MaxPayloadSize*3)
+	rand.Read(payload)
+	if err := a.SendLarge(b.public, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, len(payload))
+	_ = b.SetReadDeadline(time.Now().Add(time.Second * 5))
+	n, addr, err := b.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != a.public {
+		t.Fatalf("expected payload from %s, got %s", a.public, addr)
+	}
+	if !bytes.Equal(buf[:n], payload) {
+		t.Fatalf("reassembled payload of %d bytes doesn't match the %d bytes sent", n, len(payload))
+	}
+}
+
+func TestFragmentReassembly(t *testing.T) {
+	fragment := func(id uint32, offset int, more bool, data []byte) []byte {
+		header := types.FragmentHeader{ID: id, Offset: uint32(offset), More: more}
+		buf := make([]byte, types.FragmentHeaderSize+len(data))
+		n, _ := header.MarshalBinary(buf)
+		copy(buf[n:], data)
+		return buf
+	}
+	var r reassembler
+	source := types.PublicKey{1}
+	now := time.Now()
+
+	// Fragments can arrive out of order.
+	if _, ok := r.add(now, source, fragment(1, 3, false, []byte("def"))); ok {
+		t.Fatalf("expected payload to be incomplete")
+	}
+	payload, ok := r.add(now, source, fragment(1, 0, true, []byte("abc")))
+	if !ok || string(payload) != "abcdef" {
+		t.Fatalf("expected reassembled payload, got %q", payload)
+	}
+
+	// Incomplete payloads are dropped once they've been waiting too long.
+	if _, ok := r.add(now, source, fragment(2, 0, true, []byte("abc"))); ok {
+		t.Fatalf("expected payload to be incomplete")
+	}
+	if pending := r.pending(); pending != 1 {
+		t.Fatalf("expected 1 pending payload, got %d", pending)
+	}
+	later := now.Add(fragmentReassemblyTimeout + time.Second)
+	if _, ok := r.add(later, source, fragment(2, 3, false, []byte("def"))); ok {
+		t.Fatalf("expected expired payload not to be reassembled")
+	}
+	if pending, buffered := r.pending(), r.buffered; pending != 1 || buffered != 3 {
+		t.Fatalf("expected only the new fragment to be held, got %d payloads and %d bytes", pending, buffered)
+	}
+	if _, ok := r.add(later.Add(fragmentReassemblyTimeout+time.Second), source, fragment(3, 0, true, nil)); ok {
+		t.Fatalf("expected payload to be incomplete")
+	}
+	if pending, buffered := r.pending(), r.buffered; pending != 1 || buffered != 0 {
+		t.Fatalf("expected expired fragments to be dropped, got %d payloads and %d bytes", pending, buffered)
+	}
+}
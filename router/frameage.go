@@ -0,0 +1,67 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// setTrafficPayload copies p into the payload of a traffic frame that we are
+// about to send. If RouterOptionMaxFrameAge is set then the payload starts
+// with a signed FrameTimestamp. The frame's destination key must already be
+// set.
+func (r *Router) setTrafficPayload(f *types.Frame, p []byte) {
+	if r.maxFrameAge == 0 {
+		f.Payload = append(f.Payload[:0], p...)
+		return
+	}
+	ts := types.FrameTimestamp{
+		Time: uint64(r.clock.Now().UnixMilli()),
+	}
+	private := r.PrivateKey()
+	copy(ts.Signature[:], ed25519.Sign(private[:], ts.ProtectedPayload(f.DestinationKey, p)))
+	f.Payload = f.Payload[:types.FrameTimestampSize]
+	_, _ = ts.MarshalBinary(f.Payload)
+	f.Payload = append(f.Payload, p...)
+	f.Extra |= types.FlagTimestamped
+}
+
+// frameIsFresh returns false if the traffic frame carries a timestamp that is
+// further than RouterOptionMaxFrameAge from our own clock, or that wasn't
+// signed by the frame's sender. Frames without a timestamp are always fresh,
+// as are all frames if RouterOptionMaxFrameAge isn't set.
+func (r *Router) frameIsFresh(f *types.Frame) bool {
+	if r.maxFrameAge == 0 || f.Extra&types.FlagTimestamped == 0 {
+		return true
+	}
+	var ts types.FrameTimestamp
+	if _, err := ts.UnmarshalBinary(f.Payload); err != nil {
+		return false
+	}
+	if r.secure {
+		protected := ts.ProtectedPayload(f.DestinationKey, f.Payload[types.FrameTimestampSize:])
+		if !ed25519.Verify(f.SourceKey[:], protected, ts.Signature[:]) {
+			return false
+		}
+	}
+	age := r.clock.Now().Sub(time.UnixMilli(int64(ts.Time)))
+	if age < 0 {
+		age = -age
+	}
+	return age < r.maxFrameAge
+}
@@ -0,0 +1,167 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// newTestTimestampedTraffic returns a traffic frame to the given key, sent by
+// the given private key and timestamped with the given time.
+func newTestTimestampedTraffic(t *testing.T, sk ed25519.PrivateKey, dest types.PublicKey, at time.Time, payload []byte) *types.Frame {
+	f := getFrame()
+	f.Type = types.TypeTraffic
+	f.Extra = types.FlagTimestamped
+	f.SourceKey = testPublicKey(sk)
+	f.DestinationKey = dest
+	f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	ts := types.FrameTimestamp{Time: uint64(at.UnixMilli())}
+	copy(ts.Signature[:], ed25519.Sign(sk, ts.ProtectedPayload(dest, payload)))
+	f.Payload = f.Payload[:types.FrameTimestampSize]
+	if _, err := ts.MarshalBinary(f.Payload); err != nil {
+		t.Fatal(err)
+	}
+	f.Payload = append(f.Payload, payload...)
+	return f
+}
+
+func TestForwardFrameAge(t *testing.T) {
+	const maxAge = time.Minute
+	dest := types.PublicKey{3}
+	sender := newTestKey(t, 0x00, 0x40)
+	payload := []byte("hello")
+	now := time.Now()
+
+	for _, tc := range []struct {
+		name    string
+		dropped bool
+		frame   func() *types.Frame
+	}{
+		{"Fresh", false, func() *types.Frame {
+			return newTestTimestampedTraffic(t, sender, dest, now, payload)
+		}},
+		{"Untimestamped", false, func() *types.Frame {
+			f := newTestTimestampedTraffic(t, sender, dest, now, payload)
+			f.Extra = 0
+			f.Payload = append(f.Payload[:0], payload...)
+			return f
+		}},
+		{"Old", true, func() *types.Frame {
+			return newTestTimestampedTraffic(t, sender, dest, now.Add(-maxAge*2), payload)
+		}},
+		{"Future", true, func() *types.Frame {
+			return newTestTimestampedTraffic(t, sender, dest, now.Add(maxAge*2), payload)
+		}},
+		{"WrongSigner", true, func() *types.Frame {
+			f := newTestTimestampedTraffic(t, newTestKey(t, 0x00, 0x40), dest, now, payload)
+			f.SourceKey = testPublicKey(sender)
+			return f
+		}},
+		{"Rewritten", true, func() *types.Frame {
+			// Making an old frame look younger breaks the signature.
+			f := newTestTimestampedTraffic(t, sender, dest, now.Add(-maxAge*2), payload)
+			ts := types.FrameTimestamp{}
+			_, _ = ts.UnmarshalBinary(f.Payload)
+			ts.Time = uint64(now.UnixMilli())
+			_, _ = ts.MarshalBinary(f.Payload)
+			return f
+		}},
+		{"Truncated", true, func() *types.Frame {
+			f := newTestTimestampedTraffic(t, sender, dest, now, payload)
+			f.Payload = f.Payload[:types.FrameTimestampSize-1]
+			return f
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), RouterOptionMaxFrameAge(maxAge))
+			a := newTestPeer(r, 1, dest)
+			b := newTestPeer(r, 2, types.PublicKey{1})
+			addTestSnakeEntry(r, dest, a)
+			f := tc.frame()
+			var err error
+			phony.Block(r.state, func() {
+				err = r.state._forward(b, f)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch dropped := r._drops[DropExpired].Load(); {
+			case tc.dropped && dropped != 1:
+				t.Fatalf("expected the frame to be dropped as expired")
+			case !tc.dropped && dropped != 0:
+				t.Fatalf("expected the frame to be forwarded")
+			}
+		})
+	}
+}
+
+func TestFrameAgeDisabled(t *testing.T) {
+	// Without RouterOptionMaxFrameAge, even old frames are forwarded.
+	dest := types.PublicKey{3}
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	a := newTestPeer(r, 1, dest)
+	b := newTestPeer(r, 2, types.PublicKey{1})
+	addTestSnakeEntry(r, dest, a)
+	f := newTestTimestampedTraffic(t, newTestKey(t, 0x00, 0x40), dest, time.Unix(0, 0), []byte("hello"))
+	phony.Block(r.state, func() {
+		_ = r.state._forward(b, f)
+	})
+	if dropped := r._drops[DropExpired].Load(); dropped != 0 {
+		t.Fatalf("expected the frame to be forwarded")
+	}
+}
+
+func TestFrameAgeEndToEnd(t *testing.T) {
+	a := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xff), RouterOptionMaxFrameAge(time.Minute))
+	b := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x80), RouterOptionMaxFrameAge(time.Minute))
+	connectTestRouters(t, a, b)
+
+	// Keep sending until b has joined a's tree and a path exists. The
+	// timestamp must be removed before the payload reaches b's reader.
+	payload := []byte("timestamped payload")
+	buf := make([]byte, types.MaxPayloadSize)
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		if _, err := a.WriteTo(payload, b.public); err != nil {
+			t.Fatal(err)
+		}
+		_ = b.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, addr, err := b.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 0 {
+			if addr != a.public {
+				t.Fatalf("expected payload from %s, got %s", a.public, addr)
+			}
+			if !bytes.Equal(buf[:n], payload) {
+				t.Fatalf("expected payload %q, got %q", payload, buf[:n])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("payload never arrived")
+		}
+	}
+	if dropped := b._drops[DropExpired].Load(); dropped != 0 {
+		t.Fatalf("expected no frames to be dropped as expired, got %d", dropped)
+	}
+}
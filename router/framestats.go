@@ -0,0 +1,74 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math"
+
+	"github.com/matrix-org/pinecone/types"
+	"go.uber.org/atomic"
+)
+
+// FrameTypeStat counts the frames of a single type that this node has
+// handled. Comparing the counts for protocol frames with those for traffic
+// shows how much of the load is control overhead.
+type FrameTypeStat struct {
+	Received   uint64 // Frames that arrived from our peers
+	Originated uint64 // Frames that we created and sent to our peers
+	Forwarded  uint64 // Frames from our peers that we sent on to another peer
+}
+
+type frameTypeCounters struct {
+	received   atomic.Uint64
+	originated atomic.Uint64
+	forwarded  atomic.Uint64
+}
+
+// frameTypeStats keeps a FrameTypeStat for every possible frame type, so
+// that frames of unknown types from newer peers are counted too. It is safe
+// to be used from multiple goroutines.
+type frameTypeStats [math.MaxUint8 + 1]frameTypeCounters
+
+// received counts a frame that arrived from one of our peers.
+func (s *frameTypeStats) received(t types.FrameType) {
+	s[t].received.Inc()
+}
+
+// sent counts a frame queued for one of our peers, which we either created
+// ourselves or are forwarding for another node.
+func (s *frameTypeStats) sent(t types.FrameType, originated bool) {
+	if originated {
+		s[t].originated.Inc()
+	} else {
+		s[t].forwarded.Inc()
+	}
+}
+
+// snapshot returns a copy of the statistics for each frame type that has
+// been seen at least once.
+func (s *frameTypeStats) snapshot() map[types.FrameType]FrameTypeStat {
+	stats := map[types.FrameType]FrameTypeStat{}
+	for t := range s {
+		stat := FrameTypeStat{
+			Received:   s[t].received.Load(),
+			Originated: s[t].originated.Load(),
+			Forwarded:  s[t].forwarded.Load(),
+		}
+		if stat != (FrameTypeStat{}) {
+			stats[types.FrameType(t)] = stat
+		}
+	}
+	return stats
+}
@@ -0,0 +1,59 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"go.uber.org/atomic"
+)
+
+// linkImpairment makes a peering behave like a degraded link by losing or
+// delaying the protocol frames that are queued up for the peer. It is only
+// used by tests, through peer.impair, so that the routing logic can be tried
+// out against lossy or slow links without a real network. The random number
+// generator is seeded so that a given test loses the same frames each time.
+type linkImpairment struct {
+	loss    float64       // Probability that each frame is lost
+	latency time.Duration // Delay before each frame is queued
+	lost    atomic.Uint64 // Number of frames lost so far
+	mutex   sync.Mutex
+	rand    *rand.Rand
+}
+
+// impair starts simulating loss and latency on the peering. Peers that
+// haven't been impaired only pay for an atomic load in send.
+func (p *peer) impair(loss float64, latency time.Duration, seed int64) *linkImpairment {
+	l := &linkImpairment{
+		loss:    loss,
+		latency: latency,
+		rand:    rand.New(rand.NewSource(seed)),
+	}
+	p.impairment.Store(l)
+	return l
+}
+
+// lose returns true if the next frame should be lost.
+func (l *linkImpairment) lose() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.loss > 0 && l.rand.Float64() < l.loss {
+		l.lost.Inc()
+		return true
+	}
+	return false
+}
@@ -28,6 +28,7 @@ type manholeResponse struct {
 	Public types.PublicKey          `json:"public_key"`
 	Coords types.Coordinates        `json:"coords"`
 	Root   *types.Root              `json:"root"`
+	Depth  int                      `json:"root_distance"`
 	Parent *peer                    `json:"parent"`
 	Peers  map[string][]manholePeer `json:"peers"`
 	SNEK   struct {
@@ -50,19 +51,20 @@ type manholePeer struct {
 	TXTraffic    uint64             `json:"tx_traffic_bytes"`
 	ProtoQueue   queue              `json:"proto_queue"`
 	TrafficQueue queue              `json:"traffic_queue"`
+	Dropped      uint64             `json:"dropped_frames"`
 }
 
 func (r *Router) ManholeHandler(w http.ResponseWriter, req *http.Request) {
 	response := manholeResponse{
-		Public: r.public,
+		Public: r.PublicKey(),
 		Peers:  map[string][]manholePeer{},
 	}
 	phony.Block(r.state, func() {
-		response.Public = r.public
 		response.Coords = r.state._coords()
 		response.Parent = r.state._parent
 		if rootAnn := r.state._rootAnnouncement(); rootAnn != nil {
 			response.Root = &rootAnn.Root
+			response.Depth = len(rootAnn.Signatures)
 		}
 		response.CoordCache = map[string]types.Coordinates{}
 		for k, v := range r.state._coordsCache {
@@ -82,6 +84,7 @@ func (r *Router) ManholeHandler(w http.ResponseWriter, req *http.Request) {
 				PeerURI:      p.uri,
 				ProtoQueue:   p.proto,
 				TrafficQueue: p.traffic,
+				Dropped:      p.dropped.Load(),
 			}
 			phony.Block(&p.statistics, func() {
 				info.RXProto, info.RXTraffic = p.statistics._bytesRxProto, p.statistics._bytesRxTraffic
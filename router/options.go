@@ -14,15 +14,217 @@
 
 package router
 
-import "github.com/matrix-org/pinecone/types"
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
 
 type RouterOptionBlackhole bool
+type RouterOptionMaxSnakeEntries int
+
+// RouterOptionSnakeNeighExpiry sets how long SNEK routing table entries live
+// without being refreshed. Bootstraps are timestamped when they are sent and
+// are dropped if their timestamp is further than this from our own clock, so
+// nodes need their clocks to agree to within this period.
+type RouterOptionSnakeNeighExpiry time.Duration
+
+// RouterOptionSnakeMaintainInterval sets how often the router checks whether
+// it needs to bootstrap or clean up expired SNEK routes. Battery-powered nodes
+// might want to do this less often, and simulations more often. Intervals
+// shorter than 10ms are raised to 10ms. The default is one second.
+type RouterOptionSnakeMaintainInterval time.Duration
+
+type RouterOptionOnCoordsChanged func(coords types.Coordinates)
+
+// RouterOptionOnRootChanged is called with the previous and new root keys
+// whenever the root of our spanning tree changes, including when we become
+// the root ourselves. Like RouterOptionOnCoordsChanged, it is called from
+// the router actor so it may call back into the router.
+type RouterOptionOnRootChanged func(old, new types.PublicKey)
+
+// RouterOptionOnFrameForward is called for each frame that is forwarded
+// using tree, SNEK or source routing, describing where it came from and which
+// peer it was sent to, which is useful for tracing the path that frames take
+// through the network. Frames sent or received by this node are included,
+// with our own key in place of the peer. Like RouterOptionOnCoordsChanged, it
+// is called from the router actor, so it doesn't hold up forwarding, but it
+// is called very often and should be quick.
+type RouterOptionOnFrameForward func(frame ForwardedFrame)
+
+// ForwardedFrame describes a frame that has been forwarded, as reported to
+// RouterOptionOnFrameForward.
+type ForwardedFrame struct {
+	Type           types.FrameType
+	From           types.PublicKey    // Peer the frame arrived from
+	FromPort       types.SwitchPortID // Port the frame arrived on, 0 if local
+	To             types.PublicKey    // Peer the frame was sent to
+	ToPort         types.SwitchPortID // Port the frame was sent on, 0 if local
+	SourceKey      types.PublicKey
+	DestinationKey types.PublicKey
+	Source         types.Coordinates
+	Destination    types.Coordinates
+}
+
+type RouterOptionAnnouncementInterval time.Duration
+type RouterOptionAnnouncementTimeout time.Duration
+
+// RouterOptionBootstrapRateLimit limits how many bootstraps per second we will
+// accept from each peer, dropping any beyond that. Short bursts of up to two
+// seconds' worth are allowed. Bootstraps from many nodes can arrive through
+// the same peer, so this should be generous. The default of zero means that
+// there is no limit.
+type RouterOptionBootstrapRateLimit float64
+
+// RouterOptionMaxBootstrapsPerInterval limits how many bootstraps from our
+// peers we will handle between each run of SNEK maintenance, across all
+// peers, so that a storm of bootstraps can't keep the router too busy to
+// forward traffic. Any beyond that are dropped, and nodes will try again
+// when they next bootstrap. The default of zero means that there is no limit.
+type RouterOptionMaxBootstrapsPerInterval int
+
+// RouterOptionMaxAnnouncementSignatures sets the maximum number of signatures
+// that we will accept in a tree announcement, which limits the work done in
+// verifying them. Nodes further than this from the root will not be able to
+// join our tree. The default is 64.
+type RouterOptionMaxAnnouncementSignatures int
+
+// RouterOptionLocalQueueSize sets roughly how many traffic frames can be
+// waiting to be read using ReadFrom. When the application isn't reading
+// quickly enough, the oldest frames are dropped to make room for new ones
+// rather than holding up the router. The size is rounded up to a multiple of
+// 16. The default is 4064.
+type RouterOptionLocalQueueSize int
+
+// RouterOptionTreeCostMargin allows tree routing to choose a cheaper peer, as
+// set using SetPeerCost, over a closer one as long as the cheaper peer is no
+// more than this many hops further away from the destination. The default of
+// zero only uses the cost to choose between equally close peers.
+type RouterOptionTreeCostMargin int
+
+// RouterOptionPinnedRoot, when enabled on a single node, makes that node win
+// root election regardless of how its key compares to others. The node marks
+// its root announcements as pinned, and nodes treat a pinned root as stronger
+// than any other only if they are configured with
+// RouterOptionAcceptPinnedRoot, so every node in the topology, including the
+// pinned node itself, must opt in.
+// It is intended only for building deterministic test and simulation
+// topologies, since any node could claim to be the root this way, and
+// enabling it on more than one node will fall back to comparing keys between
+// them. It is off by default.
+type RouterOptionPinnedRoot bool
+
+// RouterOptionAcceptPinnedRoot makes the node treat a root pinned using
+// RouterOptionPinnedRoot as stronger than any other. Without it, pinned roots
+// are compared by key like any other root, which is what nodes that don't
+// know about pinning do. Like RouterOptionPinnedRoot it is only intended for
+// tests and simulations, and it is off by default.
+type RouterOptionAcceptPinnedRoot bool
+
+// RouterOptionRootElectionBand spreads the load of being the root between
+// nodes with similar keys. Roots whose keys share this many leading bits are
+// ranked by a hash of their key and the current epoch of their root sequence
+// number, rather than by their key alone, so that rootship moves between them
+// every 48 announcements, or once a day at the default announcement interval.
+// Roots in different bands are still compared by key. Since the ranking must
+// agree everywhere for the tree to converge, every node in the network has to
+// use the same value. The default of zero always elects the strongest key.
+type RouterOptionRootElectionBand int
+
+// RouterOptionParentFilter is consulted during parent selection with the
+// public key of each candidate peer. Peers for which it returns false will
+// never be chosen as our parent, which is useful for keeping metered links
+// out of the tree. If no other peer is suitable then we become a root node.
+// By default any peer can be chosen.
+type RouterOptionParentFilter func(peerPublicKey types.PublicKey) bool
+
+// RouterOptionAcceptDescending is consulted with the key of each node that
+// bootstraps to us and would otherwise become our descending node, or a
+// backup for it. Nodes for which it returns false are never chosen, which
+// allows a node to only anchor keys in a certain region of the keyspace.
+// Their bootstraps are still used to build paths through us. By default any
+// key can be chosen.
+type RouterOptionAcceptDescending func(key types.PublicKey) bool
+
+// RouterOptionClock replaces the clock that the router uses to tell the time,
+// which allows tests to advance time instantly instead of sleeping. Nodes
+// must agree on the time to within the SNEK expiry period, see
+// RouterOptionSnakeNeighExpiry. By default the system clock is used.
+type RouterOptionClock struct {
+	Clock
+}
+
+// RouterOptionTimerJitter sets the fraction by which the tree announcement
+// and SNEK maintenance intervals are randomly lengthened or shortened each
+// time, so that nodes don't all send their announcements and bootstraps at
+// the same moment. For example, 0.1 allows each interval to vary by up to
+// 10% either way. It must be less than 0.5 and zero disables jitter. The
+// default is 0.05.
+type RouterOptionTimerJitter float64
+
+// RouterOptionStaleAnnouncementFraction sets the fraction of the announcement
+// timeout after which a peer's tree announcement is considered stale. Peers
+// with stale announcements may have gone away, so they are only used as tree
+// next-hops when no peer with a fresher announcement can take the traffic
+// closer to its destination. It must be greater than zero and 1 disables it.
+// The default is 0.9.
+type RouterOptionStaleAnnouncementFraction float64
+
+// RouterOptionMaxFrameAge limits how long traffic can spend travelling
+// through the network, however many hops it takes. The router timestamps
+// and signs the traffic that it sends, and drops timestamped traffic that
+// it forwards or receives once it is older than this. Nodes need their
+// clocks to agree to within this period. Traffic without a timestamp is
+// still forwarded. The default of zero disables it.
+type RouterOptionMaxFrameAge time.Duration
+
+// RouterOptionRoutingStrategy replaces the algorithm that the router uses to
+// choose the next-hop for the frames that it forwards, which allows other
+// routing algorithms to be experimented with. See RoutingStrategy. By default
+// SNEK and tree routing are used as normal.
+type RouterOptionRoutingStrategy struct {
+	RoutingStrategy
+}
+
+// RouterOptionDescendingSlots sets how many descending nodes the router
+// keeps, including the usual one with the next lowest key. The keyspace below
+// our key is split into regions for the extra slots, each half the size of
+// the one before and closer to our key, like the fingers of a Chord ring. Each
+// extra slot keeps the closest node to us in its region that has bootstrapped
+// to us. The paths to these nodes are never evicted from a full routing table,
+// which keeps paths to far-off parts of the keyspace in sparse networks. The
+// default of 1 keeps only the closest node, and at most 16 are allowed.
+type RouterOptionDescendingSlots int
 
 type RouterOption interface {
 	isRouterOption()
 }
 
-func (o RouterOptionBlackhole) isRouterOption() {}
+func (o RouterOptionBlackhole) isRouterOption()                 {}
+func (o RouterOptionMaxSnakeEntries) isRouterOption()           {}
+func (o RouterOptionSnakeNeighExpiry) isRouterOption()          {}
+func (o RouterOptionSnakeMaintainInterval) isRouterOption()     {}
+func (o RouterOptionOnCoordsChanged) isRouterOption()           {}
+func (o RouterOptionOnRootChanged) isRouterOption()             {}
+func (o RouterOptionOnFrameForward) isRouterOption()            {}
+func (o RouterOptionAnnouncementInterval) isRouterOption()      {}
+func (o RouterOptionAnnouncementTimeout) isRouterOption()       {}
+func (o RouterOptionPinnedRoot) isRouterOption()                {}
+func (o RouterOptionAcceptPinnedRoot) isRouterOption()          {}
+func (o RouterOptionRootElectionBand) isRouterOption()          {}
+func (o RouterOptionTreeCostMargin) isRouterOption()            {}
+func (o RouterOptionBootstrapRateLimit) isRouterOption()        {}
+func (o RouterOptionMaxBootstrapsPerInterval) isRouterOption()  {}
+func (o RouterOptionMaxAnnouncementSignatures) isRouterOption() {}
+func (o RouterOptionLocalQueueSize) isRouterOption()            {}
+func (o RouterOptionParentFilter) isRouterOption()              {}
+func (o RouterOptionAcceptDescending) isRouterOption()          {}
+func (o RouterOptionClock) isRouterOption()                     {}
+func (o RouterOptionTimerJitter) isRouterOption()               {}
+func (o RouterOptionStaleAnnouncementFraction) isRouterOption() {}
+func (o RouterOptionMaxFrameAge) isRouterOption()               {}
+func (o RouterOptionRoutingStrategy) isRouterOption()           {}
+func (o RouterOptionDescendingSlots) isRouterOption()           {}
 
 type ConnectionOption interface {
 	isConnectionOption()
@@ -15,6 +15,7 @@
 package router
 
 import (
+	"io"
 	"net"
 	"time"
 
@@ -24,8 +25,9 @@ import (
 )
 
 // newLocalPeer returns a new local peer. It should only be called once when
-// the router is set up.
-func (r *Router) newLocalPeer(blackhole bool) *peer {
+// the router is set up. The local traffic queue is made up of the given
+// number of queues.
+func (r *Router) newLocalPeer(blackhole bool, queues uint16) *peer {
 	peer := &peer{
 		router:   r,
 		port:     0,
@@ -34,11 +36,11 @@ func (r *Router) newLocalPeer(blackhole bool) *peer {
 		conn:     nil,
 		zone:     "local",
 		peertype: 0,
-		public:   r.public,
+		public:   r.PublicKey(),
 		started:  *atomic.NewBool(true),
 	}
 	if !blackhole {
-		peer.traffic = newFairFIFOQueue(trafficBuffer, r.log)
+		peer.traffic = newFairFIFOQueue(queues, r.log)
 	}
 	return peer
 }
@@ -47,38 +49,75 @@ func (r *Router) newLocalPeer(blackhole bool) *peer {
 // Pinecone network. Only traffic frames will be returned here (not protocol
 // frames). The returned address will either be a `types.PublicKey` (if the
 // frame was delivered using SNEK routing) or `types.Coordinates` (if the frame
-// was delivered using tree routing).
+// was delivered using tree routing). Payloads sent using SendLarge are only
+// returned once they have been reassembled, and io.ErrShortBuffer is returned
+// if p is too small to hold all of one.
 func (r *Router) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	if r.local.traffic == nil {
 		<-r.local.context.Done()
 		return 0, nil, nil
 	}
 
-	var frame *types.Frame
-	readDeadline := r._readDeadline.Load()
-	select {
-	case <-r.local.context.Done():
-		r.local.stop(nil)
-		return
-	case <-time.After(time.Until(readDeadline)):
+	for {
+		var frame *types.Frame
+		readDeadline := r._readDeadline.Load()
+		select {
+		case <-r.local.context.Done():
+			r.local.stop(nil)
+			return
+		case <-time.After(time.Until(readDeadline)):
+			return
+		case frame = <-r.local.traffic.pop():
+			// A protocol packet is ready to send.
+			r.local.traffic.ack()
+		}
+
+		// Frames can't be resliced from the front, since that would lose
+		// some of their capacity when they go back into the pool.
+		payload := frame.Payload
+		if frame.Extra&types.FlagTimestamped != 0 {
+			if len(payload) < types.FrameTimestampSize {
+				framePool.Put(frame)
+				continue
+			}
+			payload = payload[types.FrameTimestampSize:]
+		}
+
+		if frame.Extra&types.FlagFragment != 0 {
+			// The frame only contains part of a payload, so keep reading
+			// until the whole payload has arrived.
+			payload, ok := r._reassembly.add(r.clock.Now(), frame.SourceKey, payload)
+			addr = frame.SourceKey
+			framePool.Put(frame)
+			if !ok {
+				continue
+			}
+			if n = copy(p, payload); n < len(payload) {
+				err = io.ErrShortBuffer
+			}
+			return
+		}
+
+		addr = frame.SourceKey
+		n = len(payload)
+		copy(p, payload)
 		return
-	case frame = <-r.local.traffic.pop():
-		// A protocol packet is ready to send.
-		r.local.traffic.ack()
 	}
-
-	addr = frame.SourceKey
-	n = len(frame.Payload)
-	copy(p, frame.Payload)
-	return
 }
 
 // WriteTo sends a packet into the Pinecone network. The packet will be sent
 // as a traffic packet. The supplied net.Addr will dictate the method used to
-// route the packet — the address should be a `types.PublicKey` for SNEK routing
-// or `types.Coordinates` for tree routing. Supplying an unsupported address type
-// will result in a `*net.AddrError` being returned.
+// route the packet — the address should be a `types.PublicKey` for SNEK routing,
+// `types.Coordinates` for tree routing or `types.SourceRoute` to follow an explicit
+// path of switch ports. Supplying an unsupported address type will result in a
+// `*net.AddrError` being returned.
 func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return r.writeTo(p, addr, 0)
+}
+
+// writeTo sends a packet into the Pinecone network as WriteTo does, with the
+// given flags set in the Extra field of the frame.
+func (r *Router) writeTo(p []byte, addr net.Addr, flags byte) (n int, err error) {
 	timer := time.NewTimer(time.Second * 5)
 	defer func() {
 		if !timer.Stop() {
@@ -91,15 +130,37 @@ func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		frame := getFrame()
 		frame.HopLimit = types.MaxHopLimit
 		frame.Type = types.TypeTraffic
+		frame.Extra = flags
 		frame.DestinationKey = ga
 		phony.Block(r.state, func() {
-			if cached, ok := r.state._coordsCache[ga]; ok && time.Since(cached.lastSeen) < coordsCacheLifetime {
+			if cached, ok := r.state._coordsCache[ga]; ok && r.clock.Now().Sub(cached.lastSeen) < coordsCacheLifetime {
 				frame.Destination = cached.coordinates
 			}
 		})
 		frame.Source = r.state.coords()
-		frame.SourceKey = r.public
-		frame.Payload = append(frame.Payload[:0], p...)
+		frame.SourceKey = r.PublicKey()
+		r.setTrafficPayload(frame, p)
+		frame.Watermark = types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		}
+		phony.Block(r.state, func() {
+			_ = r.state._forward(r.local, frame)
+		})
+		r._sendStats.add(ga, len(p))
+		return len(p), nil
+
+	case types.SourceRoute:
+		frame := getFrame()
+		frame.HopLimit = types.MaxHopLimit
+		frame.Type = types.TypeSourceRouted
+		frame.Extra = flags
+		frame.Path = append(frame.Path[:0], ga.Path...)
+		frame.Destination = ga.Destination
+		frame.DestinationKey = ga.PublicKey
+		frame.Source = r.state.coords()
+		frame.SourceKey = r.PublicKey()
+		r.setTrafficPayload(frame, p)
 		frame.Watermark = types.VirtualSnakeWatermark{
 			PublicKey: types.FullMask,
 			Sequence:  0,
@@ -107,6 +168,7 @@ func (r *Router) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		phony.Block(r.state, func() {
 			_ = r.state._forward(r.local, frame)
 		})
+		r._sendStats.add(ga.PublicKey, len(p))
 		return len(p), nil
 
 	default:
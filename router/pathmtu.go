@@ -0,0 +1,172 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// pathMTUHeaderSize is the size of the token and probe size carried at the
+// start of the payload of path MTU probes and replies.
+const pathMTUHeaderSize = pingTokenSize + 2
+
+// PathMTU works out the largest payload that can be sent to the node with the
+// given public key using SNEK routing. It sends probes of different sizes
+// along the path, searching for the largest one that the remote node receives
+// intact. Each probe that doesn't arrive costs a couple of seconds, so this can
+// take a while if the path MTU is small. An error is returned if there is no
+// route towards the key. If no probes arrive at all, which is the case if any
+// node along the path doesn't support them or if the key isn't on the network,
+// the largest payload that fits into a frame is returned.
+func (r *Router) PathMTU(key types.PublicKey) (int, error) {
+	largest := maxPathMTU()
+	if ok, err := r.probePathMTU(key, largest); err != nil || ok {
+		return largest, err
+	}
+	if ok, err := r.probePathMTU(key, pathMTUHeaderSize); err != nil {
+		return 0, err
+	} else if !ok {
+		return largest, nil
+	}
+	// Probes of the smallest size arrive and of the largest size don't, so
+	// search for the size in between where they stop arriving.
+	lo, hi := pathMTUHeaderSize, largest
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		ok, err := r.probePathMTU(key, mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// maxPathMTU returns the largest payload that fits into a single frame. The
+// frame length field is only 16 bits wide and also covers the headers, so
+// this is a little less than types.MaxPayloadSize.
+func maxPathMTU() int {
+	f := types.Frame{
+		Type: types.TypePathMTUProbe,
+		Watermark: types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		},
+	}
+	buf := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
+	defer frameBufferPool.Put(buf)
+	n, err := f.MarshalBinary(buf[:])
+	if err != nil {
+		panic(err)
+	}
+	if largest := math.MaxUint16 - n; largest < types.MaxPayloadSize {
+		return largest
+	}
+	return types.MaxPayloadSize
+}
+
+// probePathMTU sends a probe with a payload of the given size to the node with
+// the given public key, returning true if it arrived intact.
+func (r *Router) probePathMTU(key types.PublicKey, size int) (bool, error) {
+	token := r._pingToken.Inc()
+	done := r._pathMTUProbes.add(key, token)
+	defer r._pathMTUProbes.remove(key, token)
+
+	frame := getFrame()
+	frame.HopLimit = types.MaxHopLimit
+	frame.Type = types.TypePathMTUProbe
+	frame.DestinationKey = key
+	frame.SourceKey = r.PublicKey()
+	frame.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	// Frames are reused, so clear out the padding rather than sending
+	// whatever was in the payload before.
+	frame.Payload = frame.Payload[:size]
+	for i := range frame.Payload {
+		frame.Payload[i] = 0
+	}
+	binary.BigEndian.PutUint64(frame.Payload, token)
+	binary.BigEndian.PutUint16(frame.Payload[pingTokenSize:], uint16(size))
+
+	var unreachable bool
+	phony.Block(r.state, func() {
+		// If SNEK routing would leave the probe with us then we already know
+		// that it can't get any closer to the key.
+		nexthop, _ := r.state._nextHopsSNEK(key, frame.Type, frame.Watermark)
+		if key != r.PublicKey() && (nexthop == nil || nexthop == r.local) {
+			unreachable = true
+			framePool.Put(frame)
+			return
+		}
+		_ = r.state._forward(r.local, frame)
+	})
+	if unreachable {
+		return false, fmt.Errorf("no route to %s", key)
+	}
+
+	timer := time.NewTimer(pathMTUProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true, nil
+	case <-timer.C:
+		return false, nil
+	case <-r.context.Done():
+		return false, fmt.Errorf("router closed")
+	}
+}
+
+// _handlePathMTU is called when a path MTU probe or reply can't be routed any
+// closer to its destination key. If the frame has arrived at its destination
+// then probes that arrived intact are answered with a reply carrying the same
+// token and size, and replies are passed on to the waiting probePathMTU call.
+func (s *state) _handlePathMTU(f *types.Frame) {
+	if f.DestinationKey != s.r.PublicKey() || len(f.Payload) < pathMTUHeaderSize {
+		s._drop(f, DropNoNextHop)
+		return
+	}
+	switch f.Type {
+	case types.TypePathMTUProbe:
+		if size := int(binary.BigEndian.Uint16(f.Payload[pingTokenSize:])); size != len(f.Payload) {
+			s._drop(f, DropNoNextHop)
+			return
+		}
+		f.Type = types.TypePathMTUReply
+		f.HopLimit = types.MaxHopLimit
+		f.DestinationKey, f.SourceKey = f.SourceKey, s.r.PublicKey()
+		f.Watermark = types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		}
+		f.Payload = f.Payload[:pathMTUHeaderSize]
+		_ = s._forward(s.r.local, f)
+
+	case types.TypePathMTUReply:
+		s.r._pathMTUProbes.done(f.SourceKey, binary.BigEndian.Uint64(f.Payload))
+		framePool.Put(f)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPathMTU(t *testing.T) {
+	routers := []*Router{
+		newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff)),
+		newTestRouterWithKey(t, newTestKey(t, 0x80, 0xc0)),
+		newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80)),
+	}
+	for i := 1; i < len(routers); i++ {
+		connectTestRouters(t, routers[i-1], routers[i])
+	}
+	first, last := routers[0], routers[len(routers)-1]
+
+	// Wait for the path to work in both directions before probing it.
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
+		_, err1 := first.Ping(ctx, last.public)
+		_, err2 := last.Ping(ctx, first.public)
+		cancel()
+		if err1 == nil && err2 == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("network didn't converge")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Every node on the path is the same, so the largest probe that fits
+	// into a frame should get through.
+	mtu, err := first.PathMTU(last.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := maxPathMTU(); mtu != expected {
+		t.Fatalf("expected path MTU of %d, got %d", expected, mtu)
+	}
+	if mtu > types.MaxPayloadSize || mtu < types.MaxPayloadSize-256 {
+		t.Fatalf("implausible path MTU of %d", mtu)
+	}
+
+	// The probes mustn't have broken any of the peerings along the way.
+	for _, r := range routers {
+		if r.PeerCount(-1) == 0 {
+			t.Fatalf("expected router to still have peers")
+		}
+	}
+}
+
+func TestPathMTUNoRoute(t *testing.T) {
+	r := newTestRouter(t)
+	if _, err := r.PathMTU(types.PublicKey{1}); err == nil {
+		t.Fatalf("expected probing from an isolated node to fail")
+	}
+	if mtu, err := r.PathMTU(r.public); err != nil || mtu != maxPathMTU() {
+		t.Fatalf("expected to be able to probe ourselves, got %d, %v", mtu, err)
+	}
+}
@@ -40,7 +40,6 @@ const ( // These need to be a simple int type for gobind/gomobile to export them
 	PeerTypeBonjour
 	PeerTypeRemote
 	PeerTypeBluetooth
-	PeerTypeBonjour
 )
 
 // peer contains information about a given active peering. There are two
@@ -49,22 +48,27 @@ const ( // These need to be a simple int type for gobind/gomobile to export them
 // the peering). Having separate actors allows reads and writes to take
 // place concurrently.
 type peer struct {
-	reader     phony.Inbox
-	writer     phony.Inbox
-	router     *Router
-	port       types.SwitchPortID // Not mutated after peer setup.
-	context    context.Context    // Not mutated after peer setup.
-	cancel     context.CancelFunc // Not mutated after peer setup.
-	conn       net.Conn           // Not mutated after peer setup.
-	uri        ConnectionURI      // Not mutated after peer setup.
-	zone       ConnectionZone     // Not mutated after peer setup.
-	peertype   ConnectionPeerType // Not mutated after peer setup.
-	public     types.PublicKey    // Not mutated after peer setup.
-	keepalives bool               // Not mutated after peer setup.
-	started    atomic.Bool        // Thread-safe toggle for marking a peer as down.
-	proto      queue              // Thread-safe queue for outbound protocol messages.
-	traffic    queue              // Thread-safe queue for outbound traffic messages.
-	statistics struct {
+	reader      phony.Inbox
+	writer      phony.Inbox
+	router      *Router
+	port        types.SwitchPortID // Not mutated after peer setup.
+	context     context.Context    // Not mutated after peer setup.
+	cancel      context.CancelFunc // Not mutated after peer setup.
+	conn        net.Conn           // Not mutated after peer setup.
+	uri         ConnectionURI      // Not mutated after peer setup.
+	zone        ConnectionZone     // Not mutated after peer setup.
+	peertype    ConnectionPeerType // Not mutated after peer setup.
+	public      types.PublicKey    // Not mutated after peer setup, except by RotateKey for the local peer.
+	keepalives  bool               // Not mutated after peer setup.
+	revision    uint8              // Not mutated after peer setup.
+	started     atomic.Bool        // Thread-safe toggle for marking a peer as down.
+	proto       queue              // Thread-safe queue for outbound protocol messages.
+	traffic     queue              // Thread-safe queue for outbound traffic messages.
+	dropped     atomic.Uint64      // Thread-safe count of frames dropped due to full queues.
+	cost        atomic.Uint32      // Thread-safe cost of using this link, lower is better.
+	_bootstraps tokenBucket        // Bootstrap rate limiting, only used by the state actor.
+	impairment  atomic.Value       // Test-only *linkImpairment, see impair.
+	statistics  struct {
 		phony.Inbox
 		_bytesRxProto   uint64
 		_bytesRxTraffic uint64
@@ -117,7 +121,27 @@ func (p *peer) send(f *types.Frame) bool {
 	if q == nil {
 		return false
 	}
-	return q.push(f)
+	if l, ok := p.impairment.Load().(*linkImpairment); ok && q == p.proto {
+		if l.lose() {
+			// As far as the sender knows, the frame was sent.
+			framePool.Put(f)
+			return true
+		}
+		if l.latency > 0 {
+			time.AfterFunc(l.latency, func() {
+				if !q.push(f) {
+					p.dropped.Inc()
+					framePool.Put(f)
+				}
+			})
+			return true
+		}
+	}
+	if !q.push(f) {
+		p.dropped.Inc()
+		return false
+	}
+	return true
 }
 
 // stop will immediately mark a port as offline, before dispatching a task to
@@ -231,6 +255,7 @@ func (p *peer) _write() {
 			// we will generate a keepalive frame to send instead.
 			frame = getFrame()
 			frame.Type = types.TypeKeepalive
+			p.router._frameTypeStats.sent(types.TypeKeepalive, true)
 		}
 	}
 
@@ -439,3 +464,28 @@ func (p *peer) _coords() (types.Coordinates, error) {
 
 	return coords, err
 }
+
+// tokenBucket is a simple token bucket rate limiter. It is not thread-safe.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow returns true if an event is allowed to happen at the given time,
+// refilling the bucket at the given rate per second up to the given burst.
+func (b *tokenBucket) allow(now time.Time, rate float64, burst float64) bool {
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * rate
+		if b.tokens > burst {
+			b.tokens = burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
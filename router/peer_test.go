@@ -0,0 +1,362 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPeerSendDropsWhenQueueFull(t *testing.T) {
+	r := newTestRouter(t)
+	p := newTestPeer(r, 1, types.PublicKey{1})
+
+	newFrame := func(frameType types.FrameType) *types.Frame {
+		f := getFrame()
+		f.Type = frameType
+		return f
+	}
+
+	for i := 0; i < protoBuffer; i++ {
+		if !p.send(newFrame(types.TypeBootstrap)) {
+			t.Fatalf("expected protocol frame %d to be queued", i)
+		}
+	}
+	if dropped := p.dropped.Load(); dropped != 0 {
+		t.Fatalf("expected no dropped frames, got %d", dropped)
+	}
+
+	// The protocol queue is now full, so further protocol frames should be
+	// refused and counted.
+	for i := 1; i <= 3; i++ {
+		if p.send(newFrame(types.TypeBootstrap)) {
+			t.Fatalf("expected protocol frame to be dropped")
+		}
+		if dropped := p.dropped.Load(); dropped != uint64(i) {
+			t.Fatalf("expected %d dropped frames, got %d", i, dropped)
+		}
+	}
+	if count := p.proto.queuecount(); count != protoBuffer {
+		t.Fatalf("expected protocol queue count to be %d, got %d", protoBuffer, count)
+	}
+
+	// Traffic frames use their own queue and are unaffected.
+	if !p.send(newFrame(types.TypeTraffic)) {
+		t.Fatalf("expected traffic frame to be queued")
+	}
+}
+
+func TestPeerWriterPrioritisesProtocolFrames(t *testing.T) {
+	r := newTestRouter(t)
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		_ = local.Close()
+		_ = remote.Close()
+	})
+	p := newTestPeer(r, 1, types.PublicKey{1})
+	p.conn = local
+
+	// Queue up a mix of frames while the link is congested, i.e. before the
+	// writer has started sending anything.
+	sent := []types.FrameType{
+		types.TypeTraffic, types.TypeTraffic, types.TypeBootstrap,
+		types.TypeSourceRouted, types.TypeWakeupBroadcast, types.TypeTraffic,
+		types.TypeBootstrap,
+	}
+	for i, frameType := range sent {
+		f := getFrame()
+		f.Type = frameType
+		f.DestinationKey = types.PublicKey{byte(i)}
+		f.Payload = append(f.Payload[:0], byte(i))
+		if !p.send(f) {
+			t.Fatalf("expected frame %d to be queued", i)
+		}
+	}
+	p.writer.Act(nil, p._write)
+
+	received := make([]types.FrameType, 0, len(sent))
+	buf := make([]byte, types.MaxFrameSize)
+	for range sent {
+		if _, err := io.ReadFull(remote, buf[:types.FrameHeaderLength]); err != nil {
+			t.Fatal(err)
+		}
+		length := int(binary.BigEndian.Uint16(buf[types.FrameHeaderLength-2 : types.FrameHeaderLength]))
+		if _, err := io.ReadFull(remote, buf[types.FrameHeaderLength:length]); err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, types.FrameType(buf[5]))
+	}
+
+	// All of the protocol frames should have been sent before any traffic.
+	protocol := 0
+	for _, frameType := range sent {
+		if !frameType.IsTraffic() {
+			protocol++
+		}
+	}
+	for i, frameType := range received {
+		if frameType.IsTraffic() != (i >= protocol) {
+			t.Fatalf("expected protocol frames to be sent first, got %v", received)
+		}
+	}
+}
+
+func TestPeerLinkImpairment(t *testing.T) {
+	r := newTestRouter(t)
+	newFrame := func(frameType types.FrameType) *types.Frame {
+		f := getFrame()
+		f.Type = frameType
+		return f
+	}
+
+	// The same seed should lose the same frames, about half of them.
+	const frames = 512
+	var queued []int
+	for port := types.SwitchPortID(1); port <= 2; port++ {
+		p := newTestPeer(r, port, types.PublicKey{byte(port)})
+		l := p.impair(0.5, 0, 1)
+		for i := 0; i < frames; i++ {
+			if !p.send(newFrame(types.TypeBootstrap)) {
+				t.Fatalf("expected a lost frame to look like it was sent")
+			}
+		}
+		if !p.send(newFrame(types.TypeTraffic)) || p.traffic.queuecount() != 1 {
+			t.Fatalf("expected traffic frames not to be impaired")
+		}
+		count := p.proto.queuecount()
+		if lost := int(l.lost.Load()); count+lost != frames {
+			t.Fatalf("expected %d frames to be queued or lost, got %d and %d", frames, count, lost)
+		}
+		queued = append(queued, count)
+	}
+	if queued[0] != queued[1] {
+		t.Fatalf("expected the same seed to lose the same frames, queued %d and %d", queued[0], queued[1])
+	}
+	if queued[0] < frames/4 || queued[0] > frames*3/4 {
+		t.Fatalf("expected about half of the frames to be lost, %d of %d were queued", queued[0], frames)
+	}
+
+	// Frames on a slow link should only be queued once the latency is up.
+	p := newTestPeer(r, 3, types.PublicKey{3})
+	p.impair(0, time.Millisecond*50, 1)
+	sent := time.Now()
+	p.send(newFrame(types.TypeBootstrap))
+	if p.proto.queuecount() != 0 {
+		t.Fatalf("expected the frame to be delayed")
+	}
+	<-p.proto.pop()
+	p.proto.ack()
+	if delay := time.Since(sent); delay < time.Millisecond*50 {
+		t.Fatalf("expected the frame to be delayed by at least 50ms, got %s", delay)
+	}
+}
+
+func TestDisconnectPeer(t *testing.T) {
+	a := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x40))
+	parent := newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff))
+	other := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	connectTestRouters(t, a, parent)
+	connectTestRouters(t, a, other)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var chosen bool
+		phony.Block(a.state, func() {
+			chosen = a.state._parent != nil && a.state._parent.public == parent.public
+		})
+		if chosen {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the parent to be chosen")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Make the parent the source of a transit path too.
+	transit := testPublicKey(newTestKey(t, 0x00, 0xff))
+	phony.Block(a.state, func() {
+		for _, p := range a.state._peers {
+			if p != nil && p.public == parent.public {
+				index := virtualSnakeIndex{PublicKey: transit}
+				a.state._table[index] = &virtualSnakeEntry{
+					virtualSnakeIndex: &index,
+					Source:            p,
+					Destination:       a.local,
+					LastSeen:          a.clock.Now(),
+					expiry:            a.snakeNeighExpiry,
+				}
+			}
+		}
+	})
+
+	if err := a.DisconnectPeer(parent.public); err != nil {
+		t.Fatal(err)
+	}
+	phony.Block(a.state, func() {
+		if a.state._parent != nil && a.state._parent.public == parent.public {
+			t.Errorf("expected a new parent to be chosen")
+		}
+		for p := range a.state._announcements {
+			if p.public == parent.public {
+				t.Errorf("expected the peer's announcement to be forgotten")
+			}
+		}
+		for _, p := range a.state._peers {
+			if p != nil && p.public == parent.public {
+				t.Errorf("expected the peer to be removed from port %d", p.port)
+			}
+		}
+		if _, ok := a.state._table[virtualSnakeIndex{PublicKey: transit}]; ok {
+			t.Errorf("expected the transit path via the peer to be removed")
+		}
+	})
+	if a.IsConnected(parent.public, "") {
+		t.Fatalf("expected the peering to be closed")
+	}
+
+	if err := a.DisconnectPeer(parent.public); err == nil {
+		t.Fatalf("expected an error disconnecting a peer that isn't connected")
+	}
+}
+
+func TestRotateKey(t *testing.T) {
+	// Maintenance runs on real time, but whether a bootstrap is due depends
+	// on the router's clock, so a fast maintenance timer and a fake clock
+	// let us move through bootstrap intervals quickly.
+	clock := newTestClock()
+	opts := []RouterOption{RouterOptionClock{clock}, RouterOptionSnakeMaintainInterval(minSnakeMaintainInterval)}
+	a := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x40), opts...)
+	b := newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff), opts...)
+	oldKey := a.PublicKey()
+	newSK := newTestKey(t, 0x40, 0x80)
+	newKey := testPublicKey(newSK)
+
+	// waitForDescending waits for B to have A, under the given key, as its
+	// descending node.
+	waitForDescending := func(key types.PublicKey) {
+		for i := 0; ; i++ {
+			var descending types.PublicKey
+			phony.Block(b.state, func() {
+				if desc := b.state._descending; desc != nil {
+					descending = desc.PublicKey
+				}
+			})
+			if descending == key {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("timed out waiting for B to learn about %s", key)
+			}
+			clock.Advance(virtualSnakeBootstrapInterval)
+			time.Sleep(minSnakeMaintainInterval * 5)
+		}
+	}
+	connectTestRouters(t, a, b)
+	waitForDescending(oldKey)
+
+	if err := a.RotateKey(newSK); err != nil {
+		t.Fatal(err)
+	}
+	if a.PublicKey() != newKey || a.Addr() != newKey {
+		t.Fatalf("expected the router to use the new key")
+	}
+	if a.PeerCount(-1) != 0 {
+		t.Fatalf("expected all peerings to be closed")
+	}
+
+	// B should forget the paths to the old key once the peering goes away.
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var desc, route bool
+		phony.Block(b.state, func() {
+			desc = b.state._descending != nil && b.state._descending.PublicKey == oldKey
+			_, route = b.state._table[virtualSnakeIndex{PublicKey: oldKey}]
+		})
+		if !desc && !route {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected B to forget the paths to the old key")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	// Once reconnected, the node should join again under its new key.
+	connectTestRouters(t, a, b)
+	waitForDescending(newKey)
+	var parent *peer
+	phony.Block(a.state, func() {
+		parent = a.state._parent
+	})
+	if parent == nil || parent.public != b.PublicKey() {
+		t.Fatalf("expected A to rejoin the tree below B")
+	}
+}
+
+func TestRotateKeyWithTraffic(t *testing.T) {
+	// Keys are read by the peer goroutines, the state actor and the API
+	// while RotateKey changes them, which go test -race will spot if any of
+	// those reads aren't synchronised.
+	a := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x80))
+	b := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xff))
+	connectTestRouters(t, a, b)
+
+	payload := []byte("traffic during rotation")
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, pair := range [][2]*Router{{a, b}, {b, a}} {
+		from, to := pair[0], pair[1]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				_, _ = from.WriteTo(payload, to.PublicKey())
+				_, _ = from.LookupClosest(to.PublicKey())
+				_, _ = from.SnakeNeighbours()
+				_ = from.Health()
+				_ = from.Peers()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+				_, _ = from.Ping(ctx, to.PublicKey())
+				cancel()
+			}
+		}()
+	}
+
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Millisecond * 50)
+		if err := a.RotateKey(newTestKey(t, 0x00, 0x80)); err != nil {
+			t.Fatal(err)
+		}
+		connectTestRouters(t, a, b)
+	}
+
+	// Traffic should still be getting through from the final key.
+	buf := make([]byte, types.MaxPayloadSize)
+	deadline := time.Now().Add(time.Second * 5)
+	received := false
+	for !received && time.Now().Before(deadline) {
+		_ = b.SetReadDeadline(time.Now().Add(time.Millisecond * 100))
+		n, addr, err := b.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		received = n > 0 && addr == a.PublicKey()
+	}
+	close(done)
+	wg.Wait()
+	if !received {
+		t.Fatalf("expected traffic from the rotated key to reach B")
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// pingTokenSize is the size of the token carried in the payload of ping and
+// pong frames.
+const pingTokenSize = 8
+
+// Ping sends a ping to the node with the given public key using SNEK routing
+// and waits for it to reply, returning the round-trip time. An error is
+// returned if there is no route towards the key or if no reply arrives before
+// the context is done. Nodes that don't understand pings will drop them, so
+// they will only succeed if every node along the path supports them.
+func (r *Router) Ping(ctx context.Context, key types.PublicKey) (time.Duration, error) {
+	token := r._pingToken.Inc()
+	done := r._pings.add(key, token)
+	defer r._pings.remove(key, token)
+
+	frame := getFrame()
+	frame.HopLimit = types.MaxHopLimit
+	frame.Type = types.TypeSNEKPing
+	frame.DestinationKey = key
+	frame.SourceKey = r.PublicKey()
+	frame.Watermark = types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+		Sequence:  0,
+	}
+	frame.Payload = frame.Payload[:pingTokenSize]
+	binary.BigEndian.PutUint64(frame.Payload, token)
+
+	start := time.Now()
+	var unreachable bool
+	phony.Block(r.state, func() {
+		// If SNEK routing would leave the ping with us then we already know
+		// that it can't get any closer to the key.
+		nexthop, _ := r.state._nextHopsSNEK(key, frame.Type, frame.Watermark)
+		if key != r.PublicKey() && (nexthop == nil || nexthop == r.local) {
+			unreachable = true
+			framePool.Put(frame)
+			return
+		}
+		_ = r.state._forward(r.local, frame)
+	})
+	if unreachable {
+		return 0, fmt.Errorf("no route to %s", key)
+	}
+
+	select {
+	case <-done:
+		return time.Since(start), nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("ping to %s: %w", key, ctx.Err())
+	case <-r.context.Done():
+		return 0, fmt.Errorf("router closed")
+	}
+}
+
+// _handlePing is called when a ping or pong frame can't be routed any closer
+// to its destination key. If the frame has arrived at its destination then
+// pings are answered with a pong carrying the same token, and pongs are
+// passed on to the waiting Ping call.
+func (s *state) _handlePing(f *types.Frame) {
+	if f.DestinationKey != s.r.PublicKey() || len(f.Payload) != pingTokenSize {
+		s._drop(f, DropNoNextHop)
+		return
+	}
+	switch f.Type {
+	case types.TypeSNEKPing:
+		f.Type = types.TypeSNEKPong
+		f.HopLimit = types.MaxHopLimit
+		f.DestinationKey, f.SourceKey = f.SourceKey, s.r.PublicKey()
+		f.Watermark = types.VirtualSnakeWatermark{
+			PublicKey: types.FullMask,
+			Sequence:  0,
+		}
+		_ = s._forward(s.r.local, f)
+
+	case types.TypeSNEKPong:
+		s.r._pings.done(f.SourceKey, binary.BigEndian.Uint64(f.Payload))
+		framePool.Put(f)
+	}
+}
+
+type pingKey struct {
+	key   types.PublicKey
+	token uint64
+}
+
+// pingTable tracks the pings that are waiting for a pong. It is safe to be
+// used from multiple goroutines.
+type pingTable struct {
+	mutex   sync.Mutex
+	pending map[pingKey]chan struct{}
+}
+
+// add registers a ping to the given key, returning a channel that will be
+// closed when the pong arrives.
+func (t *pingTable) add(key types.PublicKey, token uint64) <-chan struct{} {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending == nil {
+		t.pending = map[pingKey]chan struct{}{}
+	}
+	ch := make(chan struct{})
+	t.pending[pingKey{key, token}] = ch
+	return ch
+}
+
+// remove forgets about a ping, whether or not the pong has arrived.
+func (t *pingTable) remove(key types.PublicKey, token uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.pending, pingKey{key, token})
+}
+
+// done is called when a pong arrives from the given key. Pongs that don't
+// match a waiting ping are ignored.
+func (t *pingTable) done(key types.PublicKey, token uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if ch, ok := t.pending[pingKey{key, token}]; ok {
+		close(ch)
+		delete(t.pending, pingKey{key, token})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestPing(t *testing.T) {
+	// Build a line topology so that pings between the ends take more than
+	// one hop.
+	routers := []*Router{
+		newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff)),
+		newTestRouterWithKey(t, newTestKey(t, 0x80, 0xc0)),
+		newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80)),
+	}
+	for i := 1; i < len(routers); i++ {
+		connectTestRouters(t, routers[i-1], routers[i])
+	}
+	first, last := routers[0], routers[len(routers)-1]
+
+	// Retry until the network has converged enough for the ping to get
+	// through in both directions.
+	ping := func(from, to *Router) time.Duration {
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
+			rtt, err := from.Ping(ctx, to.public)
+			cancel()
+			if err == nil {
+				return rtt
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("ping from %s to %s failed: %s", from.public, to.public, err)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+	for _, rtt := range []time.Duration{ping(last, first), ping(first, last)} {
+		if rtt <= 0 || rtt > time.Second {
+			t.Fatalf("implausible round-trip time %s", rtt)
+		}
+	}
+
+	// A key that isn't on the network never answers.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*250)
+	defer cancel()
+	if _, err := last.Ping(ctx, types.PublicKey{0x50}); err == nil {
+		t.Fatalf("expected a ping to an unknown key to fail")
+	}
+}
+
+func TestPingNoRoute(t *testing.T) {
+	r := newTestRouter(t)
+	start := time.Now()
+	if _, err := r.Ping(context.Background(), types.PublicKey{1}); err == nil {
+		t.Fatalf("expected a ping from an isolated node to fail")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("expected a ping with no route to fail straight away")
+	}
+	if rtt, err := r.Ping(context.Background(), r.public); err != nil || rtt < 0 {
+		t.Fatalf("expected to be able to ping ourselves, got %s", err)
+	}
+}
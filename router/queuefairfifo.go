@@ -56,6 +56,14 @@ func (q *fairFIFOQueue) queuesize() int { // nolint:unused
 	return int(q.num) * fairFIFOQueueSize
 }
 
+// droppedcount returns how many frames have been dropped from the head of
+// the queue to make room for new ones.
+func (q *fairFIFOQueue) droppedcount() uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.dropped
+}
+
 func (q *fairFIFOQueue) hash(frame *types.Frame) uint16 {
 	h := q.offset
 	for _, v := range frame.Source {
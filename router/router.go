@@ -23,6 +23,8 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"os"
 	"sync"
@@ -36,18 +38,67 @@ import (
 
 type Router struct {
 	phony.Inbox
-	log           types.Logger
-	context       context.Context
-	cancel        context.CancelFunc
-	public        types.PublicKey
-	private       types.PrivateKey
-	active        sync.Map
-	local         *peer
-	state         *state
-	secure        bool
-	_hopLimiting  *atomic.Bool
-	_readDeadline *atomic.Time
-	_subscribers  map[chan<- events.Event]*phony.Inbox
+	log                       types.Logger
+	context                   context.Context
+	cancel                    context.CancelFunc
+	public                    types.PublicKey  // Changed by RotateKey, only read using PublicKey
+	private                   types.PrivateKey // Changed by RotateKey, only read using PrivateKey
+	keyMutex                  sync.RWMutex     // Held by RotateKey, from the state actor, when changing keys
+	active                    sync.Map
+	local                     *peer
+	state                     *state
+	secure                    bool
+	maxSnakeEntries           int
+	descendingSlots           int
+	snakeNeighExpiry          time.Duration
+	snakeMaintainInterval     time.Duration
+	maxFrameAge               time.Duration
+	coordsChanged             RouterOptionOnCoordsChanged
+	rootChanged               RouterOptionOnRootChanged
+	frameForward              RouterOptionOnFrameForward
+	announceInterval          time.Duration
+	announceTimeout           time.Duration
+	pinnedRoot                bool // Test-only, see RouterOptionPinnedRoot
+	acceptPinnedRoot          bool // Test-only, see RouterOptionAcceptPinnedRoot
+	rootElectionBand          int  // Leading key bits, zero for strict election
+	treeCostMargin            int64
+	bootstrapRate             float64 // Per peer per second, zero if unlimited
+	maxBootstraps             int     // Per SNEK maintenance interval, zero if unlimited
+	maxAnnouncementSignatures int
+	parentFilter              RouterOptionParentFilter
+	acceptDescending          RouterOptionAcceptDescending
+	clock                     Clock
+	routing                   RoutingStrategy
+	timerJitter               float64
+	staleAnnouncement         time.Duration // Age after which announcements are stale for tree routing
+	_hopLimiting              *atomic.Bool
+	_loopsDetected            atomic.Uint64
+	_staleBootstraps          atomic.Uint64
+	_limitedBootstraps        atomic.Uint64
+	_shedBootstraps           atomic.Uint64
+	_maintenanceStalls        atomic.Uint64
+	_treeWatch                *maintenanceWatch
+	_snakeWatch               *maintenanceWatch
+	_drops                    [dropReasonCount]atomic.Uint64
+	_readDeadline             *atomic.Time
+	_fragmentID               atomic.Uint32 // ID of the last payload sent using SendLarge
+	_reassembly               reassembler
+	_sendStats                sendStats
+	_frameTypeStats           frameTypeStats
+	_signatures               signatureCache
+	_pingToken                atomic.Uint64 // Token of the last ping sent using Ping
+	_pings                    pingTable
+	_pathMTUProbes            pingTable
+	_subscribers              map[chan<- events.Event]*subscriber
+	_droppedEvents            atomic.Uint64
+}
+
+// subscriber delivers events to a single subscribed channel. Each
+// subscriber has its own inbox so that a slow consumer doesn't hold up
+// the router or any other subscribers.
+type subscriber struct {
+	phony.Inbox
+	pending atomic.Int64 // Events queued for delivery but not yet delivered
 }
 
 func NewRouter(logger types.Logger, sk ed25519.PrivateKey, opts ...RouterOption) *Router {
@@ -55,22 +106,165 @@ func NewRouter(logger types.Logger, sk ed25519.PrivateKey, opts ...RouterOption)
 		logger = log.New(ioutil.Discard, "", 0)
 	}
 	blackhole := false
+	localQueues := uint16(trafficBuffer)
+	maxSnakeEntries := defaultMaxSnakeEntries
+	descendingSlots := 1
+	snakeNeighExpiry := virtualSnakeNeighExpiryPeriod
+	snakeMaintainInterval := virtualSnakeMaintainInterval
+	var maxFrameAge time.Duration
+	var coordsChanged RouterOptionOnCoordsChanged
+	var rootChanged RouterOptionOnRootChanged
+	var frameForward RouterOptionOnFrameForward
+	announceInterval, announceTimeout := announcementInterval, time.Duration(0)
+	var pinnedRoot, acceptPinnedRoot bool
+	var rootElectionBand int
+	var treeCostMargin int64
+	var bootstrapRate float64
+	var maxBootstraps int
+	var parentFilter RouterOptionParentFilter
+	var acceptDescending RouterOptionAcceptDescending
+	var clock Clock = realClock{}
+	var routing RoutingStrategy = defaultRoutingStrategy{}
+	timerJitter := defaultTimerJitter
+	staleFraction := defaultStaleAnnouncementFraction
+	maxAnnouncementSignatures := defaultMaxAnnouncementSignatures
 	for _, opt := range opts {
 		switch v := opt.(type) {
 		case RouterOptionBlackhole:
 			blackhole = bool(v)
+		case RouterOptionLocalQueueSize:
+			if v > 0 {
+				queues := (int(v) + fairFIFOQueueSize - 1) / fairFIFOQueueSize
+				if queues > math.MaxUint16-1 {
+					queues = math.MaxUint16 - 1
+				}
+				localQueues = uint16(queues)
+			}
+		case RouterOptionMaxSnakeEntries:
+			if v > 0 {
+				maxSnakeEntries = int(v)
+			}
+		case RouterOptionDescendingSlots:
+			if v > 0 && v <= maxDescendingSlots {
+				descendingSlots = int(v)
+			}
+		case RouterOptionSnakeNeighExpiry:
+			if v > 0 {
+				snakeNeighExpiry = time.Duration(v)
+			}
+		case RouterOptionSnakeMaintainInterval:
+			if v > 0 {
+				snakeMaintainInterval = time.Duration(v)
+			}
+		case RouterOptionOnCoordsChanged:
+			coordsChanged = v
+		case RouterOptionOnRootChanged:
+			rootChanged = v
+		case RouterOptionOnFrameForward:
+			frameForward = v
+		case RouterOptionAnnouncementInterval:
+			if v > 0 {
+				announceInterval = time.Duration(v)
+			}
+		case RouterOptionAnnouncementTimeout:
+			announceTimeout = time.Duration(v)
+		case RouterOptionPinnedRoot:
+			pinnedRoot = bool(v)
+		case RouterOptionAcceptPinnedRoot:
+			acceptPinnedRoot = bool(v)
+		case RouterOptionRootElectionBand:
+			if v > 0 && v <= ed25519.PublicKeySize*8 {
+				rootElectionBand = int(v)
+			}
+		case RouterOptionTreeCostMargin:
+			if v > 0 {
+				treeCostMargin = int64(v)
+			}
+		case RouterOptionMaxAnnouncementSignatures:
+			if v > 0 {
+				maxAnnouncementSignatures = int(v)
+			}
+		case RouterOptionBootstrapRateLimit:
+			if v > 0 {
+				bootstrapRate = float64(v)
+			}
+		case RouterOptionMaxBootstrapsPerInterval:
+			if v > 0 {
+				maxBootstraps = int(v)
+			}
+		case RouterOptionParentFilter:
+			parentFilter = v
+		case RouterOptionAcceptDescending:
+			acceptDescending = v
+		case RouterOptionClock:
+			if v.Clock != nil {
+				clock = v.Clock
+			}
+		case RouterOptionRoutingStrategy:
+			if v.RoutingStrategy != nil {
+				routing = v.RoutingStrategy
+			}
+		case RouterOptionTimerJitter:
+			if v >= 0 && v < 0.5 {
+				timerJitter = float64(v)
+			}
+		case RouterOptionStaleAnnouncementFraction:
+			if v > 0 && v <= 1 {
+				staleFraction = float64(v)
+			}
+		case RouterOptionMaxFrameAge:
+			if v > 0 {
+				maxFrameAge = time.Duration(v)
+			}
+		}
+	}
+	if snakeMaintainInterval < minSnakeMaintainInterval {
+		logger.Printf("SNEK maintenance interval %s is too short, using %s", snakeMaintainInterval, minSnakeMaintainInterval)
+		snakeMaintainInterval = minSnakeMaintainInterval
+	}
+	// The announcement timeout must be longer than the interval, otherwise
+	// we would consider our peers dead between every announcement. If it
+	// wasn't specified, or was specified badly, derive it from the interval
+	// using the same ratio as the defaults.
+	if announceTimeout <= announceInterval {
+		if announceTimeout != 0 {
+			logger.Printf("Announcement timeout %s must be greater than interval %s, ignoring", announceTimeout, announceInterval)
 		}
+		announceTimeout = announceInterval + announceInterval/2
 	}
 	ctx, cancel := context.WithCancel(context.Background())
 	_, insecure := os.LookupEnv("PINECONE_DISABLE_SIGNATURES")
 	r := &Router{
-		log:           logger,
-		context:       ctx,
-		cancel:        cancel,
-		secure:        !insecure,
-		_hopLimiting:  atomic.NewBool(false),
-		_readDeadline: atomic.NewTime(time.Now().Add(time.Hour * 24 * 365 * 100)), // ~100 years
-		_subscribers:  make(map[chan<- events.Event]*phony.Inbox),
+		log:                       logger,
+		context:                   ctx,
+		cancel:                    cancel,
+		secure:                    !insecure,
+		maxSnakeEntries:           maxSnakeEntries,
+		descendingSlots:           descendingSlots,
+		snakeNeighExpiry:          snakeNeighExpiry,
+		snakeMaintainInterval:     snakeMaintainInterval,
+		maxFrameAge:               maxFrameAge,
+		coordsChanged:             coordsChanged,
+		rootChanged:               rootChanged,
+		frameForward:              frameForward,
+		announceInterval:          announceInterval,
+		announceTimeout:           announceTimeout,
+		staleAnnouncement:         time.Duration(float64(announceTimeout) * staleFraction),
+		pinnedRoot:                pinnedRoot,
+		acceptPinnedRoot:          acceptPinnedRoot,
+		rootElectionBand:          rootElectionBand,
+		treeCostMargin:            treeCostMargin,
+		parentFilter:              parentFilter,
+		acceptDescending:          acceptDescending,
+		clock:                     clock,
+		routing:                   routing,
+		timerJitter:               timerJitter,
+		bootstrapRate:             bootstrapRate,
+		maxBootstraps:             maxBootstraps,
+		maxAnnouncementSignatures: maxAnnouncementSignatures,
+		_hopLimiting:              atomic.NewBool(false),
+		_readDeadline:             atomic.NewTime(time.Now().Add(time.Hour * 24 * 365 * 100)), // ~100 years
+		_subscribers:              make(map[chan<- events.Event]*subscriber),
 	}
 	// Populate the node keys from the supplied private key.
 	copy(r.private[:], sk)
@@ -81,13 +275,33 @@ func NewRouter(logger types.Logger, sk ed25519.PrivateKey, opts ...RouterOption)
 		_table:        make(virtualSnakeTable),
 		_peers:        make([]*peer, portCount),
 		_filterPacket: nil,
+		_partitioned:  true,
+		_jitter:       rand.New(rand.NewSource(time.Now().UnixNano())),
 	}
 	// Create a new local peer and wire it into port 0.
-	r.local = r.newLocalPeer(blackhole)
+	r.local = r.newLocalPeer(blackhole, localQueues)
 	r.state._peers[0] = r.local
-	// Start the state actor.
+	// Keep track of maintenance for the watchdog.
+	r._treeWatch = &maintenanceWatch{
+		task:     "tree",
+		interval: announceInterval,
+		lastRun:  atomic.NewTime(time.Now()),
+		restart: func() {
+			r.state.Act(nil, func() { r.state._maintainTreeIn(0) })
+		},
+	}
+	r._snakeWatch = &maintenanceWatch{
+		task:     "snake",
+		interval: snakeMaintainInterval,
+		lastRun:  atomic.NewTime(time.Now()),
+		restart: func() {
+			r.state.Act(nil, func() { r.state._maintainSnakeIn(0) })
+		},
+	}
+	// Start the state actor and the watchdog.
 	r.state.Act(nil, r.state._start)
-	r.log.Println("Router identity:", r.public.String())
+	go r.watchdog()
+	r.log.Println("Router identity:", r.PublicKey().String())
 
 	return r
 }
@@ -98,6 +312,76 @@ func (r *Router) InjectPacketFilter(fn FilterFn) {
 	})
 }
 
+// Rebootstrap sends a bootstrap as soon as possible rather than waiting for
+// the next one to be due, which is useful when the application knows that
+// connectivity has changed. Calls made shortly after a previous bootstrap
+// are ignored.
+func (r *Router) Rebootstrap() {
+	r.state.Act(nil, r.state._rebootstrap)
+}
+
+// Promote makes this node the root of the tree straight away, which can be
+// useful when standing up a new network. It returns an error if any of our
+// peers is already following a root with a stronger key than ours, and the
+// node will still give way to such a root if one appears later.
+func (r *Router) Promote() (err error) {
+	phony.Block(r.state, func() {
+		err = r.state._promote()
+	})
+	return
+}
+
+// Demote runs parent selection again, undoing Promote if any of our peers is
+// following a stronger root.
+func (r *Router) Demote() {
+	r.state.Act(nil, r.state._demote)
+}
+
+// BumpSequence makes the root send out a new root announcement, with a higher
+// sequence number, straight away, so that the whole tree is refreshed without
+// waiting for the next announcement interval. It has no effect unless this
+// node is the root.
+func (r *Router) BumpSequence() {
+	r.state.Act(nil, r.state._bumpSequence)
+}
+
+// SetDraining controls whether the node is draining, which is useful before
+// taking it out of the network during a rolling upgrade. A draining node
+// stops taking on new descending nodes and stops refreshing the one that it
+// has, so the paths that end here expire and are rebuilt elsewhere. It still
+// forwards traffic and bootstraps for other nodes and still builds paths
+// through itself, so paths that pass through it keep working until they
+// move away by themselves.
+func (r *Router) SetDraining(draining bool) {
+	phony.Block(r.state, func() {
+		if r.state._draining != draining {
+			r.state._draining = draining
+			r.log.Printf("Draining: %v", draining)
+		}
+	})
+}
+
+// AddStaticSnakeRoute pins the route to the given key so that traffic for it
+// is always sent through the peer on the given port. Unlike the routes learned
+// from bootstraps, a static route doesn't expire and isn't replaced by later
+// bootstraps, although it is removed if the peering goes away. It returns an
+// error if there is no peer connected on the port.
+func (r *Router) AddStaticSnakeRoute(key types.PublicKey, port types.SwitchPortID) (err error) {
+	phony.Block(r.state, func() {
+		err = r.state._addStaticRoute(key, port)
+	})
+	return
+}
+
+// RemoveStaticSnakeRoute removes a route added by AddStaticSnakeRoute. It
+// returns false if there was no static route to the given key.
+func (r *Router) RemoveStaticSnakeRoute(key types.PublicKey) (removed bool) {
+	phony.Block(r.state, func() {
+		removed = r.state._removeStaticRoute(key)
+	})
+	return
+}
+
 func (r *Router) EnableWakeupBroadcasts() {
 	r.state.Act(r.state, func() {
 		r.state._sendBroadcastIn(0)
@@ -112,13 +396,21 @@ func (r *Router) DisableWakeupBroadcasts() {
 	})
 }
 
-// _publish notifies each subscriber of a new event.
+// _publish notifies each subscriber of a new event. If a subscriber has
+// too many events waiting to be delivered already then the event will be
+// dropped for that subscriber and counted instead.
 func (r *Router) _publish(event events.Event) {
-	for ch, inbox := range r._subscribers {
-		// Create a copy of the pointer before passing into the lambda
-		chCopy := ch
-		inbox.Act(nil, func() {
+	for ch, sub := range r._subscribers {
+		if sub.pending.Load() >= eventSubscriberBacklog {
+			r._droppedEvents.Inc()
+			continue
+		}
+		sub.pending.Inc()
+		// Create copies of the pointers before passing into the lambda
+		chCopy, subCopy := ch, sub
+		sub.Act(nil, func() {
 			chCopy <- event
+			subCopy.pending.Dec()
 		})
 	}
 }
@@ -137,6 +429,7 @@ func (r *Router) IsConnected(key types.PublicKey, zone string) bool {
 // Close will stop the Pinecone node. Once this has been called, the node cannot
 // be restarted or reused.
 func (r *Router) Close() error {
+	r.leave()
 	phony.Block(r, func() {
 		if r.cancel != nil {
 			r.cancel()
@@ -145,16 +438,49 @@ func (r *Router) Close() error {
 	return nil
 }
 
-// PrivateKey returns the private key of the node.
+// leave tells our peers that we are about to go away, so that any that are
+// using us as their parent can choose another straight away instead of
+// waiting for our announcements to time out. It waits, up to leavingTimeout,
+// for the announcements to be written before returning.
+func (r *Router) leave() {
+	var peers []*peer
+	phony.Block(r.state, func() {
+		peers = r.state._sendLeaving()
+	})
+	deadline := time.Now().Add(leavingTimeout)
+	for _, p := range peers {
+		for p.started.Load() && p.proto.queuecount() > 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+// PrivateKey returns the private key of the node. Code within the router
+// should use this rather than reading the key directly, since it can be
+// changed by RotateKey.
 func (r *Router) PrivateKey() types.PrivateKey {
+	r.keyMutex.RLock()
+	defer r.keyMutex.RUnlock()
 	return r.private
 }
 
-// PublicKey returns the public key of the node.
+// PublicKey returns the public key of the node. Code within the router should
+// use this rather than reading the key directly, since it can be changed by
+// RotateKey.
 func (r *Router) PublicKey() types.PublicKey {
+	r.keyMutex.RLock()
+	defer r.keyMutex.RUnlock()
 	return r.public
 }
 
+// keyPair returns both keys of the node, which are guaranteed to belong
+// together even if RotateKey is called at the same time.
+func (r *Router) keyPair() (types.PublicKey, types.PrivateKey) {
+	r.keyMutex.RLock()
+	defer r.keyMutex.RUnlock()
+	return r.public, r.private
+}
+
 // Addr returns the local address of the node in the form of a `types.PublicKey`.
 func (r *Router) Addr() net.Addr {
 	return r.PublicKey()
@@ -164,6 +490,8 @@ func (r *Router) Addr() net.Addr {
 // function takes one or more ConnectionOptions to configure the peer. If no
 // ConnectionPublicKey is specified, the connection will autonegotiate with the
 // remote peer to exchange public keys and version/capability information.
+// Otherwise no revision is negotiated, so the remote peer is treated as a
+// legacy node.
 func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.SwitchPortID, error) {
 	var public types.PublicKey
 	var uri ConnectionURI
@@ -185,11 +513,13 @@ func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.Swit
 		}
 	}
 
+	revision := revisionLegacy
 	var empty types.PublicKey
 	if public == empty {
+		revision = ourRevision
 		handshake := []byte{
 			ourVersion,
-			0, // unused
+			ourRevision,
 			0, // unused
 			0, // unused
 			0, // capabilities
@@ -198,8 +528,9 @@ func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.Swit
 			0, // capabilities
 		}
 		binary.BigEndian.PutUint32(handshake[4:8], ourCapabilities)
-		handshake = append(handshake, r.public[:ed25519.PublicKeySize]...)
-		handshake = append(handshake, ed25519.Sign(r.private[:], handshake)...)
+		ourPublic, ourPrivate := r.keyPair()
+		handshake = append(handshake, ourPublic[:ed25519.PublicKeySize]...)
+		handshake = append(handshake, ed25519.Sign(ourPrivate[:], handshake)...)
 		if err := conn.SetDeadline(time.Now().Add(time.Second * 10)); err != nil {
 			return 0, fmt.Errorf("conn.SetDeadline: %w", err)
 		}
@@ -230,12 +561,15 @@ func (r *Router) Connect(conn net.Conn, options ...ConnectionOption) (types.Swit
 			conn.Close()
 			return 0, fmt.Errorf("peer sent invalid signature")
 		}
+		if theirRevision := handshake[1]; theirRevision < revision {
+			revision = theirRevision
+		}
 	}
 
 	port := types.SwitchPortID(0)
 	var err error
 	phony.Block(r.state, func() {
-		port, err = r.state._addPeer(conn, public, uri, zone, peertype, keepalives)
+		port, err = r.state._addPeer(conn, public, uri, zone, peertype, keepalives, revision)
 	})
 	if err != nil {
 		return types.SwitchPortID(0), fmt.Errorf("_addPeer: %w", err)
@@ -258,22 +592,89 @@ func (r *Router) Disconnect(i types.SwitchPortID, err error) {
 	})
 }
 
-// PeerCount returns the number of nodes that are directly
-// connected to this Pinecone node.
-func (r *Router) PeerCount(peertype int) (count int) {
+// DisconnectPeer disconnects every peering with the node that has the given
+// public key, for example to evict a peer that is misbehaving. Unlike
+// Disconnect, it waits until the peerings have been cleaned up, so by the time
+// it returns, the routes and tree announcement learned from the peer have been
+// forgotten and a new parent has been chosen if it was our parent. It returns
+// an error if we aren't connected to the node.
+func (r *Router) DisconnectPeer(key types.PublicKey) error {
+	var found bool
 	phony.Block(r.state, func() {
-		seen := map[types.PublicKey]struct{}{}
 		for _, p := range r.state._peers {
-			if p == nil || p.port == 0 || !p.started.Load() {
-				continue
+			if p != nil && p.started.Load() && p != r.local && p.public == key {
+				p.stop(nil)
+				found = true
 			}
-			if int(p.peertype) == peertype || peertype < 0 {
-				if _, ok := seen[p.public]; !ok {
-					count++
-				}
-				seen[p.public] = struct{}{}
+		}
+	})
+	if !found {
+		return fmt.Errorf("not connected to peer %s", key)
+	}
+	// Stopping the peers queued their clean-up on the state actor, so
+	// wait for that to happen before returning.
+	phony.Block(r.state, func() {})
+	return nil
+}
+
+// RotateKey replaces the key pair of the node with the given private key. Our
+// peers know us by the key that we connected to them with, so every peering is
+// closed and will need to be connected again, after which the node will join
+// the tree and SNEK under its new key. Our tree and SNEK state is started
+// afresh, with the sequence number of our root announcements carrying on from
+// where it was. Any traffic that is in flight to the old key will be lost, and
+// the SNEK paths that other nodes have to the old key will expire by
+// themselves, since there is no way to tear them down.
+func (r *Router) RotateKey(sk ed25519.PrivateKey) error {
+	if len(sk) != ed25519.PrivateKeySize {
+		return fmt.Errorf("expected a private key of %d bytes, got %d", ed25519.PrivateKeySize, len(sk))
+	}
+	var public types.PublicKey
+	phony.Block(r.state, func() {
+		r.keyMutex.Lock()
+		copy(r.private[:], sk)
+		r.public = r.private.Public()
+		r.local.public = r.public
+		public = r.public
+		r.keyMutex.Unlock()
+
+		for _, p := range r.state._peers {
+			if p != nil && p.started.Load() && p != r.local {
+				p.stop(fmt.Errorf("rotating key"))
 			}
 		}
+		r.state._reset()
 	})
+	// Stopping the peers queued their clean-up on the state actor, so
+	// wait for that to happen before returning.
+	phony.Block(r.state, func() {})
+	r.log.Println("Router identity:", public.String())
+	return nil
+}
+
+// PeerCount returns the number of nodes that are directly
+// connected to this Pinecone node.
+func (r *Router) PeerCount(peertype int) (count int) {
+	phony.Block(r.state, func() {
+		count = r.state._peerCount(peertype)
+	})
+	return
+}
+
+// _peerCount returns the number of nodes of the given peer type, or of any
+// type if it is negative, that are directly connected to us.
+func (s *state) _peerCount(peertype int) (count int) {
+	seen := map[types.PublicKey]struct{}{}
+	for _, p := range s._peers {
+		if p == nil || p.port == 0 || !p.started.Load() {
+			continue
+		}
+		if int(p.peertype) == peertype || peertype < 0 {
+			if _, ok := seen[p.public]; !ok {
+				count++
+			}
+			seen[p.public] = struct{}{}
+		}
+	}
 	return
 }
@@ -0,0 +1,213 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"net"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// RoutingStrategy chooses the next-hop for each frame that the router
+// forwards, so that alternative routing algorithms can be tried out without
+// changing the router itself. The default strategy uses SNEK and greedy tree
+// routing as normal. The methods are called from within the router's state
+// actor, so they must not block or call any methods on the Router.
+type RoutingStrategy interface {
+	// NextHopSNEK returns the port that a frame routed by destination key
+	// should be sent to next, along with the watermark that the frame should
+	// carry from there. Returning false means that there is no next-hop, and
+	// returning port 0 means that the frame should be handled by this node.
+	NextHopSNEK(q *RoutingQuery) (types.SwitchPortID, types.VirtualSnakeWatermark, bool)
+
+	// NextHopTree returns the port that a frame routed by destination
+	// coordinates should be sent to next. Returning false means that there
+	// is no next-hop, and returning port 0 means that the frame should be
+	// handled by this node.
+	NextHopTree(q *RoutingQuery) (types.SwitchPortID, bool)
+}
+
+// RoutingQuery describes a frame that the router needs a next-hop for. It is
+// only valid for the duration of the RoutingStrategy call and mustn't be
+// retained, nor may the frame be modified.
+type RoutingQuery struct {
+	From              types.SwitchPortID          // Where the frame came from, or 0 if it was sent by us
+	Frame             *types.Frame                // The frame being routed
+	DestinationKey    types.PublicKey             // Set for NextHopSNEK
+	DestinationCoords types.Coordinates           // Set for NextHopTree
+	Watermark         types.VirtualSnakeWatermark // The watermark to route the frame with
+	Flow              uint64                      // Used to choose between equally good next-hops
+
+	s        *state
+	from     *peer
+	excluded []*peer
+	snapshot *RoutingState
+	nexthop  *peer // Set by the default strategy to save looking up the port
+}
+
+// Excluded returns true if the frame mustn't be sent to the given port,
+// usually because it has already been tried. The router won't use an excluded
+// port even if the strategy returns it.
+func (q *RoutingQuery) Excluded(port types.SwitchPortID) bool {
+	for _, p := range q.excluded {
+		if p.port == port {
+			return true
+		}
+	}
+	return false
+}
+
+// State returns a snapshot of the routing state that the next-hop can be
+// chosen from. It is built the first time that it is asked for, since the
+// default strategy doesn't need it.
+func (q *RoutingQuery) State() *RoutingState {
+	if q.snapshot == nil {
+		q.snapshot = q.s._routingState()
+	}
+	return q.snapshot
+}
+
+// RoutingState is a snapshot of the parts of the router's state that routing
+// decisions are based on.
+type RoutingState struct {
+	PublicKey types.PublicKey
+	Coords    types.Coordinates
+	Root      types.Root
+	Parent    types.SwitchPortID // Port 0 if we are the root
+	Peers     []RoutingPeer      // Connected peers, ordered by port
+	Routes    []RoutingEntry     // The SNEK routing table, in no particular order
+}
+
+// RoutingPeer describes one of our connected peers and the last tree
+// announcement that we received from it, if any.
+type RoutingPeer struct {
+	Port      types.SwitchPortID
+	PublicKey types.PublicKey
+	Coords    types.Coordinates // Nil if the peer hasn't sent an announcement
+	Root      types.Root
+}
+
+// RoutingEntry describes an entry in the SNEK routing table.
+type RoutingEntry struct {
+	PublicKey       types.PublicKey
+	SourcePort      types.SwitchPortID
+	DestinationPort types.SwitchPortID
+	Watermark       types.VirtualSnakeWatermark
+	Root            types.Root
+}
+
+// defaultRoutingStrategy is the RoutingStrategy that the router uses unless
+// RouterOptionRoutingStrategy is given.
+type defaultRoutingStrategy struct{}
+
+func (defaultRoutingStrategy) NextHopSNEK(q *RoutingQuery) (types.SwitchPortID, types.VirtualSnakeWatermark, bool) {
+	p, w := q.s._nextHopsSNEK(q.DestinationKey, q.Frame.Type, q.Watermark, q.excluded...)
+	if p == nil {
+		return 0, w, false
+	}
+	q.nexthop = p
+	return p.port, w, true
+}
+
+func (defaultRoutingStrategy) NextHopTree(q *RoutingQuery) (types.SwitchPortID, bool) {
+	p := q.s._nextHopsTree(q.from, q.DestinationCoords, q.Flow, q.excluded...)
+	if p == nil {
+		return 0, false
+	}
+	q.nexthop = p
+	return p.port, true
+}
+
+// _nextHopsFor returns the next-hop for the given frame, as chosen by the
+// routing strategy. Frames with a public key destination are SNEK routed and
+// frames with coordinates are tree routed. It is possible for this function
+// to return `nil` if there is no suitable candidate. Any excluded peers will
+// not be chosen.
+func (s *state) _nextHopsFor(from *peer, f *types.Frame, dest net.Addr, watermark types.VirtualSnakeWatermark, flow uint64, excluded ...*peer) (*peer, types.VirtualSnakeWatermark) {
+	// The query is reused for every frame to save allocating one each time,
+	// which is safe because strategies mustn't retain it.
+	q := &s._routingQuery
+	*q = RoutingQuery{
+		From:      from.port,
+		Frame:     f,
+		Watermark: watermark,
+		Flow:      flow,
+		s:         s,
+		from:      from,
+		excluded:  excluded,
+	}
+
+	var port types.SwitchPortID
+	var ok bool
+	switch dest := dest.(type) {
+	case types.PublicKey:
+		q.DestinationKey = dest
+		port, watermark, ok = s.r.routing.NextHopSNEK(q)
+	case types.Coordinates:
+		q.DestinationCoords = dest
+		port, ok = s.r.routing.NextHopTree(q)
+	}
+	var nexthop *peer
+	switch {
+	case !ok:
+	case q.nexthop != nil:
+		nexthop = q.nexthop
+	case int(port) < len(s._peers) && !q.Excluded(port):
+		nexthop = s._peers[port]
+	}
+	*q = RoutingQuery{}
+	return nexthop, watermark
+}
+
+// _routingState builds the snapshot returned by RoutingQuery.State.
+func (s *state) _routingState() *RoutingState {
+	rs := &RoutingState{
+		PublicKey: s.r.PublicKey(),
+		Coords:    s._coords(),
+		Root:      s._rootAnnouncement().Root,
+	}
+	if s._parent != nil {
+		rs.Parent = s._parent.port
+	}
+	for _, p := range s._peers {
+		if p == nil || p == s.r.local || !p.started.Load() {
+			continue
+		}
+		peer := RoutingPeer{
+			Port:      p.port,
+			PublicKey: p.public,
+		}
+		if ann := s._announcements[p]; ann != nil {
+			peer.Coords = ann.PeerCoords()
+			peer.Root = ann.Root
+		}
+		rs.Peers = append(rs.Peers, peer)
+	}
+	for k, v := range s._table {
+		entry := RoutingEntry{
+			PublicKey: k.PublicKey,
+			Watermark: v.Watermark,
+			Root:      v.Root,
+		}
+		if v.Source != nil {
+			entry.SourcePort = v.Source.port
+		}
+		if v.Destination != nil {
+			entry.DestinationPort = v.Destination.port
+		}
+		rs.Routes = append(rs.Routes, entry)
+	}
+	return rs
+}
@@ -0,0 +1,96 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// testRoutingStrategy sends every SNEK-routed frame to a fixed port and
+// records the queries that it was asked about.
+type testRoutingStrategy struct {
+	port    types.SwitchPortID
+	queries []RoutingQuery
+	state   *RoutingState
+}
+
+func (s *testRoutingStrategy) NextHopSNEK(q *RoutingQuery) (types.SwitchPortID, types.VirtualSnakeWatermark, bool) {
+	s.queries = append(s.queries, *q)
+	s.state = q.State()
+	return s.port, q.Watermark, true
+}
+
+func (s *testRoutingStrategy) NextHopTree(q *RoutingQuery) (types.SwitchPortID, bool) {
+	s.queries = append(s.queries, *q)
+	return 0, false
+}
+
+func TestRoutingStrategy(t *testing.T) {
+	dest := types.PublicKey{3}
+	strategy := &testRoutingStrategy{port: 2}
+	r := newTestRouter(t, RouterOptionRoutingStrategy{strategy})
+	a := newTestPeer(r, 1, dest)
+	b := newTestPeer(r, 2, types.PublicKey{4})
+	from := newTestPeer(r, 3, types.PublicKey{5})
+
+	// SNEK routing would send the frame to a, but the strategy says b.
+	addTestSnakeEntry(r, dest, a)
+	f := getFrame()
+	f.Type = types.TypeTraffic
+	f.DestinationKey = dest
+	f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	var err error
+	phony.Block(r.state, func() {
+		r.state._peers[1], r.state._peers[2], r.state._peers[3] = a, b, from
+		err = r.state._forward(from, f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(strategy.queries) != 1 {
+		t.Fatalf("expected the strategy to be consulted once, got %d", len(strategy.queries))
+	}
+	if q := strategy.queries[0]; q.From != from.port || q.DestinationKey != dest || q.Frame != f {
+		t.Fatalf("strategy was asked about the wrong frame: %+v", q)
+	}
+	if len(strategy.state.Peers) != 3 || len(strategy.state.Routes) != 1 {
+		t.Fatalf("expected 3 peers and 1 route in the snapshot, got %d and %d", len(strategy.state.Peers), len(strategy.state.Routes))
+	}
+	if b.traffic.queuecount() != 1 || a.traffic.queuecount() != 0 {
+		t.Fatalf("expected the frame to be sent to the port chosen by the strategy")
+	}
+}
+
+func TestRoutingStrategyExcluded(t *testing.T) {
+	// The strategy can't send frames to a port that has been excluded.
+	strategy := &testRoutingStrategy{port: 1}
+	r := newTestRouter(t, RouterOptionRoutingStrategy{strategy})
+	a := newTestPeer(r, 1, types.PublicKey{3})
+	var nexthop *peer
+	phony.Block(r.state, func() {
+		r.state._peers[1] = a
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		nexthop, _ = r.state._nextHopsFor(r.local, f, types.PublicKey{3}, f.Watermark, 0, a)
+		framePool.Put(f)
+	})
+	if nexthop != nil {
+		t.Fatalf("expected no next-hop, got port %d", nexthop.port)
+	}
+}
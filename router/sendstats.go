@@ -0,0 +1,78 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// SendStat counts the traffic that this node has sent towards a single
+// destination key.
+type SendStat struct {
+	Frames uint64 // Frames sent, counting each fragment of a large payload
+	Bytes  uint64 // Payload bytes sent, not including frame headers
+}
+
+type sendStatsEntry struct {
+	key types.PublicKey
+	SendStat
+}
+
+// sendStats keeps send statistics for the most recently used destination
+// keys, up to maxSendStatsEntries of them. It is safe to be used from
+// multiple goroutines.
+type sendStats struct {
+	mutex   sync.Mutex
+	entries map[types.PublicKey]*list.Element
+	order   list.List // Most recently used at the front
+}
+
+// add counts a frame with the given payload length sent to the given key.
+func (s *sendStats) add(key types.PublicKey, length int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.entries == nil {
+		s.entries = map[types.PublicKey]*list.Element{}
+	}
+	e, ok := s.entries[key]
+	if ok {
+		s.order.MoveToFront(e)
+	} else {
+		if s.order.Len() >= maxSendStatsEntries {
+			oldest := s.order.Back()
+			delete(s.entries, oldest.Value.(*sendStatsEntry).key)
+			s.order.Remove(oldest)
+		}
+		e = s.order.PushFront(&sendStatsEntry{key: key})
+		s.entries[key] = e
+	}
+	entry := e.Value.(*sendStatsEntry)
+	entry.Frames++
+	entry.Bytes += uint64(length)
+}
+
+// snapshot returns a copy of the statistics for each key.
+func (s *sendStats) snapshot() map[types.PublicKey]SendStat {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := make(map[types.PublicKey]SendStat, len(s.entries))
+	for key, e := range s.entries {
+		stats[key] = e.Value.(*sendStatsEntry).SendStat
+	}
+	return stats
+}
@@ -0,0 +1,64 @@
+// Copyright 2022 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+// signatureCache remembers our signature for the last root announcement
+// that we signed, keyed by a digest of the signed content. Our hop port isn't
+// covered by the signature and ed25519 signatures are deterministic, so the
+// same signature is valid for every peer until the announcement changes.
+// Working out the digest is much cheaper than signing, which saves work when
+// announcements are sent one peer at a time. It is safe to be used from
+// multiple goroutines.
+type signatureCache struct {
+	mutex  sync.Mutex
+	valid  bool
+	public types.PublicKey // The key that the signature was made with
+	digest [sha256.Size]byte
+	sig    types.SignatureWithHop
+	signed uint64 // Signatures generated, rather than taken from the cache
+}
+
+// sign returns a signature for the announcement as it stands with the given
+// private key, generating it only if the announcement or key has changed
+// since the last call.
+func (c *signatureCache) sign(a *types.SwitchAnnouncement, public types.PublicKey, private types.PrivateKey) (types.SignatureWithHop, error) {
+	body := make([]byte, maxAnnouncementLength(len(a.Signatures)))
+	n, err := a.MarshalBinary(body)
+	if err != nil {
+		return types.SignatureWithHop{}, fmt.Errorf("a.MarshalBinary: %w", err)
+	}
+	digest := sha256.Sum256(body[:n])
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.valid && c.public == public && c.digest == digest {
+		return c.sig, nil
+	}
+	sig, err := a.NewSignature(private[:])
+	if err != nil {
+		return types.SignatureWithHop{}, err
+	}
+	c.valid, c.public, c.digest, c.sig = true, public, digest, sig
+	c.signed++
+	return sig, nil
+}
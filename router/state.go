@@ -18,6 +18,7 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"math/rand"
 	"net"
 	"time"
 
@@ -40,6 +41,8 @@ type state struct {
 	r               *Router
 	_peers          []*peer                            // All switch ports, connected and disconnected
 	_descending     *virtualSnakeEntry                 // Next descending node in keyspace
+	_descBackups    []virtualSnakeIndex                // Backup descending candidates, closest first
+	_descSlots      []virtualSnakeIndex                // Extra descending nodes, see RouterOptionDescendingSlots
 	_parent         *peer                              // Our chosen parent in the tree
 	_announcements  announcementTable                  // Announcements received from our peers
 	_table          virtualSnakeTable                  // Virtual snake DHT entries
@@ -50,10 +53,23 @@ type state struct {
 	_broadcastTimer *time.Timer                        // Wakeup Broadcast maintenance timer
 	_seenBroadcasts map[types.PublicKey]broadcastEntry // Cache of previously seen wakeup broadcasts
 	_lastbootstrap  time.Time                          // When did we last bootstrap?
+	_bootstraps     int                                // Bootstraps handled since the last SNEK maintenance
 	_waiting        bool                               // Is the tree waiting to reparent?
+	_announcing     bool                               // Are tree announcements waiting to be sent?
+	_partitioned    bool                               // Are we our own root with no peers?
+	_draining       bool                               // Should we stop anchoring new SNEK paths?
 	_filterPacket   FilterFn                           // Function called when forwarding packets
 	_bandwidthTimer *time.Timer
 	_coordsCache    coordsCacheTable
+	_lastCoords     types.Coordinates // Coordinates last reported to OnCoordsChanged
+	_loopDetection  map[loopDetectionKey]loopDetectionEntry
+	_parentFlaps    map[types.PublicKey]parentFlapEntry // Recent parent failures, by peer key
+	_ascendingKey   types.PublicKey                     // Ascending neighbour as of the last SNEK maintenance
+	_snakeChanged   time.Time                           // When our SNEK neighbours last changed
+	_treeChanged    time.Time                           // When our coordinates last changed
+	_jitter         *rand.Rand                          // Source of randomness for timer jitter
+	_snakeCache     map[snakeNextHopCacheKey]snakeNextHopCacheEntry
+	_routingQuery   RoutingQuery // Reused by _nextHopsFor
 }
 
 type coordsCacheTable map[types.PublicKey]coordsCacheEntry
@@ -63,54 +79,66 @@ type coordsCacheEntry struct {
 	lastSeen    time.Time
 }
 
-// _start resets the state and starts tree and virtual snake maintenance.
+// _start starts tree and virtual snake maintenance with a blank slate. It is
+// only called once, when the router starts.
 func (s *state) _start() {
+	s._treetimer = time.AfterFunc(s.r.announceInterval, func() {
+		s.Act(nil, s._maintainTree)
+	})
+	s._snaketimer = time.AfterFunc(s.r.snakeMaintainInterval, func() {
+		s.Act(nil, s._maintainSnake)
+	})
+	s._broadcastTimer = time.AfterFunc(wakeupBroadcastInterval, func() {
+		s.Act(nil, s._maintainBroadcasts)
+	})
+	s._bandwidthTimer = time.AfterFunc(time.Until(
+		time.Now().Round(time.Minute).Add(BWReportingInterval)),
+		func() {
+			s.Act(nil, s._reportBandwidth)
+		})
+	time.AfterFunc(coordsCacheMaintainInterval, func() {
+		s.Act(nil, s._cleanCachedCoords)
+	})
+	s._reset()
+}
+
+// _reset resets the tree and virtual snake state and runs maintenance
+// straight away, for example when we have lost all of our peers. The
+// maintenance timers started by _start keep running.
+func (s *state) _reset() {
 	s._setParent(nil)
 	s._setDescendingNode(nil)
+	s._descBackups = nil
+	s._descSlots = make([]virtualSnakeIndex, s.r.descendingSlots-1)
+	s._lastCoords = nil
+	s._ascendingKey = types.PublicKey{}
+	s._snakeChanged = s.r.clock.Now()
+	s._treeChanged = s._snakeChanged
 
 	s._ordering = 0
 	s._waiting = false
+	s._announcing = false
 
 	s._announcements = make(announcementTable, portCount)
 	s._table = virtualSnakeTable{}
+	s._snakeCache = nil
 	s._coordsCache = coordsCacheTable{}
 	s._seenBroadcasts = make(map[types.PublicKey]broadcastEntry)
+	s._loopDetection = make(map[loopDetectionKey]loopDetectionEntry)
 
-	if s._treetimer == nil {
-		s._treetimer = time.AfterFunc(announcementInterval, func() {
-			s.Act(nil, s._maintainTree)
-		})
-	}
-
-	if s._snaketimer == nil {
-		s._snaketimer = time.AfterFunc(time.Second, func() {
-			s.Act(nil, s._maintainSnake)
-		})
-	}
-
-	if s._broadcastTimer == nil {
-		s._broadcastTimer = time.AfterFunc(wakeupBroadcastInterval, func() {
-			s.Act(nil, s._maintainBroadcasts)
-		})
-	}
-
-	if s._bandwidthTimer == nil {
-		s._bandwidthTimer = time.AfterFunc(time.Until(
-			time.Now().Round(time.Minute).Add(BWReportingInterval)),
-			func() {
-				s.Act(nil, s._reportBandwidth)
-			})
+	// Parent failures are remembered by key rather than by peering, so that
+	// a flapping parent is still penalised if it reconnects, or if we lose
+	// all of our peers and start afresh.
+	if s._parentFlaps == nil {
+		s._parentFlaps = make(map[types.PublicKey]parentFlapEntry)
 	}
 
 	s._maintainTreeIn(0)
 	s._maintainSnakeIn(0)
-	time.AfterFunc(coordsCacheMaintainInterval, func() {
-		s.Act(nil, s._cleanCachedCoords)
-	})
 }
 
 // _maintainTreeIn resets the tree maintenance timer to the specified
-// duration.
+// duration, with jitter applied.
 func (s *state) _maintainTreeIn(d time.Duration) {
 	if !s._treetimer.Stop() {
 		select {
@@ -118,11 +146,11 @@ func (s *state) _maintainTreeIn(d time.Duration) {
 		default:
 		}
 	}
-	s._treetimer.Reset(d)
+	s._treetimer.Reset(s._jittered(d))
 }
 
 // _maintainSnakeIn resets the virtual snake maintenance timer to the
-// specified duration.
+// specified duration, with jitter applied.
 func (s *state) _maintainSnakeIn(d time.Duration) {
 	if !s._snaketimer.Stop() {
 		select {
@@ -130,13 +158,24 @@ func (s *state) _maintainSnakeIn(d time.Duration) {
 		default:
 		}
 	}
-	s._snaketimer.Reset(d)
+	s._snaketimer.Reset(s._jittered(d))
+}
+
+// _jittered returns the given duration randomly lengthened or shortened by
+// up to the configured timer jitter, so that maintenance on different nodes
+// doesn't happen in lockstep. A duration of zero, meaning that maintenance
+// should happen straight away, is never changed.
+func (s *state) _jittered(d time.Duration) time.Duration {
+	if d <= 0 || s.r.timerJitter == 0 {
+		return d
+	}
+	return d + time.Duration((s._jitter.Float64()*2-1)*s.r.timerJitter*float64(d))
 }
 
 // _cleanCachedCoords clears old entries out of the coordinate cache.
 func (s *state) _cleanCachedCoords() {
 	for k, v := range s._coordsCache {
-		if time.Since(v.lastSeen) >= coordsCacheLifetime {
+		if s.r.clock.Now().Sub(v.lastSeen) >= coordsCacheLifetime {
 			delete(s._coordsCache, k)
 		}
 	}
@@ -216,7 +255,7 @@ func (s *state) _reportBandwidth() {
 }
 
 // _addPeer creates a new Peer and adds it to the switch in the next available port
-func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionURI, zone ConnectionZone, peertype ConnectionPeerType, keepalives bool) (types.SwitchPortID, error) {
+func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionURI, zone ConnectionZone, peertype ConnectionPeerType, keepalives bool, revision uint8) (types.SwitchPortID, error) {
 	var new *peer
 	for i, p := range s._peers {
 		if i == 0 || p != nil {
@@ -238,9 +277,10 @@ func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionUR
 			zone:       zone,
 			peertype:   peertype,
 			keepalives: keepalives,
+			revision:   revision,
 			context:    ctx,
 			cancel:     cancel,
-			proto:      newFIFOQueue(fifoNoMax, s.r.log),
+			proto:      newFIFOQueue(protoBuffer, s.r.log),
 			traffic:    newFairFIFOQueue(queues, s.r.log),
 		}
 		s._peers[i] = new
@@ -248,10 +288,11 @@ func (s *state) _addPeer(conn net.Conn, public types.PublicKey, uri ConnectionUR
 		v, _ := s.r.active.LoadOrStore(hex.EncodeToString(new.public[:])+string(zone), atomic.NewUint64(0))
 		v.(*atomic.Uint64).Inc()
 
-		new.proto.push(s.r.state._rootAnnouncement().forPeer(new))
+		new.send(s.r.state._rootAnnouncement().forPeer(new))
 		new.started.Store(true)
 		new.reader.Act(nil, new._read)
 		new.writer.Act(nil, new._write)
+		s._updatePartitioned()
 
 		s.r.Act(nil, func() {
 			s.r._publish(events.PeerAdded{Port: types.SwitchPortID(i), PeerID: new.public.String()})
@@ -274,9 +315,10 @@ func (s *state) _removePeer(port types.SwitchPortID) {
 func (s *state) _setParent(peer *peer) {
 	oldAnnouncement := s._rootAnnouncement()
 	s._parent = peer
+	s._invalidateSnakeCache()
 
-	if s._rootAnnouncement().RootPublicKey != oldAnnouncement.RootPublicKey {
-		s._rootChanged()
+	if newRoot := s._rootAnnouncement().RootPublicKey; newRoot != oldAnnouncement.RootPublicKey {
+		s._rootChanged(oldAnnouncement.RootPublicKey, newRoot)
 	}
 
 	s.r.Act(nil, func() {
@@ -289,12 +331,39 @@ func (s *state) _setParent(peer *peer) {
 	})
 }
 
-func (s *state) _rootChanged() {
+func (s *state) _rootChanged(oldRoot, newRoot types.PublicKey) {
 	// If the root has changed then it stands to reason that our cached
 	// coordinates are no longer valid, so clear those out.
 	for k := range s._coordsCache {
 		delete(s._coordsCache, k)
 	}
+
+	s.r.Act(nil, func() {
+		s.r._publish(events.TreeRootChanged{Root: newRoot.String(), PreviousRoot: oldRoot.String()})
+		if cb := s.r.rootChanged; cb != nil {
+			cb(oldRoot, newRoot)
+		}
+	})
+}
+
+// _updatePartitioned works out whether we have been cut off from the rest of
+// the network, that is, we are our own root and have no peers left, and tells
+// the application with a PartitionChanged event if that has changed.
+func (s *state) _updatePartitioned() {
+	partitioned := s._parent == nil
+	for _, p := range s._peers {
+		if p != nil && p.port != 0 && p.started.Load() {
+			partitioned = false
+			break
+		}
+	}
+	if partitioned == s._partitioned {
+		return
+	}
+	s._partitioned = partitioned
+	s.r.Act(nil, func() {
+		s.r._publish(events.PartitionChanged{Partitioned: partitioned})
+	})
 }
 
 func (s *state) _setDescendingNode(node *virtualSnakeEntry) {
@@ -304,8 +373,15 @@ func (s *state) _setDescendingNode(node *virtualSnakeEntry) {
 	case s._descending != nil && node != nil && s._descending.PublicKey != node.PublicKey:
 		s._bootstrapSoon()
 	}
+	switch {
+	case (s._descending == nil) != (node == nil):
+		fallthrough
+	case s._descending != nil && node != nil && s._descending.PublicKey != node.PublicKey:
+		s._snakeChanged = s.r.clock.Now()
+	}
 
 	s._descending = node
+	s._invalidateSnakeCache()
 
 	s.r.Act(nil, func() {
 		peerID := ""
@@ -319,6 +395,7 @@ func (s *state) _setDescendingNode(node *virtualSnakeEntry) {
 
 func (s *state) _addRouteEntry(index virtualSnakeIndex, entry *virtualSnakeEntry) {
 	s._table[index] = entry
+	s._invalidateSnakeCache()
 
 	s.r.Act(nil, func() {
 		s.r._publish(events.SnakeEntryAdded{EntryID: index.PublicKey.String(), PeerID: entry.Source.public.String()})
@@ -327,6 +404,7 @@ func (s *state) _addRouteEntry(index virtualSnakeIndex, entry *virtualSnakeEntry
 
 func (s *state) _removeRouteEntry(index virtualSnakeIndex) {
 	delete(s._table, index)
+	s._invalidateSnakeCache()
 
 	s.r.Act(nil, func() {
 		s.r._publish(events.SnakeEntryRemoved{EntryID: index.PublicKey.String()})
@@ -335,6 +413,7 @@ func (s *state) _removeRouteEntry(index virtualSnakeIndex) {
 
 // _portDisconnected is called when a peer disconnects.
 func (s *state) _portDisconnected(peer *peer) {
+	defer s._updatePartitioned()
 	peercount := 0
 
 	// Work out how many peers are connected now that this peer has
@@ -349,12 +428,13 @@ func (s *state) _portDisconnected(peer *peer) {
 	// snake state. When we connect to a peer in the future, we will do so
 	// with a blank slate.
 	if peercount == 0 {
-		s._start()
+		s._reset()
 		return
 	}
 
 	// Delete the last tree announcement that we received from this peer.
 	delete(s._announcements, peer)
+	s._invalidateSnakeCache()
 
 	// Scan the local routing table for any routes that transited this now-dead
 	// peering and remove them from the routing table.
@@ -365,16 +445,20 @@ func (s *state) _portDisconnected(peer *peer) {
 	}
 
 	// If the descending path was lost because it went via the now-dead
-	// peering then clear that path and wait for another incoming setup.
+	// peering then promote a backup candidate if we have one, otherwise
+	// clear that path and wait for another incoming bootstrap.
 	if desc := s._descending; desc != nil && desc.Source == peer {
-		s._setDescendingNode(nil)
+		s._setDescendingNode(s._nextDescendingBackup())
 	}
 
 	// If the peer that died was our chosen tree parent, then we will need to
 	// select a new parent. If we successfully choose a new parent (as in, we
 	// don't end up promoting ourselves to a root) then we will also need to
 	// send a new bootstrap into the network.
-	if s._parent == peer && s._selectNewParent() {
-		s._bootstrapSoon()
+	if s._parent == peer {
+		s._recordParentFailure(peer)
+		if s._selectNewParent() {
+			s._bootstrapSoon()
+		}
 	}
 }
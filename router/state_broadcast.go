@@ -31,8 +31,8 @@ type broadcastEntry struct {
 // valid returns true if the broadcast hasn't expired, or false if it has. It is
 // required for broadcasts to time out eventually, in the case that nodes leave
 // the network and return later.
-func (e *broadcastEntry) valid() bool {
-	return time.Since(e.LastSeen) < broadcastExpiryPeriod
+func (e *broadcastEntry) valid(now time.Time) bool {
+	return now.Sub(e.LastSeen) < broadcastExpiryPeriod
 }
 
 // NOTE: Functions prefixed with an underscore (_) are only safe to be called
@@ -50,7 +50,7 @@ func (s *state) _maintainBroadcasts() {
 
 	// Clean up any broadcasts that are older than the expiry period.
 	for k, v := range s._seenBroadcasts {
-		if !v.valid() {
+		if !v.valid(s.r.clock.Now()) {
 			delete(s._seenBroadcasts, k)
 		}
 	}
@@ -63,7 +63,7 @@ func (s *state) _createBroadcastFrame() (*types.Frame, error) {
 	b := frameBufferPool.Get().(*[types.MaxFrameSize]byte)
 	defer frameBufferPool.Put(b)
 	broadcast := types.WakeupBroadcast{
-		Sequence: types.Varu64(time.Now().UnixMilli()),
+		Sequence: types.Varu64(s.r.clock.Now().UnixMilli()),
 		Root:     s._rootAnnouncement().Root,
 	}
 	if s.r.secure {
@@ -71,9 +71,10 @@ func (s *state) _createBroadcastFrame() (*types.Frame, error) {
 		if err != nil {
 			return nil, err
 		}
+		private := s.r.PrivateKey()
 		copy(
 			broadcast.Signature[:],
-			ed25519.Sign(s.r.private[:], protected),
+			ed25519.Sign(private[:], protected),
 		)
 	}
 	n, err := broadcast.MarshalBinary(b[:])
@@ -84,7 +85,7 @@ func (s *state) _createBroadcastFrame() (*types.Frame, error) {
 	// Construct the frame.
 	send := getFrame()
 	send.Type = types.TypeWakeupBroadcast
-	send.SourceKey = s.r.public
+	send.SourceKey = s.r.PublicKey()
 	send.HopLimit = types.NetworkHorizonDistance
 	send.Payload = append(send.Payload[:0], b[:n]...)
 
@@ -134,7 +135,7 @@ func (s *state) _handleBroadcast(p *peer, f *types.Frame) error {
 	// If we have seen a higher sequence number before then there is no need
 	// to continue forwarding it.
 	if existing, ok := s._seenBroadcasts[f.SourceKey]; ok {
-		sendingTooFast := time.Since(existing.LastSeen) < broadcastFilterTime
+		sendingTooFast := s.r.clock.Now().Sub(existing.LastSeen) < broadcastFilterTime
 		repeatedSequence := broadcast.Sequence <= existing.Sequence
 		if sendingTooFast || repeatedSequence {
 			return nil
@@ -142,12 +143,12 @@ func (s *state) _handleBroadcast(p *peer, f *types.Frame) error {
 	}
 	s._seenBroadcasts[f.SourceKey] = broadcastEntry{
 		Sequence: broadcast.Sequence,
-		LastSeen: time.Now(),
+		LastSeen: s.r.clock.Now(),
 	}
 
 	// send event to subscribers about discovered node
 	s.r.Act(nil, func() {
-		s.r._publish(events.BroadcastReceived{PeerID: f.SourceKey.String(), Time: uint64(time.Now().UnixNano())})
+		s.r._publish(events.BroadcastReceived{PeerID: f.SourceKey.String(), Time: uint64(s.r.clock.Now().UnixNano())})
 	})
 
 	if f.HopLimit > 1 {
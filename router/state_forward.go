@@ -29,18 +29,61 @@ const (
 	TreeFlood
 )
 
-// _nextHopsFor returns the next-hop for the given frame. It will examine the packet
-// type and use the correct routing algorithm to determine the next-hop. It is possible
-// for this function to return `nil` if there is no suitable candidate.
-func (s *state) _nextHopsFor(from *peer, frameType types.FrameType, dest net.Addr, watermark types.VirtualSnakeWatermark) (*peer, types.VirtualSnakeWatermark) {
-	var nexthop *peer
-	switch dest := dest.(type) {
-	case types.PublicKey:
-		nexthop, watermark = s._nextHopsSNEK(dest, frameType, watermark)
-	case types.Coordinates:
-		nexthop = s._nextHopsTree(from, dest)
+// DropReason describes why a frame was dropped instead of being forwarded.
+type DropReason int
+
+const (
+	DropNoNextHop         DropReason = iota // There was no suitable next-hop
+	DropLoopDetected                        // The frame would have gone backwards
+	DropQueueFull                           // The next-hop's queue was full
+	DropHopLimit                            // The frame ran out of hops
+	DropFiltered                            // The frame was dropped by the packet filter
+	DropUnknownType                         // The frame type isn't known to us
+	DropBootstrapRejected                   // The bootstrap was not accepted
+	DropRateLimited                         // The peer was sending bootstraps too quickly
+	DropOverloaded                          // Too many bootstraps arrived since the last SNEK maintenance
+	DropNoDestination                       // The frame had neither a destination key nor coordinates
+	DropExpired                             // The frame's signed timestamp was too old or invalid
+	dropReasonCount
+)
+
+func (r DropReason) String() string {
+	switch r {
+	case DropNoNextHop:
+		return "NoNextHop"
+	case DropLoopDetected:
+		return "LoopDetected"
+	case DropQueueFull:
+		return "QueueFull"
+	case DropHopLimit:
+		return "HopLimit"
+	case DropFiltered:
+		return "Filtered"
+	case DropUnknownType:
+		return "UnknownType"
+	case DropBootstrapRejected:
+		return "BootstrapRejected"
+	case DropRateLimited:
+		return "RateLimited"
+	case DropOverloaded:
+		return "Overloaded"
+	case DropNoDestination:
+		return "NoDestination"
+	case DropExpired:
+		return "Expired"
+	default:
+		return "Unknown"
 	}
-	return nexthop, watermark
+}
+
+// peerExcluded returns true if the given peer is one of the excluded peers.
+func peerExcluded(p *peer, excluded []*peer) bool {
+	for _, e := range excluded {
+		if p == e {
+			return true
+		}
+	}
+	return false
 }
 
 // _forward handles frames received from a given peer. In most cases, this function will
@@ -48,8 +91,35 @@ func (s *state) _nextHopsFor(from *peer, frameType types.FrameType, dest net.Add
 // queue if possible. In some special cases, like tree announcements,
 // special handling will be done before forwarding if needed.
 func (s *state) _forward(p *peer, f *types.Frame) error {
+	if p != s.r.local {
+		s.r._frameTypeStats.received(f.Type)
+	}
+
+	// A frame that is routed by its destination but doesn't have one would
+	// otherwise be sent towards the lowest key on the network, so drop it.
+	switch f.Type {
+	case types.TypeTraffic, types.TypeSNEKPing, types.TypeSNEKPong, types.TypePathMTUProbe, types.TypePathMTUReply:
+		if f.DestinationKey.IsEmpty() && len(f.Destination) == 0 {
+			s._drop(f, DropNoDestination)
+			return nil
+		}
+	}
+
+	// Traffic that has spent too long in the network is dropped, however
+	// many hops it has left, so that it can't circulate on slow paths.
+	if f.Type.IsTraffic() && p != s.r.local && !s.r.frameIsFresh(f) {
+		s._drop(f, DropExpired)
+		return nil
+	}
+
+	// Traffic arriving from a node that we have a SNEK path to shows that the
+	// node and the path are still alive, so the path shouldn't expire.
+	if f.Type == types.TypeTraffic {
+		s._refreshRouteEntry(p, f.SourceKey)
+	}
+
 	// Allow overlay loopback traffic by directly forwarding it to the local router.
-	if f.Type.IsTraffic() && f.DestinationKey == s.r.public {
+	if f.Type.IsTraffic() && f.DestinationKey == s.r.PublicKey() {
 		if len(f.Source) > 0 {
 			// TODO: There's a potential security risk here in that currently a node
 			// on the path could modify the source coordinates and that would cause
@@ -58,36 +128,43 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 			// by encrypting them to resist changes or on-path statistical analysis.
 			s._coordsCache[f.SourceKey] = coordsCacheEntry{
 				coordinates: f.Source,
-				lastSeen:    time.Now(),
+				lastSeen:    s.r.clock.Now(),
 			}
 		}
 		if !s.r.local.send(f) {
-			framePool.Put(f)
+			s._drop(f, DropQueueFull)
 		}
 		return nil
 	}
 
 	if s._filterPacket != nil && s._filterPacket(p.public, f) {
 		s.r.log.Printf("Packet of type %s destined for port %d [%s] was dropped due to filter rules", f.Type.String(), p.port, p.public.String()[:8])
-		framePool.Put(f)
+		s._drop(f, DropFiltered)
 		return nil
 	}
 
 	var nexthop *peer
 	var watermark types.VirtualSnakeWatermark
+	var dest net.Addr // Where fallback next-hops should be found, if anywhere
+	var flow uint64
 	switch f.Type {
 	case types.TypeTraffic:
 		if len(f.Destination) > 0 {
-			if nexthop, watermark = s._nextHopsFor(p, f.Type, f.Destination, f.Watermark); nexthop != nil {
+			flow = flowHash(f)
+			if nexthop, watermark = s._nextHopsFor(p, f, f.Destination, f.Watermark, flow); nexthop != nil {
 				// We found a next-hop on the tree, so use it
+				dest = f.Destination
 				break
 			}
 		}
 		// Otherwise, we failed to find a tree next-hop, fall back to SNEK routing
 		f.Destination = f.Destination[:0]
 		fallthrough
-	case types.TypeBootstrap:
-		nexthop, watermark = s._nextHopsFor(p, f.Type, f.DestinationKey, f.Watermark)
+	case types.TypeBootstrap, types.TypeSNEKPing, types.TypeSNEKPong, types.TypePathMTUProbe, types.TypePathMTUReply:
+		dest = f.DestinationKey
+		nexthop, watermark = s._nextHopsFor(p, f, dest, f.Watermark, 0)
+	case types.TypeSourceRouted:
+		nexthop, watermark = s._nextHopSourceRouted(p, f), f.Watermark
 	}
 	deadend := nexthop == nil || nexthop == p.router.local
 
@@ -107,11 +184,49 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 		return nil
 
 	case types.TypeBootstrap:
-		// Bootstrap messages are handled at each node along the path.
-		if !s._handleBootstrap(p, nexthop, f) || deadend {
+		// If the peer is sending us bootstraps faster than we are willing to
+		// accept them then drop the excess.
+		if rate := s.r.bootstrapRate; rate > 0 && p != s.r.local {
+			if !p._bootstraps.allow(s.r.clock.Now(), rate, rate*bootstrapRateLimitBurst) {
+				s.r._limitedBootstraps.Inc()
+				s._drop(f, DropRateLimited)
+				return nil
+			}
+		}
+		// If we have already handled as many bootstraps as we are willing to
+		// since the last SNEK maintenance then shed the rest, so that we
+		// don't spend all of our time on them instead of forwarding traffic.
+		if limit := s.r.maxBootstraps; limit > 0 && p != s.r.local {
+			if s._bootstraps >= limit {
+				s.r._shedBootstraps.Inc()
+				s._drop(f, DropOverloaded)
+				return nil
+			}
+			s._bootstraps++
+		}
+		// Bootstrap messages carry a hop limit so that they can't be forwarded
+		// forever. If it has run out and we would need to forward the bootstrap
+		// any further then drop it without acting on it. Older nodes don't set
+		// a hop limit at all, so a hop limit of zero means that there is none.
+		if !deadend && f.HopLimit == 1 {
+			s._drop(f, DropHopLimit)
+			return nil
+		}
+		// Bootstrap messages are handled at each node along the path. A
+		// bootstrap that reaches its dead end has arrived, so isn't a drop.
+		// If it ends up being sent to a fallback next-hop instead then the
+		// routing table entry will be updated to match below.
+		if !s._handleBootstrap(p, nexthop, f) {
+			s._drop(f, DropBootstrapRejected)
+			return nil
+		}
+		if deadend {
 			framePool.Put(f)
 			return nil
 		}
+		if f.HopLimit > 0 {
+			f.HopLimit--
+		}
 
 	case types.TypeWakeupBroadcast:
 		// Broadcasts are a special case. The _handleBroadcast function will handle
@@ -121,7 +236,24 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 		}
 		return nil
 
-	case types.TypeTraffic:
+	case types.TypePathMTUProbe, types.TypePathMTUReply:
+		// Path MTU probes and replies are handled in the same way as pings.
+		if deadend {
+			s._handlePathMTU(f)
+			return nil
+		}
+		fallthrough
+
+	case types.TypeSNEKPing, types.TypeSNEKPong:
+		// Pings and pongs are handled once they can't get any closer to their
+		// destination key, and are otherwise forwarded just like traffic.
+		if deadend {
+			s._handlePing(f)
+			return nil
+		}
+		fallthrough
+
+	case types.TypeTraffic, types.TypeSourceRouted:
 		// Traffic type packets are forwarded normally by falling through unless hop
 		// limiting is enabled.
 		if s.r._hopLimiting.Load() {
@@ -129,12 +261,14 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 				f.HopLimit -= 1
 			} else {
 				// The packet has reached the hop limit and shouldn't be forwarded.
+				s._drop(f, DropHopLimit)
 				return nil
 			}
 		}
 
 	default:
 		// We don't know what type of packet this is so drop it.
+		s._drop(f, DropUnknownType)
 		return nil
 	}
 
@@ -144,22 +278,186 @@ func (s *state) _forward(p *peer, f *types.Frame) error {
 	// the peer we received the ping from so the "loop" is desired.
 	if nexthop == p || watermark.WorseThan(f.Watermark) {
 		// s.r.log.Println("Dropping forwarded packet of type", f.Type)
-		framePool.Put(f)
+		if f.Type.IsTraffic() {
+			s._detectLoop(p, f)
+		}
+		s._drop(f, DropLoopDetected)
 		return nil
 	}
 
-	// If there's a suitable next-hop then try sending the packet. If we fail
-	// to queue up the packet then we will log it but there isn't an awful lot
-	// we can do at this point.
+	// If there's a suitable next-hop then try sending the packet, falling back
+	// to other next-hops if its queue is full. If we fail to queue up the
+	// packet then we will count it but there isn't an awful lot we can do at
+	// this point.
+	incoming := f.Watermark
 	f.Watermark = watermark
-	if nexthop != nil && !nexthop.send(f) {
-		// s.r.log.Println("Dropping forwarded packet of type", f.Type)
-		framePool.Put(f)
+	if nexthop == nil {
+		s._drop(f, DropNoNextHop)
+		return nil
+	}
+	// The frame belongs to the next-hop once it has been queued, so take
+	// a copy of anything that we need afterwards, including anything that
+	// the frame forwarding callback needs, first.
+	var forwarded *ForwardedFrame
+	if s.r.frameForward != nil {
+		forwarded = &ForwardedFrame{
+			Type:           f.Type,
+			From:           p.public,
+			FromPort:       p.port,
+			SourceKey:      f.SourceKey,
+			DestinationKey: f.DestinationKey,
+			Source:         f.Source.Copy(),
+			Destination:    f.Destination.Copy(),
+		}
+	}
+	frameType, destKey := f.Type, f.DestinationKey
+	sentTo := s._sendWithFallbacks(p, nexthop, f, dest, incoming, flow)
+	if sentTo != nil {
+		s.r._frameTypeStats.sent(frameType, p == s.r.local)
+	}
+	switch {
+	case sentTo == nil:
+		s._drop(f, DropQueueFull)
+	case sentTo != nexthop && frameType == types.TypeBootstrap:
+		index := virtualSnakeIndex{PublicKey: destKey}
+		if entry, ok := s._table[index]; ok && entry.Destination == nexthop {
+			entry.Destination = sentTo
+		}
+	}
+	if forwarded != nil && sentTo != nil {
+		forwarded.To, forwarded.ToPort = sentTo.public, sentTo.port
+		cb := s.r.frameForward
+		s.r.Act(nil, func() {
+			cb(*forwarded)
+		})
 	}
 
 	return nil
 }
 
+// _sendWithFallbacks sends the frame to the given next-hop, returning the
+// peer that accepted it or nil if none did. If the next-hop's queue is full
+// then the next-best next-hops towards the destination are tried in turn,
+// up to maxNextHopFallbacks of them. These are chosen by the same rules as
+// the first next-hop, so they still take the frame closer to the destination
+// than we are, and the peer that the frame came from is never used, so this
+// can't create a loop.
+func (s *state) _sendWithFallbacks(from, nexthop *peer, f *types.Frame, dest net.Addr, watermark types.VirtualSnakeWatermark, flow uint64) *peer {
+	if nexthop.send(f) {
+		return nexthop
+	}
+	if dest == nil {
+		return nil
+	}
+	excluded := []*peer{from, nexthop}
+	for i := 0; i < maxNextHopFallbacks; i++ {
+		fallback, w := s._nextHopsFor(from, f, dest, watermark, flow, excluded...)
+		if fallback == nil || fallback == s.r.local || w.WorseThan(watermark) {
+			return nil
+		}
+		f.Watermark = w
+		if fallback.send(f) {
+			return fallback
+		}
+		excluded = append(excluded, fallback)
+	}
+	return nil
+}
+
+// _drop counts a frame as having been dropped for the given reason and
+// returns it to the pool.
+func (s *state) _drop(f *types.Frame, reason DropReason) {
+	s.r._drops[reason].Inc()
+	framePool.Put(f)
+}
+
+// _nextHopSourceRouted returns the next-hop for a source-routed frame. Peers
+// that predate source routing would drop the frame, so it is turned back into
+// a plain traffic frame before being handed to one of them.
+func (s *state) _nextHopSourceRouted(from *peer, f *types.Frame) *peer {
+	nexthop := s._nextHopSourceRoutedPath(from, f)
+	if nexthop != nil && nexthop != s.r.local && nexthop.revision < revisionSourceRouting {
+		f.Type = types.TypeTraffic
+		f.Extra &^= types.FlagSourceRouteFailed
+		f.Path = f.Path[:0]
+	}
+	return nexthop
+}
+
+// _nextHopSourceRoutedPath takes the next port from the front of the frame's
+// path. If that port isn't connected any more, or the path has run out before
+// reaching the destination, the frame is flagged and is routed using the tree
+// from then on.
+func (s *state) _nextHopSourceRoutedPath(from *peer, f *types.Frame) *peer {
+	if f.Extra&types.FlagSourceRouteFailed == 0 {
+		if len(f.Path) > 0 {
+			port := f.Path[0]
+			f.Path = f.Path[1:]
+			if port != 0 && int(port) < len(s._peers) {
+				if p := s._peers[port]; p != nil && p.started.Load() {
+					return p
+				}
+			}
+		}
+		f.Extra |= types.FlagSourceRouteFailed
+		f.Path = f.Path[:0]
+	}
+	if len(f.Destination) == 0 {
+		return nil
+	}
+	nexthop, _ := s._nextHopsFor(from, f, f.Destination, f.Watermark, flowHash(f))
+	return nexthop
+}
+
+type loopDetectionKey struct {
+	port        types.SwitchPortID
+	source      types.PublicKey
+	destination types.PublicKey
+}
+
+type loopDetectionEntry struct {
+	count     int
+	firstSeen time.Time
+}
+
+// valid returns true if the entry is still inside the loop detection window.
+func (e *loopDetectionEntry) valid(now time.Time) bool {
+	return now.Sub(e.firstSeen) < loopDetectionWindow
+}
+
+// _detectLoop records that a traffic frame bounced back to us from the given
+// peer, either because we would send it straight back there or because it
+// has come back around with a worse watermark. The frame will be dropped
+// anyway, but if traffic between the same two nodes keeps bouncing back from
+// the same peer then it's a sign of a routing loop, so we count it.
+func (s *state) _detectLoop(from *peer, f *types.Frame) {
+	key := loopDetectionKey{
+		port:        from.port,
+		source:      f.SourceKey,
+		destination: f.DestinationKey,
+	}
+	now := s.r.clock.Now()
+	entry, ok := s._loopDetection[key]
+	if !ok || !entry.valid(now) {
+		if !ok && len(s._loopDetection) >= loopDetectionMaxEntries {
+			var oldest loopDetectionKey
+			var oldestSeen time.Time
+			for k, v := range s._loopDetection {
+				if oldestSeen.IsZero() || v.firstSeen.Before(oldestSeen) {
+					oldest, oldestSeen = k, v.firstSeen
+				}
+			}
+			delete(s._loopDetection, oldest)
+		}
+		entry = loopDetectionEntry{firstSeen: now}
+	}
+	entry.count++
+	s._loopDetection[key] = entry
+	if entry.count == loopDetectionThreshold+1 {
+		s.r._loopsDetected.Inc()
+	}
+}
+
 // _flood sends a frame to all of our connected peers. This is used for
 // flooding the wakeup broadcast to all of our direct peers.
 // Classic flooding works by sending frames to all other peers.
@@ -214,6 +512,10 @@ func (s *state) _flood(from *peer, f *types.Frame, floodType FloodType) {
 	for _, p := range floodCandidates {
 		frame := getFrame()
 		f.CopyInto(frame)
-		p.send(frame)
+		if !p.send(frame) {
+			framePool.Put(frame)
+			continue
+		}
+		s.r._frameTypeStats.sent(f.Type, from == s.r.local)
 	}
 }
@@ -0,0 +1,601 @@
+package router
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestForwardLoopDetection(t *testing.T) {
+	r := newTestRouter(t)
+	dest := types.PublicKey{3}
+	a := newTestPeer(r, 1, dest)
+	b := newTestPeer(r, 2, types.PublicKey{1})
+	addTestSnakeEntry(r, dest, a)
+
+	forward := func(from *peer) {
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		f.SourceKey = types.PublicKey{2}
+		f.DestinationKey = dest
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		f.Payload = append(f.Payload[:0], "same payload"...)
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._forward(from, f)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A sender that isn't looping can send the same payload as many times as
+	// it likes without anything being dropped.
+	for i := 0; i < loopDetectionThreshold+2; i++ {
+		forward(b)
+	}
+	if count := a.traffic.queuecount(); count != loopDetectionThreshold+2 {
+		t.Fatalf("expected %d frames to be forwarded, got %d", loopDetectionThreshold+2, count)
+	}
+	if loops := r._loopsDetected.Load(); loops != 0 {
+		t.Fatalf("expected no loops to be detected, got %d", loops)
+	}
+
+	// Our next-hop for the destination keeps sending the traffic back to
+	// us. Every frame should be dropped and, once past the threshold, it
+	// should be counted as a loop.
+	for i := 0; i < loopDetectionThreshold+2; i++ {
+		forward(a)
+	}
+	if count := a.traffic.queuecount(); count != loopDetectionThreshold+2 {
+		t.Fatalf("expected looping frames to be dropped, got %d forwarded", count-loopDetectionThreshold-2)
+	}
+	if loops := r._loopsDetected.Load(); loops != 1 {
+		t.Fatalf("expected 1 loop to be detected, got %d", loops)
+	}
+}
+
+func TestForwardBootstrapHopLimit(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	parentSK := newTestKey(t, 0xa0, 0xf0)
+	bootstrapSK := newTestKey(t, 0x80, 0xa0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	parent := newTestPeer(r, 1, testPublicKey(parentSK))
+	from := newTestPeer(r, 2, types.PublicKey{1})
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	forward := func(hopLimit uint8, seq types.Varu64) (forwarded *types.Frame) {
+		f := newTestBootstrap(t, bootstrapSK, root, seq)
+		f.HopLimit = hopLimit
+		var err error
+		phony.Block(r.state, func() {
+			before := parent.proto.queuecount()
+			if err = r.state._forward(from, f); err != nil {
+				return
+			}
+			if parent.proto.queuecount() > before {
+				for i := 0; i <= before; i++ {
+					forwarded = <-parent.proto.pop()
+					parent.proto.ack()
+				}
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	// The bootstrapping key is higher than ours, so the bootstrap should be
+	// forwarded up to our parent.
+	var err error
+	ann := newTestAnnouncement(t, root, rootSK, parentSK)
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(parent, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := types.Varu64(time.Now().UnixMilli())
+
+	f := forward(2, seq)
+	if f == nil {
+		t.Fatalf("expected bootstrap with hop limit 2 to be forwarded")
+	}
+	if f.HopLimit != 1 {
+		t.Fatalf("expected forwarded bootstrap to have hop limit 1, got %d", f.HopLimit)
+	}
+
+	if f := forward(1, seq+1); f != nil {
+		t.Fatalf("expected bootstrap with hop limit 1 to be dropped")
+	}
+	var entrySeq types.Varu64
+	phony.Block(r.state, func() {
+		if entry := r.state._table[virtualSnakeIndex{PublicKey: testPublicKey(bootstrapSK)}]; entry != nil {
+			entrySeq = entry.Watermark.Sequence
+		}
+	})
+	if entrySeq != seq {
+		t.Fatalf("dropped bootstrap should not have updated the routing table")
+	}
+
+	// Older nodes don't set a hop limit, so their bootstraps should still
+	// be forwarded without one.
+	f = forward(0, seq+2)
+	if f == nil {
+		t.Fatalf("expected bootstrap without a hop limit to be forwarded")
+	}
+	if f.HopLimit != 0 {
+		t.Fatalf("expected forwarded bootstrap to have no hop limit, got %d", f.HopLimit)
+	}
+}
+
+func TestForwardSourceRouted(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	parentSK := newTestKey(t, 0xa0, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	parent := newTestPeer(r, 1, testPublicKey(parentSK))
+	child := newTestPeer(r, 2, types.PublicKey{1})
+	from := newTestPeer(r, 3, types.PublicKey{2})
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	ann := newTestAnnouncement(t, root, rootSK, parentSK)
+	var err error
+	phony.Block(r.state, func() {
+		for _, p := range []*peer{parent, child, from} {
+			r.state._peers[p.port] = p
+		}
+		err = r.state._handleTreeAnnouncement(parent, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forward := func(path, destination types.Coordinates, via *peer) *types.Frame {
+		f := getFrame()
+		f.Type = types.TypeSourceRouted
+		f.Path = append(f.Path[:0], path...)
+		f.Destination = destination
+		f.SourceKey = types.PublicKey{2}
+		f.DestinationKey = types.PublicKey{3}
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		f.Payload = append(f.Payload[:0], path.String()...)
+		var err error
+		var queued int
+		var forwarded *types.Frame
+		phony.Block(r.state, func() {
+			if err = r.state._forward(from, f); err != nil {
+				return
+			}
+			if queued = via.traffic.queuecount(); queued == 1 {
+				forwarded = <-via.traffic.pop()
+				via.traffic.ack()
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if queued != 1 {
+			t.Fatalf("expected frame to be forwarded to port %d", via.port)
+		}
+		return forwarded
+	}
+
+	// The first port in the path is connected, so the frame should be sent
+	// to it even though the tree would route towards the parent instead.
+	f := forward(types.Coordinates{2, 7}, types.Coordinates{1}, child)
+	if f.Type != types.TypeSourceRouted {
+		t.Fatalf("expected frame to stay source-routed, got %s", f.Type)
+	}
+	if !f.Path.EqualTo(types.Coordinates{7}) {
+		t.Fatalf("expected remaining path [7], got %s", f.Path)
+	}
+	if f.Extra&types.FlagSourceRouteFailed != 0 {
+		t.Fatalf("frame should not be flagged")
+	}
+
+	// There's nothing connected on port 5, so the frame should fall back to
+	// tree routing towards the destination coordinates and be flagged.
+	f = forward(types.Coordinates{5, 7}, types.Coordinates{1}, parent)
+	if len(f.Path) != 0 {
+		t.Fatalf("expected path to be cleared, got %s", f.Path)
+	}
+	if f.Extra&types.FlagSourceRouteFailed == 0 {
+		t.Fatalf("frame should be flagged")
+	}
+
+	// A peer that predates source routing would drop the frame, so it should
+	// be sent to them as plain traffic instead.
+	legacy := newTestPeer(r, 4, types.PublicKey{4})
+	legacy.revision = revisionLegacy
+	phony.Block(r.state, func() {
+		r.state._peers[legacy.port] = legacy
+	})
+	f = forward(types.Coordinates{4, 7}, types.Coordinates{1}, legacy)
+	if f.Type != types.TypeTraffic {
+		t.Fatalf("expected frame to be sent as traffic, got %s", f.Type)
+	}
+	if len(f.Path) != 0 || f.Extra != 0 {
+		t.Fatalf("expected source routing information to be cleared")
+	}
+}
+
+func TestForwardBootstrapRateLimit(t *testing.T) {
+	const rate = 10
+	r := newTestRouter(t, RouterOptionBootstrapRateLimit(rate))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(count int) {
+		for i := 0; i < count; i++ {
+			var root types.Root
+			phony.Block(r.state, func() {
+				root = r.state._rootAnnouncement().Root
+			})
+			f := newTestBootstrap(t, sk, root, types.Varu64(time.Now().UnixMilli()))
+			phony.Block(r.state, func() {
+				err = r.state._forward(from, f)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// A burst beyond what the limit allows should have the excess dropped.
+	burst := rate * bootstrapRateLimitBurst
+	send(burst + 5)
+	if limited := r._limitedBootstraps.Load(); limited != 5 {
+		t.Fatalf("expected 5 bootstraps to be rate limited, got %d", limited)
+	}
+
+	// Bootstraps arriving at the steady rate should all be accepted.
+	for i := 0; i < 3; i++ {
+		time.Sleep(time.Second / rate)
+		send(1)
+	}
+	if limited := r._limitedBootstraps.Load(); limited != 5 {
+		t.Fatalf("expected no more bootstraps to be rate limited, got %d", limited-5)
+	}
+}
+
+// waitForTreeMaintenance waits for the first tree maintenance to run, since
+// it changes our root sequence, which would make bootstraps built before it
+// fail.
+func waitForTreeMaintenance(t *testing.T, r *Router) {
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		var sequence uint64
+		phony.Block(r.state, func() {
+			sequence = r.state._sequence
+		})
+		if sequence > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for tree maintenance")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestForwardBootstrapOverload(t *testing.T) {
+	const limit = 4
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), RouterOptionMaxBootstrapsPerInterval(limit))
+	waitForTreeMaintenance(t, r)
+	dest := newTestPeer(r, 1, types.PublicKey{3})
+	addTestSnakeEntry(r, dest.public, dest)
+	var root types.Root
+	phony.Block(r.state, func() {
+		root = r.state._rootAnnouncement().Root
+	})
+
+	// Flood bootstraps from several peers, each from a different key below
+	// ours so that they all end at us, with some traffic in the middle.
+	froms := []*peer{
+		newTestPeer(r, 2, types.PublicKey{1}),
+		newTestPeer(r, 3, types.PublicKey{2}),
+		newTestPeer(r, 4, types.PublicKey{4}),
+	}
+	var frames []*types.Frame
+	for i := 0; i < limit*4; i++ {
+		sk := newTestKey(t, byte(i*4), byte(i*4+4))
+		frames = append(frames, newTestBootstrap(t, sk, root, types.Varu64(time.Now().UnixMilli())))
+	}
+	traffic := getFrame()
+	traffic.Type = types.TypeTraffic
+	traffic.SourceKey = types.PublicKey{2}
+	traffic.DestinationKey = dest.public
+	traffic.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	late := newTestBootstrap(t, newTestKey(t, 0x3c, 0x40), root, types.Varu64(time.Now().UnixMilli()))
+
+	var errs []error
+	var entries int
+	phony.Block(r.state, func() {
+		for i, f := range frames {
+			errs = append(errs, r.state._forward(froms[i%len(froms)], f))
+			if i == len(frames)/2 {
+				errs = append(errs, r.state._forward(froms[0], traffic))
+			}
+		}
+		entries = len(r.state._table)
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the first bootstraps up to the limit should have been handled,
+	// and the traffic should still have been forwarded.
+	if entries != limit+1 {
+		t.Fatalf("expected %d bootstraps to be handled, got %d", limit, entries-1)
+	}
+	if shed := r._shedBootstraps.Load(); shed != limit*3 {
+		t.Fatalf("expected %d bootstraps to be shed, got %d", limit*3, shed)
+	}
+	if dest.traffic.queuecount() != 1 {
+		t.Fatalf("expected traffic to be forwarded during the bootstrap flood")
+	}
+
+	// After the next SNEK maintenance, bootstraps should be handled again.
+	var err error
+	phony.Block(r.state, func() {
+		r.state._maintainSnake()
+		err = r.state._forward(froms[0], late)
+		entries = len(r.state._table)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries != limit+2 {
+		t.Fatalf("expected bootstraps to be handled again after maintenance")
+	}
+}
+
+func TestForwardDropReasons(t *testing.T) {
+	dest := types.PublicKey{3}
+	traffic := func() *types.Frame {
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		f.SourceKey = types.PublicKey{2}
+		f.DestinationKey = dest
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		return f
+	}
+	bootstrap := func(t *testing.T, r *Router, sk ed25519.PrivateKey, seq types.Varu64) *types.Frame {
+		var root types.Root
+		phony.Block(r.state, func() {
+			root = r.state._rootAnnouncement().Root
+		})
+		return newTestBootstrap(t, sk, root, seq)
+	}
+
+	for _, tc := range []struct {
+		reason DropReason
+		opts   []RouterOption
+		// setup prepares the router and returns the frames to send and the
+		// peer that they should arrive from.
+		setup func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame)
+	}{
+		{DropNoNextHop, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			// A source-routed frame whose path fails, with no coordinates to
+			// fall back to, has nowhere to go.
+			f := traffic()
+			f.Type = types.TypeSourceRouted
+			f.Path = append(f.Path[:0], 9)
+			return b, []*types.Frame{f}
+		}},
+		{DropLoopDetected, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			addTestSnakeEntry(r, dest, a)
+			return a, []*types.Frame{traffic()}
+		}},
+		{DropQueueFull, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			addTestSnakeEntry(r, dest, a)
+			a.traffic = nil
+			return b, []*types.Frame{traffic()}
+		}},
+		{DropHopLimit, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			addTestSnakeEntry(r, dest, a)
+			r.EnableHopLimiting()
+			f := traffic()
+			f.HopLimit = 1
+			return b, []*types.Frame{f}
+		}},
+		{DropFiltered, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			r.InjectPacketFilter(func(types.PublicKey, *types.Frame) bool { return true })
+			return b, []*types.Frame{traffic()}
+		}},
+		{DropUnknownType, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			f := traffic()
+			f.Type = types.FrameType(0xff)
+			return b, []*types.Frame{f}
+		}},
+		{DropBootstrapRejected, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			// A bootstrap signed a long time ago is too old to be accepted.
+			return b, []*types.Frame{bootstrap(t, r, newTestKey(t, 0x00, 0x40), 1)}
+		}},
+		{DropRateLimited, []RouterOption{RouterOptionBootstrapRateLimit(1)}, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			// Each bootstrap comes from a higher key than the last, all below
+			// ours, so that none of them is routed towards an earlier one.
+			var frames []*types.Frame
+			for i := 0; i < bootstrapRateLimitBurst+1; i++ {
+				sk := newTestKey(t, byte(i*0x10), byte(i*0x10+0x10))
+				frames = append(frames, bootstrap(t, r, sk, types.Varu64(time.Now().UnixMilli())))
+			}
+			return b, frames
+		}},
+		{DropOverloaded, []RouterOption{RouterOptionMaxBootstrapsPerInterval(1)}, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			return b, []*types.Frame{
+				bootstrap(t, r, newTestKey(t, 0x00, 0x20), types.Varu64(time.Now().UnixMilli())),
+				bootstrap(t, r, newTestKey(t, 0x20, 0x40), types.Varu64(time.Now().UnixMilli())),
+			}
+		}},
+		{DropNoDestination, nil, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			// Without a destination, the frame would otherwise be routed
+			// towards the lowest key that we know about.
+			addTestSnakeEntry(r, types.PublicKey{}, a)
+			f := traffic()
+			f.DestinationKey = types.PublicKey{}
+			return b, []*types.Frame{f}
+		}},
+		{DropExpired, []RouterOption{RouterOptionMaxFrameAge(time.Minute)}, func(t *testing.T, r *Router, a, b *peer) (*peer, []*types.Frame) {
+			addTestSnakeEntry(r, dest, a)
+			sk := newTestKey(t, 0x00, 0x40)
+			return b, []*types.Frame{newTestTimestampedTraffic(t, sk, dest, time.Now().Add(-time.Hour), nil)}
+		}},
+	} {
+		t.Run(tc.reason.String(), func(t *testing.T) {
+			r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), tc.opts...)
+			waitForTreeMaintenance(t, r)
+			a := newTestPeer(r, 1, dest)
+			b := newTestPeer(r, 2, types.PublicKey{1})
+			from, frames := tc.setup(t, r, a, b)
+			for _, f := range frames {
+				var err error
+				phony.Block(r.state, func() {
+					err = r.state._forward(from, f)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			for reason, count := range r.DroppedFrames() {
+				switch {
+				case reason == tc.reason && count != 1:
+					t.Fatalf("expected 1 frame to be dropped with reason %s, got %d", reason, count)
+				case reason != tc.reason && count != 0:
+					t.Fatalf("expected no frames to be dropped with reason %s, got %d", reason, count)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardFallbackNextHop(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	otherSK := newTestKey(t, 0xa0, 0xf0)
+	bootstrapSK := newTestKey(t, 0x80, 0xa0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	parent := newTestPeer(r, 1, testPublicKey(rootSK))
+	other := newTestPeer(r, 2, testPublicKey(otherSK))
+	from := newTestPeer(r, 3, types.PublicKey{1})
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	parentAnn := newTestAnnouncement(t, root, rootSK)
+	otherAnn := newTestAnnouncement(t, root, rootSK, otherSK)
+
+	var err error
+	phony.Block(r.state, func() {
+		for _, p := range []*peer{parent, other, from} {
+			r.state._peers[p.port] = p
+		}
+		if err = r.state._handleTreeAnnouncement(parent, parentAnn); err != nil {
+			return
+		}
+		err = r.state._handleTreeAnnouncement(other, otherAnn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The other peer is the closest to the bootstrapping key so would be the
+	// best next-hop, but its queue is full, so the bootstrap should go to
+	// our parent instead.
+	// The queue is replaced from within the state actor, since that is where
+	// frames are queued for the peer.
+	f := newTestBootstrap(t, bootstrapSK, root, types.Varu64(time.Now().UnixMilli()))
+	bootstrapKey := f.DestinationKey
+	var filled bool
+	var preferred *peer
+	var entry *virtualSnakeEntry
+	phony.Block(r.state, func() {
+		other.proto = newFIFOQueue(1, r.log)
+		if filled = other.proto.push(getFrame()); !filled {
+			return
+		}
+		preferred, _ = r.state._nextHopsSNEK(bootstrapKey, types.TypeBootstrap, f.Watermark)
+		if err = r.state._forward(from, f); err != nil {
+			return
+		}
+		entry = r.state._table[virtualSnakeIndex{PublicKey: bootstrapKey}]
+	})
+	if !filled {
+		t.Fatalf("failed to fill queue")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preferred != other {
+		t.Fatalf("expected the other peer to be the preferred next-hop")
+	}
+
+	var forwarded bool
+	for n := parent.proto.queuecount(); n > 0; n-- {
+		frame := <-parent.proto.pop()
+		parent.proto.ack()
+		if frame.Type == types.TypeBootstrap && frame.DestinationKey == bootstrapKey {
+			forwarded = true
+		}
+	}
+	if !forwarded {
+		t.Fatalf("expected the bootstrap to be forwarded to our parent")
+	}
+	if entry == nil || entry.Destination != parent {
+		t.Fatalf("expected the routing table entry to lead to our parent")
+	}
+	if drops := r.DroppedFrames()[DropQueueFull]; drops != 0 {
+		t.Fatalf("expected no frames to be dropped, got %d", drops)
+	}
+}
+
+func TestForwardFrameTraceCallback(t *testing.T) {
+	dest := types.PublicKey{3}
+	traces := make(chan ForwardedFrame, 1)
+	r := newTestRouter(t, RouterOptionOnFrameForward(func(frame ForwardedFrame) {
+		if frame.DestinationKey == dest {
+			traces <- frame
+		}
+	}))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	to := newTestPeer(r, 2, types.PublicKey{2})
+	addTestSnakeEntry(r, dest, to)
+
+	f := getFrame()
+	f.Type = types.TypeTraffic
+	f.SourceKey = types.PublicKey{4}
+	f.DestinationKey = dest
+	f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	var err error
+	phony.Block(r.state, func() {
+		err = r.state._forward(from, f)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case trace := <-traces:
+		expected := ForwardedFrame{
+			Type:           types.TypeTraffic,
+			From:           from.public,
+			FromPort:       from.port,
+			To:             to.public,
+			ToPort:         to.port,
+			SourceKey:      types.PublicKey{4},
+			DestinationKey: dest,
+		}
+		if trace.Type != expected.Type || trace.From != expected.From || trace.FromPort != expected.FromPort ||
+			trace.To != expected.To || trace.ToPort != expected.ToPort ||
+			trace.SourceKey != expected.SourceKey || trace.DestinationKey != expected.DestinationKey {
+			t.Fatalf("expected %+v, got %+v", expected, trace)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatalf("timed out waiting for the frame forwarding callback")
+	}
+}
@@ -16,6 +16,9 @@ package router
 
 import (
 	"crypto/ed25519"
+	"fmt"
+	"math/big"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/pinecone/types"
@@ -38,13 +41,22 @@ type virtualSnakeEntry struct {
 	Watermark   types.VirtualSnakeWatermark `json:"watermark"`
 	LastSeen    time.Time                   `json:"last_seen"`
 	Root        types.Root                  `json:"root"`
+	expiry      time.Duration               // If zero, virtualSnakeNeighExpiryPeriod
+	static      bool                        // Added by AddStaticSnakeRoute, never expires
 }
 
 // valid returns true if the update hasn't expired, or false if it has. It is
 // required for updates to time out eventually, in the case that paths don't get
-// torn down properly for some reason.
-func (e *virtualSnakeEntry) valid() bool {
-	return time.Since(e.LastSeen) < virtualSnakeNeighExpiryPeriod
+// torn down properly for some reason. Static routes never expire.
+func (e *virtualSnakeEntry) valid(now time.Time) bool {
+	if e.static {
+		return true
+	}
+	expiry := e.expiry
+	if expiry <= 0 {
+		expiry = virtualSnakeNeighExpiryPeriod
+	}
+	return now.Sub(e.LastSeen) < expiry
 }
 
 // _maintainSnake is responsible for working out if we need to send bootstraps
@@ -54,34 +66,73 @@ func (s *state) _maintainSnake() {
 	case <-s.r.context.Done():
 		return
 	default:
-		defer s._maintainSnakeIn(virtualSnakeMaintainInterval)
+		defer s._maintainSnakeIn(s.r.snakeMaintainInterval)
 	}
+	s.r._snakeWatch.ran()
+
+	// Start counting bootstraps afresh for RouterOptionMaxBootstrapsPerInterval.
+	s._bootstraps = 0
 
 	// Work out if we are able to bootstrap. If we are the root node then
 	// we don't send bootstraps, since there's nowhere for them to go —
 	// bootstraps are sent up to the next ascending node, but as the root,
 	// we already have the highest key on the network.
 	rootAnn := s._rootAnnouncement()
+	now := s.r.clock.Now()
 
-	// The descending node is the node with the next lowest key.
+	// The descending node is the node with the next lowest key. If it has
+	// gone away then we'll promote the next-best backup candidate, if any.
 	if desc := s._descending; desc != nil {
 		switch {
-		case !desc.valid():
+		case !desc.valid(now):
+			fallthrough
+		case !desc.Source.started.Load():
 			fallthrough
 		case !desc.Root.EqualTo(&rootAnn.Root):
-			s._setDescendingNode(nil)
+			// The descending node bootstrapped to us using a different root
+			// to the one that we now have, so we can't be sure that it still
+			// shares our tree. We stop treating it as our descending node
+			// straight away rather than waiting for it to expire. The path
+			// itself is left in the routing table, since it may still carry
+			// traffic, until it expires or is replaced by a bootstrap that
+			// uses the new root. There's no teardown to send, since paths
+			// are soft state.
+			s._setDescendingNode(s._nextDescendingBackup())
 		}
 	}
 
-	// Clean up any paths that are older than the expiry period.
+	// Clean up any paths that are older than the expiry period, or that go
+	// via a peering that has stopped. The latter will normally have been
+	// cleaned up already when the peering was disconnected, but this makes
+	// sure that they don't hang around in the meantime. Paths for bootstraps
+	// that had nowhere further to go have no destination.
 	for k, v := range s._table {
-		if !v.valid() {
+		switch {
+		case !v.valid(now):
+			fallthrough
+		case !v.Source.started.Load():
+			fallthrough
+		case v.Destination != nil && !v.Destination.started.Load():
 			s._removeRouteEntry(k)
 		}
 	}
 
+	// Keep track of when our ascending neighbour last changed. Unlike the
+	// descending node, it isn't stored anywhere, so we have to look for it.
+	ours := s.r.PublicKey()
+	var ascending types.PublicKey
+	if p, w := s._nextHopsSNEK(ours, types.TypeBootstrap, types.VirtualSnakeWatermark{
+		PublicKey: types.FullMask,
+	}); p != nil && p != s.r.local && w.PublicKey != ours {
+		ascending = w.PublicKey
+	}
+	if ascending != s._ascendingKey {
+		s._ascendingKey = ascending
+		s._snakeChanged = now
+	}
+
 	// Send a new bootstrap.
-	if time.Since(s._lastbootstrap) >= virtualSnakeBootstrapInterval {
+	if s.r.clock.Now().Sub(s._lastbootstrap) >= virtualSnakeBootstrapInterval {
 		s._bootstrapNow()
 	}
 }
@@ -90,7 +141,17 @@ func (s *state) _maintainSnake() {
 // the next maintenance interval. This is better than calling _bootstrapNow
 // directly which might cause more protocol traffic than necessary.
 func (s *state) _bootstrapSoon() {
-	s._lastbootstrap = time.Now().Add(-virtualSnakeBootstrapInterval)
+	s._lastbootstrap = s.r.clock.Now().Add(-virtualSnakeBootstrapInterval)
+}
+
+// _rebootstrap runs SNEK maintenance straight away and causes it to send a
+// bootstrap, unless we have already bootstrapped very recently.
+func (s *state) _rebootstrap() {
+	if s.r.clock.Now().Sub(s._lastbootstrap) < virtualSnakeRebootstrapInterval {
+		return
+	}
+	s._bootstrapSoon()
+	s._maintainSnakeIn(0)
 }
 
 // _bootstrapNow is responsible for sending a bootstrap message to the network.
@@ -109,16 +170,17 @@ func (s *state) _bootstrapNow() {
 	defer frameBufferPool.Put(b)
 	bootstrap := types.VirtualSnakeBootstrap{
 		Root:     ann.Root,
-		Sequence: types.Varu64(time.Now().UnixMilli()),
+		Sequence: types.Varu64(s.r.clock.Now().UnixMilli()),
 	}
 	if s.r.secure {
 		protected, err := bootstrap.ProtectedPayload()
 		if err != nil {
 			return
 		}
+		private := s.r.PrivateKey()
 		copy(
 			bootstrap.Signature[:],
-			ed25519.Sign(s.r.private[:], protected),
+			ed25519.Sign(private[:], protected),
 		)
 	}
 	n, err := bootstrap.MarshalBinary(b[:])
@@ -131,7 +193,8 @@ func (s *state) _bootstrapNow() {
 	// mean that the message gets forwarded up to the next highest key from ours.
 	send := getFrame()
 	send.Type = types.TypeBootstrap
-	send.DestinationKey = s.r.public
+	send.DestinationKey = s.r.PublicKey()
+	send.HopLimit = virtualSnakeBootstrapHopLimit
 	send.Source = s._coords()
 	send.Payload = append(send.Payload[:0], b[:n]...)
 	send.Watermark = types.VirtualSnakeWatermark{
@@ -141,11 +204,18 @@ func (s *state) _bootstrapNow() {
 
 	// Bootstrap messages are routed using SNEK routing with special rules for
 	// bootstrap packets.
-	if p, w := s._nextHopsSNEK(send.DestinationKey, types.TypeBootstrap, send.Watermark); p != nil && p.proto != nil {
+	if p, w := s._nextHopsFor(s.r.local, send, send.DestinationKey, send.Watermark, 0); p != nil {
+		watermark := send.Watermark
 		send.Watermark = w
-		p.proto.push(send)
+		if s._sendWithFallbacks(s.r.local, p, send, send.DestinationKey, watermark, 0) == nil {
+			framePool.Put(send)
+		} else {
+			s.r._frameTypeStats.sent(types.TypeBootstrap, true)
+		}
+	} else {
+		framePool.Put(send)
 	}
-	s._lastbootstrap = time.Now()
+	s._lastbootstrap = s.r.clock.Now()
 }
 
 type virtualSnakeNextHopParams struct {
@@ -158,24 +228,72 @@ type virtualSnakeNextHopParams struct {
 	lastAnnouncement  *rootAnnouncementWithTime
 	peerAnnouncements announcementTable
 	snakeRoutes       virtualSnakeTable
+	now               time.Time
+}
+
+type snakeNextHopCacheKey struct {
+	destinationKey types.PublicKey
+	watermark      types.VirtualSnakeWatermark
+}
+
+type snakeNextHopCacheEntry struct {
+	peer      *peer
+	watermark types.VirtualSnakeWatermark
+	route     *virtualSnakeEntry // The routing table entry used, if any
 }
 
-// _nextHopsSNEK locates the best next-hop for a given SNEK-routed frame.
-func (s *state) _nextHopsSNEK(dest types.PublicKey, frameType types.FrameType, watermark types.VirtualSnakeWatermark) (*peer, types.VirtualSnakeWatermark) {
-	return getNextHopSNEK(virtualSnakeNextHopParams{
+// _nextHopsSNEK locates the best next-hop for a given SNEK-routed frame,
+// ignoring any excluded peers. Since a node forwarding a stream of frames
+// will see the same destination and watermark over and over, the answer
+// for frames other than bootstraps is cached until _invalidateSnakeCache
+// is called.
+func (s *state) _nextHopsSNEK(dest types.PublicKey, frameType types.FrameType, watermark types.VirtualSnakeWatermark, excluded ...*peer) (*peer, types.VirtualSnakeWatermark) {
+	now := s.r.clock.Now()
+	cacheable := frameType != types.TypeBootstrap && len(excluded) == 0
+	key := snakeNextHopCacheKey{dest, watermark}
+	if cached, ok := s._snakeCache[key]; ok && cacheable {
+		// The peer might have stopped, or the route might have expired,
+		// without anything having been removed yet.
+		if cached.peer.started.Load() && (cached.route == nil || cached.route.valid(now)) {
+			return cached.peer, cached.watermark
+		}
+		delete(s._snakeCache, key)
+	}
+	nexthop, w := getNextHopSNEK(virtualSnakeNextHopParams{
 		frameType == types.TypeBootstrap,
 		dest,
-		s.r.public,
+		s.r.PublicKey(),
 		watermark,
 		s._parent,
 		s.r.local,
 		s._rootAnnouncement(),
 		s._announcements,
 		s._table,
-	})
+		now,
+	}, excluded...)
+	if cacheable && nexthop != nil {
+		if s._snakeCache == nil || len(s._snakeCache) >= maxSnakeNextHopCacheEntries {
+			s._snakeCache = make(map[snakeNextHopCacheKey]snakeNextHopCacheEntry)
+		}
+		entry := snakeNextHopCacheEntry{peer: nexthop, watermark: w}
+		if route, ok := s._table[virtualSnakeIndex{PublicKey: w.PublicKey}]; ok && route.Source == nexthop {
+			entry.route = route
+		}
+		s._snakeCache[key] = entry
+	}
+	return nexthop, w
 }
 
-func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnakeWatermark) {
+// _invalidateSnakeCache forgets the next-hops cached by _nextHopsSNEK. It
+// must be called whenever anything that getNextHopSNEK looks at changes,
+// other than the passing of time or a peer stopping.
+func (s *state) _invalidateSnakeCache() {
+	if len(s._snakeCache) > 0 {
+		s._snakeCache = nil
+	}
+}
+
+func getNextHopSNEK(params virtualSnakeNextHopParams, excluded ...*peer) (*peer, types.VirtualSnakeWatermark) {
 	// If the message isn't a bootstrap message and the destination is for our
 	// own public key, handle the frame locally — it's basically loopback.
 	if !params.isBootstrap && params.publicKey == params.destinationKey {
@@ -198,20 +316,26 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 		bestKey, bestSeq, bestPeer, bestAnn = key, seq, p, params.peerAnnouncements[p]
 	}
 	// newCheckedCandidate performs some sanity checks on the candidate before
-	// passing it to newCandidate.
+	// passing it to newCandidate. If more than one peer offers the same key
+	// then, so that the choice doesn't depend on map iteration order, the
+	// peer with the lowest port number wins, unless the key was first found
+	// via our parent, in which case the parent is kept.
 	newCheckedCandidate := func(candidate types.PublicKey, seq types.Varu64, p *peer) {
 		switch {
 		case !params.isBootstrap && candidate == destKey && bestKey != destKey:
 			newCandidate(candidate, seq, p)
 		case util.DHTOrdered(destKey, candidate, bestKey):
 			newCandidate(candidate, seq, p)
+		case candidate == bestKey && bestPeer != nil && bestPeer != params.selfPeer &&
+			bestPeer != params.parentPeer && p.port < bestPeer.port:
+			newCandidate(candidate, seq, p)
 		}
 	}
 
 	// Check if we can use the path to the root via our parent as a starting
 	// point. We can't do this if we are the root node as there would be no
 	// parent or ascending paths.
-	if params.parentPeer != nil && params.parentPeer.started.Load() {
+	if params.parentPeer != nil && params.parentPeer.started.Load() && !peerExcluded(params.parentPeer, excluded) {
 		switch {
 		case params.isBootstrap && bestKey == destKey:
 			// Bootstraps always start working towards thear root so that they
@@ -235,7 +359,7 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 	// Check all of the ancestors of our direct peers too, that is, all nodes
 	// between our direct peer and the root node.
 	for p, ann := range params.peerAnnouncements {
-		if !p.started.Load() {
+		if !p.started.Load() || peerExcluded(p, excluded) {
 			continue
 		}
 		for _, hop := range ann.Signatures {
@@ -249,7 +373,7 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 	// to the peer via our peering with them as opposed to routing via our
 	// parent port.
 	for p := range params.peerAnnouncements {
-		if !p.started.Load() {
+		if !p.started.Load() || peerExcluded(p, excluded) {
 			continue
 		}
 		if peerKey := p.public; bestKey == peerKey {
@@ -264,7 +388,7 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 	// higher one, this is effectively looking for paths that descend through
 	// keyspace toward lower keys rather than ascend toward higher ones.
 	for _, entry := range params.snakeRoutes {
-		if !entry.Source.started.Load() || !entry.valid() {
+		if !entry.Source.started.Load() || !entry.valid(params.now) || peerExcluded(entry.Source, excluded) {
 			continue
 		}
 		if entry.Watermark.WorseThan(params.watermark) {
@@ -279,7 +403,7 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 		for p, ann := range params.peerAnnouncements {
 			peerKey := p.public
 			switch {
-			case bestKey != peerKey:
+			case bestKey != peerKey || peerExcluded(p, excluded):
 				continue
 			case p.peertype < bestPeer.peertype:
 				// Prefer faster classes of links if possible.
@@ -299,6 +423,72 @@ func getNextHopSNEK(params virtualSnakeNextHopParams) (*peer, types.VirtualSnake
 	}
 }
 
+// _addStaticRoute adds a routing table entry for the given key that sends
+// traffic to it through the peer on the given port, replacing any entry
+// that we already have for that key. The entry never expires but is removed
+// if the peering goes away.
+func (s *state) _addStaticRoute(key types.PublicKey, port types.SwitchPortID) error {
+	if port == 0 || int(port) >= len(s._peers) {
+		return fmt.Errorf("invalid port %d", port)
+	}
+	p := s._peers[port]
+	if p == nil || !p.started.Load() {
+		return fmt.Errorf("no peer connected on port %d", port)
+	}
+	index := virtualSnakeIndex{PublicKey: key}
+	if desc := s._descending; desc != nil && desc.PublicKey == key {
+		s._setDescendingNode(s._nextDescendingBackup())
+	}
+	s._addRouteEntry(index, &virtualSnakeEntry{
+		virtualSnakeIndex: &index,
+		Source:            p,
+		Destination:       s.r.local,
+		LastSeen:          s.r.clock.Now(),
+		Root:              s._rootAnnouncement().Root,
+		static:            true,
+		Watermark: types.VirtualSnakeWatermark{
+			PublicKey: key,
+		},
+	})
+	return nil
+}
+
+// _removeStaticRoute removes a static route added by _addStaticRoute,
+// returning false if there wasn't one for the given key.
+func (s *state) _removeStaticRoute(key types.PublicKey) bool {
+	index := virtualSnakeIndex{PublicKey: key}
+	if entry, ok := s._table[index]; !ok || !entry.static {
+		return false
+	}
+	s._removeRouteEntry(index)
+	return true
+}
+
+// _refreshRouteEntry updates the last seen time of the routing table entry
+// for the node that sent a traffic frame, but only if the frame arrived from
+// the peer that the entry leads back to. Traffic that we forward towards a
+// node says nothing about whether it is still there, since senders will keep
+// trying to reach a node that has gone away, and refreshing on that would
+// keep a broken path alive forever. Traffic coming back from the node along
+// the path shows that both are still alive.
+func (s *state) _refreshRouteEntry(from *peer, source types.PublicKey) {
+	entry, ok := s._table[virtualSnakeIndex{PublicKey: source}]
+	if !ok || entry.Source != from || !entry.valid(s.r.clock.Now()) {
+		return
+	}
+	entry.LastSeen = s.r.clock.Now()
+}
+
+// bootstrapIsFresh returns true if the timestamp carried in the bootstrap
+// sequence number is within the given window of the given time.
+func bootstrapIsFresh(seq types.Varu64, now time.Time, window time.Duration) bool {
+	drift := now.Sub(time.UnixMilli(int64(seq)))
+	if drift < 0 {
+		drift = -drift
+	}
+	return drift < window
+}
+
 // _handleBootstrap is called in response to receiving a bootstrap packet.
 // Returns true if the bootstrap was handled and false otherwise.
 func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
@@ -324,6 +514,17 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		}
 	}
 
+	// The bootstrap sequence number is the time at which the bootstrap was
+	// sent and is covered by the signature, so we can use it to spot stale
+	// bootstraps that are being replayed to us. A bootstrap older than the
+	// lifetime of a routing table entry would be of no use anyway. This does
+	// rely on the clocks of both nodes roughly agreeing, so count the drops
+	// to make it possible to spot a node with a badly skewed clock.
+	if !bootstrapIsFresh(bootstrap.Sequence, s.r.clock.Now(), s.r.snakeNeighExpiry) {
+		s.r._staleBootstraps.Inc()
+		return false
+	}
+
 	// Check that the root key and sequence number in the update match our
 	// current root, otherwise we won't be able to route back to them using
 	// tree routing anyway. If they don't match, silently drop the bootstrap.
@@ -338,6 +539,11 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 	}
 	if existing, ok := s._table[index]; ok {
 		switch {
+		case existing.static:
+			// The operator has pinned the route to this node, so it takes
+			// precedence over whatever the bootstrap would tell us. Let the
+			// bootstrap carry on to its destination all the same.
+			return true
 		case !existing.Root.EqualTo(&bootstrap.Root):
 			break // the root is different
 		case bootstrap.Sequence <= existing.Watermark.Sequence:
@@ -346,12 +552,21 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		}
 	}
 
+	// If this is a new entry and the routing table is already full then we
+	// need to make room for it by evicting an existing entry first.
+	if _, ok := s._table[index]; !ok && len(s._table) >= s.r.maxSnakeEntries {
+		if evict, ok := densestSnakeEntry(s._table, s._descendingNodes()...); ok {
+			s._removeRouteEntry(evict)
+		}
+	}
+
 	entry := &virtualSnakeEntry{
 		virtualSnakeIndex: &index,
 		Source:            from,
 		Destination:       to,
-		LastSeen:          time.Now(),
+		LastSeen:          s.r.clock.Now(),
 		Root:              bootstrap.Root,
+		expiry:            s.r.snakeNeighExpiry,
 		Watermark: types.VirtualSnakeWatermark{
 			PublicKey: index.PublicKey,
 			Sequence:  bootstrap.Sequence,
@@ -360,29 +575,34 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 	s._addRouteEntry(index, entry)
 
 	// Now let's see if this is a suitable descending entry.
+	ours := s.r.PublicKey()
 	update := false
 	desc := s._descending
+	accept := !s._draining && (s.r.acceptDescending == nil || s.r.acceptDescending(rx.DestinationKey))
 	switch {
+	case !accept:
+		// The operator doesn't want us to anchor this key, or we are
+		// draining and shouldn't anchor any new paths.
 	case !root.Root.EqualTo(&bootstrap.Root):
 		// The root key in the bootstrap doesn't match our own key
 		// so it is quite possible that tree routing would fail.
-	case !util.LessThan(rx.DestinationKey, s.r.public):
+	case !util.LessThan(rx.DestinationKey, ours):
 		// The bootstrapping key should be less than ours but it isn't.
-	case desc != nil && desc.valid():
+	case desc != nil && desc.valid(s.r.clock.Now()):
 		// We already have a descending entry and it hasn't expired.
 		switch {
 		case desc.PublicKey == rx.DestinationKey:
 			// We've received another bootstrap from our direct descending node.
 			// Accept the update as this is OK.
 			update = true
-		case util.DHTOrdered(desc.PublicKey, rx.DestinationKey, s.r.public):
+		case util.DHTOrdered(desc.PublicKey, rx.DestinationKey, ours):
 			// The bootstrapping node is closer to us than our previous descending
 			// node was.
 			update = true
 		}
-	case desc == nil || !desc.valid():
+	case desc == nil || !desc.valid(s.r.clock.Now()):
 		// We don't have a descending entry, or we did but it expired.
-		if util.LessThan(rx.DestinationKey, s.r.public) {
+		if util.LessThan(rx.DestinationKey, ours) {
 			// The bootstrapping key is less than ours so we'll acknowledge it.
 			update = true
 		}
@@ -391,8 +611,250 @@ func (s *state) _handleBootstrap(from, to *peer, rx *types.Frame) bool {
 		// there's a node out there that hasn't converged to a closer node
 		// yet, so we'll just ignore the bootstrap.
 	}
-	if update {
+	switch {
+	case update:
+		// If we are replacing a different descending node then keep it
+		// around as a backup candidate in case the new one goes away.
+		if desc != nil && desc.PublicKey != index.PublicKey {
+			s._addDescendingBackup(*desc.virtualSnakeIndex)
+		}
 		s._setDescendingNode(s._table[index])
+	case accept && root.Root.EqualTo(&bootstrap.Root) && util.LessThan(rx.DestinationKey, ours):
+		// The bootstrapping node would be a suitable descending node but
+		// it isn't the closest one that we know about, so remember it as a
+		// backup candidate instead.
+		s._addDescendingBackup(index)
+	}
+	if accept && root.Root.EqualTo(&bootstrap.Root) && util.LessThan(rx.DestinationKey, ours) {
+		s._addDescendingSlot(index)
 	}
 	return true
 }
+
+// _addDescendingBackup remembers a backup descending candidate. The backups
+// are kept ordered with the closest key to our own first, and only the best
+// virtualSnakeDescendingBackups candidates are kept.
+func (s *state) _addDescendingBackup(index virtualSnakeIndex) {
+	backups := make([]virtualSnakeIndex, 0, len(s._descBackups)+1)
+	backups = append(backups, index)
+	for _, backup := range s._descBackups {
+		if backup != index {
+			backups = append(backups, backup)
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return util.LessThan(backups[j].PublicKey, backups[i].PublicKey)
+	})
+	if len(backups) > virtualSnakeDescendingBackups {
+		backups = backups[:virtualSnakeDescendingBackups]
+	}
+	s._descBackups = backups
+}
+
+// _nextDescendingBackup removes and returns the best backup descending
+// candidate. The usual descending checks are run again on each candidate
+// since they may have gone stale since they were remembered. Returns nil if
+// there are no suitable candidates left.
+func (s *state) _nextDescendingBackup() *virtualSnakeEntry {
+	root := s._rootAnnouncement()
+	for len(s._descBackups) > 0 {
+		index := s._descBackups[0]
+		s._descBackups = s._descBackups[1:]
+		entry, ok := s._table[index]
+		switch {
+		case !ok:
+			continue // the path has gone away
+		case s._descending != nil && s._descending.PublicKey == index.PublicKey:
+			continue // this is the descending node we are replacing
+		case !entry.valid(s.r.clock.Now()):
+			continue // the path has expired
+		case entry.static:
+			continue // the route was pinned, not bootstrapped
+		case !entry.Source.started.Load():
+			continue // the path went via a peering that has stopped
+		case !entry.Root.EqualTo(&root.Root):
+			continue // the path was set up using a different root
+		case !util.LessThan(index.PublicKey, s.r.PublicKey()):
+			continue // the key isn't lower than ours
+		}
+		return entry
+	}
+	return nil
+}
+
+// descendingSlot returns which of the extra descending slots covers the given
+// key, which must be lower than ours, or -1 if none do. Slot 0 covers the
+// lower half of the keyspace below our key, slot 1 the next quarter, and so
+// on, getting closer to our key each time.
+func descendingSlot(ours, key types.PublicKey, slots int) int {
+	o := new(big.Int).SetBytes(ours[:])
+	d := new(big.Int).Sub(o, new(big.Int).SetBytes(key[:]))
+	for i := 0; i < slots; i++ {
+		if d.Cmp(new(big.Int).Rsh(o, uint(i+1))) > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// _descendingSlotEntry returns the routing table entry for the node in the
+// given extra descending slot, or nil if the slot is empty or the node is no
+// longer suitable.
+func (s *state) _descendingSlotEntry(slot int) *virtualSnakeEntry {
+	index := s._descSlots[slot]
+	if index.PublicKey.IsEmpty() {
+		return nil
+	}
+	entry, ok := s._table[index]
+	root := s._rootAnnouncement()
+	if !ok || !entry.valid(s.r.clock.Now()) || !entry.Source.started.Load() || !entry.Root.EqualTo(&root.Root) {
+		return nil
+	}
+	return entry
+}
+
+// _addDescendingSlot puts a node that has bootstrapped to us, and that has a
+// lower key than ours, into the extra descending slot that covers its key if
+// it is closer to us than the node already there.
+func (s *state) _addDescendingSlot(index virtualSnakeIndex) {
+	ours := s.r.PublicKey()
+	slot := descendingSlot(ours, index.PublicKey, len(s._descSlots))
+	if slot < 0 {
+		return
+	}
+	if current := s._descendingSlotEntry(slot); current != nil && current.PublicKey != index.PublicKey {
+		if !util.DHTOrdered(current.PublicKey, index.PublicKey, ours) {
+			return
+		}
+	}
+	s._descSlots[slot] = index
+}
+
+// _descendingNodes returns the routing table entries for our descending node
+// and the nodes in any extra descending slots.
+func (s *state) _descendingNodes() []*virtualSnakeEntry {
+	var nodes []*virtualSnakeEntry
+	if s._descending != nil {
+		nodes = append(nodes, s._descending)
+	}
+	for slot := range s._descSlots {
+		if entry := s._descendingSlotEntry(slot); entry != nil {
+			nodes = append(nodes, entry)
+		}
+	}
+	return nodes
+}
+
+// densestSnakeEntry returns the index of the routing table entry that sits in
+// the most densely populated region of keyspace, that is, the entry that would
+// leave the smallest gap between its neighbours if it were removed. Evicting
+// this entry keeps the remaining entries roughly evenly spread across the
+// keyspace so that we don't open up large routing holes. The keep entries, if
+// supplied, will never be selected. Returns false if there is no candidate.
+func densestSnakeEntry(table virtualSnakeTable, keep ...*virtualSnakeEntry) (virtualSnakeIndex, bool) {
+	keys := make([]types.PublicKey, 0, len(table))
+	for k := range table {
+		keys = append(keys, k.PublicKey)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return util.LessThan(keys[i], keys[j])
+	})
+
+	// The keyspace wraps around, so the distance between two keys is always
+	// measured in ascending order modulo the size of the keyspace.
+	keyspace := new(big.Int).Lsh(big.NewInt(1), uint(len(types.PublicKey{})*8))
+	distance := func(a, b types.PublicKey) *big.Int {
+		d := new(big.Int).Sub(new(big.Int).SetBytes(b[:]), new(big.Int).SetBytes(a[:]))
+		if d.Sign() < 0 {
+			d.Add(d, keyspace)
+		}
+		return d
+	}
+
+	var best *big.Int
+	var bestIndex virtualSnakeIndex
+	for i, key := range keys {
+		if keepSnakeEntry(key, keep) {
+			continue
+		}
+		if table[virtualSnakeIndex{PublicKey: key}].static {
+			continue // static routes are never evicted
+		}
+		prev := keys[(i+len(keys)-1)%len(keys)]
+		next := keys[(i+1)%len(keys)]
+		if gap := distance(prev, next); best == nil || gap.Cmp(best) < 0 {
+			best, bestIndex = gap, virtualSnakeIndex{PublicKey: key}
+		}
+	}
+	return bestIndex, best != nil
+}
+
+// keepSnakeEntry returns true if the given key belongs to one of the entries.
+func keepSnakeEntry(key types.PublicKey, keep []*virtualSnakeEntry) bool {
+	for _, k := range keep {
+		if k != nil && k.PublicKey == key {
+			return true
+		}
+	}
+	return false
+}
+
+// _checkSnakeInvariants inspects the routing table and descending node for
+// inconsistencies that should never happen, returning one error for each
+// problem found. It is intended for debugging and testing only.
+func (s *state) _checkSnakeInvariants() []error {
+	var errs []error
+	live := func(p *peer) bool {
+		switch {
+		case p == nil:
+			return false
+		case p == s.r.local:
+			return true
+		case int(p.port) >= len(s._peers):
+			return false
+		default:
+			return s._peers[p.port] == p && p.started.Load()
+		}
+	}
+	for k, v := range s._table {
+		if v.virtualSnakeIndex == nil || *v.virtualSnakeIndex != k {
+			errs = append(errs, fmt.Errorf("entry for %s has a mismatched index", k.PublicKey))
+		}
+		if !live(v.Source) {
+			errs = append(errs, fmt.Errorf("entry for %s has a source that isn't a live peer", k.PublicKey))
+		}
+		if !live(v.Destination) {
+			errs = append(errs, fmt.Errorf("entry for %s has a destination that isn't a live peer", k.PublicKey))
+		}
+	}
+	ours := s.r.PublicKey()
+	if desc := s._descending; desc != nil {
+		switch {
+		case desc.virtualSnakeIndex == nil:
+			errs = append(errs, fmt.Errorf("descending node has no index"))
+		case s._table[*desc.virtualSnakeIndex] != desc:
+			errs = append(errs, fmt.Errorf("descending node %s isn't in the routing table", desc.PublicKey))
+		case !util.LessThan(desc.PublicKey, ours):
+			errs = append(errs, fmt.Errorf("descending node %s doesn't have a lower key than ours", desc.PublicKey))
+		}
+	}
+	for i, backup := range s._descBackups {
+		if !util.LessThan(backup.PublicKey, ours) {
+			errs = append(errs, fmt.Errorf("descending backup %s doesn't have a lower key than ours", backup.PublicKey))
+		}
+		if i > 0 && !util.LessThan(backup.PublicKey, s._descBackups[i-1].PublicKey) {
+			errs = append(errs, fmt.Errorf("descending backup %s is out of order", backup.PublicKey))
+		}
+	}
+	for slot, index := range s._descSlots {
+		if index.PublicKey.IsEmpty() {
+			continue
+		}
+		if !util.LessThan(index.PublicKey, ours) {
+			errs = append(errs, fmt.Errorf("descending slot %d holds %s, which doesn't have a lower key than ours", slot, index.PublicKey))
+		} else if descendingSlot(ours, index.PublicKey, len(s._descSlots)) != slot {
+			errs = append(errs, fmt.Errorf("descending slot %d holds %s, which belongs in another slot", slot, index.PublicKey))
+		}
+	}
+	return errs
+}
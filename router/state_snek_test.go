@@ -1,9 +1,14 @@
 package router
 
 import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Arceliar/phony"
 	"github.com/matrix-org/pinecone/types"
 	"go.uber.org/atomic"
 )
@@ -96,6 +101,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &parentAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]}, // default peer with no next hop is parent
 		{"TestBootstrapNoValidNextHop", virtualSnakeNextHopParams{
 			false,
@@ -109,6 +115,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &parentAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]}, // default bootstrap peer with no next hop is parent
 		{"TestNotBootstrapDestIsSelf", virtualSnakeNextHopParams{
 			false,
@@ -123,6 +130,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[0]},
 		{"TestBootstrapDestIsSelf", virtualSnakeNextHopParams{
 			true,
@@ -136,6 +144,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &parentAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]}, // bootstraps always start working towards root via parent
 		{"TestNotBootstrapPeerIsDestination", virtualSnakeNextHopParams{
 			false,
@@ -150,6 +159,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[2]},
 		{"TestBootstrapPeerIsDestination", virtualSnakeNextHopParams{
 			true,
@@ -164,6 +174,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]}, // bootstraps work their way toward the root
 		{"TestNotBootstrapParentKnowsDestination", virtualSnakeNextHopParams{
 			false,
@@ -177,6 +188,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]},
 		{"TestNotBootstrapPeerKnowsDestination", virtualSnakeNextHopParams{
 			false,
@@ -191,6 +203,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[2]},
 		{"TestBootstrapPeerKnowsDestination", virtualSnakeNextHopParams{
 			true,
@@ -205,6 +218,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[2]: &knowsDestUpAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]}, // bootstraps work their way toward the root
 		{"TestNotBootstrapParentKnowsCloser", virtualSnakeNextHopParams{
 			false,
@@ -218,6 +232,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &knowsHigherAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]},
 		{"TestBootstrapParentKnowsCloser", virtualSnakeNextHopParams{
 			true,
@@ -231,6 +246,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 				peers[1]: &knowsHigherAnn,
 			},
 			virtualSnakeTable{},
+			time.Now(),
 		}, peers[1]},
 		{"TestNotBootstrapSnakeEntryIsDest", virtualSnakeNextHopParams{
 			false,
@@ -250,6 +266,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 					//	Active:            true,
 					virtualSnakeIndex: &virtualSnakeIndex{PublicKey: destDownKey},
 				}},
+			time.Now(),
 		}, peers[3]},
 		{"TestBootstrapSnakeEntryIsDest", virtualSnakeNextHopParams{
 			true,
@@ -269,6 +286,7 @@ func TestSNEKNextHopSelection(t *testing.T) {
 					//	Active:            true,
 					virtualSnakeIndex: &virtualSnakeIndex{PublicKey: destDownKey},
 				}},
+			time.Now(),
 		}, nil}, // handle a bootstrap received from a lower key node
 	}
 
@@ -283,3 +301,1290 @@ func TestSNEKNextHopSelection(t *testing.T) {
 		})
 	}
 }
+
+// newTestKey generates a private key whose public key starts with a byte
+// in the range [lo, hi).
+func newTestKey(t testing.TB, lo, hi byte) ed25519.PrivateKey {
+	for {
+		pk, sk, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pk[0] >= lo && pk[0] < hi {
+			return sk
+		}
+	}
+}
+
+func testPublicKey(sk ed25519.PrivateKey) types.PublicKey {
+	var pk types.PublicKey
+	copy(pk[:], sk.Public().(ed25519.PublicKey))
+	return pk
+}
+
+func newTestRouter(t *testing.T, opts ...RouterOption) *Router {
+	return newTestRouterWithKey(t, newTestKey(t, 0, 0xff), opts...)
+}
+
+func newTestRouterWithKey(t testing.TB, sk ed25519.PrivateKey, opts ...RouterOption) *Router {
+	r := NewRouter(nil, sk, opts...)
+	t.Cleanup(func() {
+		_ = r.Close()
+	})
+	return r
+}
+
+func newTestPeer(r *Router, port types.SwitchPortID, public types.PublicKey) *peer {
+	ctx, cancel := context.WithCancel(r.context)
+	p := &peer{
+		router:   r,
+		port:     port,
+		public:   public,
+		revision: ourRevision,
+		context:  ctx,
+		cancel:   cancel,
+		proto:    newFIFOQueue(protoBuffer, r.log),
+		traffic:  newFairFIFOQueue(trafficBuffer, r.log),
+	}
+	p.started.Store(true)
+	return p
+}
+
+// addTestSnakeEntry adds a valid routing table entry for the given key, as if
+// the node had bootstrapped to us through the given peer.
+func addTestSnakeEntry(r *Router, key types.PublicKey, source *peer) {
+	phony.Block(r.state, func() {
+		index := virtualSnakeIndex{PublicKey: key}
+		r.state._addRouteEntry(index, &virtualSnakeEntry{
+			virtualSnakeIndex: &index,
+			Source:            source,
+			Destination:       r.local,
+			LastSeen:          r.clock.Now(),
+			Root:              r.state._rootAnnouncement().Root,
+			expiry:            r.snakeNeighExpiry,
+			Watermark:         types.VirtualSnakeWatermark{PublicKey: key, Sequence: 1},
+		})
+	})
+}
+
+func newTestBootstrap(t *testing.T, sk ed25519.PrivateKey, root types.Root, seq types.Varu64) *types.Frame {
+	bootstrap := types.VirtualSnakeBootstrap{
+		Root:     root,
+		Sequence: seq,
+	}
+	protected, err := bootstrap.ProtectedPayload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(bootstrap.Signature[:], ed25519.Sign(sk, protected))
+	f := getFrame()
+	f.Type = types.TypeBootstrap
+	f.DestinationKey = testPublicKey(sk)
+	f.HopLimit = virtualSnakeBootstrapHopLimit
+	f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	n, err := bootstrap.MarshalBinary(f.Payload[:cap(f.Payload)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Payload = f.Payload[:n]
+	return f
+}
+
+// newTestRoot returns the router's current root once its first round of
+// tree maintenance has bumped the root sequence. Bootstraps must match the
+// root to be accepted, so taking it any earlier is racy.
+func newTestRoot(t *testing.T, r *Router) types.Root {
+	waitForTreeMaintenance(t, r)
+	var root types.Root
+	phony.Block(r.state, func() {
+		root = r.state._rootAnnouncement().Root
+	})
+	return root
+}
+
+func TestSnakeTableDensestEntry(t *testing.T) {
+	table := virtualSnakeTable{}
+	for _, b := range []byte{0x10, 0x40, 0x41, 0x42, 0x70, 0xa0, 0xd0} {
+		index := virtualSnakeIndex{PublicKey: types.PublicKey{b}}
+		table[index] = &virtualSnakeEntry{virtualSnakeIndex: &index}
+	}
+
+	evict, ok := densestSnakeEntry(table, nil)
+	if !ok {
+		t.Fatalf("expected an entry to evict")
+	}
+	if expected := (types.PublicKey{0x41}); evict.PublicKey != expected {
+		t.Fatalf("expected: %s got: %s", expected, evict.PublicKey)
+	}
+
+	keep := table[virtualSnakeIndex{PublicKey: types.PublicKey{0x41}}]
+	evict, ok = densestSnakeEntry(table, keep)
+	if !ok {
+		t.Fatalf("expected an entry to evict")
+	}
+	if evict.PublicKey == keep.PublicKey {
+		t.Fatalf("evicted the entry that should have been kept")
+	}
+	if b := evict.PublicKey[0]; b != 0x40 && b != 0x42 {
+		t.Fatalf("expected eviction from the dense region, got: %s", evict.PublicKey)
+	}
+}
+
+func TestSnakeTableBounded(t *testing.T) {
+	const limit = 4
+	r := newTestRouter(t, RouterOptionMaxSnakeEntries(limit))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+
+	root := newTestRoot(t, r)
+	for i := 0; i < limit*3; i++ {
+		_, sk, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f := newTestBootstrap(t, sk, root, types.Varu64(time.Now().UnixMilli()))
+		var handled, descending bool
+		var count int
+		phony.Block(r.state, func() {
+			handled = r.state._handleBootstrap(from, r.local, f)
+			count = len(r.state._table)
+			descending = true
+			if desc := r.state._descending; desc != nil {
+				_, descending = r.state._table[*desc.virtualSnakeIndex]
+			}
+		})
+		if !handled {
+			t.Fatalf("bootstrap %d was not handled", i)
+		}
+		if count > limit {
+			t.Fatalf("routing table has %d entries, expected at most %d", count, limit)
+		}
+		if !descending {
+			t.Fatalf("descending entry was evicted from the routing table")
+		}
+	}
+}
+
+func TestSnakeBootstrapFreshness(t *testing.T) {
+	r := newTestRouter(t)
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+
+	root := newTestRoot(t, r)
+	handle := func(f *types.Frame) (handled bool) {
+		phony.Block(r.state, func() {
+			handled = r.state._handleBootstrap(from, r.local, f)
+		})
+		return
+	}
+
+	stale := now.Add(-r.snakeNeighExpiry * 2).UnixMilli()
+	if handle(newTestBootstrap(t, sk, root, types.Varu64(stale))) {
+		t.Fatalf("stale bootstrap should have been rejected")
+	}
+
+	future := now.Add(r.snakeNeighExpiry * 2).UnixMilli()
+	if handle(newTestBootstrap(t, sk, root, types.Varu64(future))) {
+		t.Fatalf("future bootstrap should have been rejected")
+	}
+
+	// Tamper with the signed timestamp after the bootstrap was signed.
+	tampered := newTestBootstrap(t, sk, root, types.Varu64(now.UnixMilli()))
+	var bootstrap types.VirtualSnakeBootstrap
+	if _, err := bootstrap.UnmarshalBinary(tampered.Payload); err != nil {
+		t.Fatal(err)
+	}
+	bootstrap.Sequence++
+	n, err := bootstrap.MarshalBinary(tampered.Payload[:cap(tampered.Payload)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Payload = tampered.Payload[:n]
+	if handle(tampered) {
+		t.Fatalf("tampered bootstrap should have been rejected")
+	}
+
+	if !handle(newTestBootstrap(t, sk, root, types.Varu64(now.UnixMilli()))) {
+		t.Fatalf("fresh bootstrap should have been accepted")
+	}
+
+	if stale := r._staleBootstraps.Load(); stale != 2 {
+		t.Fatalf("expected 2 stale bootstraps to be counted, got %d", stale)
+	}
+}
+
+func TestSnakeBootstrapDuplicateSuppressed(t *testing.T) {
+	r := newTestRouter(t)
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	other := newTestPeer(r, 2, types.PublicKey{2})
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := types.Varu64(time.Now().UnixMilli())
+
+	root := newTestRoot(t, r)
+	handle := func(from *peer, f *types.Frame) (handled bool) {
+		phony.Block(r.state, func() {
+			handled = r.state._handleBootstrap(from, r.local, f)
+		})
+		return
+	}
+
+	if !handle(from, newTestBootstrap(t, sk, root, seq)) {
+		t.Fatalf("first bootstrap should have been accepted")
+	}
+
+	// The same bootstrap arriving again, whether from the same peer or via
+	// a different path, must not be accepted and forwarded again.
+	if handle(from, newTestBootstrap(t, sk, root, seq)) {
+		t.Fatalf("repeated bootstrap should have been suppressed")
+	}
+	if handle(other, newTestBootstrap(t, sk, root, seq)) {
+		t.Fatalf("repeated bootstrap via another peer should have been suppressed")
+	}
+
+	// The next bootstrap from the same node is accepted as normal.
+	if !handle(from, newTestBootstrap(t, sk, root, seq+1)) {
+		t.Fatalf("newer bootstrap should have been accepted")
+	}
+}
+
+func TestSnakeBootstrapSignatureVerified(t *testing.T) {
+	victimSK := newTestKey(t, 0x00, 0x40)
+	attackerSK := newTestKey(t, 0x00, 0x40)
+	victim := testPublicKey(victimSK)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	seq := types.Varu64(time.Now().UnixMilli())
+
+	root := newTestRoot(t, r)
+	handle := func(f *types.Frame) (handled bool, entry *virtualSnakeEntry, desc *virtualSnakeEntry) {
+		phony.Block(r.state, func() {
+			handled = r.state._handleBootstrap(from, r.local, f)
+			entry = r.state._table[virtualSnakeIndex{PublicKey: victim}]
+			desc = r.state._descending
+		})
+		return
+	}
+
+	// A bootstrap claiming to be from the victim but signed by someone else
+	// must not be acted upon.
+	forged := newTestBootstrap(t, attackerSK, root, seq)
+	forged.DestinationKey = victim
+	if handled, entry, desc := handle(forged); handled || entry != nil || desc != nil {
+		t.Fatalf("forged bootstrap should have been ignored")
+	}
+
+	// Nor should a genuine bootstrap that has been changed after signing.
+	tampered := newTestBootstrap(t, victimSK, root, seq)
+	var bootstrap types.VirtualSnakeBootstrap
+	if _, err := bootstrap.UnmarshalBinary(tampered.Payload); err != nil {
+		t.Fatal(err)
+	}
+	bootstrap.Sequence++
+	n, err := bootstrap.MarshalBinary(tampered.Payload[:cap(tampered.Payload)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Payload = tampered.Payload[:n]
+	if handled, entry, desc := handle(tampered); handled || entry != nil || desc != nil {
+		t.Fatalf("tampered bootstrap should have been ignored")
+	}
+
+	// The genuine bootstrap should be accepted, and the victim becomes our
+	// descending node since their key is lower than ours.
+	handled, entry, desc := handle(newTestBootstrap(t, victimSK, root, seq))
+	if !handled || entry == nil {
+		t.Fatalf("genuine bootstrap should have been accepted")
+	}
+	if desc == nil || desc.PublicKey != victim {
+		t.Fatalf("expected the bootstrapping node to become our descending node")
+	}
+}
+
+func TestSnakeDescendingBackupPromotion(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	further := newTestKey(t, 0x10, 0x20)
+	closer := newTestKey(t, 0x80, 0x90)
+
+	root := newTestRoot(t, r)
+	seq := types.Varu64(time.Now().UnixMilli())
+	for _, sk := range []ed25519.PrivateKey{further, closer} {
+		f := newTestBootstrap(t, sk, root, seq)
+		var handled bool
+		phony.Block(r.state, func() {
+			handled = r.state._handleBootstrap(from, r.local, f)
+		})
+		if !handled {
+			t.Fatalf("bootstrap was not handled")
+		}
+	}
+
+	var desc *virtualSnakeEntry
+	phony.Block(r.state, func() {
+		desc = r.state._descending
+	})
+	if desc == nil || desc.PublicKey != testPublicKey(closer) {
+		t.Fatalf("expected the closer node to be the descending node")
+	}
+
+	// Expire the descending path and run maintenance. The backup should
+	// be promoted straight away without waiting for another bootstrap.
+	var backups int
+	phony.Block(r.state, func() {
+		desc.LastSeen = time.Now().Add(-virtualSnakeNeighExpiryPeriod * 2)
+		r.state._maintainSnake()
+		desc = r.state._descending
+		backups = len(r.state._descBackups)
+	})
+	if desc == nil || desc.PublicKey != testPublicKey(further) {
+		t.Fatalf("expected the backup node to be promoted to the descending node")
+	}
+	if backups != 0 {
+		t.Fatalf("expected the promoted backup to be removed from the backups")
+	}
+}
+
+func TestSnakeDescendingRootChanged(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	descSK := newTestKey(t, 0x10, 0x20)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	parent := newTestPeer(r, 1, testPublicKey(rootSK))
+	from := newTestPeer(r, 2, types.PublicKey{2})
+
+	// Our first root update would otherwise be able to change the root
+	// sequence after we have built the bootstrap, so wait for it to happen.
+	waitForTreeMaintenance(t, r)
+
+	// The descending node bootstraps to us while we are our own root.
+	var oldRoot types.Root
+	phony.Block(r.state, func() {
+		r.state._peers[parent.port], r.state._peers[from.port] = parent, from
+		oldRoot = r.state._rootAnnouncement().Root
+	})
+	bootstrap := newTestBootstrap(t, descSK, oldRoot, types.Varu64(time.Now().UnixMilli()))
+	var handled bool
+	var desc *virtualSnakeEntry
+	phony.Block(r.state, func() {
+		handled = r.state._handleBootstrap(from, r.local, bootstrap)
+		desc = r.state._descending
+	})
+	if !handled || desc == nil || desc.PublicKey != testPublicKey(descSK) {
+		t.Fatalf("expected the bootstrapping node to become our descending node")
+	}
+
+	// Then we join a tree with a stronger root, so the descending path no
+	// longer matches our root and shouldn't be used as our descending node.
+	newRoot := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	ann := newTestAnnouncement(t, newRoot, rootSK)
+	var err error
+	var stale bool
+	phony.Block(r.state, func() {
+		if err = r.state._handleTreeAnnouncement(parent, ann); err != nil {
+			return
+		}
+		r.state._maintainSnake()
+		desc = r.state._descending
+		_, stale = r.state._table[virtualSnakeIndex{PublicKey: testPublicKey(descSK)}]
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if desc != nil {
+		t.Fatalf("expected the stale descending node to be cleared")
+	}
+	if !stale {
+		t.Fatalf("expected the stale path to be left to expire")
+	}
+}
+
+func TestSnakeNeighExpiryConfigurable(t *testing.T) {
+	const expiry = time.Millisecond * 50
+	r := newTestRouter(t, RouterOptionSnakeNeighExpiry(expiry))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	_, sk, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	index := virtualSnakeIndex{PublicKey: testPublicKey(sk)}
+
+	root := newTestRoot(t, r)
+	f := newTestBootstrap(t, sk, root, types.Varu64(time.Now().UnixMilli()))
+	var handled, valid bool
+	phony.Block(r.state, func() {
+		handled = r.state._handleBootstrap(from, r.local, f)
+		entry, ok := r.state._table[index]
+		valid = ok && entry.valid(time.Now())
+	})
+	if !handled {
+		t.Fatalf("bootstrap was not handled")
+	}
+	if !valid {
+		t.Fatalf("expected a valid routing table entry")
+	}
+
+	time.Sleep(expiry * 2)
+
+	var present bool
+	phony.Block(r.state, func() {
+		r.state._maintainSnake()
+		_, present = r.state._table[index]
+	})
+	if present {
+		t.Fatalf("expected the routing table entry to have expired")
+	}
+}
+
+func TestSnakeNeighExpiryDefault(t *testing.T) {
+	for _, expiry := range []time.Duration{0, -time.Second} {
+		r := newTestRouter(t, RouterOptionSnakeNeighExpiry(expiry))
+		if r.snakeNeighExpiry != virtualSnakeNeighExpiryPeriod {
+			t.Fatalf("expected default expiry for %s, got %s", expiry, r.snakeNeighExpiry)
+		}
+	}
+}
+
+func TestSnakeEntryRefreshedByTraffic(t *testing.T) {
+	const expiry = time.Millisecond * 200
+	r := newTestRouter(t, RouterOptionSnakeNeighExpiry(expiry))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	alive := newTestPeer(r, 2, types.PublicKey{2})
+	departed := newTestPeer(r, 3, types.PublicKey{3})
+	aliveKey, departedKey := types.PublicKey{4}, types.PublicKey{5}
+
+	addTestSnakeEntry(r, aliveKey, alive)
+	addTestSnakeEntry(r, departedKey, departed)
+
+	forward := func(p *peer, source, destination types.PublicKey) {
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		f.SourceKey = source
+		f.DestinationKey = destination
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		f.Payload = append(f.Payload[:0], time.Now().String()...)
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._forward(p, f)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// For longer than the expiry period, one node keeps sending us traffic
+	// along its path, while the other node has gone away but traffic is
+	// still being sent towards it.
+	for start := time.Now(); time.Since(start) < expiry*2; time.Sleep(expiry / 10) {
+		forward(alive, aliveKey, r.public)
+		forward(from, from.public, departedKey)
+	}
+
+	var aliveValid, departedValid bool
+	phony.Block(r.state, func() {
+		if entry := r.state._table[virtualSnakeIndex{PublicKey: aliveKey}]; entry != nil {
+			aliveValid = entry.valid(time.Now())
+		}
+		if entry := r.state._table[virtualSnakeIndex{PublicKey: departedKey}]; entry != nil {
+			departedValid = entry.valid(time.Now())
+		}
+	})
+	if !aliveValid {
+		t.Fatalf("entry for a node sending traffic along the path should not have expired")
+	}
+	if departedValid {
+		t.Fatalf("entry for a node that has gone away should have expired")
+	}
+}
+
+func TestSnakeRebootstrap(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x80))
+	parent := newTestPeer(r, 1, testPublicKey(rootSK))
+	// Let the first round of maintenance run before we pick up a parent, so
+	// that it can't bootstrap again behind our back later on.
+	waitForTreeMaintenance(t, r)
+
+	var err error
+	root := types.Root{RootPublicKey: parent.public, RootSequence: 1}
+	ann := newTestAnnouncement(t, root, rootSK)
+	phony.Block(r.state, func() {
+		r.state._peers[parent.port] = parent
+		err = r.state._handleTreeAnnouncement(parent, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bootstraps := func() (count int) {
+		phony.Block(r.state, func() {
+			for n := parent.proto.queuecount(); n > 0; n-- {
+				f := <-parent.proto.pop()
+				parent.proto.ack()
+				if f.Type == types.TypeBootstrap {
+					count++
+				}
+			}
+		})
+		return
+	}
+	bootstraps()
+	// Pretend that we bootstrapped recently enough that maintenance won't
+	// send another one by itself for a while.
+	phony.Block(r.state, func() {
+		r.state._lastbootstrap = time.Now().Add(-virtualSnakeRebootstrapInterval)
+	})
+
+	r.Rebootstrap()
+	deadline := time.Now().Add(r.snakeMaintainInterval / 2)
+	count := 0
+	for count == 0 && time.Now().Before(deadline) {
+		count += bootstraps()
+		time.Sleep(time.Millisecond * 10)
+	}
+	if count != 1 {
+		t.Fatalf("expected 1 bootstrap after rebootstrapping, got %d", count)
+	}
+
+	// Having just bootstrapped, a further call should be ignored.
+	r.Rebootstrap()
+	time.Sleep(time.Millisecond * 100)
+	if count := bootstraps(); count != 0 {
+		t.Fatalf("expected repeated rebootstrap to be ignored, got %d bootstraps", count)
+	}
+}
+
+func TestSnakeInvariants(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0x80, 0x90))
+	live := newTestPeer(r, 1, types.PublicKey{1})
+	dead := newTestPeer(r, 2, types.PublicKey{2})
+	phony.Block(r.state, func() {
+		r.state._peers[live.port] = live
+	})
+	lowKey := testPublicKey(newTestKey(t, 0, 0x40))
+	highKey := testPublicKey(newTestKey(t, 0xf0, 0xff))
+	addTestSnakeEntry(r, lowKey, live)
+
+	var healthy, corrupted []error
+	phony.Block(r.state, func() {
+		r.state._setDescendingNode(r.state._table[virtualSnakeIndex{PublicKey: lowKey}])
+		healthy = r.state._checkSnakeInvariants()
+
+		// An entry stored under the wrong index, via a peer that isn't live,
+		// a descending node that has gone missing from the table and a
+		// backup descending candidate with a higher key than ours.
+		misplaced := virtualSnakeIndex{PublicKey: types.PublicKey{3}}
+		r.state._table[virtualSnakeIndex{PublicKey: types.PublicKey{4}}] = &virtualSnakeEntry{
+			virtualSnakeIndex: &misplaced,
+			Source:            dead,
+			Destination:       r.local,
+			LastSeen:          time.Now(),
+		}
+		delete(r.state._table, virtualSnakeIndex{PublicKey: lowKey})
+		r.state._descBackups = []virtualSnakeIndex{{PublicKey: highKey}}
+		corrupted = r.state._checkSnakeInvariants()
+	})
+
+	if len(healthy) != 0 {
+		t.Fatalf("expected no violations, got %v", healthy)
+	}
+	expected := []string{
+		"mismatched index",
+		"source that isn't a live peer",
+		"isn't in the routing table",
+		"backup",
+	}
+	if len(corrupted) != len(expected) {
+		t.Fatalf("expected %d violations, got %v", len(expected), corrupted)
+	}
+	for _, want := range expected {
+		found := false
+		for _, err := range corrupted {
+			found = found || strings.Contains(err.Error(), want)
+		}
+		if !found {
+			t.Fatalf("expected a violation mentioning %q, got %v", want, corrupted)
+		}
+	}
+}
+
+func TestSnakeMaintenancePrunesStoppedPeers(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xff))
+	// The backup is only promoted if its root matches ours, so wait for the
+	// first tree maintenance to settle our root before building entries.
+	waitForTreeMaintenance(t, r)
+	live := newTestPeer(r, 1, types.PublicKey{1})
+	stopped := newTestPeer(r, 2, types.PublicKey{2})
+	liveKey, stoppedKey := types.PublicKey{1}, types.PublicKey{2}
+	deadendKey := types.PublicKey{3}
+	addTestSnakeEntry(r, liveKey, live)
+	addTestSnakeEntry(r, stoppedKey, stopped)
+	addTestSnakeEntry(r, deadendKey, live)
+
+	// Stop the peering without the state actor hearing about it yet, as
+	// happens when a peering goes away abruptly.
+	var remaining map[types.PublicKey]bool
+	var descending *virtualSnakeEntry
+	phony.Block(r.state, func() {
+		r.state._peers[live.port] = live
+		r.state._peers[stopped.port] = stopped
+		r.state._setDescendingNode(r.state._table[virtualSnakeIndex{PublicKey: stoppedKey}])
+		r.state._addDescendingBackup(virtualSnakeIndex{PublicKey: liveKey})
+		stopped.started.Store(false)
+
+		// A bootstrap that had nowhere further to go leaves an entry with no
+		// destination, which should be left alone.
+		r.state._table[virtualSnakeIndex{PublicKey: deadendKey}].Destination = nil
+
+		r.state._maintainSnake()
+		remaining = map[types.PublicKey]bool{}
+		for k := range r.state._table {
+			remaining[k.PublicKey] = true
+		}
+		descending = r.state._descending
+	})
+
+	if remaining[stoppedKey] {
+		t.Fatalf("expected entry via the stopped peer to be removed")
+	}
+	if !remaining[liveKey] {
+		t.Fatalf("expected entry via the live peer to be kept")
+	}
+	if !remaining[deadendKey] {
+		t.Fatalf("expected entry with no destination to be kept")
+	}
+	if descending == nil || descending.PublicKey != liveKey {
+		t.Fatalf("expected the descending node to be replaced by the backup")
+	}
+}
+
+func TestSnakeNextHopTieBreak(t *testing.T) {
+	selfKey := types.PublicKey{0x80}
+	rootKey := types.PublicKey{0xff}
+	ancestorKey := types.PublicKey{0x40}
+	destKey := types.PublicKey{0x30}
+	root := types.Root{RootPublicKey: rootKey, RootSequence: 1}
+
+	// Both peers are children of the same ancestor, so either of them could
+	// be used to reach it.
+	newAnn := func(peerKey types.PublicKey, order uint64) *rootAnnouncementWithTime {
+		return &rootAnnouncementWithTime{
+			receiveOrder: order,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+				Signatures: []types.SignatureWithHop{
+					{PublicKey: rootKey, Hop: 1},
+					{PublicKey: ancestorKey, Hop: 1},
+					{PublicKey: peerKey, Hop: 1},
+				},
+			},
+		}
+	}
+	self := &peer{port: 0, public: selfKey, started: *atomic.NewBool(true)}
+	low := &peer{port: 1, public: types.PublicKey{0x10}, started: *atomic.NewBool(true)}
+	high := &peer{port: 2, public: types.PublicKey{0x20}, started: *atomic.NewBool(true)}
+	params := virtualSnakeNextHopParams{
+		false,
+		destKey,
+		selfKey,
+		types.VirtualSnakeWatermark{PublicKey: types.FullMask, Sequence: 0},
+		nil,
+		self,
+		&rootAnnouncementWithTime{SwitchAnnouncement: types.SwitchAnnouncement{Root: root}},
+		announcementTable{
+			high: newAnn(high.public, 1),
+			low:  newAnn(low.public, 2),
+		},
+		virtualSnakeTable{},
+		time.Now(),
+	}
+
+	// Map iteration order is random, so repeat to make sure that the same
+	// next-hop is always chosen.
+	for i := 0; i < 50; i++ {
+		if next, watermark := getNextHopSNEK(params); next != low || watermark.PublicKey != ancestorKey {
+			t.Fatalf("expected the ancestor to be reached via port %d, got port %d", low.port, next.port)
+		}
+	}
+}
+
+func TestSnakeStaticRoute(t *testing.T) {
+	clock := newTestClock()
+	r := newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff), RouterOptionClock{clock})
+	a := newTestPeer(r, 1, types.PublicKey{1})
+	b := newTestPeer(r, 2, types.PublicKey{2})
+	sk := newTestKey(t, 0x40, 0x80)
+	key := testPublicKey(sk)
+	phony.Block(r.state, func() {
+		r.state._peers[a.port], r.state._peers[b.port] = a, b
+	})
+
+	if err := r.AddStaticSnakeRoute(key, 3); err == nil {
+		t.Fatalf("expected a static route via an unconnected port to be refused")
+	}
+	if err := r.AddStaticSnakeRoute(key, b.port); err != nil {
+		t.Fatal(err)
+	}
+
+	nexthop := func() (p *peer, static bool) {
+		phony.Block(r.state, func() {
+			r.state._maintainSnake()
+			p, _ = r.state._nextHopsSNEK(key, types.TypeTraffic, types.VirtualSnakeWatermark{
+				PublicKey: types.FullMask,
+			})
+			entry, ok := r.state._table[virtualSnakeIndex{PublicKey: key}]
+			static = ok && entry.static
+		})
+		return
+	}
+
+	// The static route should outlive the expiry period and be used for
+	// traffic to the key.
+	clock.Advance(r.snakeNeighExpiry * 2)
+	if p, static := nexthop(); p != b || !static {
+		t.Fatalf("expected the static route to survive expiry and be used")
+	}
+
+	// A bootstrap from the node arriving through another peer should still
+	// be accepted, but shouldn't replace the static route.
+	root := newTestRoot(t, r)
+	f := newTestBootstrap(t, sk, root, types.Varu64(clock.Now().UnixMilli()))
+	var handled bool
+	phony.Block(r.state, func() {
+		handled = r.state._handleBootstrap(a, r.local, f)
+	})
+	if !handled {
+		t.Fatalf("expected the bootstrap to be accepted")
+	}
+	if p, static := nexthop(); p != b || !static {
+		t.Fatalf("expected the static route to be kept")
+	}
+
+	if !r.RemoveStaticSnakeRoute(key) {
+		t.Fatalf("expected the static route to be removed")
+	}
+	if r.RemoveStaticSnakeRoute(key) {
+		t.Fatalf("expected there to be no static route left to remove")
+	}
+	if p, static := nexthop(); p == b || static {
+		t.Fatalf("expected the static route to no longer be used")
+	}
+}
+
+func TestSnakeRerouteAroundStoppedPeer(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xff))
+	near := newTestPeer(r, 1, types.PublicKey{1})
+	other := newTestPeer(r, 2, types.PublicKey{2})
+	destKey, otherKey := types.PublicKey{0x30}, types.PublicKey{0x40}
+	addTestSnakeEntry(r, destKey, near)
+	addTestSnakeEntry(r, otherKey, other)
+	phony.Block(r.state, func() {
+		r.state._peers[near.port] = near
+		r.state._peers[other.port] = other
+	})
+
+	send := func() error {
+		f := getFrame()
+		f.Type = types.TypeTraffic
+		f.SourceKey = types.PublicKey{0xf0}
+		f.DestinationKey = destKey
+		f.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._forward(r.local, f)
+		})
+		return err
+	}
+
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if near.traffic.queuecount() != 1 {
+		t.Fatalf("expected traffic to follow the path to the destination")
+	}
+
+	// Stop the peering behind the path without the state actor hearing
+	// about it yet. Traffic should still make progress through the next
+	// best path rather than being dropped.
+	near.started.Store(false)
+	if err := send(); err != nil {
+		t.Fatal(err)
+	}
+	if other.traffic.queuecount() != 1 {
+		t.Fatalf("expected traffic to be rerouted around the stopped peer")
+	}
+	if dropped := r._drops[DropNoNextHop].Load(); dropped != 0 {
+		t.Fatalf("expected no frames to be dropped, got %d", dropped)
+	}
+
+	// The path through the stopped peer is cleaned up by the next SNEK
+	// maintenance, since SNEK paths are soft state.
+	var remaining bool
+	phony.Block(r.state, func() {
+		r.state._maintainSnake()
+		_, remaining = r.state._table[virtualSnakeIndex{PublicKey: destKey}]
+	})
+	if remaining {
+		t.Fatalf("expected the path through the stopped peer to be removed")
+	}
+}
+
+func TestSnakeAcceptDescendingFilter(t *testing.T) {
+	// Only anchor keys in the upper half of the keyspace.
+	accept := func(key types.PublicKey) bool {
+		return key[0] >= 0x40
+	}
+	r := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xc0), RouterOptionAcceptDescending(accept))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	acceptedSK := newTestKey(t, 0x40, 0x60)
+	seq := types.Varu64(time.Now().UnixMilli())
+
+	root := newTestRoot(t, r)
+	rejected := newTestBootstrap(t, newTestKey(t, 0x00, 0x40), root, seq)
+	accepted := newTestBootstrap(t, acceptedSK, root, seq)
+
+	var handled bool
+	var descending *virtualSnakeEntry
+	var backups []virtualSnakeIndex
+	var entry bool
+	handle := func(f *types.Frame) {
+		key := f.DestinationKey
+		phony.Block(r.state, func() {
+			handled = r.state._handleBootstrap(from, r.local, f)
+			descending = r.state._descending
+			backups = append(backups[:0], r.state._descBackups...)
+			_, entry = r.state._table[virtualSnakeIndex{PublicKey: key}]
+		})
+	}
+
+	// A node that would otherwise be our descending node is rejected by the
+	// filter, but the bootstrap is still handled so that the path through
+	// us is usable.
+	handle(rejected)
+	if !handled || !entry {
+		t.Fatalf("expected the bootstrap to be handled")
+	}
+	if descending != nil || len(backups) != 0 {
+		t.Fatalf("expected the rejected node not to become our descending node")
+	}
+
+	// A node in the accepted region becomes our descending node as usual.
+	handle(accepted)
+	if !handled || descending == nil || descending.PublicKey != testPublicKey(acceptedSK) {
+		t.Fatalf("expected the accepted node to become our descending node")
+	}
+	if len(backups) != 0 {
+		t.Fatalf("expected the rejected node not to be kept as a backup")
+	}
+}
+
+func TestSnakeDraining(t *testing.T) {
+	r := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xc0))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	transit := newTestPeer(r, 2, types.PublicKey{3})
+	descendingSK := newTestKey(t, 0x40, 0x80)
+	seq := types.Varu64(time.Now().UnixMilli())
+
+	root := newTestRoot(t, r)
+	first := newTestBootstrap(t, descendingSK, root, seq)
+	second := newTestBootstrap(t, descendingSK, root, seq+1)
+	traffic := getFrame()
+	traffic.Type = types.TypeTraffic
+	traffic.DestinationKey = transit.public
+	traffic.Watermark = types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+	addTestSnakeEntry(r, transit.public, transit)
+
+	var handled, entry bool
+	var descending *virtualSnakeEntry
+	handle := func(f *types.Frame) {
+		key := f.DestinationKey
+		phony.Block(r.state, func() {
+			handled = r.state._handleBootstrap(from, r.local, f)
+			descending = r.state._descending
+			_, entry = r.state._table[virtualSnakeIndex{PublicKey: key}]
+		})
+	}
+
+	// While draining, a node that would otherwise become our descending
+	// node isn't anchored here, although the path through us is still built.
+	r.SetDraining(true)
+	handle(first)
+	if !handled || !entry {
+		t.Fatalf("expected the bootstrap to be handled")
+	}
+	if descending != nil {
+		t.Fatalf("expected no descending node to be set while draining")
+	}
+
+	// Traffic along existing paths is still forwarded.
+	var err error
+	phony.Block(r.state, func() {
+		err = r.state._forward(from, traffic)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transit.traffic.queuecount() != 1 {
+		t.Fatalf("expected transit traffic to be forwarded while draining")
+	}
+
+	// Once draining stops, the node is anchored as usual.
+	r.SetDraining(false)
+	handle(second)
+	if !handled || descending == nil || descending.PublicKey != testPublicKey(descendingSK) {
+		t.Fatalf("expected a descending node to be set after draining stops")
+	}
+}
+
+func TestSnakeDescendingSlots(t *testing.T) {
+	// With our key at 0x80, the first extra slot covers keys below 0x40
+	// and the second covers keys from 0x40 up to 0x60.
+	r := newTestRouterWithKey(t, newTestKey(t, 0x80, 0x81), RouterOptionDescendingSlots(3))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	far, farther := newTestKey(t, 0x20, 0x30), newTestKey(t, 0x10, 0x20)
+	mid, midCloser := newTestKey(t, 0x44, 0x4c), newTestKey(t, 0x50, 0x58)
+	near := newTestKey(t, 0x70, 0x78)
+	seq := types.Varu64(time.Now().UnixMilli())
+
+	root := newTestRoot(t, r)
+	var frames []*types.Frame
+	for _, sk := range []ed25519.PrivateKey{far, farther, mid, midCloser, near} {
+		frames = append(frames, newTestBootstrap(t, sk, root, seq))
+	}
+
+	var descending *virtualSnakeEntry
+	var slots []virtualSnakeIndex
+	var nodes int
+	var errs []error
+	phony.Block(r.state, func() {
+		r.state._peers[from.port] = from
+		for _, f := range frames {
+			r.state._handleBootstrap(from, r.local, f)
+		}
+		descending = r.state._descending
+		slots = append(slots, r.state._descSlots...)
+		nodes = len(r.state._descendingNodes())
+		errs = r.state._checkSnakeInvariants()
+	})
+
+	// The closest node is still our descending node, and each extra slot
+	// has kept the closest node in its region, regardless of the order in
+	// which they bootstrapped.
+	if descending == nil || descending.PublicKey != testPublicKey(near) {
+		t.Fatalf("expected the closest node to be our descending node")
+	}
+	if len(slots) != 2 {
+		t.Fatalf("expected 2 extra descending slots, got %d", len(slots))
+	}
+	if slots[0].PublicKey != testPublicKey(far) {
+		t.Fatalf("expected the first slot to keep the closest node below 0x40")
+	}
+	if slots[1].PublicKey != testPublicKey(midCloser) {
+		t.Fatalf("expected the second slot to keep the closest node from 0x40")
+	}
+	if nodes != 3 {
+		t.Fatalf("expected 3 descending nodes, got %d", nodes)
+	}
+	for _, err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestSnakeDescendingSlotsNotEvicted(t *testing.T) {
+	const limit = 4
+	r := newTestRouterWithKey(t, newTestKey(t, 0x80, 0x81), RouterOptionDescendingSlots(2), RouterOptionMaxSnakeEntries(limit))
+	from := newTestPeer(r, 1, types.PublicKey{1})
+	slotted := newTestKey(t, 0x3e, 0x40)
+	seq := types.Varu64(time.Now().UnixMilli())
+
+	// The extra slot covers keys below 0x40. The node in it sits in the
+	// middle of a dense cluster of keys, which is where entries are evicted
+	// from when the table is full. The nodes above it are closer to us, so
+	// one of them becomes our descending node, but they aren't in the slot's
+	// region.
+	root := newTestRoot(t, r)
+	frames := []*types.Frame{newTestBootstrap(t, slotted, root, seq)}
+	for i := 0; i < limit; i++ {
+		frames = append(frames,
+			newTestBootstrap(t, newTestKey(t, 0x38, 0x3e), root, seq),
+			newTestBootstrap(t, newTestKey(t, 0x41, 0x44), root, seq),
+		)
+	}
+
+	var kept bool
+	var entries int
+	phony.Block(r.state, func() {
+		for _, f := range frames {
+			r.state._handleBootstrap(from, r.local, f)
+		}
+		_, kept = r.state._table[virtualSnakeIndex{PublicKey: testPublicKey(slotted)}]
+		entries = len(r.state._table)
+	})
+	if entries > limit {
+		t.Fatalf("expected at most %d entries, got %d", limit, entries)
+	}
+	if !kept {
+		t.Fatalf("expected the path to the node in the extra slot to be kept")
+	}
+}
+
+func TestSnakeRootRoutesBootstraps(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	childSK := newTestKey(t, 0x00, 0x40)
+	middleSK := newTestKey(t, 0x40, 0xf0)
+
+	for _, withMiddle := range []bool{false, true} {
+		r := newTestRouterWithKey(t, rootSK)
+		waitForTreeMaintenance(t, r)
+		child := newTestPeer(r, 1, testPublicKey(childSK))
+		middle := newTestPeer(r, 2, testPublicKey(middleSK))
+		var root types.Root
+		phony.Block(r.state, func() {
+			r.state._peers[child.port] = child
+			if withMiddle {
+				r.state._peers[middle.port] = middle
+			}
+			root = r.state._rootAnnouncement().Root
+		})
+		childAnn := newTestAnnouncement(t, root, rootSK, childSK)
+		middleAnn := newTestAnnouncement(t, root, rootSK, middleSK)
+		bootstrap := newTestBootstrap(t, childSK, root, types.Varu64(time.Now().UnixMilli()))
+
+		// We are the root, so we have no parent to fall back on, but the
+		// bootstrap should still end up somewhere sensible.
+		var err error
+		var parent *peer
+		var descending *virtualSnakeEntry
+		phony.Block(r.state, func() {
+			if err = r.state._handleTreeAnnouncement(child, childAnn); err != nil {
+				return
+			}
+			if withMiddle {
+				if err = r.state._handleTreeAnnouncement(middle, middleAnn); err != nil {
+					return
+				}
+			}
+			parent = r.state._parent
+			err = r.state._forward(child, bootstrap)
+			descending = r.state._descending
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent != nil {
+			t.Fatalf("expected to be the root")
+		}
+		for reason := range r._drops {
+			if dropped := r._drops[reason].Load(); dropped != 0 {
+				t.Fatalf("expected no frames to be dropped, got %d with reason %s", dropped, DropReason(reason))
+			}
+		}
+		// The middle peer will also have been sent our own announcements.
+		forwarded := false
+		for middle.proto.queuecount() > 0 {
+			f := <-middle.proto.pop()
+			middle.proto.ack()
+			if f.Type == types.TypeBootstrap && f.DestinationKey == child.public {
+				forwarded = true
+			}
+		}
+		switch {
+		case withMiddle && !forwarded:
+			// A node between the bootstrapping key and ours is closer, so
+			// the bootstrap should carry on to it.
+			t.Fatalf("expected the bootstrap to be forwarded to the closer peer")
+		case !withMiddle && (descending == nil || descending.PublicKey != child.public):
+			// Nobody is closer to the bootstrapping key than we are, so
+			// the bootstrap ends with us.
+			t.Fatalf("expected the bootstrap to end with us")
+		}
+	}
+}
+
+func TestSnakeNextHopCacheInvalidated(t *testing.T) {
+	clock := newTestClock()
+	r := newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff), RouterOptionClock{clock})
+	a := newTestPeer(r, 1, types.PublicKey{1})
+	b := newTestPeer(r, 2, types.PublicKey{2})
+	key := testPublicKey(newTestKey(t, 0x40, 0x80))
+	phony.Block(r.state, func() {
+		r.state._peers[a.port], r.state._peers[b.port] = a, b
+	})
+
+	nexthop := func() (p *peer, cached int) {
+		phony.Block(r.state, func() {
+			p, _ = r.state._nextHopsSNEK(key, types.TypeTraffic, types.VirtualSnakeWatermark{
+				PublicKey: types.FullMask,
+			})
+			cached = len(r.state._snakeCache)
+		})
+		return
+	}
+
+	addTestSnakeEntry(r, key, a)
+	if p, cached := nexthop(); p != a || cached != 1 {
+		t.Fatalf("expected the route via the first peer to be used and cached")
+	}
+	if p, _ := nexthop(); p != a {
+		t.Fatalf("expected the cached route to be used")
+	}
+
+	// Replacing the route should stop the cached next-hop from being used.
+	addTestSnakeEntry(r, key, b)
+	if p, _ := nexthop(); p != b {
+		t.Fatalf("expected the cache to be invalidated when the table changed")
+	}
+
+	// The route expiring shouldn't change the table, but the cached next-hop
+	// mustn't outlive it.
+	clock.Advance(r.snakeNeighExpiry * 2)
+	if p, _ := nexthop(); p == b {
+		t.Fatalf("expected the cached route to expire with the routing table entry")
+	}
+
+	// Neither should a cached next-hop be used once the peer has stopped.
+	addTestSnakeEntry(r, key, a)
+	if p, _ := nexthop(); p != a {
+		t.Fatalf("expected the new route via the first peer to be used")
+	}
+	a.started.Store(false)
+	if p, _ := nexthop(); p == a {
+		t.Fatalf("expected a stopped peer not to be used from the cache")
+	}
+}
+
+func BenchmarkSnakeNextHop(b *testing.B) {
+	r := newTestRouterWithKey(b, newTestKey(b, 0xc0, 0xff))
+	rootSK := newTestKey(b, 0xf0, 0xff)
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	for port := types.SwitchPortID(1); port <= 8; port++ {
+		sk := newTestKey(b, 0x00, 0xc0)
+		p := newTestPeer(r, port, testPublicKey(sk))
+		ann := newTestAnnouncement(b, root, rootSK, sk)
+		var err error
+		phony.Block(r.state, func() {
+			r.state._peers[port] = p
+			err = r.state._handleTreeAnnouncement(p, ann)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	var peers []*peer
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p != nil && p != r.local {
+				peers = append(peers, p)
+			}
+		}
+	})
+	for i := 0; i < 256; i++ {
+		addTestSnakeEntry(r, testPublicKey(newTestKey(b, 0x00, 0xc0)), peers[i%len(peers)])
+	}
+	dest := testPublicKey(newTestKey(b, 0x00, 0xc0))
+	watermark := types.VirtualSnakeWatermark{PublicKey: types.FullMask}
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Cached=%v", cached), func(b *testing.B) {
+			phony.Block(r.state, func() {
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !cached {
+						r.state._invalidateSnakeCache()
+					}
+					r.state._nextHopsSNEK(dest, types.TypeTraffic, watermark)
+				}
+			})
+		})
+	}
+}
+
+func TestSnakeMaintainInterval(t *testing.T) {
+	if r := newTestRouter(t, RouterOptionSnakeMaintainInterval(time.Microsecond)); r.snakeMaintainInterval != minSnakeMaintainInterval {
+		t.Fatalf("expected a too short interval to be raised to %s, got %s", minSnakeMaintainInterval, r.snakeMaintainInterval)
+	}
+
+	// Maintenance timers run on real time rather than the router's clock,
+	// so count how many times maintenance runs over a short period. Each run
+	// resets the bootstrap count, so set it and watch for that to happen.
+	const interval = time.Millisecond * 50
+	const period = interval * 10
+	r := newTestRouter(t, RouterOptionSnakeMaintainInterval(interval), RouterOptionTimerJitter(0))
+	runs := 0
+	for deadline := time.Now().Add(period); time.Now().Before(deadline); {
+		phony.Block(r.state, func() {
+			if r.state._bootstraps == 0 {
+				runs++
+				r.state._bootstraps = 1
+			}
+		})
+		time.Sleep(time.Millisecond * 2)
+	}
+	if expected := int(period / interval); runs < expected/2 || runs > expected*3/2 {
+		t.Fatalf("expected about %d maintenance runs, got %d", expected, runs)
+	}
+}
+
+func TestSnakeBootstrapRetriedOverLossyLink(t *testing.T) {
+	// Maintenance runs on real time, but whether a bootstrap is due depends
+	// on the router's clock, so a fast maintenance timer and a fake clock
+	// let us move through bootstrap intervals quickly.
+	clock := newTestClock()
+	opts := []RouterOption{RouterOptionClock{clock}, RouterOptionSnakeMaintainInterval(minSnakeMaintainInterval)}
+	a := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x80), opts...)
+	b := newTestRouterWithKey(t, newTestKey(t, 0x80, 0xff), opts...)
+	connectTestRouters(t, a, b)
+
+	// Half of the protocol frames that A sends to B are lost, including
+	// its bootstraps.
+	var lossy *linkImpairment
+	phony.Block(a.state, func() {
+		for _, p := range a.state._peers {
+			if p != nil && p.public == b.public {
+				lossy = p.impair(0.5, 0, 1)
+			}
+		}
+	})
+	if lossy == nil {
+		t.Fatalf("expected A to be peered with B")
+	}
+	waitForDescending := func() {
+		for i := 0; ; i++ {
+			var descending types.PublicKey
+			phony.Block(b.state, func() {
+				if desc := b.state._descending; desc != nil {
+					descending = desc.PublicKey
+				}
+			})
+			if descending == a.public {
+				return
+			}
+			if i == 100 {
+				t.Fatalf("expected B to learn about A over the lossy link, %d frames were lost", lossy.lost.Load())
+			}
+			clock.Advance(virtualSnakeBootstrapInterval)
+			time.Sleep(minSnakeMaintainInterval * 5)
+		}
+	}
+	waitForDescending()
+
+	// Once the tree has settled, the only protocol frames that A sends are
+	// its bootstraps. Each time B forgets about A, A's next bootstrap that
+	// makes it through should put things right, however many are lost.
+	before := lossy.lost.Load()
+	for i := 0; i < 20; i++ {
+		phony.Block(b.state, func() {
+			b.state._setDescendingNode(nil)
+			b.state._removeRouteEntry(virtualSnakeIndex{PublicKey: a.public})
+		})
+		waitForDescending()
+	}
+	if lossy.lost.Load() == before {
+		t.Fatalf("expected some bootstraps to be lost")
+	}
+}
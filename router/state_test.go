@@ -0,0 +1,64 @@
+package router
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/Arceliar/phony"
+)
+
+func TestTimerJitter(t *testing.T) {
+	const interval = time.Second
+	const jitter = 0.1
+	min := interval - time.Duration(jitter*float64(interval))
+	max := interval + time.Duration(jitter*float64(interval))
+
+	jittered := func(r *Router, d time.Duration, count int) []time.Duration {
+		intervals := make([]time.Duration, 0, count)
+		phony.Block(r.state, func() {
+			r.state._jitter = rand.New(rand.NewSource(1))
+			for i := 0; i < count; i++ {
+				intervals = append(intervals, r.state._jittered(d))
+			}
+		})
+		return intervals
+	}
+
+	r := newTestRouter(t, RouterOptionTimerJitter(jitter))
+	intervals := jittered(r, interval, 100)
+	varied := false
+	for _, d := range intervals {
+		if d < min || d > max {
+			t.Fatalf("interval %s is outside of the range %s to %s", d, min, max)
+		}
+		if d != intervals[0] {
+			varied = true
+		}
+	}
+	if !varied {
+		t.Fatalf("expected the intervals to vary")
+	}
+
+	// The same seed should give the same intervals.
+	for i, d := range jittered(r, interval, len(intervals)) {
+		if d != intervals[i] {
+			t.Fatalf("expected interval %d to be %s with the same seed, got %s", i, intervals[i], d)
+		}
+	}
+
+	// Maintenance that should happen straight away must not be delayed.
+	for _, d := range jittered(r, 0, 10) {
+		if d != 0 {
+			t.Fatalf("expected no jitter on an immediate run, got %s", d)
+		}
+	}
+
+	// Without jitter the intervals should be exact.
+	r = newTestRouter(t, RouterOptionTimerJitter(0))
+	for _, d := range jittered(r, interval, 10) {
+		if d != interval {
+			t.Fatalf("expected interval %s without jitter, got %s", interval, d)
+		}
+	}
+}
@@ -15,7 +15,12 @@
 package router
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash/fnv"
 	"math"
 	"time"
 
@@ -36,35 +41,78 @@ func (s *state) _maintainTree() {
 	case <-s.r.context.Done():
 		return
 	default:
-		defer s._maintainTreeIn(announcementInterval)
+		defer s._maintainTreeIn(s.r.announceInterval)
 	}
+	s.r._treeWatch.ran()
 
 	// If we don't have a parent then we are acting as if we are a root node,
 	// so we need to send tree announcements to our peers. In each instance,
 	// we will update the sequence number so that downstream nodes know that
-	// it's a new update.
+	// it's a new update. If we do have a parent but it has stopped sending
+	// us announcements then we should assume that it is dead and look for
+	// another one.
 	if s._parent == nil {
 		s._sequence++
 		s._sendTreeAnnouncements()
+	} else if ann := s._announcements[s._parent]; ann == nil || s.r.clock.Now().Sub(ann.receiveTime) >= s.r.announceTimeout {
+		s._recordParentFailure(s._parent)
+		if s._selectNewParent() {
+			s._bootstrapSoon()
+		}
 	}
 }
 
 type rootAnnouncementWithTime struct {
 	types.SwitchAnnouncement
-	receiveTime  time.Time // when did we receive the update?
-	receiveOrder uint64    // the relative order that the update was received
+	receiveTime  time.Time         // when did we receive the update?
+	receiveOrder uint64            // the relative order that the update was received
+	coords       types.Coordinates // cached result of Coords, if not nil
+	peerCoords   types.Coordinates // cached result of PeerCoords, if not nil
+	raw          []byte            // the payload as received, to spot repeats
+	rawExtra     byte              // the Extra field as received, to spot repeats
+}
+
+// cacheCoords works out the coordinates from the announcement signatures
+// up front, so that they don't need to be worked out again for every frame
+// that we forward. It must be called again if the signatures change.
+func (a *rootAnnouncementWithTime) cacheCoords() {
+	a.coords = a.SwitchAnnouncement.Coords()
+	a.peerCoords = a.SwitchAnnouncement.PeerCoords()
+}
+
+// Coords returns our coordinates if the sender of the announcement were our
+// parent. The result is shared and must not be modified.
+func (a *rootAnnouncementWithTime) Coords() types.Coordinates {
+	if a.coords != nil {
+		return a.coords
+	}
+	return a.SwitchAnnouncement.Coords()
+}
+
+// PeerCoords returns the coordinates of the sender of the announcement. The
+// result is shared and must not be modified.
+func (a *rootAnnouncementWithTime) PeerCoords() types.Coordinates {
+	if a.peerCoords != nil {
+		return a.peerCoords
+	}
+	return a.SwitchAnnouncement.PeerCoords()
 }
 
 // forPeer generates a frame with a signed root announcement for the given
 // peer.
 func (a *rootAnnouncementWithTime) forPeer(p *peer) *types.Frame {
-	if p == nil || p.port == 0 {
-		panic("trying to send announcement to nil port or port 0")
-	}
-	announcement := a.SwitchAnnouncement
-	announcement.Signatures = append([]types.SignatureWithHop{}, a.Signatures...)
-	for _, sig := range announcement.Signatures {
-		if p.router.public == sig.PublicKey {
+	return a.forPeerWithSignature(p, a.sign(p.router))
+}
+
+// sign generates our signature for the root announcement. Since the hop port
+// isn't covered by the signature, the result can be used with
+// forPeerWithSignature to send the announcement to any number of peers. The
+// signature is cached, so signing the same announcement again, e.g. from
+// forPeer, doesn't cost another signing operation.
+func (a *rootAnnouncementWithTime) sign(r *Router) types.SignatureWithHop {
+	public, private := r.keyPair()
+	for _, sig := range a.Signatures {
+		if public == sig.PublicKey {
 			// For some reason the announcement that we want to send already
 			// includes our signature. This shouldn't really happen but if we
 			// did send it, other nodes would end up ignoring the announcement
@@ -72,17 +120,37 @@ func (a *rootAnnouncementWithTime) forPeer(p *peer) *types.Frame {
 			panic("trying to send announcement with loop")
 		}
 	}
-	// Sign the announcement.
-	if err := announcement.Sign(p.router.private[:], p.port); err != nil {
+	sig, err := r._signatures.sign(&a.SwitchAnnouncement, public, private)
+	if err != nil {
 		panic("failed to sign switch announcement: " + err.Error())
 	}
+	return sig
+}
+
+// forPeerWithSignature generates a frame with the root announcement for the
+// given peer, using a signature previously generated by sign.
+func (a *rootAnnouncementWithTime) forPeerWithSignature(p *peer, sig types.SignatureWithHop) *types.Frame {
+	if p == nil || p.port == 0 {
+		panic("trying to send announcement to nil port or port 0")
+	}
+	sig.Hop = types.Varu64(p.port)
+	announcement := a.SwitchAnnouncement
+	announcement.Signatures = append(make([]types.SignatureWithHop, 0, len(a.Signatures)+1), a.Signatures...)
+	announcement.Signatures = append(announcement.Signatures, sig)
 	frame := getFrame()
 	frame.Type = types.TypeTreeAnnouncement
-	n, err := announcement.MarshalBinary(frame.Payload[:cap(frame.Payload)])
+	marshal := announcement.MarshalBinary
+	if p.revision >= revisionCompactAnnouncements {
+		// The peer can fill in the public keys that it already knows.
+		marshal = announcement.MarshalCompact
+		frame.Extra |= types.FlagCompactAnnouncement
+	}
+	n, err := marshal(frame.Payload[:cap(frame.Payload)])
 	if err != nil {
 		panic("failed to marshal switch announcement: " + err.Error())
 	}
 	frame.Payload = frame.Payload[:n]
+	p.router._frameTypeStats.sent(types.TypeTreeAnnouncement, true)
 	return frame
 }
 
@@ -93,22 +161,34 @@ func (s *state) _rootAnnouncement() *rootAnnouncementWithTime {
 	if s._parent == nil || s._announcements[s._parent] == nil {
 		return &rootAnnouncementWithTime{
 			SwitchAnnouncement: types.SwitchAnnouncement{
-				Root: types.Root{
-					RootPublicKey: s.r.public,
-					RootSequence:  types.Varu64(s._sequence),
-				},
+				Root: s._ourRoot(s._sequence),
 			},
 		}
 	}
 	return s._announcements[s._parent]
 }
 
+// _ourRoot returns the root that we announce, with the given sequence number,
+// when we are the root node. If we are the pinned root then it is marked as
+// such.
+func (s *state) _ourRoot(sequence uint64) types.Root {
+	root := types.Root{
+		RootPublicKey: s.r.PublicKey(),
+		RootSequence:  types.Varu64(sequence),
+	}
+	if s.r.pinnedRoot {
+		root.RootSequence |= pinnedRootSequence
+	}
+	return root
+}
+
 // coords returns our tree coordinates, or an empty array if we are the
 // root. This function is safe to be called from other actors.
 func (s *state) coords() types.Coordinates {
 	var coords types.Coordinates
 	phony.Block(s, func() {
-		coords = s._coords()
+		ours := s._coords()
+		coords = ours.Copy()
 	})
 	return coords
 }
@@ -122,6 +202,21 @@ func (s *state) _coords() types.Coordinates {
 	return types.Coordinates{}
 }
 
+// _ancestors returns the public keys of the nodes on our path to the root,
+// starting with the root and ending with our parent. It is empty if we are
+// the root.
+func (s *state) _ancestors() []types.PublicKey {
+	if s._parent == nil {
+		return nil
+	}
+	ann := s._rootAnnouncement()
+	ancestors := make([]types.PublicKey, 0, len(ann.Signatures))
+	for _, sig := range ann.Signatures {
+		ancestors = append(ancestors, sig.PublicKey)
+	}
+	return ancestors
+}
+
 // _becomeRoot removes our current parent, effectively making us a root
 // node. It then kicks off tree maintenance, which will result in a tree
 // announcement being sent to our peers.
@@ -133,23 +228,131 @@ func (s *state) _becomeRoot() {
 	s._maintainTree()
 }
 
+// _promote makes us the root node straight away, sending out new root
+// announcements, rather than waiting for parent selection to do so. This
+// can't be used to override a stronger root: if any of our peers has a
+// current announcement from a root stronger than our own key, an error is
+// returned and nothing changes.
+func (s *state) _promote() error {
+	ourRoot := s._ourRoot(s._sequence + 1)
+	for p, ann := range s._announcements {
+		switch {
+		case ann == nil || !p.started.Load():
+			continue
+		case s.r.clock.Now().Sub(ann.receiveTime) >= s.r.announceTimeout:
+			continue
+		case s._compareRoots(ann.Root, ourRoot) > 0:
+			return fmt.Errorf("peer %s is following a stronger root", p.public.String()[:8])
+		}
+	}
+	if s._parent != nil {
+		s._setParent(nil)
+	}
+	s._maintainTree()
+	return nil
+}
+
+// _demote runs parent selection again, so that we will follow a stronger
+// root than our own if any of our peers has one.
+func (s *state) _demote() {
+	if s._selectNewParent() {
+		s._bootstrapSoon()
+	}
+}
+
+// _sendLeaving sends a final tree announcement to each of our peers, flagged
+// to say that we are leaving, and returns the peers that it was sent to.
+func (s *state) _sendLeaving() []*peer {
+	var peers []*peer
+	ann := s._rootAnnouncement()
+	var sig *types.SignatureWithHop
+	for _, p := range s._peers {
+		if p == nil || p.port == 0 || !p.started.Load() {
+			continue
+		}
+		if sig == nil {
+			signature := ann.sign(s.r)
+			sig = &signature
+		}
+		f := ann.forPeerWithSignature(p, *sig)
+		f.Extra |= types.FlagLeaving
+		if !p.send(f) {
+			framePool.Put(f)
+			continue
+		}
+		if p.conn != nil {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// _bumpSequence increases the sequence number of our root announcement and
+// sends it to our peers straight away, rather than waiting for the next tree
+// maintenance to do so. It does nothing if we aren't the root.
+func (s *state) _bumpSequence() {
+	if s._parent != nil {
+		return
+	}
+	s._sequence++
+	s._sendTreeAnnouncements()
+}
+
 // sendTreeAnnouncementToPeer signs and sends the given root announcement
 // to a given peer.
 func (s *state) sendTreeAnnouncementToPeer(ann *rootAnnouncementWithTime, p *peer) {
-	p.proto.push(ann.forPeer(p))
+	if f := ann.forPeer(p); !p.send(f) {
+		framePool.Put(f)
+	}
 }
 
-// _sendTreeAnnouncements signs and sends the current root announcement to
-// all of our active peers.
+// _sendTreeAnnouncements schedules the current root announcement to be signed
+// and sent to all of our peers. Several calls that happen before the state
+// actor gets around to sending them, e.g. when processing a burst of updates,
+// are coalesced into a single round of announcements, which will carry the
+// root announcement as it is at that point.
 func (s *state) _sendTreeAnnouncements() {
+	if s._announcing {
+		return
+	}
+	s._announcing = true
+	s.Act(nil, s._flushTreeAnnouncements)
+}
+
+// _flushTreeAnnouncements signs the current root announcement once and then
+// sends it to all of our peers.
+func (s *state) _flushTreeAnnouncements() {
+	s._announcing = false
 	ann := s._rootAnnouncement()
+	var sig *types.SignatureWithHop
 	for _, p := range s._peers {
 		if p == nil || p.port == 0 || !p.started.Load() {
 			continue
 		}
-		s.sendTreeAnnouncementToPeer(ann, p)
+		if sig == nil {
+			signature := ann.sign(s.r)
+			sig = &signature
+		}
+		if f := ann.forPeerWithSignature(p, *sig); !p.send(f) {
+			framePool.Put(f)
+		}
+	}
+
+	// If our coordinates have changed as a result of this announcement then
+	// let the application know. The callback is run from the router actor
+	// rather than the state actor so that it is free to call back into the
+	// router without deadlocking.
+	if coords := ann.Coords(); !coords.EqualTo(s._lastCoords) {
+		s._lastCoords = coords
+		s._treeChanged = s.r.clock.Now()
+		if cb := s.r.coordsChanged; cb != nil {
+			s.r.Act(nil, func() {
+				cb(coords.Copy())
+			})
+		}
 	}
 
+	ours := ann.RootPublicKey == s.r.PublicKey()
 	s.r.Act(nil, func() {
 		coords := []uint64{}
 		for _, val := range ann.Coords() {
@@ -157,8 +360,8 @@ func (s *state) _sendTreeAnnouncements() {
 		}
 
 		var announcementTime int64
-		if ann.RootPublicKey == s.r.public {
-			announcementTime = time.Now().UnixNano()
+		if ours {
+			announcementTime = s.r.clock.Now().UnixNano()
 		} else {
 			announcementTime = ann.receiveTime.UnixNano()
 		}
@@ -179,12 +382,17 @@ type treeNextHopParams struct {
 	selfPeer          *peer
 	lastAnnouncement  *rootAnnouncementWithTime
 	peerAnnouncements *announcementTable
+	costMargin        int64
+	flow              uint64    // Used to choose between equally good next-hops
+	staleBefore       time.Time // Announcements received before this are stale, if set
 }
 
 // _nextHopsTree returns the best next-hop candidate for a given frame. The
 // "from" peer must be supplied in order to prevent routing loops. It is
 // possible for this function to return nil if no next best-hop is available.
-func (s *state) _nextHopsTree(from *peer, dest types.Coordinates) *peer {
+// Where more than one peer is equally good, the flow is used to choose one,
+// so frames with the same flow will always take the same path.
+func (s *state) _nextHopsTree(from *peer, dest types.Coordinates, flow uint64, excluded ...*peer) *peer {
 	nextHopParams := treeNextHopParams{
 		dest,
 		s._coords(),
@@ -192,12 +400,15 @@ func (s *state) _nextHopsTree(from *peer, dest types.Coordinates) *peer {
 		s.r.local,
 		s._rootAnnouncement(),
 		&s._announcements,
+		s.r.treeCostMargin,
+		flow,
+		s.r.clock.Now().Add(-s.r.staleAnnouncement),
 	}
 
-	return getNextHopTree(nextHopParams)
+	return getNextHopTree(nextHopParams, excluded...)
 }
 
-func getNextHopTree(params treeNextHopParams) *peer {
+func getNextHopTree(params treeNextHopParams, excluded ...*peer) *peer {
 	// If it's loopback then don't bother doing anything else.
 	if params.destinationCoords.EqualTo(params.ourCoords) {
 		return params.selfPeer
@@ -215,41 +426,118 @@ func getNextHopTree(params treeNextHopParams) *peer {
 		return params.selfPeer
 	}
 
-	// Now work out which of our peers takes the message closer.
-	var bestPeer *peer
-	bestDist := ourDist
-	bestType := math.MaxUint16
-	bestOrdering := uint64(math.MaxUint64)
+	// candidateDistance returns the distance across the tree from the given
+	// peer to the destination, or false if the peer isn't a suitable next-hop.
 	ourRoot := params.lastAnnouncement
-	for p, ann := range *params.peerAnnouncements {
+	candidateDistance := func(p *peer, ann *rootAnnouncementWithTime) (int64, bool) {
 		switch {
 		case !p.started.Load():
-			continue // ignore peers that have stopped
+			return 0, false // ignore peers that have stopped
 		case ann == nil:
-			continue // ignore peers that haven't sent us announcements
+			return 0, false // ignore peers that haven't sent us announcements
 		case p == params.fromPeer:
-			continue // don't route back where the packet came from
+			return 0, false // don't route back where the packet came from
+		case peerExcluded(p, excluded):
+			return 0, false // ignore peers that we've been told not to use
 		case !ourRoot.Root.EqualTo(&ann.Root):
-			continue // ignore peers that are following a different root or seq
+			return 0, false // ignore peers that are following a different root or seq
+		}
+		return int64(ann.PeerCoords().DistanceTo(params.destinationCoords)), true
+	}
+
+	// Work out how close the closest of our peers can take the message. Any
+	// peer within the cost margin of this distance, whilst still taking the
+	// message closer than we are, is a candidate. A peer whose announcement
+	// is stale may be about to time out, so if any peer with a fresh
+	// announcement can take the message closer then only those are used.
+	stale := func(ann *rootAnnouncementWithTime) bool {
+		return ann.receiveTime.Before(params.staleBefore)
+	}
+	minDist, minFreshDist := ourDist, ourDist
+	for p, ann := range *params.peerAnnouncements {
+		peerDist, ok := candidateDistance(p, ann)
+		if !ok {
+			continue
+		}
+		if peerDist < minDist {
+			minDist = peerDist
 		}
+		if peerDist < minFreshDist && !stale(ann) {
+			minFreshDist = peerDist
+		}
+	}
+	skipStale := minFreshDist < ourDist
+	if skipStale {
+		minDist = minFreshDist
+	}
+	maxDist := minDist + params.costMargin
 
-		// Look up the coordinates of the peer, and the distance
-		// across the tree to those coordinates.
-		peerCoords := ann.PeerCoords()
-		peerDist := int64(peerCoords.DistanceTo(params.destinationCoords))
+	// Now work out which of our peers takes the message closer. Cheaper links
+	// are preferred amongst the candidates, otherwise the closest one wins.
+	// Where peers are exactly as good as each other, the one that scores
+	// highest for the flow wins, so that different flows are spread across
+	// them but each flow always takes the same path.
+	var bestPeer *peer
+	var bestScore uint64
+	var bestCost uint32
+	bestDist := ourDist
+	bestType := math.MaxUint16
+	bestOrdering := uint64(math.MaxUint64)
+	for p, ann := range *params.peerAnnouncements {
+		peerDist, ok := candidateDistance(p, ann)
+		if !ok || peerDist >= ourDist || peerDist > maxDist || (skipStale && stale(ann)) {
+			continue
+		}
+		peerCost := p.cost.Load()
 		peerType := int(p.peertype)
-		if isBetterNextHopCandidate(
+		switch {
+		case bestPeer != nil && peerCost < bestCost:
+			// The peer is a cheaper link than our current best candidate.
+		case bestPeer != nil && peerCost > bestCost:
+			// The peer is a more expensive link than our current best candidate.
+			continue
+		case !isBetterNextHopCandidate(
 			peerType, peerDist, ann.receiveOrder,
 			bestType, bestDist, bestOrdering,
 			bestPeer == p,
-		) {
-			bestPeer, bestDist, bestOrdering, bestType = p, peerDist, ann.receiveOrder, peerType
+		):
+			if bestPeer == nil || peerDist != bestDist {
+				continue
+			}
+			if flowScore(params.flow, p.port) <= bestScore {
+				continue
+			}
 		}
+		bestPeer, bestDist, bestOrdering, bestType, bestCost = p, peerDist, ann.receiveOrder, peerType, peerCost
+		bestScore = flowScore(params.flow, p.port)
 	}
 
 	return bestPeer
 }
 
+// flowScore mixes the flow with the port number of a peer. Picking the peer
+// with the highest score spreads flows evenly across the peers and, unlike
+// taking the flow modulo the number of peers, only moves the flows for that
+// peer when a peer comes or goes.
+func flowScore(flow uint64, port types.SwitchPortID) uint64 {
+	x := flow ^ uint64(port)*0x9e3779b97f4a7c15
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// flowHash returns a value identifying the flow that a frame belongs to, so
+// that frames between the same pair of nodes can be kept on the same path.
+func flowHash(f *types.Frame) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(f.SourceKey[:])
+	_, _ = h.Write(f.DestinationKey[:])
+	return h.Sum64()
+}
+
 func isBetterNextHopCandidate(
 	peerType int, peerDistance int64, peerOrder uint64,
 	bestType int, bestDistance int64, bestOrder uint64,
@@ -291,26 +579,86 @@ const (
 // received from a direct peer. It stores the update and then works out
 // if that update is good news or bad news.
 func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
+	// If the peer is shutting down then it won't be sending us any more
+	// announcements. Forget the last one, so that we don't choose it as our
+	// parent again, and if it is our parent then look for another one now
+	// rather than waiting for its announcement to time out. Older nodes
+	// don't know about the flag and will handle the announcement normally.
+	if f.Extra&types.FlagLeaving != 0 {
+		delete(s._announcements, p)
+		s._invalidateSnakeCache()
+		if s._parent == p && s._selectNewParent() {
+			s._bootstrapSoon()
+		}
+		return nil
+	}
+
+	// Peers often send us the same announcement again, for example when
+	// something changes that only matters to their other peers. If it's
+	// identical to the last one, which we have already verified and acted
+	// upon, then it only tells us that the peer is still alive, so we can
+	// skip checking the signatures and choosing a parent again. That isn't
+	// true if the last one had timed out, since the peer will have been
+	// treated as dead in the meantime.
+	if ann := s._announcements[p]; ann != nil && ann.raw != nil && ann.rawExtra == f.Extra && bytes.Equal(ann.raw, f.Payload) {
+		if now := s.r.clock.Now(); now.Sub(ann.receiveTime) < s.r.announceTimeout {
+			// Other actors may still be reading the stored announcement, so
+			// replace it with an updated copy rather than changing it.
+			updated := *ann
+			updated.receiveTime = now
+			s._announcements[p] = &updated
+			return nil
+		}
+	}
+
+	// Since every signature has to be verified, reject announcements with
+	// more signatures than we are willing to accept before unmarshalling.
+	maxSignatures := s.r.maxAnnouncementSignatures
+	if l := len(f.Payload); l > maxAnnouncementLength(maxSignatures) {
+		return fmt.Errorf("update is too long (%d bytes) to contain at most %d signatures", l, maxSignatures)
+	}
+
 	// Unmarshal the frame and check that it is sane. The sanity checks
 	// do things like ensure that all updates are signed, the first
 	// signature is from the root, the last signature is from our direct
 	// peer etc.
 	var newUpdate types.SwitchAnnouncement
-	if _, err := newUpdate.UnmarshalBinary(f.Payload); err != nil {
+	unmarshal := newUpdate.UnmarshalBinary
+	if f.Extra&types.FlagCompactAnnouncement != 0 {
+		unmarshal = func(data []byte) (int, error) {
+			return newUpdate.UnmarshalCompact(data, p.public)
+		}
+	}
+	if _, err := unmarshal(f.Payload); err != nil {
 		return fmt.Errorf("update unmarshal failed: %w", err)
 	}
+	if l := len(newUpdate.Signatures); l > maxSignatures {
+		return fmt.Errorf("update has too many signatures (%d, maximum %d)", l, maxSignatures)
+	}
 	if err := newUpdate.SanityCheck(p.public); err != nil {
 		return fmt.Errorf("update sanity checks failed: %w", err)
 	}
 
 	isFirstAnnouncement := false
 	shouldSendBroadcast := false
+	regressed := false
 
-	// If the peer is replaying an old sequence number to us then we
-	// assume that they are up to no good.
+	// If the peer is replaying an old sequence number to us, or the sequence
+	// number has jumped further ahead than it possibly could have, then we
+	// assume that they are up to no good. The exception is our parent going
+	// back to an older sequence number, which can happen if it switches to a
+	// path that the latest update hasn't reached yet.
 	if ann := s._announcements[p]; ann != nil {
-		if newUpdate.RootPublicKey == ann.RootPublicKey && newUpdate.RootSequence < ann.RootSequence {
-			return fmt.Errorf("update replays old sequence number")
+		if newUpdate.RootPublicKey == ann.RootPublicKey {
+			if compareRootSequences(newUpdate.RootSequence, ann.RootSequence) < 0 {
+				if p != s._parent {
+					return fmt.Errorf("update replays old sequence number")
+				}
+				regressed = true
+			}
+			if !rootSequenceJumpIsSane(newUpdate.RootSequence, ann.RootSequence) {
+				return fmt.Errorf("update sequence number jumps too far ahead")
+			}
 		}
 	} else {
 		isFirstAnnouncement = true
@@ -331,38 +679,70 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 	// Get the key of our current root and then work out if the root
 	// key in the new update is stronger, weaker or the same key.
 	lastParentUpdate := s._rootAnnouncement()
-	lastRootKey := s.r.public
+	lastRoot := s._ourRoot(0)
 	if lastParentUpdate != nil {
-		lastRootKey = lastParentUpdate.RootPublicKey
+		lastRoot = lastParentUpdate.Root
 	}
-	rootDelta := newUpdate.RootPublicKey.CompareTo(lastRootKey)
+	rootDelta := s._compareRoots(newUpdate.Root, lastRoot)
 
 	// Save the root announcement for the peer. If the update is not
-	// obviously bad then it isn't safe to "skip" storing updates.
+	// obviously bad then it isn't safe to "skip" storing updates. This is
+	// true even if our parent has gone back to an older sequence number,
+	// since the older update is the path that the parent really has now.
 	s._ordering++
 	s._announcements[p] = &rootAnnouncementWithTime{
 		SwitchAnnouncement: newUpdate,
-		receiveTime:        time.Now(),
+		receiveTime:        s.r.clock.Now(),
 		receiveOrder:       s._ordering,
+		raw:                append([]byte(nil), f.Payload...),
+		rawExtra:           f.Extra,
 	}
+	s._announcements[p].cacheCoords()
+	s._invalidateSnakeCache()
 
 	// If we're currently waiting to re-parent then there is no
 	// further action
 	if !s._waiting {
 		announcementAction := determineAnnouncementAction(p == s._parent,
-			newUpdate.IsLoopOrChildOf(s.r.public), rootDelta,
+			newUpdate.IsLoopOrChildOf(s.r.PublicKey()), rootDelta,
 			newUpdate.RootSequence, lastParentUpdate.RootSequence)
 
 		switch announcementAction {
 		case DropFrame:
 			// Do nothing
 		case AcceptUpdate:
+			if newUpdate.RootPublicKey != lastParentUpdate.RootPublicKey {
+				s._rootChanged(lastParentUpdate.RootPublicKey, newUpdate.RootPublicKey)
+			}
+			if s.r.rootElectionBand > 0 && s._compareRoots(newUpdate.Root, s._ourRoot(s._sequence+1)) < 0 {
+				// Under weighted root election, a new epoch can make our
+				// root weaker than our own key, in which case it's our
+				// turn to be the root.
+				if s._selectNewParent() {
+					s._bootstrapSoon()
+				}
+				break
+			}
 			s._sendTreeAnnouncements()
 		case AcceptNewParent:
+			if !s._allowedParent(p) {
+				// We aren't allowed to use this peer as our parent, so
+				// look for the best peer that we are allowed to use.
+				if s._selectNewParent() {
+					s._bootstrapSoon()
+				}
+				break
+			}
 			s._setParent(p)
 			s._sendTreeAnnouncements()
 		case SelectNewParent:
-			if s._selectNewParent() {
+			// If our parent has gone backwards then it is behind the rest
+			// of the tree, so choose another parent that is up to date.
+			var excluded []*peer
+			if regressed {
+				excluded = append(excluded, p)
+			}
+			if s._selectNewParent(excluded...) {
 				s._bootstrapSoon()
 			}
 		case SelectNewParentWithWait:
@@ -386,7 +766,11 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 
 	if shouldSendBroadcast {
 		if broadcast, err := s._createBroadcastFrame(); err == nil {
-			p.send(broadcast)
+			if !p.send(broadcast) {
+				framePool.Put(broadcast)
+			} else {
+				s.r._frameTypeStats.sent(types.TypeWakeupBroadcast, true)
+			}
 		}
 	}
 
@@ -411,24 +795,29 @@ func determineAnnouncementAction(senderIsParent bool, updateContainsLoop bool,
 			// news.
 			action = SelectNewParentWithWait
 		case rootDelta == 0 && newRootSequence == lastRootSequence:
-			// The update contains the same root key, but the sequence
-			// number is being replayed. This usually happens when the
-			// parent has chosen a new parent and is re-signing the last
-			// update to notify their peers of their new coordinates.
-			// In this case, we consider this also to be bad news. We
-			// will switch to being the root, which notifies our peers
-			// of the bad news (since the update will be coming from a
-			// weaker key) and then we start a 1 second timer, after
-			// which we will re-run the parent selection. During that 1
-			// second period, we will not act on root updates apart from
-			// saving them.
-			action = SelectNewParentWithWait
+			// The update contains the same root key and sequence number
+			// as before. This usually happens when the parent has chosen
+			// a new parent and is re-signing the last update to notify
+			// their peers of their new coordinates. The root hasn't
+			// changed and the update doesn't contain a loop, so the
+			// parent is still a valid choice and there's no need to
+			// re-parent. We will repeat the update to our peers, since
+			// our own coordinates have changed along with our parent's.
+			// Exact repeats of the last update never get this far.
+			action = AcceptUpdate
+		case rootDelta == 0 && compareRootSequences(newRootSequence, lastRootSequence) < 0:
+			// The update contains the same root key but an older sequence
+			// number than before, so the parent has gone back to an older
+			// update, possibly because it has switched to a path that the
+			// latest update hasn't reached yet. Another peer may now be a
+			// better parent, so we will re-run parent selection.
+			action = SelectNewParent
 		case rootDelta > 0:
 			// The root update contains a stronger key than before.
 			// Since this node is already our parent, we can just send out
 			// the update as normal.
 			action = AcceptUpdate
-		case rootDelta == 0 && newRootSequence > lastRootSequence:
+		case rootDelta == 0 && compareRootSequences(newRootSequence, lastRootSequence) > 0:
 			// The root update contains the same key as before but it has
 			// a new sequence number, so the parent is repeating a new
 			// update to us. We will repeat that update to our peers.
@@ -470,7 +859,25 @@ func determineAnnouncementAction(senderIsParent bool, updateContainsLoop bool,
 // and decide if we should re-parent. If a new peer is selected, this
 // function will return true. If no change is made, or we become the root
 // as a result, this function will return false.
-func (s *state) _selectNewParent() bool {
+//
+// Candidates are ordered by root key first, then by root sequence number,
+// then by the length of their path to the root, then by the order in which
+// their announcements were received. To stop the tree from flapping between
+// two equally good peers, we will keep our current parent unless a candidate
+// offers a stronger root key or a shorter path to the root than it, or the
+// current parent is no longer usable, i.e. it has stopped, timed out or now
+// contains a loop. Any excluded peers, including our current parent, won't
+// be chosen.
+func (s *state) _selectNewParent(excluded ...*peer) bool {
+	isExcluded := func(p *peer) bool {
+		for _, e := range excluded {
+			if e == p {
+				return true
+			}
+		}
+		return false
+	}
+
 	// Start with our current root key as the strongest candidate. If we
 	// don't have any peers that also have this root update then this will
 	// cause us to fail parent selection, marking ourselves as the root.
@@ -478,15 +885,17 @@ func (s *state) _selectNewParent() bool {
 	bestRoot := root.Root
 
 	// If our own key happens to be stronger than our current root for some
-	// reason then we will just compare against our own key instead.
-	if bestRoot.RootPublicKey.CompareTo(s.r.public) < 0 {
-		bestRoot = types.Root{
-			RootPublicKey: s.r.public,
-			RootSequence:  0,
-		}
+	// reason then we will just compare against our own key instead. We use
+	// the sequence number that we would announce if we became the root, as
+	// that decides how we rank under weighted root election.
+	if ourRoot := s._ourRoot(s._sequence + 1); s._compareRoots(bestRoot, ourRoot) < 0 {
+		bestRoot = ourRoot
 	}
 	bestOrder := uint64(math.MaxUint64)
+	bestLen := math.MaxInt
 	var bestPeer *peer
+	ours := s.r.PublicKey()
+	now := s.r.clock.Now()
 
 	// Iterate through all of the announcements received from our peers.
 	// This will exclude any peers that haven't sent us updates yet.
@@ -497,15 +906,38 @@ func (s *state) _selectNewParent() bool {
 			continue
 		}
 
+		if !s._allowedParent(peer) || isExcluded(peer) {
+			// The application doesn't want us to use this peer as our
+			// parent, or it has been excluded by the caller.
+			continue
+		}
+
 		if ann != nil {
-			if isBetterParentCandidate(*ann, bestRoot, bestOrder, ann.IsLoopOrChildOf(s.r.public)) {
+			// If our current parent is tied with another candidate on root
+			// key, sequence number and path length then we'd rather keep it
+			// than switch to whichever peer's announcement arrived first, so
+			// treat the parent's announcement as the earliest.
+			candidate := *ann
+			if peer == s._parent {
+				candidate.receiveOrder = 0
+			}
+			if isBetterParentCandidate(candidate, bestRoot, bestLen, bestOrder, ann.IsLoopOrChildOf(ours), s.r.rootElectionBand, s.r.acceptPinnedRoot, s.r.announceTimeout, now) {
 				bestRoot = ann.Root
 				bestPeer = peer
-				bestOrder = ann.receiveOrder
+				bestLen = len(ann.Signatures)
+				bestOrder = candidate.receiveOrder
 			}
 		}
 	}
 
+	// If the best candidate is only as good as our current parent in terms
+	// of root key and path length then stick with the parent we already have.
+	if parent := s._parent; bestPeer != nil && parent != nil && bestPeer != parent && parent.started.Load() && !isExcluded(parent) {
+		if ann := s._announcements[parent]; ann != nil && shouldKeepParent(*ann, bestRoot, bestLen, ann.IsLoopOrChildOf(ours), s.r.announceTimeout, now) {
+			return false
+		}
+	}
+
 	// If we found a suitable candidate then we should see if a change needs
 	// to be made.
 	if bestPeer != nil {
@@ -528,11 +960,59 @@ func (s *state) _selectNewParent() bool {
 	return false
 }
 
+// _allowedParent returns true if the given peer may be chosen as our parent,
+// as decided by RouterOptionParentFilter, and it isn't being penalised for
+// flapping.
+func (s *state) _allowedParent(p *peer) bool {
+	if entry, ok := s._parentFlaps[p.public]; ok && entry.penalised(s.r.clock.Now()) {
+		return false
+	}
+	return s.r.parentFilter == nil || s.r.parentFilter(p.public)
+}
+
+type parentFlapEntry struct {
+	count     int
+	firstSeen time.Time
+	until     time.Time // Excluded from parent selection until then, if set
+}
+
+// penalised returns true if the peer is excluded from parent selection.
+func (e *parentFlapEntry) penalised(now time.Time) bool {
+	return now.Before(e.until)
+}
+
+// _recordParentFailure records that our parent has timed out or disconnected.
+// A parent that keeps winning parent selection and then failing again will
+// make us thrash, so if it fails parentFlapThreshold times within the flap
+// window then it is excluded from parent selection for a while. Failures are
+// forgotten once the window has passed, so a peer that later settles down
+// can be chosen again.
+func (s *state) _recordParentFailure(p *peer) {
+	now := s.r.clock.Now()
+	window := s.r.announceTimeout * parentFlapWindow
+	for k, v := range s._parentFlaps {
+		if now.Sub(v.firstSeen) >= window && !v.penalised(now) {
+			delete(s._parentFlaps, k)
+		}
+	}
+	entry, ok := s._parentFlaps[p.public]
+	if !ok || now.Sub(entry.firstSeen) >= window {
+		entry = parentFlapEntry{firstSeen: now, until: entry.until}
+	}
+	entry.count++
+	if entry.count >= parentFlapThreshold {
+		entry.count, entry.firstSeen = 0, now
+		entry.until = now.Add(s.r.announceTimeout * parentFlapPenalty)
+		s.r.log.Println("Parent", p.public.String(), "keeps failing, excluding it from parent selection")
+	}
+	s._parentFlaps[p.public] = entry
+}
+
 func isBetterParentCandidate(ann rootAnnouncementWithTime, bestRoot types.Root,
-	bestOrder uint64, containsLoop bool) bool {
+	bestLen int, bestOrder uint64, containsLoop bool, band int, pinning bool, timeout time.Duration, now time.Time) bool {
 	isBetterCandidate := false
 
-	if time.Since(ann.receiveTime) >= announcementTimeout {
+	if now.Sub(ann.receiveTime) >= timeout {
 		// If the announcement has expired then don't consider this peer
 		// as a possible candidate.
 		return false
@@ -540,7 +1020,7 @@ func isBetterParentCandidate(ann rootAnnouncementWithTime, bestRoot types.Root,
 
 	// Work out if the parent's announcement contains a stronger root
 	// key than our current best candidate.
-	keyDelta := ann.RootPublicKey.CompareTo(bestRoot.RootPublicKey)
+	keyDelta := compareElectedRoots(ann.Root, bestRoot, band, pinning)
 	switch {
 	case containsLoop:
 		// The announcement from this peer contains our own public key in
@@ -553,21 +1033,155 @@ func isBetterParentCandidate(ann rootAnnouncementWithTime, bestRoot types.Root,
 	case keyDelta < 0:
 		// The peer has a weaker root key than our current best candidate,
 		// so ignore this peer.
-	case ann.RootSequence > bestRoot.RootSequence:
+	case compareRootSequences(ann.RootSequence, bestRoot.RootSequence) > 0:
 		// The peer has the same root key as our current candidate but the
 		// sequence number is higher, so they have sent us a newer tree
 		// announcement. They are a better candidate as a result.
 		isBetterCandidate = true
-	case ann.RootSequence < bestRoot.RootSequence:
+	case compareRootSequences(ann.RootSequence, bestRoot.RootSequence) < 0:
 		// The peer has the same root key as our current candidate but a
 		// worse sequence number, so their announcement is out of date.
-	case ann.receiveOrder < bestOrder:
+	case len(ann.Signatures) < bestLen:
 		// The peer has the same root key and update sequence number as our
-		// current best candidate, but the update from this peer was received
-		// first. This condition is a tie-break that helps us to pick a parent
+		// current best candidate, but offers a shorter path to the root.
+		// Shorter paths mean shorter coordinates and better tree routing.
+		isBetterCandidate = true
+	case len(ann.Signatures) > bestLen:
+		// The peer offers a longer path to the root than our current best
+		// candidate, so ignore this peer.
+	case ann.receiveOrder < bestOrder:
+		// The peer has the same root key, update sequence number and path
+		// length as our current best candidate, but the update from this peer
+		// was received first. This condition is a tie-break that helps us to pick a parent
 		// which will have the lowest latency path to the root, all else equal.
 		isBetterCandidate = true
 	}
 
 	return isBetterCandidate
 }
+
+// maxAnnouncementLength returns the longest that an encoded tree announcement
+// with the given number of signatures could be, with each sequence number and
+// hop taking up as many bytes as a Varu64 possibly can.
+func maxAnnouncementLength(signatures int) int {
+	const maxVaru64Length = 10
+	return ed25519.PublicKeySize + maxVaru64Length +
+		signatures*(ed25519.PublicKeySize+ed25519.SignatureSize+maxVaru64Length)
+}
+
+// compareRootSequences compares two sequence numbers from the same root using
+// serial number arithmetic, such that a positive result means that a is the
+// newer. This keeps working if the sequence number ever wraps around, as long
+// as the two are less than half of the sequence number space apart.
+func compareRootSequences(a, b types.Varu64) int {
+	switch diff := int64(a - b); {
+	case diff > 0:
+		return 1
+	case diff < 0:
+		return -1
+	default:
+		return 0
+	}
+}
+
+// rootSequenceJumpIsSane returns false if the sequence number a is further
+// ahead of the previous sequence number b than rootSequenceWindow allows.
+func rootSequenceJumpIsSane(a, b types.Varu64) bool {
+	return compareRootSequences(a, b) <= 0 || a-b <= rootSequenceWindow
+}
+
+// compareRoots compares the keys of two roots in the same way as CompareTo,
+// such that a positive result means that a is the stronger root. If pinning
+// is true then a pinned root is always stronger than a root that isn't
+// pinned, otherwise the pin is ignored.
+func compareRoots(a, b types.Root, pinning bool) int {
+	aPinned := pinning && a.RootSequence&pinnedRootSequence != 0
+	bPinned := pinning && b.RootSequence&pinnedRootSequence != 0
+	if aPinned != bPinned && a.RootPublicKey != b.RootPublicKey {
+		if aPinned {
+			return 1
+		}
+		return -1
+	}
+	return a.RootPublicKey.CompareTo(b.RootPublicKey)
+}
+
+// _compareRoots compares two roots using compareElectedRoots with the
+// election band from RouterOptionRootElectionBand, honouring pinned roots
+// only if RouterOptionAcceptPinnedRoot is set.
+func (s *state) _compareRoots(a, b types.Root) int {
+	return compareElectedRoots(a, b, s.r.rootElectionBand, s.r.acceptPinnedRoot)
+}
+
+// compareElectedRoots compares two roots in the same way as compareRoots,
+// except that roots with different keys that share the first band bits are
+// ranked by rootElectionWeight instead, falling back to the key if the
+// weights happen to be equal. This is still a total order over keys for any
+// given set of sequence numbers, so all nodes that see the same announcements
+// will agree on the root. A band of zero always compares the keys.
+func compareElectedRoots(a, b types.Root, band int, pinning bool) int {
+	if band == 0 || a.RootPublicKey == b.RootPublicKey {
+		return compareRoots(a, b, pinning)
+	}
+	aPinned := pinning && a.RootSequence&pinnedRootSequence != 0
+	bPinned := pinning && b.RootSequence&pinnedRootSequence != 0
+	if aPinned != bPinned || !sharesKeyPrefix(a.RootPublicKey, b.RootPublicKey, band) {
+		return compareRoots(a, b, pinning)
+	}
+	switch aw, bw := rootElectionWeight(a), rootElectionWeight(b); {
+	case aw > bw:
+		return 1
+	case aw < bw:
+		return -1
+	}
+	return a.RootPublicKey.CompareTo(b.RootPublicKey)
+}
+
+// rootElectionWeight returns a hash of the root key and the epoch that the
+// root sequence number falls into. It only depends on what the root signed,
+// so every node will work out the same weight for the same announcement.
+func rootElectionWeight(root types.Root) uint64 {
+	var input [ed25519.PublicKeySize + 8]byte
+	copy(input[:], root.RootPublicKey[:])
+	epoch := uint64(root.RootSequence&^pinnedRootSequence) / rootElectionEpoch
+	binary.BigEndian.PutUint64(input[ed25519.PublicKeySize:], epoch)
+	sum := sha256.Sum256(input[:])
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// sharesKeyPrefix returns true if the first bits of the two keys are equal.
+func sharesKeyPrefix(a, b types.PublicKey, bits int) bool {
+	for i := 0; bits > 0; i, bits = i+1, bits-8 {
+		mask := byte(0xff)
+		if bits < 8 {
+			mask <<= 8 - bits
+		}
+		if a[i]&mask != b[i]&mask {
+			return false
+		}
+	}
+	return true
+}
+
+// shouldKeepParent returns true if our current parent, which sent us the
+// given announcement, is still good enough to keep when compared against
+// the best candidate root. This provides hysteresis in parent selection:
+// a candidate that is only marginally better, in that it has the same root
+// key and path length, is not enough to make us switch.
+func shouldKeepParent(parentAnn rootAnnouncementWithTime, bestRoot types.Root, bestLen int, containsLoop bool, timeout time.Duration, now time.Time) bool {
+	switch {
+	case containsLoop:
+		// Our parent is now sending us our own key in the path to the root.
+		return false
+	case now.Sub(parentAnn.receiveTime) >= timeout:
+		// Our parent hasn't sent us an announcement for too long.
+		return false
+	case parentAnn.RootPublicKey != bestRoot.RootPublicKey:
+		// The candidate has a stronger root key than our parent.
+		return false
+	case bestLen < len(parentAnn.Signatures):
+		// The candidate has a shorter path to the root than our parent.
+		return false
+	}
+	return true
+}
@@ -1,10 +1,17 @@
 package router
 
 import (
+	"crypto/ed25519"
+	"fmt"
+	"math"
+	"net"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Arceliar/phony"
 	"github.com/matrix-org/pinecone/types"
 	"go.uber.org/atomic"
 )
@@ -34,8 +41,8 @@ func TestHandleTreeAnnouncement(t *testing.T) {
 		{"TestParentHigherRoot1", true, false, 1, 1, 1, AcceptUpdate},
 		{"TestParentHigherRoot2", true, false, 1, 1, 2, AcceptUpdate},
 		{"TestParentHigherRoot3", true, false, 1, 2, 1, AcceptUpdate},
-		{"TestParentSameRootSameSeq", true, false, 0, 1, 1, SelectNewParentWithWait},
-		{"TestParentSameRootLowerSeq", true, false, 0, 1, 2, DropFrame},
+		{"TestParentSameRootSameSeq", true, false, 0, 1, 1, AcceptUpdate},
+		{"TestParentSameRootLowerSeq", true, false, 0, 1, 2, SelectNewParent},
 		{"TestParentSameRootHigherSeq", true, false, 0, 2, 1, AcceptUpdate},
 
 		{"TestNonParentLoop1", false, true, -1, 1, 1, DropFrame},
@@ -74,6 +81,7 @@ func TestTreeParentSelection(t *testing.T) {
 		desc         string
 		announcement rootAnnouncementWithTime
 		bestRoot     types.Root
+		bestLen      int
 		bestOrder    uint64
 		containsLoop bool
 		expected     bool
@@ -513,11 +521,83 @@ func TestTreeParentSelection(t *testing.T) {
 			containsLoop: false,
 			expected:     false,
 		},
+		{desc: "TestSameRootSameSequenceShorterPath",
+			announcement: rootAnnouncementWithTime{
+				receiveTime:  time.Now(),
+				receiveOrder: 1,
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					},
+					Signatures: make([]types.SignatureWithHop, 2),
+				}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			bestLen:      3,
+			bestOrder:    0,
+			containsLoop: false,
+			expected:     true,
+		},
+		{desc: "TestSameRootSameSequenceLongerPath",
+			announcement: rootAnnouncementWithTime{
+				receiveTime:  time.Now(),
+				receiveOrder: 0,
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					},
+					Signatures: make([]types.SignatureWithHop, 3),
+				}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			bestLen:      2,
+			bestOrder:    1,
+			containsLoop: false,
+			expected:     false,
+		},
+		{desc: "TestSameRootHigherSequenceLongerPath",
+			announcement: rootAnnouncementWithTime{
+				receiveTime:  time.Now(),
+				receiveOrder: 1,
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 2,
+					},
+					Signatures: make([]types.SignatureWithHop, 3),
+				}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			bestLen:      2,
+			bestOrder:    0,
+			containsLoop: false,
+			expected:     true,
+		},
+		{desc: "TestShorterPathContainsLoop",
+			announcement: rootAnnouncementWithTime{
+				receiveTime:  time.Now(),
+				receiveOrder: 0,
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					},
+					Signatures: make([]types.SignatureWithHop, 1),
+				}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			bestLen:      2,
+			bestOrder:    1,
+			containsLoop: true,
+			expected:     false,
+		},
 	}
 
 	for _, tc := range cases {
 		t.Run(tc.desc, func(t *testing.T) {
-			actual := isBetterParentCandidate(tc.announcement, tc.bestRoot, tc.bestOrder, tc.containsLoop)
+			actual := isBetterParentCandidate(tc.announcement, tc.bestRoot, tc.bestLen, tc.bestOrder, tc.containsLoop, 0, false, announcementTimeout, time.Now())
 			if actual != tc.expected {
 				t.Fatalf("expected: %t got: %t", tc.expected, actual)
 			}
@@ -654,6 +734,9 @@ func TestTreeNextHopSelection(t *testing.T) {
 			peers[0],
 			&selfAnn,
 			&announcementTable{peers[1]: &validAnn},
+			0,
+			0,
+			time.Time{},
 		}, nil},
 		{"TestDestIsSelf", treeNextHopParams{
 			destCoords,
@@ -662,6 +745,9 @@ func TestTreeNextHopSelection(t *testing.T) {
 			peers[0],
 			&selfAnn,
 			&announcementTable{peers[1]: &validAnn},
+			0,
+			0,
+			time.Time{},
 		}, peers[0]},
 		{"TestPeerIsDestination", treeNextHopParams{
 			destCoords,
@@ -674,6 +760,9 @@ func TestTreeNextHopSelection(t *testing.T) {
 				peers[2]: &destAnn,
 				peers[3]: &closerAnn,
 			},
+			0,
+			0,
+			time.Time{},
 		}, peers[2]},
 		{"TestDontCreateLoops", treeNextHopParams{
 			destCoords,
@@ -685,6 +774,9 @@ func TestTreeNextHopSelection(t *testing.T) {
 				// Even if from peer is the dest, don't loop back to from peer
 				peers[1]: &destAnn,
 			},
+			0,
+			0,
+			time.Time{},
 		}, nil},
 		{"TestDifferentRootIsIgnored", treeNextHopParams{
 			destCoords,
@@ -696,6 +788,9 @@ func TestTreeNextHopSelection(t *testing.T) {
 				peers[1]: &validAnn,
 				peers[2]: &differentRootDestAnn,
 			},
+			0,
+			0,
+			time.Time{},
 		}, nil},
 		{"TestPeerIsBetterCandidate", treeNextHopParams{
 			destCoords,
@@ -708,6 +803,9 @@ func TestTreeNextHopSelection(t *testing.T) {
 				peers[2]: &validAnn,
 				peers[3]: &closerAnn,
 			},
+			0,
+			0,
+			time.Time{},
 		}, peers[3]},
 	}
 
@@ -723,28 +821,1915 @@ func TestTreeNextHopSelection(t *testing.T) {
 	}
 }
 
-func convertToString(actual *peer, expected *peer, peers []*peer) (string, string) {
-	actualIndex, expectedIndex := 0, 0
-	for i := range peers {
-		if peers[i] == actual {
-			actualIndex = i
+func TestTreeKeepParent(t *testing.T) {
+	cases := []struct {
+		desc         string
+		announcement rootAnnouncementWithTime
+		bestRoot     types.Root
+		bestLen      int
+		containsLoop bool
+		expected     bool
+	}{
+		{desc: "TestSameRootSameSequence",
+			announcement: rootAnnouncementWithTime{
+				receiveTime: time.Now(),
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					}}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			expected: true,
+		},
+		{desc: "TestSameRootHigherSequence",
+			announcement: rootAnnouncementWithTime{
+				receiveTime: time.Now(),
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					}}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 2,
+			},
+			expected: true,
+		},
+		{desc: "TestStrongerRoot",
+			announcement: rootAnnouncementWithTime{
+				receiveTime: time.Now(),
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 2,
+					}}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{6}, RootSequence: 1,
+			},
+			expected: false,
+		},
+		{desc: "TestShorterPath",
+			announcement: rootAnnouncementWithTime{
+				receiveTime: time.Now(),
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					},
+					Signatures: make([]types.SignatureWithHop, 3),
+				}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			bestLen:  2,
+			expected: false,
+		},
+		{desc: "TestParentTimedOut",
+			announcement: rootAnnouncementWithTime{
+				receiveTime: time.Now().Add(-announcementTimeout * 2),
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					}}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			expected: false,
+		},
+		{desc: "TestParentContainsLoop",
+			announcement: rootAnnouncementWithTime{
+				receiveTime: time.Now(),
+				SwitchAnnouncement: types.SwitchAnnouncement{
+					Root: types.Root{
+						RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+					}}},
+			bestRoot: types.Root{
+				RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+			},
+			containsLoop: true,
+			expected:     false,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			actual := shouldKeepParent(tc.announcement, tc.bestRoot, tc.bestLen, tc.containsLoop, announcementTimeout, time.Now())
+			if actual != tc.expected {
+				t.Fatalf("expected: %t got: %t", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestTreeParentHysteresis(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0x80)
+	bSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	b := newTestPeer(r, 2, testPublicKey(bSK))
+
+	announce := func(p *peer, sk ed25519.PrivateKey, seq types.Varu64) {
+		f := newTestAnnouncement(t, types.Root{
+			RootPublicKey: testPublicKey(rootSK),
+			RootSequence:  seq,
+		}, rootSK, sk)
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._handleTreeAnnouncement(p, f)
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
-		if peers[i] == expected {
-			expectedIndex = i
+	}
+	parent := func() (parent *peer) {
+		phony.Block(r.state, func() {
+			parent = r.state._parent
+		})
+		return
+	}
+
+	announce(a, aSK, 1)
+	if p := parent(); p != a {
+		t.Fatalf("expected peer A to be selected as the first parent")
+	}
+
+	// Peer B keeps beating peer A to each new root sequence number, which
+	// without hysteresis would cause us to flip between the two.
+	for seq := types.Varu64(2); seq < 10; seq++ {
+		announce(b, bSK, seq)
+		if p := parent(); p != a {
+			t.Fatalf("parent changed after announcement %d from peer B", seq)
+		}
+		announce(a, aSK, seq)
+		if p := parent(); p != a {
+			t.Fatalf("parent changed after announcement %d from peer A", seq)
 		}
 	}
+}
 
-	actualString, expectedString := "", ""
-	if actual == nil {
-		actualString = "nil"
-	} else {
-		actualString = strconv.Itoa(actualIndex)
+func TestTreeParentTieBreakPrefersParent(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0x80)
+	bSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	b := newTestPeer(r, 2, testPublicKey(bSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	parent := newTestAnnouncement(t, root, rootSK, aSK)
+	newcomer := newTestAnnouncement(t, root, rootSK, bSK)
+
+	var errA, errB error
+	var chosen *peer
+	var changed bool
+	phony.Block(r.state, func() {
+		errA = r.state._handleTreeAnnouncement(a, parent)
+		errB = r.state._handleTreeAnnouncement(b, newcomer)
+		// Make it look like the newcomer's announcement arrived first, so
+		// that it would win on receive order alone.
+		r.state._announcements[a].receiveOrder, r.state._announcements[b].receiveOrder =
+			r.state._announcements[b].receiveOrder, r.state._announcements[a].receiveOrder
+		changed = r.state._selectNewParent()
+		chosen = r.state._parent
+	})
+	if errA != nil {
+		t.Fatal(errA)
 	}
-	if expected == nil {
-		expectedString = "nil"
-	} else {
-		expectedString = strconv.Itoa(expectedIndex)
+	if errB != nil {
+		t.Fatal(errB)
+	}
+	if changed || chosen != a {
+		t.Fatalf("expected the current parent to win a tie with the newcomer")
 	}
+}
 
-	return actualString, expectedString
+func TestTreeDuplicateAnnouncement(t *testing.T) {
+	clock := newTestClock()
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40), RouterOptionClock{clock})
+	p := newTestPeer(r, 1, testPublicKey(rootSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	// Signatures are deterministic, so signing the same announcement again
+	// produces an identical frame.
+	first := newTestAnnouncement(t, root, rootSK)
+	repeat := newTestAnnouncement(t, root, rootSK)
+	var err error
+	var stored *rootAnnouncementWithTime
+	var ordering uint64
+	phony.Block(r.state, func() {
+		if err = r.state._handleTreeAnnouncement(p, first); err != nil {
+			return
+		}
+		stored, ordering = r.state._announcements[p], r.state._ordering
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Second * 10)
+	var after *rootAnnouncementWithTime
+	var afterOrdering uint64
+	var parent *peer
+	var waiting bool
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(p, repeat)
+		after, afterOrdering = r.state._announcements[p], r.state._ordering
+		parent, waiting = r.state._parent, r.state._waiting
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.receiveOrder != stored.receiveOrder || afterOrdering != ordering {
+		t.Fatalf("expected the repeated announcement to skip processing")
+	}
+	if !after.receiveTime.Equal(clock.Now()) {
+		t.Fatalf("expected the repeated announcement to refresh the receive time")
+	}
+	if after == stored || stored.receiveTime.Equal(clock.Now()) {
+		t.Fatalf("expected the stored announcement to be replaced rather than changed")
+	}
+	if parent != p || waiting {
+		t.Fatalf("expected the repeated announcement not to affect parent selection")
+	}
+
+	// An announcement with a new sequence number is processed in full.
+	root.RootSequence++
+	next := newTestAnnouncement(t, root, rootSK)
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(p, next)
+		after, afterOrdering = r.state._announcements[p], r.state._ordering
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.receiveOrder == stored.receiveOrder || afterOrdering == ordering || after.RootSequence != root.RootSequence {
+		t.Fatalf("expected the new announcement to be processed")
+	}
+
+	// Once the last announcement has timed out, a repeat of it shows that
+	// the peer is back, so it is processed in full.
+	stored, ordering = after, afterOrdering
+	clock.Advance(r.announceTimeout)
+	revived := newTestAnnouncement(t, root, rootSK)
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(p, revived)
+		after, afterOrdering = r.state._announcements[p], r.state._ordering
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == stored || afterOrdering == ordering {
+		t.Fatalf("expected the repeat of a timed out announcement to be processed")
+	}
+}
+
+func TestTreeParentSameSequenceRepeat(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	aSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	// Our parent repeats the same update after switching to a new parent
+	// of its own, so the signatures change but the sequence number doesn't.
+	first := newTestAnnouncement(t, root, rootSK, aSK)
+	repeat := newTestAnnouncement(t, root, rootSK, midSK, aSK)
+	var errFirst, errRepeat error
+	var parent *peer
+	var waiting bool
+	var coords types.Coordinates
+	phony.Block(r.state, func() {
+		if errFirst = r.state._handleTreeAnnouncement(a, first); errFirst != nil {
+			return
+		}
+		errRepeat = r.state._handleTreeAnnouncement(a, repeat)
+		parent, waiting = r.state._parent, r.state._waiting
+		coords = r.state._coords()
+	})
+	if errFirst != nil {
+		t.Fatal(errFirst)
+	}
+	if errRepeat != nil {
+		t.Fatal(errRepeat)
+	}
+	if parent != a || waiting {
+		t.Fatalf("expected a repeated sequence number not to cause re-parenting")
+	}
+	if len(coords) != 3 {
+		t.Fatalf("expected our coordinates to follow our parent's new path, got %v", coords)
+	}
+}
+
+func TestTreeParentRegressingSequence(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	aSK := newTestKey(t, 0x40, 0x80)
+	bSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	b := newTestPeer(r, 2, testPublicKey(bSK))
+	root := func(seq types.Varu64) types.Root {
+		return types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: seq}
+	}
+	current := newTestAnnouncement(t, root(2), rootSK, midSK, aSK)
+	newer := newTestAnnouncement(t, root(3), rootSK, bSK)
+	older := newTestAnnouncement(t, root(1), rootSK, midSK, aSK)
+
+	var errs [3]error
+	var before, after *peer
+	var stored types.Varu64
+	var coords types.Coordinates
+	phony.Block(r.state, func() {
+		if errs[0] = r.state._handleTreeAnnouncement(a, current); errs[0] != nil {
+			return
+		}
+		// Hold off parent selection while the newer update from b arrives,
+		// so that a is still our parent when it goes backwards.
+		r.state._waiting = true
+		errs[1] = r.state._handleTreeAnnouncement(b, newer)
+		r.state._waiting = false
+		before = r.state._parent
+		errs[2] = r.state._handleTreeAnnouncement(a, older)
+		after = r.state._parent
+		stored = r.state._announcements[a].RootSequence
+		coords = r.state._coords()
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if before != a {
+		t.Fatalf("expected a to still be our parent before it went backwards")
+	}
+	if after != b {
+		t.Fatalf("expected a regressing sequence number to cause parent selection")
+	}
+	if stored != 1 {
+		t.Fatalf("expected to store the older update from a, got sequence %d", stored)
+	}
+	// Our coordinates must follow the path through b, not the path that a
+	// advertised before it went backwards.
+	if expected := (types.Coordinates{1, 2}); !coords.EqualTo(expected) {
+		t.Fatalf("expected coordinates %v through b, got %v", expected, coords)
+	}
+}
+
+func TestTreeParentRegressingSequenceOnlyPeer(t *testing.T) {
+	// If our parent goes backwards and there is nobody else to choose, we
+	// become the root rather than advertise a path that it no longer has.
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	root := func(seq types.Varu64) types.Root {
+		return types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: seq}
+	}
+	current := newTestAnnouncement(t, root(2), rootSK, aSK)
+	older := newTestAnnouncement(t, root(1), rootSK, aSK)
+
+	var errs [2]error
+	var before, after *peer
+	var coords types.Coordinates
+	phony.Block(r.state, func() {
+		if errs[0] = r.state._handleTreeAnnouncement(a, current); errs[0] != nil {
+			return
+		}
+		before = r.state._parent
+		errs[1] = r.state._handleTreeAnnouncement(a, older)
+		after = r.state._parent
+		coords = r.state._coords()
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if before != a {
+		t.Fatalf("expected a to be our parent before it went backwards")
+	}
+	if after != nil || len(coords) != 0 {
+		t.Fatalf("expected to become the root, got parent %v and coordinates %v", after, coords)
+	}
+}
+
+func TestTreeParentShortestPath(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	aSK := newTestKey(t, 0x40, 0x80)
+	bSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	b := newTestPeer(r, 2, testPublicKey(bSK))
+	root := types.Root{
+		RootPublicKey: testPublicKey(rootSK),
+		RootSequence:  1,
+	}
+
+	// Peer A is two hops from the root and its announcement arrives first.
+	// Peer B is directly connected to the root.
+	var errA, errB error
+	var parent *peer
+	annA := newTestAnnouncement(t, root, rootSK, midSK, aSK)
+	annB := newTestAnnouncement(t, root, rootSK, bSK)
+	phony.Block(r.state, func() {
+		errA = r.state._handleTreeAnnouncement(a, annA)
+		errB = r.state._handleTreeAnnouncement(b, annB)
+		parent = r.state._parent
+	})
+	if errA != nil {
+		t.Fatal(errA)
+	}
+	if errB != nil {
+		t.Fatal(errB)
+	}
+	if parent != b {
+		t.Fatalf("expected peer B with the shorter path to be selected as parent")
+	}
+}
+
+func TestTreeCoordsChangedCallback(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0xf0)
+	changes := make(chan types.Coordinates, 4)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40), RouterOptionOnCoordsChanged(
+		func(coords types.Coordinates) {
+			changes <- coords
+		},
+	))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	root := types.Root{
+		RootPublicKey: testPublicKey(rootSK),
+		RootSequence:  1,
+	}
+
+	expect := func(expected types.Coordinates) {
+		select {
+		case coords := <-changes:
+			if !coords.EqualTo(expected) {
+				t.Fatalf("expected coords %v, got %v", expected, coords)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for coords %v", expected)
+		}
+	}
+
+	var err error
+	ann := newTestAnnouncement(t, root, rootSK, aSK)
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(a, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(types.Coordinates{1, 2})
+
+	// A repeat of the same announcement with a new sequence number doesn't
+	// change our coordinates, so the callback shouldn't fire again.
+	root.RootSequence++
+	ann = newTestAnnouncement(t, root, rootSK, aSK)
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(a, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phony.Block(r.state, r.state._becomeRoot)
+	expect(types.Coordinates{})
+}
+
+func TestTreeRootChangedCallback(t *testing.T) {
+	clock := newTestClock()
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0xf0)
+	type change struct{ old, new types.PublicKey }
+	changes := make(chan change, 4)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40), RouterOptionClock{clock}, RouterOptionOnRootChanged(
+		func(old, new types.PublicKey) {
+			changes <- change{old, new}
+		},
+	))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	expect := func(expected change) {
+		select {
+		case got := <-changes:
+			if got != expected {
+				t.Fatalf("expected root change from %s to %s, got %s to %s", expected.old, expected.new, got.old, got.new)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for root change from %s to %s", expected.old, expected.new)
+		}
+	}
+
+	// A stronger root appears.
+	var err error
+	ann := newTestAnnouncement(t, root, rootSK, aSK)
+	phony.Block(r.state, func() {
+		r.state._peers[a.port] = a
+		err = r.state._handleTreeAnnouncement(a, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(change{old: r.public, new: root.RootPublicKey})
+
+	// Our parent times out, leaving us as the root.
+	clock.Advance(r.announceTimeout)
+	phony.Block(r.state, r.state._maintainTree)
+	expect(change{old: root.RootPublicKey, new: r.public})
+
+	// Nothing else should have been reported once the router has caught up.
+	phony.Block(r, func() {})
+	select {
+	case got := <-changes:
+		t.Fatalf("unexpected root change from %s to %s", got.old, got.new)
+	default:
+	}
+}
+
+func TestTreeAnnouncementTimingsConfigurable(t *testing.T) {
+	cases := []struct {
+		desc             string
+		opts             []RouterOption
+		expectedInterval time.Duration
+		expectedTimeout  time.Duration
+	}{
+		{"TestDefaults", nil, announcementInterval, announcementTimeout},
+		{"TestIntervalOnly", []RouterOption{
+			RouterOptionAnnouncementInterval(time.Second * 10),
+		}, time.Second * 10, time.Second * 15},
+		{"TestIntervalAndTimeout", []RouterOption{
+			RouterOptionAnnouncementInterval(time.Second * 10),
+			RouterOptionAnnouncementTimeout(time.Second * 30),
+		}, time.Second * 10, time.Second * 30},
+		{"TestTimeoutNotGreaterThanInterval", []RouterOption{
+			RouterOptionAnnouncementInterval(time.Second * 10),
+			RouterOptionAnnouncementTimeout(time.Second * 10),
+		}, time.Second * 10, time.Second * 15},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			r := newTestRouter(t, tc.opts...)
+			if r.announceInterval != tc.expectedInterval {
+				t.Fatalf("expected interval %s, got %s", tc.expectedInterval, r.announceInterval)
+			}
+			if r.announceTimeout != tc.expectedTimeout {
+				t.Fatalf("expected timeout %s, got %s", tc.expectedTimeout, r.announceTimeout)
+			}
+		})
+	}
+}
+
+func TestTreeParentTimeout(t *testing.T) {
+	const interval, timeout = time.Millisecond * 50, time.Millisecond * 200
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40),
+		RouterOptionAnnouncementInterval(interval),
+		RouterOptionAnnouncementTimeout(timeout),
+	)
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	parent := func() (parent *peer) {
+		phony.Block(r.state, func() {
+			parent = r.state._parent
+		})
+		return
+	}
+
+	var err error
+	ann := newTestAnnouncement(t, types.Root{
+		RootPublicKey: testPublicKey(rootSK),
+		RootSequence:  1,
+	}, rootSK, aSK)
+	start := time.Now()
+	phony.Block(r.state, func() {
+		err = r.state._handleTreeAnnouncement(a, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent() != a {
+		t.Fatalf("expected peer A to be selected as parent")
+	}
+
+	// Peer A never sends another announcement, so once the timeout passes
+	// we should give up on it and become the root.
+	for parent() == a {
+		if time.Since(start) > time.Second {
+			t.Fatalf("parent was not timed out")
+		}
+		time.Sleep(interval / 5)
+	}
+	if since := time.Since(start); since < timeout {
+		t.Fatalf("parent was timed out after %s, before the timeout of %s", since, timeout)
+	}
+}
+
+func TestTreeCompareRoots(t *testing.T) {
+	low := types.Root{RootPublicKey: types.PublicKey{1}, RootSequence: 1}
+	high := types.Root{RootPublicKey: types.PublicKey{2}, RootSequence: 1}
+	pinned := types.Root{RootPublicKey: types.PublicKey{1}, RootSequence: 1 | pinnedRootSequence}
+	pinnedHigh := types.Root{RootPublicKey: types.PublicKey{2}, RootSequence: 1 | pinnedRootSequence}
+	cases := []struct {
+		desc     string
+		a, b     types.Root
+		pinning  bool
+		expected int
+	}{
+		{"TestNotPinnedStronger", high, low, true, 1},
+		{"TestNotPinnedWeaker", low, high, true, -1},
+		{"TestNotPinnedEqual", low, low, true, 0},
+		{"TestPinnedStronger", pinned, high, true, 1},
+		{"TestPinnedWeaker", high, pinned, true, -1},
+		{"TestPinnedEqual", pinned, low, true, 0},
+		{"TestBothPinned", pinnedHigh, pinned, true, 1},
+		{"TestPinIgnoredWeaker", pinned, high, false, -1},
+		{"TestPinIgnoredStronger", high, pinned, false, 1},
+		{"TestPinIgnoredEqual", pinned, low, false, 0},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if actual := compareRoots(tc.a, tc.b, tc.pinning); actual != tc.expected {
+				t.Fatalf("expected: %d got: %d", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestTreeCompareElectedRoots(t *testing.T) {
+	const band = 4
+	var roots []types.Root
+	for i := 0; i < 8; i++ {
+		for _, seq := range []types.Varu64{1, rootElectionEpoch + 1, 5 * rootElectionEpoch} {
+			key := testPublicKey(newTestKey(t, 0x00, 0xff))
+			key[0] = 0x10 | byte(i>>2) // Two bands of four keys each
+			roots = append(roots, types.Root{RootPublicKey: key, RootSequence: seq})
+		}
+	}
+
+	for _, a := range roots {
+		for _, b := range roots {
+			delta := compareElectedRoots(a, b, band, false)
+			if reverse := compareElectedRoots(b, a, band, false); reverse != -delta {
+				t.Fatalf("comparison isn't symmetric: %d and %d", delta, reverse)
+			}
+			switch {
+			case a.RootPublicKey == b.RootPublicKey:
+				if delta != 0 {
+					t.Fatalf("expected the same key to compare equal in any epoch")
+				}
+			case !sharesKeyPrefix(a.RootPublicKey, b.RootPublicKey, band):
+				if delta != a.RootPublicKey.CompareTo(b.RootPublicKey) {
+					t.Fatalf("expected keys in different bands to be compared by key")
+				}
+			}
+			if strict := compareElectedRoots(a, b, 0, false); strict != compareRoots(a, b, false) {
+				t.Fatalf("expected a band of zero to compare keys only")
+			}
+		}
+	}
+
+	// Every node sorting the same announcements must end up with the same
+	// order, which also means that the comparison must be transitive.
+	routers := []*Router{
+		newTestRouter(t, RouterOptionRootElectionBand(band)),
+		newTestRouter(t, RouterOptionRootElectionBand(band)),
+	}
+	var orders [][]types.Root
+	for _, r := range routers {
+		order := append([]types.Root{}, roots...)
+		phony.Block(r.state, func() {
+			sort.SliceStable(order, func(i, j int) bool {
+				return r.state._compareRoots(order[i], order[j]) > 0
+			})
+		})
+		orders = append(orders, order)
+	}
+	for i := range orders[0] {
+		if orders[0][i] != orders[1][i] {
+			t.Fatalf("nodes disagree on the order of roots at position %d", i)
+		}
+		for j := i + 1; j < len(orders[0]); j++ {
+			if compareElectedRoots(orders[0][i], orders[0][j], band, false) < 0 {
+				t.Fatalf("comparison isn't transitive")
+			}
+		}
+	}
+
+	// Given enough epochs, each key in a band should get a turn at winning.
+	a, b := roots[0].RootPublicKey, roots[3].RootPublicKey
+	won := map[int]bool{}
+	for epoch := types.Varu64(0); epoch < 64; epoch++ {
+		seq := epoch * rootElectionEpoch
+		won[compareElectedRoots(
+			types.Root{RootPublicKey: a, RootSequence: seq},
+			types.Root{RootPublicKey: b, RootSequence: seq},
+			band, false,
+		)] = true
+	}
+	if !won[1] || !won[-1] {
+		t.Fatalf("expected rootship to rotate between keys in the same band")
+	}
+}
+
+func TestTreeWeightedRootElectionRotates(t *testing.T) {
+	const band = 1
+	rootSK := newTestKey(t, 0x40, 0x80)
+	peerSK := newTestKey(t, 0x80, 0xff)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x00, 0x40), RouterOptionRootElectionBand(band))
+	waitForTreeMaintenance(t, r)
+	p := newTestPeer(r, 1, testPublicKey(peerSK))
+	var ourRoot types.Root
+	phony.Block(r.state, func() {
+		r.state._peers[p.port] = p
+		ourRoot = r.state._ourRoot(r.state._sequence + 1)
+	})
+
+	// Find an epoch in which the other root outranks us, followed by one in
+	// which it doesn't. Our own epoch doesn't change while we aren't the root.
+	rootAt := func(epoch types.Varu64) types.Root {
+		return types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: epoch*rootElectionEpoch + 1}
+	}
+	var stronger, weaker types.Varu64
+	for stronger = 0; compareElectedRoots(rootAt(stronger), ourRoot, band, false) < 0; stronger++ {
+	}
+	for weaker = stronger + 1; compareElectedRoots(rootAt(weaker), ourRoot, band, false) > 0; weaker++ {
+	}
+	first := newTestAnnouncement(t, rootAt(stronger), rootSK, peerSK)
+	second := newTestAnnouncement(t, rootAt(weaker), rootSK, peerSK)
+
+	handle := func(f *types.Frame) (parent *peer) {
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._handleTreeAnnouncement(p, f)
+			parent = r.state._parent
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	if parent := handle(first); parent != p {
+		t.Fatalf("expected to follow the root while it outranks us")
+	}
+	if parent := handle(second); parent != nil {
+		t.Fatalf("expected to become the root once the new epoch made it our turn")
+	}
+}
+
+func TestTreePinnedRootConverges(t *testing.T) {
+	// The pinned node has the weakest key, so it would never be elected as
+	// the root without pinning. All of the nodes opt in to accepting it.
+	pinnedSK := newTestKey(t, 0x00, 0x40)
+	accept := RouterOptionAcceptPinnedRoot(true)
+	routers := []*Router{
+		newTestRouterWithKey(t, newTestKey(t, 0xc0, 0xff), accept),
+		newTestRouterWithKey(t, pinnedSK, RouterOptionPinnedRoot(true), accept),
+		newTestRouterWithKey(t, newTestKey(t, 0x80, 0xc0), accept),
+		newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), accept),
+	}
+	for i := 1; i < len(routers); i++ {
+		connectTestRouters(t, routers[i-1], routers[i])
+	}
+	waitForTestRoot(t, routers, testPublicKey(pinnedSK))
+}
+
+func TestTreePinnedRootIgnored(t *testing.T) {
+	// Nodes that haven't opted in compare the pinned root by key, so the
+	// strongest key wins as usual and claiming a pin gains nothing.
+	strongSK := newTestKey(t, 0xc0, 0xff)
+	routers := []*Router{
+		newTestRouterWithKey(t, strongSK),
+		newTestRouterWithKey(t, newTestKey(t, 0x00, 0x40), RouterOptionPinnedRoot(true)),
+		newTestRouterWithKey(t, newTestKey(t, 0x40, 0xc0)),
+	}
+	for i := 1; i < len(routers); i++ {
+		connectTestRouters(t, routers[i-1], routers[i])
+	}
+	waitForTestRoot(t, routers, testPublicKey(strongSK))
+}
+
+// waitForTestRoot waits until all of the routers have the given root.
+func waitForTestRoot(t *testing.T, routers []*Router, expected types.PublicKey) {
+	deadline := time.Now().Add(time.Second * 5)
+	for _, r := range routers {
+		for {
+			var root types.PublicKey
+			phony.Block(r.state, func() {
+				root = r.state._rootAnnouncement().RootPublicKey
+			})
+			if root == expected {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("node %s has root %s, expected root %s", r.public, root, expected)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func TestTreeAnnouncementSignaturesVerified(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	cases := []struct {
+		desc   string
+		tamper func(payload []byte)
+		valid  bool
+	}{
+		{"TestRootSignatureTampered", func(payload []byte) {
+			// With two signatures in the chain, the middle of the payload
+			// falls inside the root's signature.
+			payload[len(payload)/2-1] ^= 0xff
+		}, false},
+		{"TestPeerSignatureTampered", func(payload []byte) {
+			payload[len(payload)-1] ^= 0xff
+		}, false},
+		{"TestValidChain", func(payload []byte) {}, true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			f := newTestAnnouncement(t, root, rootSK, aSK)
+			tc.tamper(f.Payload)
+			var err error
+			phony.Block(r.state, func() {
+				err = r.state._handleTreeAnnouncement(a, f)
+			})
+			switch {
+			case tc.valid && err != nil:
+				t.Fatalf("expected announcement to be accepted, got %s", err)
+			case !tc.valid && err == nil:
+				t.Fatalf("expected announcement to be rejected")
+			}
+		})
+	}
+}
+
+// connectTestRouters peers the two given routers with each other using an
+// in-memory connection.
+func connectTestRouters(t *testing.T, a, b *Router) {
+	ca, cb := net.Pipe()
+	if _, err := a.Connect(ca, ConnectionPublicKey(b.PublicKey()), ConnectionKeepalives(false)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Connect(cb, ConnectionPublicKey(a.PublicKey()), ConnectionKeepalives(false)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestAnnouncement returns a tree announcement frame for the given root,
+// signed in turn by each of the given keys, the first of which should be
+// the root key and the last of which should be the sending peer.
+func newTestAnnouncement(t testing.TB, root types.Root, signers ...ed25519.PrivateKey) *types.Frame {
+	ann := types.SwitchAnnouncement{Root: root}
+	for i, sk := range signers {
+		if err := ann.Sign(sk, types.SwitchPortID(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f := getFrame()
+	f.Type = types.TypeTreeAnnouncement
+	n, err := ann.MarshalBinary(f.Payload[:cap(f.Payload)])
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Payload = f.Payload[:n]
+	return f
+}
+
+func TestTreeNextHopCost(t *testing.T) {
+	newPeer := func(cost uint32) *peer {
+		p := &peer{started: *atomic.NewBool(true)}
+		p.cost.Store(cost)
+		return p
+	}
+	root := types.Root{
+		RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+	}
+	newAnn := func(hops ...types.SwitchPortID) *rootAnnouncementWithTime {
+		ann := &rootAnnouncementWithTime{
+			receiveTime:  time.Now(),
+			receiveOrder: 1,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+			},
+		}
+		for _, hop := range hops {
+			ann.Signatures = append(ann.Signatures, types.SignatureWithHop{Hop: types.Varu64(hop)})
+		}
+		return ann
+	}
+
+	destCoords := types.Coordinates{1, 1, 1}
+	ourCoords := types.Coordinates{2}
+	selfAnn := newAnn(2, 2)
+	nearAnn := newAnn(1, 1, 1, 1, 1) // one hop from the destination
+	farAnn := newAnn(1, 1)           // two hops from the destination
+
+	cheap, expensive := newPeer(1), newPeer(10)
+	cheapFar, expensiveNear := newPeer(1), newPeer(10)
+	peers := []*peer{cheap, expensive, cheapFar, expensiveNear}
+
+	cases := []struct {
+		desc     string
+		margin   int64
+		table    announcementTable
+		expected *peer
+	}{
+		{"TestEquidistantCheaperWins", 0, announcementTable{
+			cheap:     nearAnn,
+			expensive: nearAnn,
+		}, cheap},
+		{"TestCloserWinsWithoutMargin", 0, announcementTable{
+			cheapFar:      farAnn,
+			expensiveNear: nearAnn,
+		}, expensiveNear},
+		{"TestCheaperWinsWithinMargin", 1, announcementTable{
+			cheapFar:      farAnn,
+			expensiveNear: nearAnn,
+		}, cheapFar},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			// Repeat a number of times, since map iteration order is random.
+			for i := 0; i < 20; i++ {
+				actual := getNextHopTree(treeNextHopParams{
+					destCoords,
+					ourCoords,
+					nil,
+					nil,
+					selfAnn,
+					&tc.table,
+					tc.margin,
+					0,
+					time.Time{},
+				})
+				if actual != tc.expected {
+					actualString, expectedString := convertToString(actual, tc.expected, peers)
+					t.Fatalf("expected: %s got: %s", expectedString, actualString)
+				}
+			}
+		})
+	}
+}
+
+func TestTreeNextHopExcluded(t *testing.T) {
+	root := types.Root{
+		RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+	}
+	newAnn := func(hops ...types.SwitchPortID) *rootAnnouncementWithTime {
+		ann := &rootAnnouncementWithTime{
+			receiveTime:  time.Now(),
+			receiveOrder: 1,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+			},
+		}
+		for _, hop := range hops {
+			ann.Signatures = append(ann.Signatures, types.SignatureWithHop{Hop: types.Varu64(hop)})
+		}
+		return ann
+	}
+
+	near := &peer{started: *atomic.NewBool(true)}
+	far := &peer{started: *atomic.NewBool(true)}
+	table := announcementTable{
+		near: newAnn(1, 1, 1, 1, 1), // one hop from the destination
+		far:  newAnn(1, 1),          // two hops from the destination
+	}
+	params := treeNextHopParams{
+		types.Coordinates{1, 1, 1},
+		types.Coordinates{2},
+		nil,
+		nil,
+		newAnn(2, 2),
+		&table,
+		0,
+		0,
+		time.Time{},
+	}
+
+	// Excluding the closest peer leaves the next closest as the next-hop,
+	// and excluding both leaves nowhere to go.
+	if actual := getNextHopTree(params); actual != near {
+		t.Fatalf("expected the closest peer to be chosen")
+	}
+	if actual := getNextHopTree(params, near); actual != far {
+		t.Fatalf("expected the next closest peer to be chosen")
+	}
+	if actual := getNextHopTree(params, near, far); actual != nil {
+		t.Fatalf("expected no next-hop with all peers excluded")
+	}
+}
+
+func TestTreeNextHopSkipsStale(t *testing.T) {
+	root := types.Root{
+		RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+	}
+	now := time.Now()
+	newAnn := func(age time.Duration, hops ...types.SwitchPortID) *rootAnnouncementWithTime {
+		ann := &rootAnnouncementWithTime{
+			receiveTime:  now.Add(-age),
+			receiveOrder: 1,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+			},
+		}
+		for _, hop := range hops {
+			ann.Signatures = append(ann.Signatures, types.SignatureWithHop{Hop: types.Varu64(hop)})
+		}
+		return ann
+	}
+
+	// Announcements older than a second are stale.
+	fresh := &peer{port: 1, started: *atomic.NewBool(true)}
+	stale := &peer{port: 2, started: *atomic.NewBool(true)}
+	nextHop := func(table announcementTable) *peer {
+		return getNextHopTree(treeNextHopParams{
+			types.Coordinates{1, 1, 1},
+			types.Coordinates{2},
+			nil,
+			nil,
+			newAnn(0, 2, 2),
+			&table,
+			0,
+			0,
+			now.Add(-time.Second),
+		})
+	}
+
+	for _, tc := range []struct {
+		desc     string
+		table    announcementTable
+		expected *peer
+	}{
+		{"EquallyClose", announcementTable{
+			fresh: newAnn(0, 1, 1, 1, 1),
+			stale: newAnn(time.Second*2, 1, 1, 1, 1),
+		}, fresh},
+		{"StaleIsCloser", announcementTable{
+			fresh: newAnn(0, 1, 1),
+			stale: newAnn(time.Second*2, 1, 1, 1, 1),
+		}, fresh},
+		{"FreshDoesNotHelp", announcementTable{
+			fresh: newAnn(0, 3, 3),
+			stale: newAnn(time.Second*2, 1, 1, 1, 1),
+		}, stale},
+		{"AllStale", announcementTable{
+			stale: newAnn(time.Second*2, 1, 1, 1, 1),
+		}, stale},
+	} {
+		t.Run(tc.desc, func(t *testing.T) {
+			// Repeat a number of times, since map iteration order is random.
+			for i := 0; i < 20; i++ {
+				if actual := nextHop(tc.table); actual != tc.expected {
+					t.Fatalf("expected port %d, got %v", tc.expected.port, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestTreeNextHopEqualCostMultipath(t *testing.T) {
+	root := types.Root{
+		RootPublicKey: types.PublicKey{5}, RootSequence: 1,
+	}
+	newAnn := func(hops ...types.SwitchPortID) *rootAnnouncementWithTime {
+		ann := &rootAnnouncementWithTime{
+			receiveTime:  time.Now(),
+			receiveOrder: 1,
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: root,
+			},
+		}
+		for _, hop := range hops {
+			ann.Signatures = append(ann.Signatures, types.SignatureWithHop{Hop: types.Varu64(hop)})
+		}
+		return ann
+	}
+
+	a := &peer{port: 1, started: *atomic.NewBool(true)}
+	b := &peer{port: 2, started: *atomic.NewBool(true)}
+	table := announcementTable{
+		a: newAnn(1, 1, 1, 1, 1),
+		b: newAnn(1, 1, 1, 1, 1),
+	}
+
+	used := map[*peer]int{}
+	for i := byte(0); i < 32; i++ {
+		f := getFrame()
+		f.SourceKey = types.PublicKey{i}
+		f.DestinationKey = types.PublicKey{0xff}
+		params := treeNextHopParams{
+			types.Coordinates{1, 1, 1},
+			types.Coordinates{2},
+			nil,
+			nil,
+			newAnn(2, 2),
+			&table,
+			0,
+			flowHash(f),
+			time.Time{},
+		}
+		framePool.Put(f)
+
+		// Map iteration order is random, so make sure that the flow is
+		// consistently sent to the same peer.
+		first := getNextHopTree(params)
+		for j := 0; j < 20; j++ {
+			if next := getNextHopTree(params); next != first {
+				t.Fatalf("flow %d switched between peers", i)
+			}
+		}
+		used[first]++
+	}
+
+	if used[a] == 0 || used[b] == 0 {
+		t.Fatalf("expected flows to be split across both peers, got %d and %d", used[a], used[b])
+	}
+}
+
+func convertToString(actual *peer, expected *peer, peers []*peer) (string, string) {
+	actualIndex, expectedIndex := 0, 0
+	for i := range peers {
+		if peers[i] == actual {
+			actualIndex = i
+		}
+		if peers[i] == expected {
+			expectedIndex = i
+		}
+	}
+
+	actualString, expectedString := "", ""
+	if actual == nil {
+		actualString = "nil"
+	} else {
+		actualString = strconv.Itoa(actualIndex)
+	}
+	if expected == nil {
+		expectedString = "nil"
+	} else {
+		expectedString = strconv.Itoa(expectedIndex)
+	}
+
+	return actualString, expectedString
+}
+
+func TestTreeAnnouncementsSignedPerPeer(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	parentSK := newTestKey(t, 0xa0, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	peers := []*peer{
+		newTestPeer(r, 1, testPublicKey(parentSK)),
+		newTestPeer(r, 2, types.PublicKey{1}),
+		newTestPeer(r, 3, types.PublicKey{2}),
+	}
+	// Older peers should be sent announcements that they can understand.
+	peers[2].revision = revisionSourceRouting
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	var err error
+	ann := newTestAnnouncement(t, root, rootSK, parentSK)
+	phony.Block(r.state, func() {
+		for _, p := range peers {
+			r.state._peers[p.port] = p
+		}
+		if err = r.state._handleTreeAnnouncement(peers[0], ann); err != nil {
+			return
+		}
+		// Further calls before the announcements go out should be coalesced.
+		r.state._sendTreeAnnouncements()
+		r.state._sendTreeAnnouncements()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other protocol frames, like bootstraps, may also be queued for our
+	// peers, so only look at the tree announcements.
+	announcements := map[types.SwitchPortID][]*types.Frame{}
+	phony.Block(r.state, func() {
+		for _, p := range peers {
+			for count := p.proto.queuecount(); count > 0; count-- {
+				f := <-p.proto.pop()
+				p.proto.ack()
+				if f.Type == types.TypeTreeAnnouncement {
+					announcements[p.port] = append(announcements[p.port], f)
+				}
+			}
+		}
+	})
+
+	for _, p := range peers {
+		if count := len(announcements[p.port]); count != 1 {
+			t.Fatalf("expected 1 announcement on port %d, got %d", p.port, count)
+		}
+		f := announcements[p.port][0]
+		var ann types.SwitchAnnouncement
+		var err error
+		switch compact := f.Extra&types.FlagCompactAnnouncement != 0; {
+		case compact != (p.revision >= revisionCompactAnnouncements):
+			t.Fatalf("announcement on port %d used the wrong encoding", p.port)
+		case compact:
+			_, err = ann.UnmarshalCompact(f.Payload, r.public)
+		default:
+			_, err = ann.UnmarshalBinary(f.Payload)
+		}
+		if err != nil {
+			t.Fatalf("announcement on port %d failed to verify: %s", p.port, err)
+		}
+		last := ann.Signatures[len(ann.Signatures)-1]
+		if last.PublicKey != r.public || last.Hop != types.Varu64(p.port) {
+			t.Fatalf("announcement on port %d has wrong final signature", p.port)
+		}
+		if err := ann.SanityCheck(r.public); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestTreeAnnouncementSignatureCache(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	r := &Router{}
+	copy(r.private[:], newTestKey(t, 0x40, 0x80))
+	r.public = r.private.Public()
+	peers := make([]*peer, 8)
+	for i := range peers {
+		peers[i] = &peer{router: r, port: types.SwitchPortID(i + 1)}
+	}
+	newAnnouncement := func(sequence types.Varu64) *rootAnnouncementWithTime {
+		ann := &rootAnnouncementWithTime{
+			SwitchAnnouncement: types.SwitchAnnouncement{
+				Root: types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: sequence},
+			},
+		}
+		if err := ann.Sign(rootSK, 1); err != nil {
+			t.Fatal(err)
+		}
+		return ann
+	}
+
+	// Every peer must get an announcement that verifies and that carries
+	// its own port, even though the signature is only generated once for
+	// each announcement. A stale signature wouldn't verify.
+	for i, ann := range []*rootAnnouncementWithTime{
+		newAnnouncement(1), newAnnouncement(1), newAnnouncement(2),
+	} {
+		for _, p := range peers {
+			f := ann.forPeer(p)
+			var received types.SwitchAnnouncement
+			if _, err := received.UnmarshalBinary(f.Payload); err != nil {
+				t.Fatalf("announcement %d on port %d failed to verify: %s", i, p.port, err)
+			}
+			framePool.Put(f)
+			last := received.Signatures[len(received.Signatures)-1]
+			if last.PublicKey != r.public || last.Hop != types.Varu64(p.port) {
+				t.Fatalf("announcement %d on port %d has wrong final signature", i, p.port)
+			}
+		}
+		expected, err := ann.NewSignature(r.private[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sig := ann.sign(r); sig != expected {
+			t.Fatalf("cached signature for announcement %d doesn't match a fresh one", i)
+		}
+	}
+	// The first two announcements have the same content, so only the
+	// third one needs to be signed again.
+	if signed := r._signatures.signed; signed != 2 {
+		t.Fatalf("expected 2 signing operations, got %d", signed)
+	}
+
+	// A new key must not be given the signature made with the old one.
+	copy(r.private[:], newTestKey(t, 0x80, 0xc0))
+	r.public = r.private.Public()
+	ann := newAnnouncement(2)
+	f := ann.forPeer(peers[0])
+	defer framePool.Put(f)
+	var received types.SwitchAnnouncement
+	if _, err := received.UnmarshalBinary(f.Payload); err != nil {
+		t.Fatalf("announcement failed to verify after changing key: %s", err)
+	}
+	if signed := r._signatures.signed; signed != 3 {
+		t.Fatalf("expected 3 signing operations, got %d", signed)
+	}
+}
+
+func BenchmarkTreeAnnouncementSigning(b *testing.B) {
+	_, sk, _ := ed25519.GenerateKey(nil)
+	r := &Router{}
+	copy(r.private[:], sk)
+	r.public = r.private.Public()
+	peers := make([]*peer, 256)
+	for i := range peers {
+		peers[i] = &peer{router: r, port: types.SwitchPortID(i + 1)}
+	}
+	ann := &rootAnnouncementWithTime{
+		SwitchAnnouncement: types.SwitchAnnouncement{
+			Root: types.Root{RootPublicKey: r.public, RootSequence: 1},
+		},
+	}
+
+	// Each iteration sends a new announcement to every peer, so that it has
+	// to be signed at least once. The signs/op metric shows how many times
+	// it was actually signed.
+	run := func(name string, send func()) {
+		b.Run(name, func(b *testing.B) {
+			signed := r._signatures.signed
+			for i := 0; i < b.N; i++ {
+				ann.RootSequence++
+				send()
+			}
+			b.ReportMetric(float64(r._signatures.signed-signed)/float64(b.N), "signs/op")
+		})
+	}
+	run("SignPerPeer", func() {
+		for _, p := range peers {
+			framePool.Put(ann.forPeer(p))
+		}
+	})
+	run("SignPerPeerUncached", func() {
+		for _, p := range peers {
+			r._signatures.valid = false
+			framePool.Put(ann.forPeer(p))
+		}
+	})
+	run("SignOnce", func() {
+		sig := ann.sign(r)
+		for _, p := range peers {
+			framePool.Put(ann.forPeerWithSignature(p, sig))
+		}
+	})
+}
+
+func BenchmarkTreeDuplicateAnnouncement(b *testing.B) {
+	rootSK := newTestKey(b, 0xf0, 0xff)
+	midSK := newTestKey(b, 0x80, 0xf0)
+	r := newTestRouterWithKey(b, newTestKey(b, 0, 0x40))
+	p := newTestPeer(r, 1, testPublicKey(midSK))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	f := newTestAnnouncement(b, root, rootSK, midSK)
+
+	for _, duplicate := range []bool{true, false} {
+		name := "Duplicate"
+		if !duplicate {
+			name = "Verified"
+		}
+		b.Run(name, func(b *testing.B) {
+			var err error
+			phony.Block(r.state, func() {
+				for i := 0; i < b.N && err == nil; i++ {
+					if ann := r.state._announcements[p]; ann != nil && !duplicate {
+						// Forget the payload so that the announcement
+						// is verified and processed in full every time.
+						ann.raw = nil
+					}
+					err = r.state._handleTreeAnnouncement(p, f)
+				}
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTreeCompareRootSequences(t *testing.T) {
+	cases := []struct {
+		desc     string
+		a, b     types.Varu64
+		expected int
+		sane     bool
+	}{
+		{"TestIncrement", 2, 1, 1, true},
+		{"TestSame", 1, 1, 0, true},
+		{"TestOlder", 1, 2, -1, true},
+		{"TestWrap", 0, math.MaxUint64, 1, true},
+		{"TestWrapOlder", math.MaxUint64, 1, -1, true},
+		{"TestWithinWindow", rootSequenceWindow + 1, 1, 1, true},
+		{"TestAbsurdJump", rootSequenceWindow + 2, 1, 1, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.desc, func(t *testing.T) {
+			if actual := compareRootSequences(tc.a, tc.b); actual != tc.expected {
+				t.Fatalf("expected: %d got: %d", tc.expected, actual)
+			}
+			if actual := rootSequenceJumpIsSane(tc.a, tc.b); actual != tc.sane {
+				t.Fatalf("expected sane: %v got: %v", tc.sane, actual)
+			}
+		})
+	}
+}
+
+func TestTreeRootSequenceJumpRejected(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	aSK := newTestKey(t, 0x40, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+
+	announce := func(seq types.Varu64) (err error) {
+		f := newTestAnnouncement(t, types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: seq}, rootSK, aSK)
+		phony.Block(r.state, func() {
+			err = r.state._handleTreeAnnouncement(a, f)
+		})
+		return
+	}
+
+	if err := announce(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := announce(rootSequenceWindow + 2); err == nil {
+		t.Fatalf("expected absurd sequence number jump to be rejected")
+	}
+	if err := announce(rootSequenceWindow + 1); err != nil {
+		t.Fatalf("expected sequence number jump within the window to be accepted, got %s", err)
+	}
+}
+
+func TestTreeAnnouncementSignatureLimit(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	aSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40), RouterOptionMaxAnnouncementSignatures(2))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+
+	announce := func(seq types.Varu64, signers ...ed25519.PrivateKey) (err error) {
+		f := newTestAnnouncement(t, types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: seq}, signers...)
+		phony.Block(r.state, func() {
+			err = r.state._handleTreeAnnouncement(a, f)
+		})
+		return
+	}
+
+	if err := announce(1, rootSK, aSK); err != nil {
+		t.Fatalf("expected announcement within the limit to be accepted, got %s", err)
+	}
+	err := announce(2, rootSK, midSK, aSK)
+	if err == nil {
+		t.Fatalf("expected announcement with too many signatures to be rejected")
+	}
+	if !strings.Contains(err.Error(), "signatures") {
+		t.Fatalf("expected error about signatures, got %s", err)
+	}
+}
+
+func TestTreeBumpSequence(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	a := newTestPeer(r, 1, types.PublicKey{1})
+	phony.Block(r.state, func() {
+		r.state._peers[a.port] = a
+	})
+
+	// Wait for the first tree maintenance to run, which will give us our
+	// first sequence number as the root.
+	deadline := time.Now().Add(time.Second * 5)
+	for r.Sequence() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for tree maintenance")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// announced returns the sequence numbers of the announcements that have
+	// been sent to the peer since it was last called.
+	announced := func() (sequences []types.Varu64) {
+		// The announcements are sent by a separate action, so wait for it.
+		phony.Block(r.state, func() {})
+		phony.Block(r.state, func() {
+			for n := a.proto.queuecount(); n > 0; n-- {
+				f := <-a.proto.pop()
+				a.proto.ack()
+				var ann types.SwitchAnnouncement
+				if f.Type == types.TypeTreeAnnouncement {
+					if _, err := ann.UnmarshalBinary(f.Payload); err == nil {
+						sequences = append(sequences, ann.RootSequence)
+					}
+				}
+			}
+		})
+		return
+	}
+	announced()
+
+	before := r.Sequence()
+	r.BumpSequence()
+	sequences := announced()
+	if after := r.Sequence(); after != before+1 {
+		t.Fatalf("expected sequence %d after bumping, got %d", before+1, after)
+	}
+	if len(sequences) != 1 || uint64(sequences[0]) != before+1 {
+		t.Fatalf("expected an announcement with sequence %d, got %v", before+1, sequences)
+	}
+
+	// Once we are following another root, we can't change its sequence.
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	ann := newTestAnnouncement(t, root, rootSK)
+	parent := newTestPeer(r, 2, testPublicKey(rootSK))
+	var err error
+	phony.Block(r.state, func() {
+		r.state._peers[parent.port] = parent
+		err = r.state._handleTreeAnnouncement(parent, ann)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	announced()
+	r.BumpSequence()
+	if sequences := announced(); len(sequences) != 0 {
+		t.Fatalf("expected no announcements when not the root, got %v", sequences)
+	}
+	if sequence := r.Sequence(); sequence != 1 {
+		t.Fatalf("expected the root's sequence 1, got %d", sequence)
+	}
+}
+
+func TestTreePromote(t *testing.T) {
+	weakSK := newTestKey(t, 0, 0x40)
+	strongSK := newTestKey(t, 0xf0, 0xff)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	weak := newTestPeer(r, 1, testPublicKey(weakSK))
+	strong := newTestPeer(r, 2, testPublicKey(strongSK))
+
+	// Pretend that we are stuck following a weaker root, as could happen
+	// during initial convergence.
+	var err error
+	weakAnn := newTestAnnouncement(t, types.Root{RootPublicKey: weak.public, RootSequence: 1}, weakSK)
+	phony.Block(r.state, func() {
+		r.state._peers[weak.port] = weak
+		if err = r.state._handleTreeAnnouncement(weak, weakAnn); err != nil {
+			return
+		}
+		r.state._setParent(weak)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.Promote(); err != nil {
+		t.Fatalf("expected promotion to succeed, got %s", err)
+	}
+	var parent *peer
+	var root types.Root
+	var announced []types.PublicKey
+	phony.Block(r.state, func() {
+		parent, root = r.state._parent, r.state._rootAnnouncement().Root
+		for n := weak.proto.queuecount(); n > 0; n-- {
+			f := <-weak.proto.pop()
+			weak.proto.ack()
+			var ann types.SwitchAnnouncement
+			if f.Type == types.TypeTreeAnnouncement {
+				if _, err := ann.UnmarshalBinary(f.Payload); err == nil {
+					announced = append(announced, ann.RootPublicKey)
+				}
+			}
+		}
+	})
+	if parent != nil || root.RootPublicKey != r.public {
+		t.Fatalf("expected to be the root after promotion")
+	}
+	if len(announced) == 0 || announced[len(announced)-1] != r.public {
+		t.Fatalf("expected to announce ourselves as the root after promotion")
+	}
+
+	// Once a stronger root appears we should follow it, and promotion should
+	// no longer be possible.
+	strongAnn := newTestAnnouncement(t, types.Root{RootPublicKey: strong.public, RootSequence: 1}, strongSK)
+	phony.Block(r.state, func() {
+		r.state._peers[strong.port] = strong
+		err = r.state._handleTreeAnnouncement(strong, strongAnn)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Promote(); err == nil {
+		t.Fatalf("expected promotion to fail with a stronger root present")
+	}
+	phony.Block(r.state, func() {
+		parent = r.state._parent
+	})
+	if parent != strong {
+		t.Fatalf("expected to follow the stronger root")
+	}
+
+	// Demoting ourselves should find the stronger root again.
+	phony.Block(r.state, func() {
+		r.state._setParent(nil)
+	})
+	r.Demote()
+	phony.Block(r.state, func() {
+		parent = r.state._parent
+	})
+	if parent != strong {
+		t.Fatalf("expected to follow the stronger root after demotion")
+	}
+}
+
+func TestTreeCachedCoords(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	aSK := newTestKey(t, 0x40, 0x80)
+	r := newTestRouterWithKey(t, newTestKey(t, 0, 0x40))
+	a := newTestPeer(r, 1, testPublicKey(aSK))
+
+	var seq types.Varu64
+	check := func(signers ...ed25519.PrivateKey) {
+		seq++
+		root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: seq}
+		var err error
+		var cached, fresh [2]types.Coordinates
+		update := newTestAnnouncement(t, root, signers...)
+		phony.Block(r.state, func() {
+			r.state._peers[a.port] = a
+			if err = r.state._handleTreeAnnouncement(a, update); err != nil {
+				return
+			}
+			ann := r.state._announcements[a]
+			cached = [2]types.Coordinates{ann.Coords(), ann.PeerCoords()}
+			fresh = [2]types.Coordinates{ann.SwitchAnnouncement.Coords(), ann.SwitchAnnouncement.PeerCoords()}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cached[0].EqualTo(fresh[0]) || !cached[1].EqualTo(fresh[1]) {
+			t.Fatalf("cached coords %v and %v don't match computed coords %v and %v", cached[0], cached[1], fresh[0], fresh[1])
+		}
+	}
+
+	check(rootSK, midSK, aSK)
+	check(rootSK, aSK) // a new announcement should replace the cached coords
+
+	// Modifying the coordinates returned to callers outside of the actor
+	// shouldn't affect the cache.
+	coords := r.state.coords()
+	for i := range coords {
+		coords[i] = 99
+	}
+	if again := r.state.coords(); again.EqualTo(coords) {
+		t.Fatalf("modifying returned coordinates changed the cached coordinates")
+	}
+}
+
+func BenchmarkTreeNextHop(b *testing.B) {
+	rootSK := newTestKey(b, 0xf0, 0xff)
+	midSK := newTestKey(b, 0x80, 0xf0)
+	r := newTestRouterWithKey(b, newTestKey(b, 0, 0x40))
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+
+	// Each peer is a child of the same node, so we are all siblings.
+	var dest types.Coordinates
+	for port := types.SwitchPortID(1); port <= 8; port++ {
+		sk := newTestKey(b, 0x40, 0x80)
+		p := newTestPeer(r, port, testPublicKey(sk))
+		ann := newTestAnnouncement(b, root, rootSK, midSK, sk)
+		var err error
+		phony.Block(r.state, func() {
+			r.state._peers[port] = p
+			err = r.state._handleTreeAnnouncement(p, ann)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	phony.Block(r.state, func() {
+		sibling := r.state._announcements[r.state._peers[1]].PeerCoords()
+		dest = append(sibling.Copy(), 1, 2)
+	})
+
+	for _, cached := range []bool{false, true} {
+		b.Run(fmt.Sprintf("Cached=%v", cached), func(b *testing.B) {
+			phony.Block(r.state, func() {
+				for _, ann := range r.state._announcements {
+					ann.coords, ann.peerCoords = nil, nil
+					if cached {
+						ann.cacheCoords()
+					}
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					r.state._nextHopsTree(nil, dest, 0)
+				}
+			})
+		})
+	}
+}
+
+func TestTreeParentFilter(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	direct := newTestAnnouncement(t, root, rootSK)
+	indirect := newTestAnnouncement(t, root, rootSK, midSK)
+
+	// The peer directly connected to the root would normally be the best
+	// parent, but the filter doesn't allow us to use it.
+	metered := testPublicKey(rootSK)
+	filter := RouterOptionParentFilter(func(public types.PublicKey) bool {
+		return public != metered
+	})
+
+	t.Run("NextBest", func(t *testing.T) {
+		r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), filter)
+		a := newTestPeer(r, 1, testPublicKey(rootSK))
+		b := newTestPeer(r, 2, testPublicKey(midSK))
+
+		var err error
+		var parent *peer
+		phony.Block(r.state, func() {
+			r.state._peers[a.port], r.state._peers[b.port] = a, b
+			if err = r.state._handleTreeAnnouncement(a, direct); err != nil {
+				return
+			}
+			if err = r.state._handleTreeAnnouncement(b, indirect); err != nil {
+				return
+			}
+			r.state._selectNewParent()
+			parent = r.state._parent
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent != b {
+			t.Fatalf("expected to choose the allowed peer as our parent")
+		}
+	})
+
+	t.Run("BecomeRoot", func(t *testing.T) {
+		r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), filter)
+		a := newTestPeer(r, 1, testPublicKey(rootSK))
+
+		var err error
+		var parent *peer
+		var ourRoot types.PublicKey
+		phony.Block(r.state, func() {
+			r.state._peers[a.port] = a
+			if err = r.state._handleTreeAnnouncement(a, direct); err != nil {
+				return
+			}
+			r.state._selectNewParent()
+			parent, ourRoot = r.state._parent, r.state._rootAnnouncement().RootPublicKey
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parent != nil || ourRoot != r.public {
+			t.Fatalf("expected to become the root with no allowed parents")
+		}
+	})
+}
+
+func TestTreeFlappingParentExcluded(t *testing.T) {
+	clock := newTestClock()
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80), RouterOptionClock{clock})
+	flappy := newTestPeer(r, 1, testPublicKey(rootSK))
+	stable := newTestPeer(r, 2, testPublicKey(midSK))
+	phony.Block(r.state, func() {
+		r.state._peers[flappy.port], r.state._peers[stable.port] = flappy, stable
+	})
+
+	// The flapping peer is directly connected to the root so it is always
+	// the better parent, as long as it keeps sending announcements.
+	announce := func(p *peer, sequence types.Varu64, signers ...ed25519.PrivateKey) {
+		root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: sequence}
+		ann := newTestAnnouncement(t, root, signers...)
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._handleTreeAnnouncement(p, ann)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	state := func(maintain bool) (parent *peer, penalised bool) {
+		phony.Block(r.state, func() {
+			if maintain {
+				r.state._maintainTree()
+			}
+			parent = r.state._parent
+			entry, ok := r.state._parentFlaps[flappy.public]
+			penalised = ok && entry.penalised(clock.Now())
+		})
+		return
+	}
+
+	announce(stable, 1, rootSK, midSK)
+	for i := 0; i < parentFlapThreshold; i++ {
+		announce(flappy, 1, rootSK)
+		if parent, penalised := state(false); parent != flappy || penalised {
+			t.Fatalf("flap %d: expected the flapping peer to be chosen as our parent", i)
+		}
+		// The stable peer keeps announcing while the flapping peer goes
+		// silent until it times out.
+		clock.Advance(r.announceTimeout / 2)
+		announce(stable, 1, rootSK, midSK)
+		clock.Advance(r.announceTimeout / 2)
+		if parent, _ := state(true); parent != stable {
+			t.Fatalf("flap %d: expected to fall back to the stable peer", i)
+		}
+	}
+
+	// The flapping peer is back and is still the better candidate, but it
+	// should be excluded from parent selection for now.
+	announce(flappy, 1, rootSK)
+	if parent, penalised := state(false); parent != stable || !penalised {
+		t.Fatalf("expected the flapping peer to be excluded in favour of the stable peer")
+	}
+
+	// Once the penalty has expired, the flapping peer can be chosen again.
+	clock.Advance(r.announceTimeout * parentFlapPenalty)
+	announce(stable, 2, rootSK, midSK)
+	announce(flappy, 2, rootSK)
+	if parent, penalised := state(false); parent != flappy || penalised {
+		t.Fatalf("expected the flapping peer to be chosen again after the penalty")
+	}
+}
+
+func TestTreeLeavingParent(t *testing.T) {
+	rootSK := newTestKey(t, 0xf0, 0xff)
+	midSK := newTestKey(t, 0x80, 0xf0)
+	r := newTestRouterWithKey(t, newTestKey(t, 0x40, 0x80))
+	leaving := newTestPeer(r, 1, testPublicKey(rootSK))
+	other := newTestPeer(r, 2, testPublicKey(midSK))
+	phony.Block(r.state, func() {
+		r.state._peers[leaving.port], r.state._peers[other.port] = leaving, other
+	})
+
+	root := types.Root{RootPublicKey: testPublicKey(rootSK), RootSequence: 1}
+	direct := newTestAnnouncement(t, root, rootSK)
+	indirect := newTestAnnouncement(t, root, rootSK, midSK)
+	final := newTestAnnouncement(t, root, rootSK)
+	final.Extra |= types.FlagLeaving
+
+	handle := func(p *peer, f *types.Frame) (parent *peer) {
+		var err error
+		phony.Block(r.state, func() {
+			err = r.state._handleTreeAnnouncement(p, f)
+			parent = r.state._parent
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	handle(other, indirect)
+	if parent := handle(leaving, direct); parent != leaving {
+		t.Fatalf("expected the peer closest to the root to be our parent")
+	}
+
+	// The leaving announcement should make us switch parent straight away,
+	// without waiting for the old parent's announcement to time out.
+	if parent := handle(leaving, final); parent != other {
+		t.Fatalf("expected to re-parent as soon as our parent said it was leaving")
+	}
+	phony.Block(r.state, func() {
+		if _, ok := r.state._announcements[leaving]; ok {
+			t.Errorf("expected the leaving peer's announcement to be forgotten")
+		}
+		if _, ok := r.state._parentFlaps[leaving.public]; ok {
+			t.Errorf("expected a graceful departure not to count as a parent failure")
+		}
+	})
+}
+
+func TestTreeLeavingAnnouncementSent(t *testing.T) {
+	r := newTestRouter(t)
+	p := newTestPeer(r, 1, testPublicKey(newTestKey(t, 0x00, 0xff)))
+	// Make sure that our first root announcement has already gone out, so
+	// that the only one sent to the new peer is the leaving one.
+	waitForTreeMaintenance(t, r)
+	phony.Block(r.state, func() {
+		r.state._peers[p.port] = p
+	})
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case f := <-p.proto.pop():
+		p.proto.ack()
+		if f.Type != types.TypeTreeAnnouncement {
+			t.Fatalf("expected a tree announcement, got %s", f.Type)
+		}
+		if f.Extra&types.FlagLeaving == 0 {
+			t.Fatalf("expected the announcement to be flagged as leaving")
+		}
+	default:
+		t.Fatalf("expected a leaving announcement to be sent on close")
+	}
 }
@@ -24,4 +24,18 @@ const (
 )
 
 const ourVersion uint8 = 1
+
+// Protocol revisions are exchanged in the handshake and describe additions to
+// the protocol that older nodes can live without, so unlike the version and
+// capabilities they don't need to match. Nodes that predate revisions send 0.
+// Each peering uses the lower of the two revisions, and behaviours that older
+// nodes wouldn't understand are gated on it. Peerings that skip the handshake
+// have nothing to go on, so they are treated as legacy.
+const (
+	revisionLegacy               uint8 = iota
+	revisionSourceRouting              // understands TypeSourceRouted frames
+	revisionCompactAnnouncements       // understands FlagCompactAnnouncement
+)
+
+const ourRevision = revisionCompactAnnouncements
 const ourCapabilities uint32 = capabilityLengthenedRootInterval | capabilityCryptographicSetups | capabilityDedupedCoordinateInfo | capabilitySoftState | capabilityHybridRouting
@@ -0,0 +1,80 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/matrix-org/pinecone/router/events"
+	"go.uber.org/atomic"
+)
+
+// maintenanceWatch tracks when a maintenance task last ran, so that the
+// watchdog can tell if the state actor has stopped running it.
+type maintenanceWatch struct {
+	task     string
+	interval time.Duration
+	lastRun  *atomic.Time
+	stalled  bool // Only used by the watchdog goroutine
+	restart  func()
+}
+
+// ran records that the maintenance task has just run. It is safe to call
+// from any goroutine.
+func (w *maintenanceWatch) ran() {
+	w.lastRun.Store(time.Now())
+}
+
+// watchdog checks that tree and SNEK maintenance keep running. If something
+// blocks the state actor, such as a slow filter, then maintenance stops and
+// the node silently stops converging. The watchdog turns that into a log
+// line and a MaintenanceStalled event, and resets the maintenance timer in
+// case it was lost, so that maintenance runs as soon as the actor is free.
+// It uses real time, like the maintenance timers, and runs until the router
+// is closed.
+func (r *Router) watchdog() {
+	watches := []*maintenanceWatch{r._treeWatch, r._snakeWatch}
+	interval := r.snakeMaintainInterval
+	if r.announceInterval < interval {
+		interval = r.announceInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.context.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, w := range watches {
+			since := time.Since(w.lastRun.Load())
+			switch stalled := since > w.interval*maintenanceStallFactor; {
+			case stalled && !w.stalled:
+				r.log.Printf("Watchdog: %s maintenance hasn't run for %s, rescheduling", w.task, since.Round(time.Millisecond))
+				r._maintenanceStalls.Inc()
+				w.restart()
+			case !stalled && w.stalled:
+				r.log.Printf("Watchdog: %s maintenance has resumed", w.task)
+			default:
+				continue
+			}
+			w.stalled = !w.stalled
+			event := events.MaintenanceStalled{Task: w.task, Stalled: w.stalled}
+			r.Act(nil, func() {
+				r._publish(event)
+			})
+		}
+	}
+}
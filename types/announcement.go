@@ -39,20 +39,31 @@ type SwitchAnnouncement struct {
 }
 
 func (a *SwitchAnnouncement) Sign(privKey ed25519.PrivateKey, forPort SwitchPortID) error {
+	hop, err := a.NewSignature(privKey)
+	if err != nil {
+		return fmt.Errorf("a.NewSignature: %w", err)
+	}
+	hop.Hop = Varu64(forPort)
+	a.Signatures = append(a.Signatures, hop)
+	return nil
+}
+
+// NewSignature signs the announcement as it stands with the given private key
+// but doesn't append the signature. The hop port isn't covered by the
+// signature, so the same signature can be reused when sending the announcement
+// to more than one port, setting the Hop field for each.
+func (a *SwitchAnnouncement) NewSignature(privKey ed25519.PrivateKey) (SignatureWithHop, error) {
 	var body [65535]byte
+	var hop SignatureWithHop
 	n, err := a.MarshalBinary(body[:])
 	if err != nil {
-		return fmt.Errorf("a.MarshalBinary: %w", err)
-	}
-	hop := SignatureWithHop{
-		Hop: Varu64(forPort),
+		return hop, fmt.Errorf("a.MarshalBinary: %w", err)
 	}
 	copy(hop.PublicKey[:], privKey.Public().(ed25519.PublicKey))
 	if _, ok := os.LookupEnv("PINECONE_DISABLE_SIGNATURES"); !ok {
 		copy(hop.Signature[:], ed25519.Sign(privKey, body[:n]))
 	}
-	a.Signatures = append(a.Signatures, hop)
-	return nil
+	return hop, nil
 }
 
 func (a *SwitchAnnouncement) UnmarshalBinary(data []byte) (int, error) {
@@ -101,6 +112,97 @@ func (a *SwitchAnnouncement) MarshalBinary(buffer []byte) (int, error) {
 	return offset, nil
 }
 
+// MarshalCompact marshals the announcement like MarshalBinary, but leaves out
+// the public keys that the receiver already knows. The first signature is
+// always from the root and the last is always from the peer that sends the
+// announcement, so neither key needs to be sent. UnmarshalCompact fills them
+// back in. The signatures still cover the announcement as MarshalBinary would
+// encode it, so this only changes how it is sent to a single peer.
+func (a *SwitchAnnouncement) MarshalCompact(buffer []byte) (int, error) {
+	if len(a.Signatures) == 0 || a.Signatures[0].PublicKey != a.RootPublicKey {
+		return 0, fmt.Errorf("first signature must be from the root")
+	}
+	if len(buffer) < ed25519.PublicKeySize+a.RootSequence.Length() {
+		return 0, fmt.Errorf("buffer is too small")
+	}
+	offset := copy(buffer, a.RootPublicKey[:])
+	n, err := a.RootSequence.MarshalBinary(buffer[offset:])
+	if err != nil {
+		return 0, fmt.Errorf("a.Sequence.MarshalBinary: %w", err)
+	}
+	offset += n
+	last := len(a.Signatures) - 1
+	for i, sig := range a.Signatures {
+		withKey := i != 0 && i != last
+		size := sig.Hop.Length() + ed25519.SignatureSize
+		if withKey {
+			size += ed25519.PublicKeySize
+		}
+		if len(buffer)-offset < size {
+			return 0, fmt.Errorf("buffer is too small")
+		}
+		n, err := sig.Hop.MarshalBinary(buffer[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("sig.Hop.MarshalBinary: %w", err)
+		}
+		offset += n
+		if withKey {
+			offset += copy(buffer[offset:], sig.PublicKey[:])
+		}
+		offset += copy(buffer[offset:], sig.Signature[:])
+	}
+	return offset, nil
+}
+
+// UnmarshalCompact unmarshals an announcement that was marshalled using
+// MarshalCompact by the given peer, verifying the signatures as
+// UnmarshalBinary does.
+func (a *SwitchAnnouncement) UnmarshalCompact(data []byte, from PublicKey) (int, error) {
+	expected := ed25519.PublicKeySize + 1
+	if size := len(data); size < expected {
+		return 0, fmt.Errorf("expecting at least %d bytes, got %d bytes", expected, size)
+	}
+	var root PublicKey
+	var sequence Varu64
+	copy(root[:], data)
+	l, err := sequence.UnmarshalBinary(data[ed25519.PublicKeySize:])
+	if err != nil {
+		return 0, fmt.Errorf("a.Sequence.UnmarshalBinary: %w", err)
+	}
+	full := make([]byte, 0, len(data)+ed25519.PublicKeySize*2)
+	full = append(full, data[:ed25519.PublicKeySize+l]...)
+	remaining := data[ed25519.PublicKeySize+l:]
+	for i := 0; len(remaining) > 0; i++ {
+		var hop Varu64
+		l, err := hop.UnmarshalBinary(remaining)
+		if err != nil {
+			return 0, fmt.Errorf("signature %d hop.UnmarshalBinary: %w", i, err)
+		}
+		full = append(full, remaining[:l]...)
+		remaining = remaining[l:]
+		switch {
+		case i == 0:
+			full = append(full, root[:]...)
+		case len(remaining) == ed25519.SignatureSize:
+			full = append(full, from[:]...)
+		case len(remaining) < ed25519.PublicKeySize:
+			return 0, fmt.Errorf("signature %d is truncated", i)
+		default:
+			full = append(full, remaining[:ed25519.PublicKeySize]...)
+			remaining = remaining[ed25519.PublicKeySize:]
+		}
+		if len(remaining) < ed25519.SignatureSize {
+			return 0, fmt.Errorf("signature %d is truncated", i)
+		}
+		full = append(full, remaining[:ed25519.SignatureSize]...)
+		remaining = remaining[ed25519.SignatureSize:]
+	}
+	if _, err := a.UnmarshalBinary(full); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
 func (a *SwitchAnnouncement) SanityCheck(from PublicKey) error {
 	if len(a.Signatures) == 0 {
 		return fmt.Errorf("update has no signatures")
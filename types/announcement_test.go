@@ -78,3 +78,102 @@ func TestMarshalUnmarshalAnnouncement(t *testing.T) {
 		t.Fatalf("third public key doesn't match")
 	}
 }
+
+// newTestChain returns an announcement that has been signed by a chain of the
+// given number of nodes, the first of which is the root.
+func newTestChain(tb testing.TB, length int) (*SwitchAnnouncement, PublicKey) {
+	announcement := &SwitchAnnouncement{
+		Root: Root{
+			RootSequence: 1,
+		},
+	}
+	var last PublicKey
+	for i := 0; i < length; i++ {
+		pk, sk, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if i == 0 {
+			copy(announcement.RootPublicKey[:], pk)
+		}
+		if err = announcement.Sign(sk, SwitchPortID(i+1)); err != nil {
+			tb.Fatal(err)
+		}
+		copy(last[:], pk)
+	}
+	return announcement, last
+}
+
+func TestMarshalUnmarshalCompactAnnouncement(t *testing.T) {
+	for _, length := range []int{1, 2, 3, 20} {
+		input, from := newTestChain(t, length)
+		var buffer [65535]byte
+		n, err := input.MarshalCompact(buffer[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var output SwitchAnnouncement
+		if _, err = output.UnmarshalCompact(buffer[:n], from); err != nil {
+			t.Fatalf("chain of %d: %s", length, err)
+		}
+		if output.Root != input.Root || len(output.Signatures) != len(input.Signatures) {
+			t.Fatalf("chain of %d: announcement doesn't match", length)
+		}
+		for i := range input.Signatures {
+			if output.Signatures[i] != input.Signatures[i] {
+				t.Fatalf("chain of %d: signature %d doesn't match", length, i)
+			}
+		}
+
+		// The signatures can't be verified if the announcement claims to
+		// come from someone else, or if it has been cut short. With only one
+		// signature, the sender is the root, whose key is always sent.
+		if _, err = output.UnmarshalCompact(buffer[:n], PublicKey{1}); length > 1 && err == nil {
+			t.Fatalf("chain of %d: expected the wrong sender to be rejected", length)
+		}
+		if _, err = output.UnmarshalCompact(buffer[:n-1], from); err == nil {
+			t.Fatalf("chain of %d: expected a truncated announcement to be rejected", length)
+		}
+	}
+}
+
+func TestUnmarshalCompactAnnouncementTruncatedVaru64(t *testing.T) {
+	input, from := newTestChain(t, 2)
+	var buffer [65535]byte
+	n, err := input.MarshalCompact(buffer[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Cut the announcement off part way through the sequence number, and
+	// part way through the first hop, by leaving the continuation bit set.
+	sequence := append(append([]byte{}, buffer[:ed25519.PublicKeySize]...), 0x80)
+	hop := append(append([]byte{}, buffer[:ed25519.PublicKeySize+1]...), 0x80)
+	for name, data := range map[string][]byte{"Sequence": sequence, "Hop": hop} {
+		var output SwitchAnnouncement
+		if _, err := output.UnmarshalCompact(data, from); err == nil {
+			t.Fatalf("%s: expected a truncated announcement to be rejected, got %+v", name, output)
+		}
+	}
+	var output SwitchAnnouncement
+	if _, err := output.UnmarshalCompact(buffer[:n], from); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkMarshalCompactAnnouncement(b *testing.B) {
+	input, _ := newTestChain(b, 30)
+	var buffer [65535]byte
+	full, err := input.MarshalBinary(buffer[:])
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	var compact int
+	for i := 0; i < b.N; i++ {
+		if compact, err = input.MarshalCompact(buffer[:]); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(full), "full-bytes")
+	b.ReportMetric(float64(compact), "compact-bytes")
+}
@@ -0,0 +1,56 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// FragmentHeaderSize is the length of an encoded FragmentHeader.
+const FragmentHeaderSize = 9
+
+// FragmentHeader is prepended to the payload of a traffic frame that carries
+// part of a larger payload. Such frames have FlagFragment set in their Extra
+// field. Nodes that don't support fragmentation will deliver each fragment
+// to the application as-is, header included.
+type FragmentHeader struct {
+	ID     uint32 // Identifies the payload that the fragment belongs to
+	Offset uint32 // Where the fragment starts within the payload
+	More   bool   // Set on all but the final fragment
+}
+
+func (h *FragmentHeader) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < FragmentHeaderSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint32(buf[0:4], h.ID)
+	binary.BigEndian.PutUint32(buf[4:8], h.Offset)
+	buf[8] = 0
+	if h.More {
+		buf[8] = 1
+	}
+	return FragmentHeaderSize, nil
+}
+
+func (h *FragmentHeader) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < FragmentHeaderSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	h.ID = binary.BigEndian.Uint32(buf[0:4])
+	h.Offset = binary.BigEndian.Uint32(buf[4:8])
+	h.More = buf[8]&1 != 0
+	return FragmentHeaderSize, nil
+}
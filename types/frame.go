@@ -39,12 +39,39 @@ const (
 	TypeBootstrap                         // protocol frame, forwarded using SNEK
 	TypeTraffic                           // traffic frame, forwarded using tree or SNEK
 	TypeWakeupBroadcast                   // protocol frame, special broadcast forwarding
+	TypeSourceRouted                      // traffic frame, forwarded along an explicit port path
+	TypeSNEKPing                          // protocol frame, forwarded using SNEK
+	TypeSNEKPong                          // protocol frame, forwarded using SNEK
+	TypePathMTUProbe                      // protocol frame, forwarded using SNEK
+	TypePathMTUReply                      // protocol frame, forwarded using SNEK
 )
 
 func (t FrameType) IsTraffic() bool {
-	return t == TypeTraffic
+	return t == TypeTraffic || t == TypeSourceRouted
 }
 
+// FlagSourceRouteFailed is set in the Extra field of a source-routed frame
+// when one of the ports in its path could not be followed and the frame has
+// fallen back to normal tree routing instead.
+const FlagSourceRouteFailed byte = 1 << 0
+
+// FlagFragment is set in the Extra field of a traffic frame when its payload
+// starts with a FragmentHeader and carries only part of a larger payload.
+const FlagFragment byte = 1 << 1
+
+// FlagCompactAnnouncement is set in the Extra field of a tree announcement
+// when its payload was marshalled using SwitchAnnouncement.MarshalCompact.
+const FlagCompactAnnouncement byte = 1 << 2
+
+// FlagLeaving is set in the Extra field of the final tree announcement that a
+// node sends to each of its peers when it is shutting down, so that they can
+// stop using it as their parent straight away.
+const FlagLeaving byte = 1 << 3
+
+// FlagTimestamped is set in the Extra field of a traffic frame when its
+// payload starts with a FrameTimestamp recording when the frame was sent.
+const FlagTimestamped byte = 1 << 4
+
 const (
 	Version0 FrameVersion = iota
 )
@@ -69,6 +96,7 @@ type Frame struct {
 	Source         Coordinates
 	SourceKey      PublicKey
 	Watermark      VirtualSnakeWatermark
+	Path           Coordinates // remaining switch ports for source-routed frames
 	Payload        []byte
 }
 
@@ -81,6 +109,7 @@ func (f *Frame) Reset() {
 	f.Source = Coordinates{}
 	f.SourceKey = PublicKey{}
 	f.Watermark = VirtualSnakeWatermark{}
+	f.Path = Coordinates{}
 	f.Payload = f.Payload[:0]
 }
 
@@ -92,6 +121,7 @@ func (f *Frame) CopyInto(t *Frame) {
 	t.DestinationKey = f.DestinationKey
 	t.SourceKey = f.SourceKey
 	t.Watermark = f.Watermark
+	t.Path = append(t.Path[:0], f.Path...)
 	t.Payload = t.Payload[:len(f.Payload)]
 	copy(t.Payload, f.Payload)
 }
@@ -170,6 +200,49 @@ func (f *Frame) MarshalBinary(buffer []byte) (int, error) {
 			offset += copy(buffer[offset:], f.Payload[:payloadLen])
 		}
 
+	case TypeSNEKPing, TypeSNEKPong, TypePathMTUProbe, TypePathMTUReply: // destination = key, source = key
+		payloadLen := len(f.Payload)
+		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
+		offset += 2
+		offset += copy(buffer[offset:], f.DestinationKey[:ed25519.PublicKeySize])
+		offset += copy(buffer[offset:], f.SourceKey[:ed25519.PublicKeySize])
+		offset += copy(buffer[offset:], f.Watermark.PublicKey[:ed25519.PublicKeySize])
+		n, err := f.Watermark.Sequence.MarshalBinary(buffer[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("f.WatermarkSeq.MarshalBinary: %w", err)
+		}
+		offset += n
+		if f.Payload != nil {
+			f.Payload = f.Payload[:payloadLen]
+			offset += copy(buffer[offset:], f.Payload[:payloadLen])
+		}
+
+	case TypeSourceRouted:
+		payloadLen := len(f.Payload)
+		binary.BigEndian.PutUint16(buffer[offset+0:offset+2], uint16(payloadLen))
+		pn, err := f.Path.MarshalBinary(buffer[offset+2:])
+		if err != nil {
+			return 0, fmt.Errorf("f.Path.MarshalBinary: %w", err)
+		}
+		dn, err := f.Destination.MarshalBinary(buffer[offset+2+pn:])
+		if err != nil {
+			return 0, fmt.Errorf("f.Destination.MarshalBinary: %w", err)
+		}
+		sn, err := f.Source.MarshalBinary(buffer[offset+2+pn+dn:])
+		if err != nil {
+			return 0, fmt.Errorf("f.Source.MarshalBinary: %w", err)
+		}
+		if pn > math.MaxUint16 || dn > math.MaxUint16 || sn > math.MaxUint16 || payloadLen > math.MaxUint16 {
+			return 0, fmt.Errorf("frame contents too large")
+		}
+		offset += 2 + pn + dn + sn
+		offset += copy(buffer[offset:], f.DestinationKey[:ed25519.PublicKeySize])
+		offset += copy(buffer[offset:], f.SourceKey[:ed25519.PublicKeySize])
+		if f.Payload != nil {
+			f.Payload = f.Payload[:payloadLen]
+			offset += copy(buffer[offset:], f.Payload[:payloadLen])
+		}
+
 	default:
 		return 0, nil
 	}
@@ -206,7 +279,7 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 		offset += 2
 		f.Payload = f.Payload[:payloadLen]
 		offset += copy(f.Payload, data[offset:])
-		return offset + payloadLen, nil
+		return offset, nil
 
 	case TypeBootstrap: // destination = key, source = coords
 		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
@@ -271,7 +344,62 @@ func (f *Frame) UnmarshalBinary(data []byte) (int, error) {
 		}
 		f.Payload = f.Payload[:payloadLen]
 		offset += copy(f.Payload, data[offset:])
-		return offset + payloadLen, nil
+		return offset, nil
+
+	case TypeSNEKPing, TypeSNEKPong, TypePathMTUProbe, TypePathMTUReply: // destination = key, source = key
+		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
+		if payloadLen > cap(f.Payload) {
+			return 0, fmt.Errorf("payload length exceeds frame capacity")
+		}
+		offset += 2
+		offset += copy(f.DestinationKey[:], data[offset:])
+		offset += copy(f.SourceKey[:], data[offset:])
+		offset += copy(f.Watermark.PublicKey[:], data[offset:])
+		n, err := f.Watermark.Sequence.UnmarshalBinary(data[offset:])
+		if err != nil {
+			return 0, fmt.Errorf("f.WatermarkSeq.UnmarshalBinary: %w", err)
+		}
+		offset += n
+		if size := offset + payloadLen; len(data) != int(size) {
+			return 0, fmt.Errorf("frame expecting %d total bytes, got %d bytes", size, len(data))
+		}
+		f.Payload = f.Payload[:payloadLen]
+		offset += copy(f.Payload, data[offset:])
+		return offset, nil
+
+	case TypeSourceRouted:
+		payloadLen := int(binary.BigEndian.Uint16(data[offset+0 : offset+2]))
+		if payloadLen > cap(f.Payload) {
+			return 0, fmt.Errorf("payload length exceeds frame capacity")
+		}
+		offset += 2
+		pathLen, pathErr := f.Path.UnmarshalBinary(data[offset:])
+		if pathErr != nil {
+			return 0, fmt.Errorf("f.Path.UnmarshalBinary: %w", pathErr)
+		}
+		offset += pathLen
+		dstLen, dstErr := f.Destination.UnmarshalBinary(data[offset:])
+		if dstErr != nil {
+			return 0, fmt.Errorf("f.Destination.UnmarshalBinary: %w", dstErr)
+		}
+		offset += dstLen
+		srcLen, srcErr := f.Source.UnmarshalBinary(data[offset:])
+		if srcErr != nil {
+			return 0, fmt.Errorf("f.Source.UnmarshalBinary: %w", srcErr)
+		}
+		offset += srcLen
+		offset += copy(f.DestinationKey[:], data[offset:])
+		offset += copy(f.SourceKey[:], data[offset:])
+		f.Watermark = VirtualSnakeWatermark{
+			PublicKey: FullMask,
+			Sequence:  0,
+		}
+		if size := offset + payloadLen; len(data) != int(size) {
+			return 0, fmt.Errorf("frame expecting %d total bytes, got %d bytes", size, len(data))
+		}
+		f.Payload = f.Payload[:payloadLen]
+		offset += copy(f.Payload, data[offset:])
+		return offset, nil
 
 	default:
 		return 0, nil
@@ -290,6 +418,16 @@ func (t FrameType) String() string {
 		return "WakeupBroadcast"
 	case TypeTraffic:
 		return "OverlayTraffic"
+	case TypeSourceRouted:
+		return "SourceRoutedTraffic"
+	case TypeSNEKPing:
+		return "SNEKPing"
+	case TypeSNEKPong:
+		return "SNEKPong"
+	case TypePathMTUProbe:
+		return "PathMTUProbe"
+	case TypePathMTUReply:
+		return "PathMTUReply"
 	default:
 		return "Unknown"
 	}
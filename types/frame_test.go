@@ -255,3 +255,140 @@ func TestMarshalUnmarshalSNEKBootstrapFrame(t *testing.T) {
 		t.Fatal("wrong payload")
 	}
 }
+
+func TestMarshalUnmarshalSNEKPingFrame(t *testing.T) {
+	for _, frameType := range []FrameType{TypeSNEKPing, TypeSNEKPong, TypePathMTUProbe, TypePathMTUReply} {
+		dst, _, _ := ed25519.GenerateKey(nil)
+		src, _, _ := ed25519.GenerateKey(nil)
+		wpk, _, _ := ed25519.GenerateKey(nil)
+		input := Frame{
+			Version:  Version0,
+			Type:     frameType,
+			HopLimit: MaxHopLimit,
+			Payload:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Watermark: VirtualSnakeWatermark{
+				Sequence: 100,
+			},
+		}
+		copy(input.DestinationKey[:], dst)
+		copy(input.SourceKey[:], src)
+		copy(input.Watermark.PublicKey[:], wpk)
+		expected := []byte{
+			0x70, 0x69, 0x6e, 0x65, // magic bytes
+			0,               // version 0
+			byte(frameType), // type
+			0,               // extra
+			MaxHopLimit,     // hop limit
+			0, 117,          // frame length
+			0, 8, // payload length
+		}
+		expected = append(expected, dst...)
+		expected = append(expected, src...)
+		expected = append(expected, wpk...)
+		var seq [4]byte
+		n, err := input.Watermark.Sequence.MarshalBinary(seq[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, seq[:n]...)
+		expected = append(expected, input.Payload...)
+		buf := make([]byte, 65535)
+		n, err = input.MarshalBinary(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], expected) {
+			t.Fatalf("%s: wrong marshalled output, got %v, want %v", frameType, buf[:n], expected)
+		}
+
+		output := Frame{
+			Payload: make([]byte, 0, MaxPayloadSize),
+		}
+		if m, err := output.UnmarshalBinary(buf[:n]); err != nil {
+			t.Fatal(err)
+		} else if m != n {
+			t.Fatalf("%s: unmarshalled %d bytes, expected %d", frameType, m, n)
+		}
+		if output.Type != input.Type || output.HopLimit != input.HopLimit {
+			t.Fatalf("%s: wrong header", frameType)
+		}
+		if output.DestinationKey != input.DestinationKey || output.SourceKey != input.SourceKey {
+			t.Fatalf("%s: wrong keys", frameType)
+		}
+		if output.Watermark != input.Watermark {
+			t.Fatalf("%s: wrong watermark", frameType)
+		}
+		if !bytes.Equal(input.Payload, output.Payload) {
+			t.Fatalf("%s: wrong payload", frameType)
+		}
+	}
+}
+
+func TestMarshalUnmarshalFrameSourceRouted(t *testing.T) {
+	src, _, _ := ed25519.GenerateKey(nil)
+	dst, _, _ := ed25519.GenerateKey(nil)
+	input := Frame{
+		Version:     Version0,
+		Type:        TypeSourceRouted,
+		Extra:       FlagSourceRouteFailed,
+		Path:        Coordinates{3, 7},
+		Destination: Coordinates{1},
+		Source:      Coordinates{4, 2},
+		Payload:     []byte("ABC"),
+	}
+	copy(input.DestinationKey[:], dst)
+	copy(input.SourceKey[:], src)
+	expected := []byte{
+		0x70, 0x69, 0x6e, 0x65, // magic bytes
+		0,                      // version 0
+		byte(TypeSourceRouted), // type source routed
+		FlagSourceRouteFailed,  // extra
+		0,                      // hop limit
+		0, 90,                  // frame length
+		0, 3, // payload len
+		0, 2, 3, 7, // path (2+2 bytes)
+		0, 1, 1, // destination (2+1 bytes)
+		0, 2, 4, 2, // source (2+2 bytes)
+	}
+	expected = append(expected, dst...)
+	expected = append(expected, src...)
+	expected = append(expected, input.Payload...)
+	buf := make([]byte, 65535)
+	n, err := input.MarshalBinary(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], expected) {
+		t.Fatalf("wrong marshalled output, \ngot      %v, \nexpected %v", buf[:n], expected)
+	}
+	output := Frame{
+		Payload: make([]byte, 0, MaxPayloadSize),
+	}
+	if consumed, err := output.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	} else if consumed != n {
+		t.Fatalf("expected to consume %d bytes, consumed %d", n, consumed)
+	}
+	if output.Type != input.Type || output.Extra != input.Extra {
+		t.Fatal("wrong type or flags")
+	}
+	if !output.Path.EqualTo(input.Path) {
+		t.Fatalf("wrong path (got %s, expected %s)", output.Path, input.Path)
+	}
+	copied := Frame{
+		Payload: make([]byte, 0, MaxPayloadSize),
+	}
+	output.CopyInto(&copied)
+	if !copied.Path.EqualTo(input.Path) {
+		t.Fatalf("wrong copied path (got %s, expected %s)", copied.Path, input.Path)
+	}
+	if !output.Destination.EqualTo(input.Destination) || !output.Source.EqualTo(input.Source) {
+		t.Fatal("wrong coordinates")
+	}
+	if output.DestinationKey != input.DestinationKey || output.SourceKey != input.SourceKey {
+		t.Fatal("wrong keys")
+	}
+	if !bytes.Equal(input.Payload, output.Payload) {
+		t.Fatal("wrong payload")
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import "fmt"
+
+// SourceRoute is an address that describes an explicit path through the
+// tree to a given node, as a list of switch ports to follow at each hop.
+// The destination coordinates are used to fall back to tree routing if
+// any of the ports in the path can't be followed. Nodes that don't support
+// source routing will drop source-routed frames, so every node along the
+// path needs to support it.
+type SourceRoute struct {
+	Path        Coordinates
+	Destination Coordinates
+	PublicKey   PublicKey
+}
+
+func (r SourceRoute) Network() string {
+	return "source"
+}
+
+func (r SourceRoute) String() string {
+	return fmt.Sprintf("%s via %s", r.PublicKey, r.Path)
+}
@@ -0,0 +1,65 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+)
+
+// FrameTimestampSize is the length of an encoded FrameTimestamp.
+const FrameTimestampSize = 8 + ed25519.SignatureSize
+
+// FrameTimestamp is prepended to the payload of a traffic frame to record
+// when the frame was sent. Such frames have FlagTimestamped set in their
+// Extra field. The sender signs the timestamp along with the destination key
+// and the rest of the payload, so that nodes along the path can't make the
+// frame look younger than it is. Nodes that don't support timestamps will
+// deliver the frame to the application as-is, timestamp included.
+type FrameTimestamp struct {
+	Time      uint64 // Milliseconds since the Unix epoch
+	Signature [ed25519.SignatureSize]byte
+}
+
+// ProtectedPayload returns the data that the signature covers for a frame to
+// the given destination key, where payload is the part of the frame payload
+// that follows the timestamp.
+func (t *FrameTimestamp) ProtectedPayload(destination PublicKey, payload []byte) []byte {
+	hash := sha256.Sum256(payload)
+	buf := make([]byte, 8, 8+ed25519.PublicKeySize+sha256.Size)
+	binary.BigEndian.PutUint64(buf, t.Time)
+	buf = append(buf, destination[:]...)
+	return append(buf, hash[:]...)
+}
+
+func (t *FrameTimestamp) MarshalBinary(buf []byte) (int, error) {
+	if len(buf) < FrameTimestampSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	binary.BigEndian.PutUint64(buf[0:8], t.Time)
+	copy(buf[8:FrameTimestampSize], t.Signature[:])
+	return FrameTimestampSize, nil
+}
+
+func (t *FrameTimestamp) UnmarshalBinary(buf []byte) (int, error) {
+	if len(buf) < FrameTimestampSize {
+		return 0, fmt.Errorf("buffer too small")
+	}
+	t.Time = binary.BigEndian.Uint64(buf[0:8])
+	copy(t.Signature[:], buf[8:FrameTimestampSize])
+	return FrameTimestampSize, nil
+}
@@ -40,10 +40,10 @@ func (n *Varu64) UnmarshalBinary(buf []byte) (int, error) {
 		*n |= Varu64(b & 0x7f)
 		l++
 		if b&0x80 == 0 {
-			break
+			return l, nil
 		}
 	}
-	return l, nil
+	return 0, fmt.Errorf("input slice ends before the end of the number")
 }
 
 func (n Varu64) Length() int {
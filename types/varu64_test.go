@@ -67,3 +67,12 @@ func TestUnmarshalBinaryVaru64(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalBinaryVaru64Truncated(t *testing.T) {
+	for _, input := range [][]byte{{}, {0x80}, {133, 241, 194}} {
+		var num Varu64
+		if _, err := num.UnmarshalBinary(input); err == nil {
+			t.Fatalf("expected %v to be rejected as truncated", input)
+		}
+	}
+}
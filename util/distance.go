@@ -33,11 +33,21 @@ func LessThan(first, second types.PublicKey) bool {
 }
 
 // DHTOrdered returns true if the order of A, B and C is
-// correct, where A < B < C without wrapping.
+// correct, where A < B < C without wrapping. Both bounds are
+// exclusive, so B is never ordered between A and C if it is
+// equal to either of them.
 func DHTOrdered(a, b, c types.PublicKey) bool {
 	return LessThan(a, b) && LessThan(b, c)
 }
 
+// DHTOrderedInclusive returns true if the order of A, B and C
+// is correct, where A <= B <= C without wrapping. It is the same
+// as DHTOrdered except that both bounds are inclusive, so B may
+// be equal to A or C, or to both.
+func DHTOrderedInclusive(a, b, c types.PublicKey) bool {
+	return !LessThan(b, a) && !LessThan(c, b)
+}
+
 // DHTWrappedOrdered returns true if the ordering of A, B
 // and C is correct, where we may wrap around from C to A.
 // This gives us the property of the successor always being
@@ -16,6 +16,7 @@ package util
 
 import (
 	"fmt"
+	"math/rand"
 	"sort"
 	"strings"
 	"testing"
@@ -61,3 +62,104 @@ func TestDHTWrappedOrdering(t *testing.T) {
 		}
 	}
 }
+
+func TestDHTOrderedInclusive(t *testing.T) {
+	for _, tc := range []struct {
+		a, b, c   types.PublicKey
+		ordered   bool
+		inclusive bool
+	}{
+		{types.PublicKey{1}, types.PublicKey{2}, types.PublicKey{3}, true, true},
+		{types.PublicKey{1}, types.PublicKey{1}, types.PublicKey{3}, false, true},
+		{types.PublicKey{1}, types.PublicKey{3}, types.PublicKey{3}, false, true},
+		{types.PublicKey{2}, types.PublicKey{2}, types.PublicKey{2}, false, true},
+		{types.PublicKey{3}, types.PublicKey{2}, types.PublicKey{1}, false, false},
+		{types.PublicKey{3}, types.PublicKey{3}, types.PublicKey{1}, false, false},
+		// Neither form wraps around the end of the keyspace.
+		{types.FullMask, types.PublicKey{}, types.PublicKey{1}, false, false},
+		{types.PublicKey{9}, types.FullMask, types.PublicKey{1}, false, false},
+	} {
+		if got := DHTOrdered(tc.a, tc.b, tc.c); got != tc.ordered {
+			t.Errorf("DHTOrdered(%d, %d, %d) = %v, want %v", tc.a[0], tc.b[0], tc.c[0], got, tc.ordered)
+		}
+		if got := DHTOrderedInclusive(tc.a, tc.b, tc.c); got != tc.inclusive {
+			t.Errorf("DHTOrderedInclusive(%d, %d, %d) = %v, want %v", tc.a[0], tc.b[0], tc.c[0], got, tc.inclusive)
+		}
+	}
+}
+
+// checkDHTOrdering checks that the ordering functions agree with each other
+// for the given keys.
+func checkDHTOrdering(t *testing.T, a, b, c types.PublicKey) {
+	t.Helper()
+	ordered := DHTOrdered(a, b, c)
+	inclusive := DHTOrderedInclusive(a, b, c)
+	wrapped := DHTWrappedOrdered(a, b, c)
+	distinct := a != b && b != c && a != c
+
+	// The exclusive form is the inclusive form without the bounds.
+	if ordered != (inclusive && a != b && b != c) {
+		t.Fatalf("DHTOrdered = %v but DHTOrderedInclusive = %v for %v, %v, %v", ordered, inclusive, a, b, c)
+	}
+	// Anything ordered without wrapping is also ordered with wrapping.
+	if ordered && !wrapped {
+		t.Fatalf("DHTOrdered but not DHTWrappedOrdered for %v, %v, %v", a, b, c)
+	}
+	// Wrapping means that the ordering is the same wherever we start.
+	if wrapped != DHTWrappedOrdered(b, c, a) || wrapped != DHTWrappedOrdered(c, a, b) {
+		t.Fatalf("DHTWrappedOrdered is not the same for all rotations of %v, %v, %v", a, b, c)
+	}
+	// Going around the keyspace from A, we must reach exactly one of B and C
+	// first, unless any of the keys are the same.
+	if reversed := DHTWrappedOrdered(a, c, b); distinct && wrapped == reversed {
+		t.Fatalf("DHTWrappedOrdered is %v for both orders of %v, %v, %v", wrapped, a, b, c)
+	} else if !distinct && (wrapped || reversed) {
+		t.Fatalf("DHTWrappedOrdered is true for repeated keys %v, %v, %v", a, b, c)
+	}
+}
+
+// testDHTKeys are keys at and around the ends of the keyspace, where the
+// ordering wraps around.
+var testDHTKeys = []types.PublicKey{
+	{},
+	{0x00, 0x01},
+	{0x01},
+	{0x80},
+	{0xfe},
+	func() types.PublicKey {
+		k := types.FullMask
+		k[len(k)-1] = 0xfe
+		return k
+	}(),
+	types.FullMask,
+}
+
+func TestDHTOrderingProperties(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	key := func() (k types.PublicKey) {
+		if n := rng.Intn(len(testDHTKeys) * 2); n < len(testDHTKeys) {
+			return testDHTKeys[n]
+		}
+		rng.Read(k[:])
+		return
+	}
+	for i := 0; i < 10000; i++ {
+		checkDHTOrdering(t, key(), key(), key())
+	}
+}
+
+func FuzzDHTOrdering(f *testing.F) {
+	for _, a := range testDHTKeys {
+		for _, b := range testDHTKeys {
+			f.Add(a[:], b[:], testDHTKeys[0][:])
+			f.Add(a[:], b[:], types.FullMask[:])
+		}
+	}
+	f.Fuzz(func(t *testing.T, a, b, c []byte) {
+		var ka, kb, kc types.PublicKey
+		copy(ka[:], a)
+		copy(kb[:], b)
+		copy(kc[:], c)
+		checkDHTOrdering(t, ka, kb, kc)
+	})
+}